@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/checksum"
 	"strconv"
 	"strings"
 )
@@ -30,9 +31,8 @@ func PubEncoder(msg *protocol.RawMessage) *bytes.Buffer {
 
 	storeMsg := msg.Body.(*protocol.PubPayload)
 
-	buff.WriteString(fmt.Sprintf("%d\n", len(storeMsg.Payload)+1))
-
-	binary.LittleEndian.PutUint32(buff.Bytes(), uint32(buff.Len()-4))
+	buff.WriteString(fmt.Sprintf("%d", len(storeMsg.Payload)+1))
+	endCmdLine(&buff, storeMsg.Codec, storeMsg.Payload)
 
 	buff.Write(storeMsg.Payload)
 	buff.WriteRune('\n')
@@ -58,9 +58,8 @@ func DelayApplyEncoder(msg *protocol.RawMessage) *bytes.Buffer {
 
 	storeMsg := msg.Body.(*protocol.DelayApplyPayload)
 
-	buff.WriteString(fmt.Sprintf("%d\n", len(storeMsg.Payload)+1))
-
-	binary.LittleEndian.PutUint32(buff.Bytes(), uint32(buff.Len()-4))
+	buff.WriteString(fmt.Sprintf("%d", len(storeMsg.Payload)+1))
+	endCmdLine(&buff, protocol.PayloadCodec(storeMsg.Payload[16:]), storeMsg.Payload)
 
 	buff.Write(storeMsg.Payload)
 	buff.WriteRune('\n')
@@ -97,9 +96,11 @@ func DDLEncoder(msg *protocol.RawMessage) *bytes.Buffer {
 		}
 		buff.WriteString(strconv.Itoa(payloadLen))
 	}
-	buff.WriteRune('\n')
-
-	binary.LittleEndian.PutUint32(buff.Bytes(), uint32(buff.Len()-4))
+	if payloadLen > 0 {
+		endCmdLine(&buff, 0, payloadBuf)
+	} else {
+		endCmdLine(&buff, 0, nil)
+	}
 
 	if payloadLen > 0 {
 		buff.Write(payloadBuf)
@@ -127,15 +128,31 @@ func DelayEncode(msg *protocol.RawMessage) *bytes.Buffer {
 
 	storeMsg := msg.Body.(*protocol.DelayPayload)
 
-	buff.WriteString(fmt.Sprintf("%d\n", len(storeMsg.Payload)+1))
-
-	binary.LittleEndian.PutUint32(buff.Bytes(), uint32(buff.Len()-4))
+	buff.WriteString(fmt.Sprintf("%d", len(storeMsg.Payload)+1))
+	endCmdLine(&buff, protocol.PayloadCodec(storeMsg.Payload[16:]), storeMsg.Payload)
 
 	buff.Write(storeMsg.Payload)
 	buff.WriteRune('\n')
 	return &buff
 }
 
+var lineEnd = []byte{'\n'}
+
+// endCmdLine 追加 codec 和 crc 两列，结束命令行并写入命令行的长度。payload 为 nil 表示块中没有 payload，
+// 否则 payload 之后还有一个 \n，都被 crc 覆盖
+func endCmdLine(buff *bytes.Buffer, codec byte, payload []byte) {
+	buff.WriteRune('\t')
+	buff.WriteString(strconv.Itoa(int(codec)))
+	if payload == nil {
+		checksum.AppendColumn(buff)
+	} else {
+		checksum.AppendColumn(buff, payload, lineEnd)
+	}
+	buff.WriteRune('\n')
+
+	binary.LittleEndian.PutUint32(buff.Bytes(), uint32(buff.Len()-4))
+}
+
 func CmdDecoder(buf []byte) *protocol.DecodedRawMessage {
 	cmdLine := string(buf[:len(buf)-1])
 	items := strings.Split(cmdLine, "\t")
@@ -153,6 +170,11 @@ func CmdDecoder(buf []byte) *protocol.DecodedRawMessage {
 
 	msg.TopicName = items[4]
 	msg.PayloadLen, _ = strconv.Atoi(items[5])
+	if len(items) > 6 {
+		c, _ := strconv.Atoi(items[6])
+		msg.Codec = byte(c)
+	}
+	msg.HasChecksum = len(items) > 7
 
 	return &msg
 }
@@ -0,0 +1,481 @@
+package cluster
+
+import (
+	"errors"
+	"github.com/rolandhe/smss/pkg/logger"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 基于租约的选主：leader 每个 heartbeat 周期向其他节点发送心跳，续约 lease；follower 超过 lease 没有收到心跳后发起选举，
+// term 加一并向其他节点请求投票，得到多数票后成为 leader。节点只会把票投给 eventId 不小于自己的候选者，
+// 所以最终当选的是数据最新的节点。leader 超过 lease 没有得到多数节点的心跳响应时主动退位，避免网络分区时出现两个 master。
+// Node 不依赖包级变量，同一进程内可以运行多个节点，通过 Transport 通信
+
+type StateEnum int
+
+const (
+	Follower  StateEnum = 0
+	Candidate StateEnum = 1
+	Leader    StateEnum = 2
+)
+
+const (
+	MsgHeartbeat = "heartbeat"
+	MsgVote      = "vote"
+)
+
+var InvalidConfigErr = errors.New("invalid cluster config")
+
+// Peer 集群中的一个节点，Addr 是该节点 smss 服务的地址，host:port
+type Peer struct {
+	Id   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+type Config struct {
+	NodeId string
+	// Peers 集群所有节点，包括自己
+	Peers     []Peer
+	Lease     time.Duration
+	Heartbeat time.Duration
+	// PreferLeader 启动时更早发起选举，以 master 角色启动的节点设置
+	PreferLeader bool
+}
+
+// Message 节点之间的请求与响应
+type Message struct {
+	Type    string `json:"type"`
+	Term    int64  `json:"term"`
+	From    string `json:"from"`
+	EventId int64  `json:"eventId"`
+	Ok      bool   `json:"ok"`
+}
+
+// Transport 向 addr 的节点发送请求并返回响应
+type Transport interface {
+	Call(addr string, req *Message) (*Message, error)
+}
+
+// VoteStore 持久化 term 与投出的票，节点重启后不会在同一个 term 再把票投给其他节点
+type VoteStore interface {
+	LoadVote() (int64, string, error)
+	SaveVote(term int64, votedFor string) error
+}
+
+// Callback 角色变化时的回调，在独立的 goroutine 中按顺序执行
+type Callback interface {
+	// OnLeader 本节点当选 leader
+	OnLeader(term int64)
+	// OnFollower 其他节点当选 leader
+	OnFollower(leader Peer, term int64)
+	// OnLeaderLost 本节点不再是 leader，新的 leader 还没有产生
+	OnLeaderLost(term int64)
+	// LastEventId 本节点已经写入的最大 eventId
+	LastEventId() int64
+}
+
+// LeaderInfo 当前的 leader，Known 为 false 表示正在选举
+type LeaderInfo struct {
+	Known bool   `json:"known"`
+	Term  int64  `json:"term"`
+	Id    string `json:"id"`
+	Addr  string `json:"addr"`
+	Self  bool   `json:"self"`
+}
+
+type Node struct {
+	sync.Mutex
+	cfg       Config
+	self      Peer
+	peers     map[string]Peer
+	transport Transport
+	votes     VoteStore
+	cb        Callback
+
+	state    StateEnum
+	term     int64
+	votedFor string
+	leaderId string
+	// follower 收到心跳后延长，leader 得到多数响应后延长
+	leaseExpire time.Time
+
+	// events 等待 dispatch 执行的回调，post 在持有锁时调用，所以队列不限长度，不会阻塞
+	eventLock sync.Mutex
+	events    []func()
+	eventWake chan struct{}
+	quit      chan struct{}
+	done      chan struct{}
+	stopOnce  sync.Once
+}
+
+func NewNode(cfg Config, transport Transport, votes VoteStore, cb Callback) (*Node, error) {
+	n := &Node{
+		cfg:       cfg,
+		peers:     map[string]Peer{},
+		transport: transport,
+		votes:     votes,
+		cb:        cb,
+		eventWake: make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for _, p := range cfg.Peers {
+		n.peers[p.Id] = p
+	}
+	self, ok := n.peers[cfg.NodeId]
+	if !ok || cfg.Lease <= 0 || cfg.Heartbeat <= 0 || cfg.Heartbeat >= cfg.Lease {
+		return nil, InvalidConfigErr
+	}
+	n.self = self
+	term, votedFor, err := votes.LoadVote()
+	if err != nil {
+		return nil, err
+	}
+	n.term = term
+	n.votedFor = votedFor
+	return n, nil
+}
+
+// Start 启动选举与心跳线程
+func (n *Node) Start() {
+	n.Lock()
+	first := n.cfg.Lease
+	if n.cfg.PreferLeader {
+		first = n.cfg.Heartbeat
+	}
+	n.leaseExpire = time.Now().Add(first + n.jitter())
+	n.Unlock()
+	go n.dispatch()
+	go n.run()
+}
+
+// Stop 停止选举与心跳，等待正在执行的回调结束
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.quit)
+	})
+	<-n.done
+}
+
+func (n *Node) Leader() *LeaderInfo {
+	n.Lock()
+	defer n.Unlock()
+	if n.leaderId == "" {
+		return &LeaderInfo{
+			Term: n.term,
+		}
+	}
+	p := n.peers[n.leaderId]
+	return &LeaderInfo{
+		Known: true,
+		Term:  n.term,
+		Id:    p.Id,
+		Addr:  p.Addr,
+		Self:  p.Id == n.self.Id,
+	}
+}
+
+// HoldsLease 本节点是 leader 并且租约没有过期。master 接收写入前同步检查，租约过期后立即拒绝写入，不等待异步执行的 fence
+func (n *Node) HoldsLease() bool {
+	n.Lock()
+	defer n.Unlock()
+	return n.state == Leader && time.Now().Before(n.leaseExpire)
+}
+
+func (n *Node) majority() int {
+	return len(n.peers)/2 + 1
+}
+
+func (n *Node) jitter() time.Duration {
+	return time.Duration(rand.Int63n(int64(n.cfg.Heartbeat)))
+}
+
+// post 回调投递到 dispatch 线程执行，保证顺序且不阻塞选举。调用者可能持有 n 的锁，而回调可能调用 Leader 等需要锁的方法，
+// 所以 post 不能等待 dispatch
+func (n *Node) post(f func()) {
+	n.eventLock.Lock()
+	n.events = append(n.events, f)
+	n.eventLock.Unlock()
+	select {
+	case n.eventWake <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) dispatch() {
+	defer close(n.done)
+	for {
+		select {
+		case <-n.eventWake:
+		case <-n.quit:
+			return
+		}
+		n.eventLock.Lock()
+		events := n.events
+		n.events = nil
+		n.eventLock.Unlock()
+		for _, f := range events {
+			select {
+			case <-n.quit:
+				return
+			default:
+			}
+			f()
+		}
+	}
+}
+
+func (n *Node) run() {
+	ticker := time.NewTicker(n.cfg.Heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-ticker.C:
+		}
+		n.Lock()
+		state := n.state
+		expired := time.Now().After(n.leaseExpire)
+		n.Unlock()
+		if state == Leader {
+			n.heartbeat()
+			continue
+		}
+		if expired {
+			n.elect()
+		}
+	}
+}
+
+// broadcast 并发向其他节点发送请求，返回 timeout 之内收到的成功的响应，超时的请求不再等待
+func (n *Node) broadcast(req *Message, timeout time.Duration) []*Message {
+	respChan := make(chan *Message, len(n.peers))
+	count := 0
+	for _, p := range n.peers {
+		if p.Id == n.self.Id {
+			continue
+		}
+		count++
+		go func(p Peer) {
+			resp, err := n.transport.Call(p.Addr, req)
+			if err != nil {
+				resp = nil
+			}
+			respChan <- resp
+		}(p)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var resps []*Message
+	for i := 0; i < count; i++ {
+		select {
+		case resp := <-respChan:
+			if resp != nil {
+				resps = append(resps, resp)
+			}
+		case <-timer.C:
+			return resps
+		}
+	}
+	return resps
+}
+
+func (n *Node) heartbeat() {
+	start := time.Now()
+	n.Lock()
+	req := &Message{
+		Type:    MsgHeartbeat,
+		Term:    n.term,
+		From:    n.self.Id,
+		EventId: n.cb.LastEventId(),
+	}
+	// 整轮心跳最多等待一个心跳周期，并且不超过租约的剩余时间，租约到期时能及时退位
+	timeout := n.cfg.Heartbeat
+	if remain := n.leaseExpire.Sub(start); remain > 0 && remain < timeout {
+		timeout = remain
+	}
+	n.Unlock()
+
+	resps := n.broadcast(req, timeout)
+
+	n.Lock()
+	defer n.Unlock()
+	if n.state != Leader || n.term != req.Term {
+		return
+	}
+	acks := 1
+	for _, resp := range resps {
+		if resp.Term > n.term {
+			logger.Infof("cluster: node %s found higher term %d from heartbeat, step down", n.self.Id, resp.Term)
+			n.stepDown(resp.Term)
+			return
+		}
+		if resp.Ok {
+			acks++
+		}
+	}
+	if acks >= n.majority() {
+		// 从发送心跳开始计算，并且比 follower 的租约短一个心跳周期，保证 leader 先于 follower 发现租约过期
+		n.leaseExpire = start.Add(n.cfg.Lease - n.cfg.Heartbeat)
+		return
+	}
+	if !time.Now().Before(n.leaseExpire) {
+		logger.Infof("cluster: leader %s lost quorum, %d/%d acks, step down", n.self.Id, acks, len(n.peers))
+		n.stepDown(n.term)
+	}
+}
+
+// stepDown leader 退位，调用者持有锁
+func (n *Node) stepDown(term int64) {
+	wasLeader := n.state == Leader
+	n.state = Follower
+	if term > n.term {
+		n.votedFor = ""
+	}
+	n.term = term
+	n.leaderId = ""
+	n.leaseExpire = time.Now().Add(n.cfg.Lease + n.jitter())
+	if wasLeader {
+		n.post(func() {
+			n.cb.OnLeaderLost(term)
+		})
+	}
+}
+
+func (n *Node) elect() {
+	n.Lock()
+	// 先持久化给自己的投票，否则重启后可能在同一个 term 再投给其他节点
+	if err := n.votes.SaveVote(n.term+1, n.self.Id); err != nil {
+		n.leaseExpire = time.Now().Add(n.cfg.Lease + n.jitter())
+		n.Unlock()
+		logger.Infof("cluster: node %s save vote err:%v, skip election", n.self.Id, err)
+		return
+	}
+	n.state = Candidate
+	n.term++
+	n.votedFor = n.self.Id
+	n.leaderId = ""
+	req := &Message{
+		Type:    MsgVote,
+		Term:    n.term,
+		From:    n.self.Id,
+		EventId: n.cb.LastEventId(),
+	}
+	n.Unlock()
+	logger.Infof("cluster: node %s start election, term=%d, eventId=%d", n.self.Id, req.Term, req.EventId)
+
+	resps := n.broadcast(req, n.cfg.Heartbeat)
+
+	n.Lock()
+	defer n.Unlock()
+	if n.state != Candidate || n.term != req.Term {
+		return
+	}
+	votes := 1
+	for _, resp := range resps {
+		if resp.Term > n.term {
+			n.stepDown(resp.Term)
+			return
+		}
+		if resp.Ok {
+			votes++
+		}
+	}
+	if votes < n.majority() {
+		n.state = Follower
+		n.leaseExpire = time.Now().Add(n.cfg.Lease + n.jitter())
+		logger.Infof("cluster: node %s election failed, term=%d, votes=%d", n.self.Id, req.Term, votes)
+		return
+	}
+	n.state = Leader
+	n.leaderId = n.self.Id
+	n.leaseExpire = time.Now().Add(n.cfg.Lease - n.cfg.Heartbeat)
+	term := n.term
+	logger.Infof("cluster: node %s become leader, term=%d, votes=%d", n.self.Id, term, votes)
+	n.post(func() {
+		n.cb.OnLeader(term)
+	})
+}
+
+// Handle 处理其他节点的请求
+func (n *Node) Handle(req *Message) *Message {
+	n.Lock()
+	defer n.Unlock()
+	resp := &Message{
+		Type: req.Type,
+		From: n.self.Id,
+	}
+	if _, ok := n.peers[req.From]; !ok {
+		resp.Term = n.term
+		return resp
+	}
+	switch req.Type {
+	case MsgHeartbeat:
+		resp.Ok = n.handleHeartbeat(req)
+	case MsgVote:
+		resp.Ok = n.handleVote(req)
+	}
+	resp.Term = n.term
+	return resp
+}
+
+func (n *Node) handleHeartbeat(req *Message) bool {
+	if req.Term < n.term {
+		return false
+	}
+	if req.Term == n.term && n.state == Leader {
+		// 同一个 term 不会有两个 leader
+		return false
+	}
+	if req.Term > n.term {
+		n.votedFor = ""
+	}
+	n.term = req.Term
+	n.state = Follower
+	n.leaseExpire = time.Now().Add(n.cfg.Lease)
+	if n.leaderId != req.From {
+		n.leaderId = req.From
+		leader := n.peers[req.From]
+		term := req.Term
+		logger.Infof("cluster: node %s follow leader %s(%s), term=%d", n.self.Id, leader.Id, leader.Addr, term)
+		n.post(func() {
+			n.cb.OnFollower(leader, term)
+		})
+	}
+	return true
+}
+
+func (n *Node) handleVote(req *Message) bool {
+	// leader 还在租约内时拒绝投票，避免网络抖动的节点打断正常的 leader
+	if n.leaderId != "" && time.Now().Before(n.leaseExpire) {
+		return false
+	}
+	if req.Term < n.term {
+		return false
+	}
+	if req.Term > n.term {
+		if n.state == Leader {
+			n.stepDown(req.Term)
+		}
+		n.term = req.Term
+		n.state = Follower
+		n.votedFor = ""
+	}
+	if n.votedFor != "" && n.votedFor != req.From {
+		return false
+	}
+	if req.EventId < n.cb.LastEventId() {
+		return false
+	}
+	// 投票结果持久化之后才能回复，保存失败时不投票
+	if err := n.votes.SaveVote(n.term, req.From); err != nil {
+		logger.Infof("cluster: node %s save vote for %s err:%v", n.self.Id, req.From, err)
+		return false
+	}
+	n.votedFor = req.From
+	n.leaseExpire = time.Now().Add(n.cfg.Lease + n.jitter())
+	return true
+}
@@ -0,0 +1,376 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rolandhe/smss/pkg/logger"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitLogger("stderr")
+	os.Exit(m.Run())
+}
+
+// memTransport 进程内的 Transport，down 中的节点收不到也发不出请求，用于模拟节点故障与网络分区；
+// hang 中的节点发出的请求一直阻塞到 unblock 关闭，用于模拟没有响应的网络
+type memTransport struct {
+	sync.Mutex
+	nodes   map[string]*Node
+	down    map[string]bool
+	hang    map[string]bool
+	unblock chan struct{}
+}
+
+func (t *memTransport) Call(addr string, req *Message) (*Message, error) {
+	t.Lock()
+	n := t.nodes[addr]
+	unreachable := t.down[addr] || t.down[req.From]
+	hang := t.hang[req.From]
+	t.Unlock()
+	if hang {
+		<-t.unblock
+		return nil, errors.New("unreachable")
+	}
+	if n == nil || unreachable {
+		return nil, errors.New("unreachable")
+	}
+	return n.Handle(req), nil
+}
+
+func (t *memTransport) setDown(id string, down bool) {
+	t.Lock()
+	defer t.Unlock()
+	t.down[id] = down
+}
+
+func (t *memTransport) setHang(id string, hang bool) {
+	t.Lock()
+	defer t.Unlock()
+	t.hang[id] = hang
+}
+
+// memVoteStore 内存中的 VoteStore，err 不为 nil 时模拟写入失败
+type memVoteStore struct {
+	sync.Mutex
+	term     int64
+	votedFor string
+	err      error
+}
+
+func (vs *memVoteStore) LoadVote() (int64, string, error) {
+	vs.Lock()
+	defer vs.Unlock()
+	return vs.term, vs.votedFor, nil
+}
+
+func (vs *memVoteStore) SaveVote(term int64, votedFor string) error {
+	vs.Lock()
+	defer vs.Unlock()
+	if vs.err != nil {
+		return vs.err
+	}
+	vs.term = term
+	vs.votedFor = votedFor
+	return nil
+}
+
+type testCallback struct {
+	node    *Node
+	eventId atomic.Int64
+	leader  atomic.Int64
+	lost    atomic.Int64
+	// onEvent 回调中调用 Node 的方法，检查回调与选举之间不会死锁
+	onEvent func()
+}
+
+func (cb *testCallback) OnLeader(term int64) {
+	cb.leader.Store(term)
+	if cb.onEvent != nil {
+		cb.onEvent()
+	}
+}
+
+func (cb *testCallback) OnFollower(leader Peer, term int64) {
+	if cb.onEvent != nil {
+		cb.onEvent()
+	}
+}
+
+func (cb *testCallback) OnLeaderLost(term int64) {
+	cb.lost.Add(1)
+	if cb.onEvent != nil {
+		cb.onEvent()
+	}
+}
+
+func (cb *testCallback) LastEventId() int64 {
+	return cb.eventId.Load()
+}
+
+// startCluster 节点的 id 与 addr 相同，都是 n0、n1...
+func startCluster(t *testing.T, count int, eventIds ...int64) (*memTransport, []*Node, []*testCallback) {
+	tr := &memTransport{
+		nodes:   map[string]*Node{},
+		down:    map[string]bool{},
+		hang:    map[string]bool{},
+		unblock: make(chan struct{}),
+	}
+	var peers []Peer
+	for i := 0; i < count; i++ {
+		id := fmt.Sprintf("n%d", i)
+		peers = append(peers, Peer{Id: id, Addr: id})
+	}
+	var nodes []*Node
+	var cbs []*testCallback
+	for i := 0; i < count; i++ {
+		cb := &testCallback{}
+		if i < len(eventIds) {
+			cb.eventId.Store(eventIds[i])
+		}
+		n, err := NewNode(Config{
+			NodeId:    peers[i].Id,
+			Peers:     peers,
+			Lease:     time.Millisecond * 300,
+			Heartbeat: time.Millisecond * 50,
+		}, tr, &memVoteStore{}, cb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cb.node = n
+		tr.nodes[peers[i].Addr] = n
+		nodes = append(nodes, n)
+		cbs = append(cbs, cb)
+	}
+	for _, n := range nodes {
+		n.Start()
+	}
+	t.Cleanup(func() {
+		close(tr.unblock)
+		for _, n := range nodes {
+			n.Stop()
+		}
+	})
+	return tr, nodes, cbs
+}
+
+// waitLeader 等待 nodes 中只有一个 leader，并且其他节点都跟随它
+func waitLeader(t *testing.T, nodes []*Node) *Node {
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		var leader *Node
+		leaders := 0
+		for _, n := range nodes {
+			if info := n.Leader(); info.Known && info.Self {
+				leader = n
+				leaders++
+			}
+		}
+		if leaders == 1 {
+			agreed := true
+			for _, n := range nodes {
+				if info := n.Leader(); !info.Known || info.Id != leader.self.Id {
+					agreed = false
+				}
+			}
+			if agreed {
+				return leader
+			}
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+func TestElectLeader(t *testing.T) {
+	_, nodes, cbs := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	for i, n := range nodes {
+		if n == leader && cbs[i].leader.Load() == 0 {
+			time.Sleep(time.Millisecond * 100)
+			if cbs[i].leader.Load() == 0 {
+				t.Fatal("OnLeader is not called")
+			}
+		}
+	}
+}
+
+// TestLaggingNodeNotElected 节点只投票给 eventId 不小于自己的候选者，当选的节点不落后于多数节点
+func TestLaggingNodeNotElected(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		_, nodes, _ := startCluster(t, 3, 10, 30, 20)
+		if leader := waitLeader(t, nodes); leader.self.Id == "n0" {
+			t.Fatal("n0 with the smallest eventId is elected")
+		}
+		for _, n := range nodes {
+			n.Stop()
+		}
+	}
+}
+
+func TestLeaderStepDownWithoutQuorum(t *testing.T) {
+	tr, nodes, cbs := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	var rest []*Node
+	var leaderCb *testCallback
+	for i, n := range nodes {
+		if n == leader {
+			leaderCb = cbs[i]
+		} else {
+			rest = append(rest, n)
+		}
+	}
+	tr.setDown(leader.self.Id, true)
+
+	newLeader := waitLeader(t, rest)
+	if newLeader == leader {
+		t.Fatal("partitioned leader is still leader")
+	}
+	deadline := time.Now().Add(time.Second * 2)
+	for leaderCb.lost.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 20)
+	}
+	if leaderCb.lost.Load() == 0 {
+		t.Fatal("partitioned leader doesn't step down")
+	}
+
+	tr.setDown(leader.self.Id, false)
+	if waitLeader(t, nodes) != newLeader {
+		t.Fatal("old leader should follow the new leader after recovery")
+	}
+}
+
+// TestLeaderLosesLeaseWhenHeartbeatHangs 心跳请求没有响应时，一轮心跳最多等待到租约到期，leader 同步检查租约后拒绝写入并按时退位
+func TestLeaderLosesLeaseWhenHeartbeatHangs(t *testing.T) {
+	tr, nodes, cbs := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	var leaderCb *testCallback
+	for i, n := range nodes {
+		if n == leader {
+			leaderCb = cbs[i]
+		}
+	}
+	if !leader.HoldsLease() {
+		t.Fatal("leader should hold the lease")
+	}
+	start := time.Now()
+	tr.setHang(leader.self.Id, true)
+
+	// leader 的租约比 follower 短一个心跳周期，从最后一次成功的心跳开始计算
+	deadline := start.Add(leader.cfg.Lease)
+	for leader.HoldsLease() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	if leader.HoldsLease() {
+		t.Fatalf("leader still holds the lease %v after heartbeats hang", time.Since(start))
+	}
+	deadline = time.Now().Add(leader.cfg.Heartbeat * 3)
+	for leaderCb.lost.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	if leaderCb.lost.Load() == 0 {
+		t.Fatalf("leader doesn't step down %v after heartbeats hang", time.Since(start))
+	}
+}
+
+// TestPostUnderLockDoesNotBlock 回调中调用 Leader 需要节点的锁，post 在持有锁时调用，不能等待回调执行
+func TestPostUnderLockDoesNotBlock(t *testing.T) {
+	tr := &memTransport{nodes: map[string]*Node{}, down: map[string]bool{}}
+	cb := &testCallback{}
+	release := make(chan struct{})
+	n, err := NewNode(Config{
+		NodeId:    "n0",
+		Peers:     []Peer{{Id: "n0", Addr: "n0"}, {Id: "n1", Addr: "n1"}, {Id: "n2", Addr: "n2"}},
+		Lease:     time.Hour,
+		Heartbeat: time.Minute,
+	}, tr, &memVoteStore{}, cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var called atomic.Int64
+	cb.onEvent = func() {
+		<-release
+		n.Leader()
+		called.Add(1)
+	}
+	n.Start()
+	defer n.Stop()
+
+	const events = 200
+	posted := make(chan struct{})
+	go func() {
+		n.Lock()
+		for i := 0; i < events; i++ {
+			n.post(func() {
+				cb.OnLeaderLost(0)
+			})
+		}
+		n.Unlock()
+		close(posted)
+	}()
+	select {
+	case <-posted:
+	case <-time.After(time.Second * 2):
+		t.Fatal("post blocked while dispatch is busy")
+	}
+	close(release)
+	deadline := time.Now().Add(time.Second * 2)
+	for called.Load() < events && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if called.Load() != events {
+		t.Fatalf("expect %d callbacks, got %d", events, called.Load())
+	}
+}
+
+// TestVotePersistedBeforeReply 重启后从 VoteStore 恢复 term 与投票，同一个 term 不会投给第二个节点；保存失败时不投票
+func TestVotePersistedBeforeReply(t *testing.T) {
+	votes := &memVoteStore{}
+	newNode := func() *Node {
+		n, err := NewNode(Config{
+			NodeId:    "n0",
+			Peers:     []Peer{{Id: "n0", Addr: "n0"}, {Id: "n1", Addr: "n1"}, {Id: "n2", Addr: "n2"}},
+			Lease:     time.Hour,
+			Heartbeat: time.Minute,
+		}, &memTransport{}, votes, &testCallback{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	vote := func(n *Node, from string, term int64) bool {
+		return n.Handle(&Message{Type: MsgVote, Term: term, From: from}).Ok
+	}
+
+	if !vote(newNode(), "n1", 5) {
+		t.Fatal("n1 should get the vote of term 5")
+	}
+	if votes.term != 5 || votes.votedFor != "n1" {
+		t.Fatalf("vote is not saved, term=%d, votedFor=%s", votes.term, votes.votedFor)
+	}
+
+	restarted := newNode()
+	if term := restarted.Leader().Term; term != 5 {
+		t.Fatalf("restarted node should load term 5, got %d", term)
+	}
+	if vote(restarted, "n2", 5) {
+		t.Fatal("restarted node voted twice in term 5")
+	}
+	if !vote(restarted, "n1", 5) {
+		t.Fatal("repeated request from n1 should be granted")
+	}
+
+	votes.err = errors.New("disk error")
+	if vote(restarted, "n2", 6) {
+		t.Fatal("vote should be refused when it can't be saved")
+	}
+	votes.err = nil
+	if !vote(restarted, "n2", 6) {
+		t.Fatal("n2 should get the vote of term 6")
+	}
+}
@@ -0,0 +1,54 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/nets"
+	"net"
+	"time"
+)
+
+// TcpTransport 通过 smss 服务端口发送 CommandCluster 命令，每次请求使用一个短连接，
+// Timeout 是整个请求的超时时间，包括建立连接、发送与读取响应
+type TcpTransport struct {
+	Timeout time.Duration
+}
+
+func (t *TcpTransport) Call(addr string, req *Message) (*Message, error) {
+	deadline := time.Now().Add(t.Timeout)
+	conn, err := net.DialTimeout("tcp", addr, t.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	body, _ := json.Marshal(req)
+	buf := make([]byte, protocol.HeaderSize+len(body))
+	buf[0] = byte(protocol.CommandCluster)
+	binary.LittleEndian.PutUint32(buf[3:], uint32(len(body)))
+	copy(buf[protocol.HeaderSize:], body)
+	if err = nets.WriteAll(conn, buf, time.Until(deadline)); err != nil {
+		return nil, err
+	}
+
+	hBuf := buf[:protocol.RespHeaderSize]
+	if err = nets.ReadAll(conn, hBuf, time.Until(deadline)); err != nil {
+		return nil, err
+	}
+	code := binary.LittleEndian.Uint16(hBuf)
+	if code != protocol.OkCode {
+		return nil, errors.New("cluster call failed")
+	}
+	payLen := int(binary.LittleEndian.Uint32(hBuf[2:]))
+	respBody := make([]byte, payLen)
+	if err = nets.ReadAll(conn, respBody, time.Until(deadline)); err != nil {
+		return nil, err
+	}
+	resp := &Message{}
+	if err = json.Unmarshal(respBody, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
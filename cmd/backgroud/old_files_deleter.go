@@ -5,6 +5,7 @@ import (
 	"github.com/robfig/cron/v3"
 	"github.com/rolandhe/smss/cmd/protocol"
 	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/archive"
 	"github.com/rolandhe/smss/pkg/dir"
 	"github.com/rolandhe/smss/pkg/logger"
 	"github.com/rolandhe/smss/pkg/tm"
@@ -13,7 +14,9 @@ import (
 	"os"
 	"path"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -22,43 +25,96 @@ const (
 	DeleteFileAfterStateChangeTimeout = int64(1000 * 60 * 5)
 )
 
-var cronIns *cron.Cron
-var delTaskRunning atomic.Bool
-
-func StartClearOldFiles(root string, store store.Store, worker standard.MessageWorking, delTopicFileExecutor protocol.DelTopicFileExecutor) {
-	cronIns = cron.New()
+// OldFilesCleaner 定时回收过期文件，每个 server 一个
+type OldFilesCleaner struct {
+	running atomic.Bool
+	// cronLock 保护 cronIns 与 clearEntry，在线修改 store.clearInterval 时重新调度
+	cronLock   sync.Mutex
+	cronIns    *cron.Cron
+	clearEntry cron.EntryID
+	// task 回收一次过期文件，磁盘水位超过上限时会被提前调用
+	task func()
+}
 
-	// 添加定时任务
-	cronIns.AddFunc(fmt.Sprintf("@every %ds", conf.StoreClearInterval), func() {
-		if !delTaskRunning.CompareAndSwap(false, true) {
+// StartClearOldFiles 定时删除过期的 binlog 与 topic 文件，archiver 不为 nil 时先归档，归档失败的文件保留到下一次
+func StartClearOldFiles(root string, store store.Store, worker standard.MessageWorking, delTopicFileExecutor protocol.DelTopicFileExecutor, archiver archive.Archiver) *OldFilesCleaner {
+	c := &OldFilesCleaner{
+		cronIns: cron.New(),
+	}
+	c.task = func() {
+		if !c.running.CompareAndSwap(false, true) {
 			logger.Infof("last deleteOldFiles task not finish,wait next...")
 			return
 		}
 
-		defer delTaskRunning.Store(false)
+		defer c.running.Store(false)
+
+		deleteOldFiles(root, store, worker, delTopicFileExecutor, archiver)
+	}
 
-		deleteOldFiles(root, store, worker, delTopicFileExecutor)
-	})
+	c.cronLock.Lock()
+	defer c.cronLock.Unlock()
+	// 添加定时任务
+	c.clearEntry, _ = c.cronIns.AddFunc(fmt.Sprintf("@every %ds", conf.StoreClearInterval.Load()), c.task)
 
 	// 启动 cron 调度器
-	cronIns.Start()
+	c.cronIns.Start()
 	logger.Infof("StartClearOldFiles run ok")
+	return c
+}
+
+// ResetClearInterval 按新的 conf.StoreClearInterval 重新调度，正在执行的回收不受影响
+func (c *OldFilesCleaner) ResetClearInterval() {
+	if c == nil {
+		return
+	}
+	c.cronLock.Lock()
+	defer c.cronLock.Unlock()
+	if c.cronIns == nil {
+		return
+	}
+	interval := conf.StoreClearInterval.Load()
+	c.cronIns.Remove(c.clearEntry)
+	var err error
+	if c.clearEntry, err = c.cronIns.AddFunc(fmt.Sprintf("@every %ds", interval), c.task); err != nil {
+		logger.Infof("reset clear interval %ds err:%v", interval, err)
+		return
+	}
+	logger.Infof("reset clear interval to %ds", interval)
+}
+
+func (c *OldFilesCleaner) Stop() {
+	if c == nil {
+		return
+	}
+	c.cronLock.Lock()
+	defer c.cronLock.Unlock()
+	if c.cronIns == nil {
+		return
+	}
+	c.cronIns.Stop()
+	c.cronIns = nil
 }
 
-func StopClear() {
-	if cronIns == nil {
+// ClearNow 不等待定时任务，立即回收一次过期文件，阻塞直到完成，正在回收时直接返回
+func (c *OldFilesCleaner) ClearNow() {
+	if c == nil {
 		return
 	}
-	cronIns.Stop()
-	cronIns = nil
+	c.cronLock.Lock()
+	stopped := c.cronIns == nil
+	c.cronLock.Unlock()
+	if !stopped {
+		c.task()
+	}
 }
 
-func deleteOldFiles(root string, fstore store.Store, worker standard.MessageWorking, delTopicFileExecutor protocol.DelTopicFileExecutor) {
+func deleteOldFiles(root string, fstore store.Store, worker standard.MessageWorking, delTopicFileExecutor protocol.DelTopicFileExecutor, archiver archive.Archiver) {
 	traceId := fmt.Sprintf("delOldFile-%d", time.Now().UnixMilli())
 
 	logger.Infof("tid=%s,run deleteOldFiles", traceId)
 
-	deleteBinlogFiles(traceId, path.Join(root, store.BinlogDir))
+	deleteBinlogFiles(traceId, path.Join(root, store.BinlogDir), archiver)
 
 	infoList, err := fstore.GetTopicInfoReader().GetTopicSimpleInfoList()
 	if err != nil {
@@ -74,7 +130,8 @@ func deleteOldFiles(root string, fstore store.Store, worker standard.MessageWork
 			for {
 				unLockFunc, waiter := locker.Lock(info.Name, "ClearOldFiles", traceId)
 				if unLockFunc != nil {
-					deleteInvalidFiles(p, unLockFunc, traceId, "topic")
+					// 同名 topic 删除后重新创建时 fileId 从 0 开始，归档路径中加上创建的 eventId 区分
+					deleteInvalidFiles(p, unLockFunc, traceId, "topic", archiver, path.Join(store.TopicDir, info.Name, strconv.FormatInt(info.CreateEventId, 10)))
 					break
 				}
 				if !waiter(time.Second * 3) {
@@ -93,11 +150,12 @@ func deleteOldFiles(root string, fstore store.Store, worker standard.MessageWork
 	}
 }
 
-func deleteBinlogFiles(traceId, binlogPath string) {
-	deleteInvalidFiles(binlogPath, nil, traceId, "binlog")
+func deleteBinlogFiles(traceId, binlogPath string, archiver archive.Archiver) {
+	deleteInvalidFiles(binlogPath, nil, traceId, "binlog", archiver, store.BinlogDir)
 }
 
-func deleteInvalidFiles(p string, unLockFunc func(), traceId string, scenario string) {
+// deleteInvalidFiles archiveDir 是归档时文件所在的相对路径
+func deleteInvalidFiles(p string, unLockFunc func(), traceId string, scenario string, archiver archive.Archiver, archiveDir string) {
 	if unLockFunc != nil {
 		defer unLockFunc()
 	}
@@ -135,7 +193,7 @@ func deleteInvalidFiles(p string, unLockFunc func(), traceId string, scenario st
 			continue
 		}
 		modDate := tm.ToDate(info.ModTime())
-		if tm.DiffDays(nowDate, modDate) >= conf.StoreMaxDays {
+		if int64(tm.DiffDays(nowDate, modDate)) >= conf.StoreMaxDays.Load() {
 			delIds = append(delIds, num)
 		}
 	}
@@ -151,6 +209,15 @@ func deleteInvalidFiles(p string, unLockFunc func(), traceId string, scenario st
 
 	for _, id := range delIds {
 		dp := fmt.Sprintf("%s/%d.log", p, id)
+		if archiver != nil {
+			name := fmt.Sprintf("%s/%d.log", archiveDir, id)
+			if err = archiver.Archive(dp, name); err != nil {
+				// 后面的文件也保留，已经删除的文件与剩余的文件之间不留空洞
+				logger.Infof("tid=%s,%s,archive %s err:%v", traceId, scenario, dp, err)
+				break
+			}
+			logger.Infof("tid=%s,%s,archive %s to %s", traceId, scenario, dp, name)
+		}
 		err = os.Remove(dp)
 		logger.Infof("tid=%s,%s,delete %s err:%v", traceId, scenario, dp, err)
 	}
@@ -0,0 +1,56 @@
+package backgroud
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rolandhe/smss/pkg/logger"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitLogger("stderr")
+	os.Exit(m.Run())
+}
+
+// failingArchiver 归档 failName 时失败，记录成功归档的 name
+type failingArchiver struct {
+	failName string
+	names    []string
+}
+
+func (a *failingArchiver) Archive(src string, name string) error {
+	if name == a.failName {
+		return errors.New("archive failed")
+	}
+	a.names = append(a.names, name)
+	return nil
+}
+
+// TestArchiveFailureKeepsLaterFiles 一个文件归档失败时，之后的文件也不能删除，否则剩余的文件之间有空洞
+func TestArchiveFailureKeepsLaterFiles(t *testing.T) {
+	p := t.TempDir()
+	old := time.Now().AddDate(0, 0, -30)
+	for i := 0; i < 4; i++ {
+		f := path.Join(p, fmt.Sprintf("%d.log", i))
+		if err := os.WriteFile(f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &failingArchiver{failName: "topic/t/5/1.log"}
+	deleteInvalidFiles(p, nil, "tid", "topic", a, "topic/t/5")
+	if fmt.Sprint(a.names) != "[topic/t/5/0.log]" {
+		t.Fatalf("unexpected archived files %v", a.names)
+	}
+	for i, expect := range []bool{false, true, true, true} {
+		_, err := os.Stat(path.Join(p, fmt.Sprintf("%d.log", i)))
+		if exist := err == nil; exist != expect {
+			t.Fatalf("%d.log exist=%v, expect %v", i, exist, expect)
+		}
+	}
+}
@@ -18,6 +18,7 @@ type task struct {
 
 type topicDelExecutor struct {
 	deleteList chan *task
+	quit       chan struct{}
 	locker     *protocol.DelFileLock
 	fstore     store.Store
 }
@@ -52,7 +53,13 @@ func (de *topicDelExecutor) GetDeleteFileLocker() *protocol.DelFileLock {
 
 func (de *topicDelExecutor) run() {
 	for {
-		t := <-de.deleteList
+		var t *task
+		select {
+		case t = <-de.deleteList:
+		case <-de.quit:
+			logger.Infof("topicDelExecutor stopped")
+			return
+		}
 		unlocker, waiter := de.locker.Lock(t.name, t.who, t.traceId)
 		if waiter != nil {
 			if !waiter(conf.WaitFileDeleteLockerTimeout) {
@@ -75,9 +82,17 @@ func (de *topicDelExecutor) run() {
 	}
 }
 
+// StopTopicFileDelete 停止删除topic文件的线程, 用于server关闭
+func StopTopicFileDelete(delExec protocol.DelTopicFileExecutor) {
+	if exec, ok := delExec.(*topicDelExecutor); ok {
+		close(exec.quit)
+	}
+}
+
 func StartTopicFileDelete(fstore store.Store) protocol.DelTopicFileExecutor {
 	exec := &topicDelExecutor{
 		deleteList: make(chan *task, 128),
+		quit:       make(chan struct{}),
 		fstore:     fstore,
 		locker:     &protocol.DelFileLock{},
 	}
@@ -0,0 +1,130 @@
+package backgroud
+
+import (
+	"errors"
+	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/dir"
+	"github.com/rolandhe/smss/pkg/logger"
+	"sync/atomic"
+	"time"
+)
+
+// WatermarkGuard 定时检查磁盘剩余空间与数据目录大小，超过上限时先提前回收过期文件，仍然超过时标记存储已满，
+// 此时拒绝发布但继续提供订阅，降到下限以下后自动恢复
+type WatermarkGuard struct {
+	root    string
+	cleaner *OldFilesCleaner
+	full    atomic.Bool
+	// freeUnsupported 当前平台无法获取剩余空间时只检查数据大小
+	freeUnsupported bool
+	stop            chan struct{}
+	done            chan struct{}
+}
+
+// StartWatermarkGuard 没有配置任何水位时返回 nil
+func StartWatermarkGuard(root string, cleaner *OldFilesCleaner) *WatermarkGuard {
+	if conf.StoreMinFreeBytes <= 0 && conf.StoreMaxDataBytes <= 0 {
+		return nil
+	}
+	g := &WatermarkGuard{
+		root:    root,
+		cleaner: cleaner,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go g.run()
+	logger.Infof("StartWatermarkGuard run ok,minFree=%d,resumeFree=%d,maxData=%d,resumeData=%d", conf.StoreMinFreeBytes, conf.StoreResumeFreeBytes, conf.StoreMaxDataBytes, conf.StoreResumeDataBytes)
+	return g
+}
+
+// StorageFull 存储是否已满，nil 表示没有开启检查
+func (g *WatermarkGuard) StorageFull() bool {
+	return g != nil && g.full.Load()
+}
+
+func (g *WatermarkGuard) Stop() {
+	if g == nil {
+		return
+	}
+	close(g.stop)
+	<-g.done
+}
+
+func (g *WatermarkGuard) run() {
+	defer close(g.done)
+	interval := conf.StoreWatermarkInterval
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	g.check()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+			g.check()
+		}
+	}
+}
+
+func (g *WatermarkGuard) check() {
+	free, data, ok := g.usage()
+	if !ok {
+		return
+	}
+	if g.full.Load() {
+		if g.belowLow(free, data) {
+			g.full.Store(false)
+			logger.Infof("storage below low watermark,resume pub,free=%d,data=%d", free, data)
+		}
+		return
+	}
+	if !g.aboveHigh(free, data) {
+		return
+	}
+	logger.Infof("storage above high watermark,clear old files now,free=%d,data=%d", free, data)
+	g.cleaner.ClearNow()
+	if free, data, ok = g.usage(); ok && g.aboveHigh(free, data) {
+		g.full.Store(true)
+		logger.Infof("storage full,reject pub,free=%d,data=%d", free, data)
+	}
+}
+
+func (g *WatermarkGuard) aboveHigh(free, data int64) bool {
+	if conf.StoreMinFreeBytes > 0 && !g.freeUnsupported && free < conf.StoreMinFreeBytes {
+		return true
+	}
+	return conf.StoreMaxDataBytes > 0 && data > conf.StoreMaxDataBytes
+}
+
+func (g *WatermarkGuard) belowLow(free, data int64) bool {
+	if conf.StoreMinFreeBytes > 0 && !g.freeUnsupported && free < conf.StoreResumeFreeBytes {
+		return false
+	}
+	return conf.StoreMaxDataBytes <= 0 || data <= conf.StoreResumeDataBytes
+}
+
+// usage 读取失败时本次不改变状态
+func (g *WatermarkGuard) usage() (int64, int64, bool) {
+	var free, data int64
+	var err error
+	if conf.StoreMinFreeBytes > 0 && !g.freeUnsupported {
+		free, err = dir.FreeSpace(g.root)
+		if errors.Is(err, dir.FreeSpaceUnsupportedErr) {
+			logger.Infof("watermark get free space of %s err:%v,ignore free space", g.root, err)
+			g.freeUnsupported = true
+		} else if err != nil {
+			logger.Infof("watermark get free space of %s err:%v", g.root, err)
+			return 0, 0, false
+		}
+	}
+	if conf.StoreMaxDataBytes > 0 {
+		if data, err = dir.DirSize(g.root); err != nil {
+			logger.Infof("watermark get size of %s err:%v", g.root, err)
+			return 0, 0, false
+		}
+	}
+	return free, data, true
+}
@@ -0,0 +1,115 @@
+package backgroud
+
+import (
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"github.com/rolandhe/smss/conf"
+	"math"
+	"os"
+	"path"
+	"testing"
+)
+
+const watermarkFileSize = 64 * 1024
+
+func setWatermark(t *testing.T, minFree, resumeFree, maxData, resumeData int64) {
+	oldMinFree, oldResumeFree := conf.StoreMinFreeBytes, conf.StoreResumeFreeBytes
+	oldMaxData, oldResumeData := conf.StoreMaxDataBytes, conf.StoreResumeDataBytes
+	t.Cleanup(func() {
+		conf.StoreMinFreeBytes, conf.StoreResumeFreeBytes = oldMinFree, oldResumeFree
+		conf.StoreMaxDataBytes, conf.StoreResumeDataBytes = oldMaxData, oldResumeData
+	})
+	conf.StoreMinFreeBytes, conf.StoreResumeFreeBytes = minFree, resumeFree
+	conf.StoreMaxDataBytes, conf.StoreResumeDataBytes = maxData, resumeData
+}
+
+// writeDataFiles 保留 root 下 count 个文件，每个 watermarkFileSize 字节
+func writeDataFiles(t *testing.T, root string, count int) {
+	for i := 0; i < 8; i++ {
+		f := path.Join(root, fmt.Sprintf("%d.log", i))
+		if i >= count {
+			os.Remove(f)
+			continue
+		}
+		if err := os.WriteFile(f, make([]byte, watermarkFileSize), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testWatermarkGuard 不启动定时检查，cleaner 的回收任务只计数，removeTo >= 0 时回收到只剩 removeTo 个文件
+func testWatermarkGuard(root string, cleared *int, removeTo *int) *WatermarkGuard {
+	cleaner := &OldFilesCleaner{cronIns: cron.New()}
+	cleaner.task = func() {
+		*cleared++
+		if *removeTo >= 0 {
+			for i := *removeTo; i < 8; i++ {
+				os.Remove(path.Join(root, fmt.Sprintf("%d.log", i)))
+			}
+		}
+	}
+	return &WatermarkGuard{
+		root:    root,
+		cleaner: cleaner,
+	}
+}
+
+// TestWatermarkDataTriggerAndRelease 数据超过上限时先回收过期文件，仍然超过才标记已满；降到上限以下但没有低于下限时保持已满
+func TestWatermarkDataTriggerAndRelease(t *testing.T) {
+	setWatermark(t, 0, 0, watermarkFileSize*4, watermarkFileSize*2)
+	root := t.TempDir()
+	cleared := 0
+	removeTo := -1
+	g := testWatermarkGuard(root, &cleared, &removeTo)
+
+	for i, step := range []struct {
+		name     string
+		files    int
+		removeTo int
+		full     bool
+		cleared  int
+	}{
+		{"below high", 3, -1, false, 0},
+		{"above high and clear old files helps", 6, 3, false, 1},
+		{"above high after clearing", 6, -1, true, 2},
+		{"below high but above low", 3, -1, true, 2},
+		{"below low", 1, -1, false, 2},
+	} {
+		writeDataFiles(t, root, step.files)
+		removeTo = step.removeTo
+		g.check()
+		if g.StorageFull() != step.full || cleared != step.cleared {
+			t.Fatalf("step %d %s: full=%v cleared=%d, expect full=%v cleared=%d", i, step.name, g.StorageFull(), cleared, step.full, step.cleared)
+		}
+	}
+}
+
+// TestWatermarkFreeSpaceTriggerAndRelease 剩余空间低于下限时标记已满，恢复到 resumeFree 以上后恢复
+func TestWatermarkFreeSpaceTriggerAndRelease(t *testing.T) {
+	setWatermark(t, math.MaxInt64/2, math.MaxInt64/2, 0, 0)
+	cleared := 0
+	removeTo := -1
+	g := testWatermarkGuard(t.TempDir(), &cleared, &removeTo)
+	g.check()
+	if g.freeUnsupported {
+		t.Skip("free space is not supported on this platform")
+	}
+	if !g.StorageFull() || cleared != 1 {
+		t.Fatalf("should be full when free space is below the min, full=%v cleared=%d", g.StorageFull(), cleared)
+	}
+	conf.StoreMinFreeBytes, conf.StoreResumeFreeBytes = 1, 1
+	g.check()
+	if g.StorageFull() {
+		t.Fatal("should resume when free space is above the resume mark")
+	}
+}
+
+// TestWatermarkGuardDisabled 没有配置任何水位时不启动检查，nil 的 guard 不会标记已满
+func TestWatermarkGuardDisabled(t *testing.T) {
+	setWatermark(t, 0, 0, 0, 0)
+	g := StartWatermarkGuard(t.TempDir(), nil)
+	if g != nil || g.StorageFull() {
+		t.Fatal("guard should be disabled")
+	}
+	g.Stop()
+}
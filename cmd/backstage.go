@@ -10,51 +10,75 @@ import (
 	"github.com/rolandhe/smss/standard"
 	"github.com/rolandhe/smss/store"
 	"github.com/rolandhe/smss/store/fss"
-	"os"
+	"io"
 	"path"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 const secondMills = 1000
 
+var ServerClosedErr = dir.NewBizError("server is shutting down")
+
 type backWorker struct {
 	c      chan *standard.FutureMsg[protocol.RawMessage]
 	writer *binlog.WalWriter[protocol.RawMessage]
 	store  store.Store
+	// routers 所属 server 的路由，处理消息时使用
+	routers *router.Routers
+	// flushLevel 刷盘方式，在线修改后 worker 在下一个消息前切换
+	flushLevel atomic.Int64
 	logger.SampleLoggerSupport
+
+	// 保护 closed 与 向 c 投递消息，保证关闭后不会再有消息进入 c
+	closeLock sync.RWMutex
+	closed    bool
+	quit      chan struct{}
+	done      chan struct{}
+
+	// 收集 group 时遇到的不能合并的消息，下一轮处理
+	pending *standard.FutureMsg[protocol.RawMessage]
+
+	// rejected 队列已满被拒绝的请求数，expired 在队列中过期被丢弃的请求数
+	rejected atomic.Int64
+	expired  atomic.Int64
 }
 
-func newWriter(root string, meta store.Meta) (*binlog.WalWriter[protocol.RawMessage], store.Store, error) {
+func newWriter(root string, meta store.Meta, maxLogSize int64, routers *router.Routers) (*binlog.WalWriter[protocol.RawMessage], store.Store, error) {
 	binlogRoot := path.Join(root, store.BinlogDir)
 	dir.EnsurePathExist(binlogRoot)
 
-	fstore, err := fss.NewFileStore(root, meta)
+	fstore, err := fss.NewFileStore(root, meta, maxLogSize)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	binlogWriter := standard.NewMsgWriter[protocol.RawMessage](store.BinlogDir, binlogRoot, conf.MaxLogSize, func(f *os.File, msg *protocol.RawMessage) (int64, error) {
-		handler := router.GetRouter(msg.Command)
+	binlogWriter := standard.NewMsgWriter[protocol.RawMessage](store.BinlogDir, binlogRoot, maxLogSize, func(f io.Writer, msg *protocol.RawMessage) (int64, error) {
+		handler := routers.GetRouter(msg.Command)
 		return handler.DoBinlog(f, msg)
 	})
 
 	topicWriterFunc := func(msg *protocol.RawMessage, fileId, pos int64) (int, error) {
-		handler := router.GetRouter(msg.Command)
+		handler := routers.GetRouter(msg.Command)
 		return handler.AfterBinlog(msg, fileId, pos)
 	}
 	return binlog.NewWalWriter[protocol.RawMessage](binlogWriter, topicWriterFunc), fstore, nil
 
 }
 
-func startBack(buffSize int, w *binlog.WalWriter[protocol.RawMessage], store store.Store) (*backWorker, error) {
+func startBack(buffSize int, flushLevel int, w *binlog.WalWriter[protocol.RawMessage], store store.Store, routers *router.Routers) (*backWorker, error) {
 	worker := &backWorker{
 		c:                   make(chan *standard.FutureMsg[protocol.RawMessage], buffSize),
 		writer:              w,
 		store:               store,
+		routers:             routers,
 		SampleLoggerSupport: logger.NewSampleLoggerSupport(conf.WorkerWaitMsgTimeoutLogSample),
+		quit:                make(chan struct{}),
+		done:                make(chan struct{}),
 	}
+	worker.flushLevel.Store(int64(flushLevel))
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -68,11 +92,29 @@ func startBack(buffSize int, w *binlog.WalWriter[protocol.RawMessage], store sto
 }
 
 func (worker *backWorker) process() {
-	syncCtrl := buildFsyncControl()
+	flushLevel := worker.flushLevel.Load()
+	syncCtrl := buildFsyncControl(flushLevel)
 	waitNext := conf.WorkerWaitMsgTimeout
 	syncWake := false
+	defer close(worker.done)
 	for {
-		msg := worker.waitMsg(waitNext, syncWake)
+		msg, quit := worker.waitMsg(waitNext, syncWake)
+		if quit {
+			worker.drain(syncCtrl)
+			return
+		}
+		// 在线修改了刷盘方式，先把已经写入的数据刷盘再切换
+		if level := worker.flushLevel.Load(); level != flushLevel {
+			syncCtrl.sync(0, 0, nil, true)
+			logger.Infof("worker change flushLevel from %d to %d", flushLevel, level)
+			flushLevel = level
+			syncCtrl = buildFsyncControl(flushLevel)
+			syncWake = false
+			waitNext = conf.WorkerWaitMsgTimeout
+		}
+		if msg != nil && worker.dropExpired(msg) {
+			continue
+		}
 		if msg == nil {
 			if syncWake {
 				syncCtrl.sync(0, 0, nil, true)
@@ -81,14 +123,7 @@ func (worker *backWorker) process() {
 			}
 			continue
 		}
-		binlogSyncFd, dataSyncFd, err := worker.writer.Write(msg.Msg)
-
-		if msg.Msg.Command == protocol.CommandDeleteTopic {
-			syncCtrl.rmTopic(msg.Msg.TopicName)
-		}
-
-		nextTime := syncCtrl.sync(binlogSyncFd, dataSyncFd, msg.Msg, false)
-		msg.Complete(err)
+		nextTime := worker.handleGroup(worker.collectGroup(msg), syncCtrl)
 		if nextTime == 0 {
 			syncWake = false
 			waitNext = conf.WorkerWaitMsgTimeout
@@ -99,11 +134,236 @@ func (worker *backWorker) process() {
 	}
 }
 
-func buildFsyncControl() fsyncControl {
-	if conf.FlushLevel == 0 {
+// dropExpired 请求在队列中已经过期时直接返回 RequestExpiredErr，不写 binlog
+func (worker *backWorker) dropExpired(msg *standard.FutureMsg[protocol.RawMessage]) bool {
+	if !msg.Msg.Expired(time.Now().UnixMilli()) {
+		return false
+	}
+	worker.expired.Add(1)
+	if worker.CanLogger() {
+		logger.Infof("tid=%s,cmd=%d,request expired in queue,cost=%d ms", msg.Msg.TraceId, msg.Msg.Command, msg.Msg.Cost())
+	}
+	msg.Complete(standard.RequestExpiredErr)
+	return true
+}
+
+func (worker *backWorker) handle(msg *standard.FutureMsg[protocol.RawMessage], syncCtrl fsyncControl) int64 {
+	if msg.Msg.Command == protocol.CommandBarrier {
+		syncCtrl.sync(0, 0, nil, true)
+		if f, ok := msg.Msg.Body.(protocol.BarrierFunc); ok {
+			f()
+		}
+		msg.Complete(nil)
+		return 0
+	}
+	binlogSyncFd, dataSyncFd, err := worker.writer.Write(msg.Msg)
+
+	if msg.Msg.Command == protocol.CommandDeleteTopic {
+		syncCtrl.rmTopic(msg.Msg.TopicName)
+	}
+
+	nextTime := syncCtrl.sync(binlogSyncFd, dataSyncFd, msg.Msg, false)
+	msg.Complete(err)
+	return nextTime
+}
+
+// collectGroup 从 channel 中继续取出最多 WorkerGroupMaxSize 个可以合并写入的消息，最多等待 WorkerGroupWait，
+// 遇到不能合并的消息(比如DDL)则停止，该消息留到下一轮单独处理
+func (worker *backWorker) collectGroup(first *standard.FutureMsg[protocol.RawMessage]) []*standard.FutureMsg[protocol.RawMessage] {
+	group := []*standard.FutureMsg[protocol.RawMessage]{first}
+	if conf.WorkerGroupMaxSize <= 1 || worker.routers.GetBatchRouter(first.Msg.Command) == nil {
+		return group
+	}
+	var timeout <-chan time.Time
+	if conf.WorkerGroupWait > 0 {
+		timer := time.NewTimer(conf.WorkerGroupWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for len(group) < conf.WorkerGroupMaxSize {
+		var msg *standard.FutureMsg[protocol.RawMessage]
+		if timeout == nil {
+			select {
+			case msg = <-worker.c:
+			default:
+				return group
+			}
+		} else {
+			select {
+			case msg = <-worker.c:
+			case <-timeout:
+				return group
+			case <-worker.quit:
+				return group
+			}
+		}
+		if worker.routers.GetBatchRouter(msg.Msg.Command) == nil {
+			worker.pending = msg
+			return group
+		}
+		if worker.dropExpired(msg) {
+			continue
+		}
+		group = append(group, msg)
+	}
+	return group
+}
+
+// handleGroup 一组消息按到达的顺序一次写入binlog，相邻的同一个topic的消息合并成一次写入，整组只刷一次盘。
+// 某个topic写入失败时，binlog回滚到该段消息的起始位置，eventId 也回滚到该段的第一条消息，之后的消息逐个重新处理，
+// 复用回滚的 eventId，binlog 中的 eventId 保持连续
+func (worker *backWorker) handleGroup(group []*standard.FutureMsg[protocol.RawMessage], syncCtrl fsyncControl) int64 {
+	if len(group) == 1 {
+		return worker.handle(group[0], syncCtrl)
+	}
+
+	firstEventId := worker.routers.LastEventId() + 1
+	msgs := make([]*protocol.RawMessage, len(group))
+	for i, fmsg := range group {
+		msgs[i] = fmsg.Msg
+	}
+	errs := make([]error, len(group))
+	var retry []int
+	var dataFds []topicFd
+
+	binlogSyncFd, err := worker.writer.WriteBatch(msgs, errs, func(indexes []int, fileId int64, positions []int64) int {
+		for start := 0; start < len(indexes); {
+			first := msgs[indexes[start]]
+			end := start + 1
+			for end < len(indexes) && msgs[indexes[end]].Command == first.Command && msgs[indexes[end]].TopicName == first.TopicName {
+				end++
+			}
+			runMsgs := make([]*protocol.RawMessage, end-start)
+			for i, idx := range indexes[start:end] {
+				runMsgs[i] = msgs[idx]
+			}
+			fd, e := worker.routers.GetBatchRouter(first.Command).AfterBinlogBatch(runMsgs, fileId, positions[start:end])
+			if e != nil {
+				logger.Infof("to handle group msg after writing binlog error,rollback %d msg", len(indexes)-start)
+				for _, idx := range indexes[start:end] {
+					errs[idx] = e
+				}
+				retry = indexes[end:]
+				worker.routers.RollbackEventId(first.EventId)
+				return start
+			}
+			dataFds = append(dataFds, topicFd{fd, runMsgs[len(runMsgs)-1]})
+			start = end
+		}
+		return len(indexes)
+	})
+
+	if err != nil {
+		worker.routers.RollbackEventId(firstEventId)
+	}
+	var nextTime int64
+	if err == nil {
+		nextTime = syncGroup(syncCtrl, binlogSyncFd, dataFds, msgs[len(msgs)-1])
+	}
+
+	retrySet := map[int]struct{}{}
+	for _, idx := range retry {
+		retrySet[idx] = struct{}{}
+	}
+	for i, fmsg := range group {
+		if _, ok := retrySet[i]; ok {
+			continue
+		}
+		if err != nil {
+			fmsg.Complete(err)
+		} else {
+			fmsg.Complete(errs[i])
+		}
+	}
+	for _, idx := range retry {
+		nextTime = worker.handle(group[idx], syncCtrl)
+	}
+	return nextTime
+}
+
+// topicFd 一段消息写入的 topic 文件，msg 是该段最后一条消息
+type topicFd struct {
+	fd  int
+	msg *protocol.RawMessage
+}
+
+// syncGroup 一组消息写入后刷盘，binlog 只刷一次。同一个 topic 可能出现在不相邻的多段中，同一个文件只刷一次，使用最后一段的消息
+func syncGroup(syncCtrl fsyncControl, binlogFd int, dataFds []topicFd, last *protocol.RawMessage) int64 {
+	if len(dataFds) == 0 {
+		return syncCtrl.sync(binlogFd, standard.SyncFdIgnore, last, false)
+	}
+	type fileKey struct {
+		topic string
+		fd    int
+	}
+	index := map[fileKey]int{}
+	var files []topicFd
+	for _, tf := range dataFds {
+		key := fileKey{tf.msg.TopicName, tf.fd}
+		if i, ok := index[key]; ok {
+			files[i].msg = tf.msg
+			continue
+		}
+		index[key] = len(files)
+		files = append(files, tf)
+	}
+	var nextTime int64
+	for i, tf := range files {
+		blFd := standard.SyncFdIgnore
+		if i == 0 {
+			blFd = binlogFd
+		}
+		nextTime = syncCtrl.sync(blFd, tf.fd, tf.msg, false)
+	}
+	return nextTime
+}
+
+// drain 关闭时处理完 channel 中剩余的消息，然后强制刷盘并关闭binlog文件
+func (worker *backWorker) drain(syncCtrl fsyncControl) {
+	count := 0
+	if worker.pending != nil {
+		if !worker.dropExpired(worker.pending) {
+			worker.handle(worker.pending, syncCtrl)
+			count++
+		}
+		worker.pending = nil
+	}
+	for {
+		select {
+		case msg := <-worker.c:
+			if worker.dropExpired(msg) {
+				continue
+			}
+			worker.handle(msg, syncCtrl)
+			count++
+		default:
+			syncCtrl.sync(0, 0, nil, true)
+			worker.writer.Close()
+			logger.Infof("worker drained %d msg and closed", count)
+			return
+		}
+	}
+}
+
+// Close 拒绝新的消息，等待 worker 处理完已经进入 channel 的消息并刷盘
+func (worker *backWorker) Close() {
+	worker.closeLock.Lock()
+	if worker.closed {
+		worker.closeLock.Unlock()
+		<-worker.done
+		return
+	}
+	worker.closed = true
+	worker.closeLock.Unlock()
+	close(worker.quit)
+	<-worker.done
+}
+
+func buildFsyncControl(flushLevel int64) fsyncControl {
+	if flushLevel == 0 {
 		return &noneFsyncControl{}
 	}
-	if conf.FlushLevel == 2 {
+	if flushLevel == 2 {
 		return &everyFsyncControl{}
 	}
 	return &secondaryFsyncControl{
@@ -113,25 +373,72 @@ func buildFsyncControl() fsyncControl {
 }
 
 func (worker *backWorker) Work(msg *protocol.RawMessage) error {
-	fmsg := standard.NewFutureMsg(msg)
-	worker.c <- fmsg
+	fmsg, err := worker.WorkAsync(msg)
+	if err != nil {
+		return err
+	}
 	fmsg.Wait()
 	return fmsg.GetErr()
 }
 
-func (worker *backWorker) waitMsg(timeout time.Duration, syncWake bool) *standard.FutureMsg[protocol.RawMessage] {
+// Barrier 等待之前投递给 worker 的消息都处理完成并刷盘
+func (worker *backWorker) Barrier() error {
+	return worker.Work(&protocol.RawMessage{
+		Command:   protocol.CommandBarrier,
+		Timestamp: time.Now().UnixMilli(),
+	})
+}
+
+// WorkAsync 有截止时间的请求在队列已满时立即返回 ServerBusyErr，内部消息等待队列空出位置
+func (worker *backWorker) WorkAsync(msg *protocol.RawMessage) (*standard.FutureMsg[protocol.RawMessage], error) {
+	fmsg := standard.NewFutureMsg(msg)
+	worker.closeLock.RLock()
+	defer worker.closeLock.RUnlock()
+	if worker.closed {
+		return nil, ServerClosedErr
+	}
+	if msg.Deadline == 0 {
+		worker.c <- fmsg
+		return fmsg, nil
+	}
+	select {
+	case worker.c <- fmsg:
+		return fmsg, nil
+	default:
+		worker.rejected.Add(1)
+		return nil, standard.ServerBusyErr
+	}
+}
+
+func (worker *backWorker) Stats() *standard.WorkerStats {
+	return &standard.WorkerStats{
+		QueueDepth:    len(worker.c),
+		QueueCapacity: cap(worker.c),
+		Rejected:      worker.rejected.Load(),
+		Expired:       worker.expired.Load(),
+	}
+}
+
+func (worker *backWorker) waitMsg(timeout time.Duration, syncWake bool) (*standard.FutureMsg[protocol.RawMessage], bool) {
+	if worker.pending != nil {
+		msg := worker.pending
+		worker.pending = nil
+		return msg, false
+	}
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 	select {
 	case msg := <-worker.c:
-		return msg
+		return msg, false
+	case <-worker.quit:
+		return nil, true
 	case <-timer.C:
 		if !syncWake {
 			if worker.CanLogger() {
 				logger.Infof("get future task tomeout")
 			}
 		}
-		return nil
+		return nil, false
 	}
 }
 
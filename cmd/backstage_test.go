@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"errors"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/standard"
+	"testing"
+	"time"
+)
+
+type syncCall struct {
+	blFd   int
+	dataFd int
+	// eventId 刷盘时使用的消息，同一个文件使用最后一段的消息
+	eventId int64
+}
+
+type recordFsyncControl struct {
+	calls []syncCall
+}
+
+func (r *recordFsyncControl) sync(blFd, dataFd int, msg *protocol.RawMessage, force bool) int64 {
+	r.calls = append(r.calls, syncCall{blFd, dataFd, msg.EventId})
+	return 0
+}
+
+func (r *recordFsyncControl) rmTopic(name string) {}
+
+func topicMsg(topic string, eventId int64) *protocol.RawMessage {
+	msg := &protocol.RawMessage{}
+	msg.TopicName = topic
+	msg.EventId = eventId
+	return msg
+}
+
+// TestSyncGroupOncePerTopicFile 同一个 topic 出现在不相邻的多段中时只刷一次盘，binlog 随第一个文件刷盘
+func TestSyncGroupOncePerTopicFile(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		dataFds []topicFd
+		expect  []syncCall
+	}{
+		{
+			name:   "no topic file",
+			expect: []syncCall{{10, standard.SyncFdIgnore, 5}},
+		},
+		{
+			name:    "a b a b",
+			dataFds: []topicFd{{1, topicMsg("a", 1)}, {2, topicMsg("b", 2)}, {1, topicMsg("a", 3)}, {2, topicMsg("b", 4)}},
+			expect:  []syncCall{{10, 1, 3}, {standard.SyncFdIgnore, 2, 4}},
+		},
+		{
+			name:    "topic rolled to a new file",
+			dataFds: []topicFd{{1, topicMsg("a", 1)}, {2, topicMsg("b", 2)}, {3, topicMsg("a", 3)}},
+			expect:  []syncCall{{10, 1, 1}, {standard.SyncFdIgnore, 2, 2}, {standard.SyncFdIgnore, 3, 3}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := &recordFsyncControl{}
+			syncGroup(ctrl, 10, tc.dataFds, topicMsg("last", 5))
+			if len(ctrl.calls) != len(tc.expect) {
+				t.Fatalf("expect %v, got %v", tc.expect, ctrl.calls)
+			}
+			for i := range tc.expect {
+				if ctrl.calls[i] != tc.expect[i] {
+					t.Fatalf("expect %v, got %v", tc.expect, ctrl.calls)
+				}
+			}
+		})
+	}
+}
+
+// idleWorker 不启动处理线程的 worker，队列容量为 size
+func idleWorker(size int) *backWorker {
+	return &backWorker{
+		c:                   make(chan *standard.FutureMsg[protocol.RawMessage], size),
+		SampleLoggerSupport: logger.NewSampleLoggerSupport(1),
+		quit:                make(chan struct{}),
+		done:                make(chan struct{}),
+	}
+}
+
+// TestWorkAsyncRejectsWhenBusy 队列满时有截止时间的请求立即返回 ServerBusyErr，没有截止时间的请求等待队列空出位置
+func TestWorkAsyncRejectsWhenBusy(t *testing.T) {
+	worker := idleWorker(1)
+	now := time.Now().UnixMilli()
+	if _, err := worker.WorkAsync(&protocol.RawMessage{Command: protocol.CommandPub, Deadline: now + 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worker.WorkAsync(&protocol.RawMessage{Command: protocol.CommandPub, Deadline: now + 1000}); !errors.Is(err, standard.ServerBusyErr) {
+		t.Fatalf("expect ServerBusyErr when queue is full, got %v", err)
+	}
+	if stats := worker.Stats(); stats.Rejected != 1 || stats.QueueDepth != 1 || stats.QueueCapacity != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	queued := make(chan error, 1)
+	go func() {
+		_, err := worker.WorkAsync(&protocol.RawMessage{Command: protocol.CommandPub})
+		queued <- err
+	}()
+	select {
+	case err := <-queued:
+		t.Fatalf("request without deadline should wait, got %v", err)
+	case <-time.After(time.Millisecond * 100):
+	}
+	<-worker.c
+	select {
+	case err := <-queued:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request without deadline is not queued after space is freed")
+	}
+}
+
+// TestDropExpiredRequest 在队列中超过截止时间的请求返回 RequestExpiredErr，不写 binlog；没有截止时间的请求不会过期
+func TestDropExpiredRequest(t *testing.T) {
+	worker := idleWorker(1)
+	now := time.Now().UnixMilli()
+	for _, tc := range []struct {
+		name     string
+		deadline int64
+		dropped  bool
+	}{
+		{"expired", now - 1, true},
+		{"not expired", now + 60000, false},
+		{"no deadline", 0, false},
+	} {
+		msg := standard.NewFutureMsg(&protocol.RawMessage{Command: protocol.CommandPub, Deadline: tc.deadline})
+		if dropped := worker.dropExpired(msg); dropped != tc.dropped {
+			t.Fatalf("%s: dropped=%v, expect %v", tc.name, dropped, tc.dropped)
+		}
+		if tc.dropped {
+			msg.Wait()
+			if !errors.Is(msg.GetErr(), standard.RequestExpiredErr) {
+				t.Fatalf("%s: expect RequestExpiredErr, got %v", tc.name, msg.GetErr())
+			}
+		}
+	}
+	if stats := worker.Stats(); stats.Expired != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// TestRequestTimeoutDisabledByDefault 默认没有截止时间，与之前的版本一样队列满时等待
+func TestRequestTimeoutDisabledByDefault(t *testing.T) {
+	DefaultServerOptions()
+	if conf.WorkerRequestTimeout != 0 {
+		t.Fatalf("worker.requestTimeoutMs should default to 0, got %v", conf.WorkerRequestTimeout)
+	}
+}
@@ -0,0 +1,208 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/dir"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/standard"
+	"github.com/rolandhe/smss/store"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 在线备份：备份点通过 CommandBarrier 在 worker 中获取，此时之前的消息都已经写入，之后的消息还没有写入。
+// 在 worker 中记录最后的 eventId，把 meta 以 badger 备份格式读到内存，打开 binlog 与 topic 文件并记录它们的长度；
+// 之后在 worker 之外从打开的文件复制备份点时的长度，不使用硬链接，备份与数据目录不共享 inode，之后对数据文件的修复、截断不会影响备份。
+// 目标以 .tar、.tar.gz 或者 .tgz 结尾时输出 tar 包，否则输出到目录，都是先写到临时路径，完成后重命名
+
+const (
+	// ManifestName 备份的描述文件，json 格式
+	ManifestName = "backup.json"
+	// MetaName meta 的 badger 备份
+	MetaName = "meta.backup"
+
+	tmpSuffix = ".tmp"
+)
+
+var targetExistErr = dir.NewBizError("backup target exists")
+
+// ManifestFile 备份中的一个 binlog 或者 topic 文件
+type ManifestFile struct {
+	// Name 相对数据目录的路径
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+}
+
+type Manifest struct {
+	// EventId 备份点，备份中包含它以及它之前的所有数据
+	EventId   int64           `json:"eventId"`
+	Timestamp int64           `json:"timestamp"`
+	Files     []*ManifestFile `json:"files"`
+}
+
+type backupFile struct {
+	*ManifestFile
+	f *os.File
+}
+
+type backupPoint struct {
+	manifest *Manifest
+	meta     bytes.Buffer
+	files    []*backupFile
+	err      error
+}
+
+// Take 把 root 下的数据备份到 target，target 必须不存在
+func Take(root, target string, fstore store.Store, worker standard.MessageWorking, lastEventId func() int64, traceId string) (*Manifest, error) {
+	exist, err := dir.PathExist(target)
+	if err != nil {
+		return nil, err
+	}
+	if exist {
+		return nil, targetExistErr
+	}
+	tmp := target + tmpSuffix
+	if err = os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+	out, err := newSink(tmp)
+	if err != nil {
+		return nil, err
+	}
+	point := &backupPoint{}
+	defer point.closeFiles()
+	err = worker.Work(&protocol.RawMessage{
+		Command:   protocol.CommandBarrier,
+		Timestamp: time.Now().UnixMilli(),
+		TraceId:   traceId,
+		Body: protocol.BarrierFunc(func() {
+			point.err = point.capture(root, fstore, lastEventId())
+		}),
+	})
+	if err == nil {
+		err = point.err
+	}
+	if err == nil {
+		logger.Infof("tid=%s,backup to %s begin, eventId=%d, files=%d", traceId, target, point.manifest.EventId, len(point.files))
+		err = point.output(out)
+	}
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, target)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	logger.Infof("tid=%s,backup to %s end, eventId=%d", traceId, target, point.manifest.EventId)
+	return point.manifest, nil
+}
+
+// capture 在 worker 中执行
+func (p *backupPoint) capture(root string, fstore store.Store, eventId int64) error {
+	p.manifest = &Manifest{
+		EventId:   eventId,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	if err := fstore.GetManagerMeta().Backup(&p.meta); err != nil {
+		return err
+	}
+	if err := p.addDir(root, path.Join(root, store.BinlogDir)); err != nil {
+		return err
+	}
+	infos, err := fstore.GetTopicInfoReader().GetTopicSimpleInfoList()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.State == store.TopicStateDeleted {
+			continue
+		}
+		if err = p.addDir(root, fstore.GetTopicPath(info.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addDir 打开目录中的日志文件
+func (p *backupPoint) addDir(root, dirPath string) error {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".log")
+		if entry.IsDir() || !ok {
+			continue
+		}
+		if dir.ParseNumber(name) < 0 {
+			continue
+		}
+		src := path.Join(dirPath, entry.Name())
+		rel, err := filepath.Rel(root, src)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		p.files = append(p.files, &backupFile{
+			ManifestFile: &ManifestFile{
+				Name:    filepath.ToSlash(rel),
+				Size:    stat.Size(),
+				ModTime: stat.ModTime().UnixMilli(),
+			},
+			f: f,
+		})
+	}
+	return nil
+}
+
+func (p *backupPoint) output(out sink) error {
+	for _, bf := range p.files {
+		p.manifest.Files = append(p.manifest.Files, bf.ManifestFile)
+	}
+	mBuf, err := json.MarshalIndent(p.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err = out.write(ManifestName, bytes.NewReader(mBuf), int64(len(mBuf)), now); err != nil {
+		return err
+	}
+	if err = out.write(MetaName, &p.meta, int64(p.meta.Len()), now); err != nil {
+		return err
+	}
+	for _, bf := range p.files {
+		// 文件在备份点之后可能被清理或者继续追加，从备份点打开的文件复制
+		if err = out.write(bf.Name, io.NewSectionReader(bf.f, 0, bf.Size), bf.Size, time.UnixMilli(bf.ModTime)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *backupPoint) closeFiles() {
+	for _, bf := range p.files {
+		bf.f.Close()
+	}
+}
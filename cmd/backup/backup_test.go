@@ -0,0 +1,245 @@
+package backup
+
+import (
+	"archive/tar"
+	"errors"
+	"github.com/rolandhe/smss/pkg/dir"
+	"github.com/rolandhe/smss/store"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSource 在数据目录下写一个文件，修改时间为 modTime
+func writeSource(t *testing.T, root, name, content string, modTime time.Time) {
+	p := filepath.Join(root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// takePoint 不经过 worker 取得备份点，binlog 与 topic order 目录中的日志文件
+func takePoint(t *testing.T, root string) *backupPoint {
+	p := &backupPoint{manifest: &Manifest{EventId: 7, Timestamp: time.Now().UnixMilli()}}
+	t.Cleanup(p.closeFiles)
+	p.meta.WriteString("meta")
+	for _, d := range []string{store.BinlogDir, "order", "missing"} {
+		if err := p.addDir(root, filepath.Join(root, d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+func TestTarballSuffix(t *testing.T) {
+	for _, tc := range []struct {
+		target  string
+		tarball bool
+		gzip    bool
+	}{
+		{"/data/bak", false, false},
+		{"/data/bak.tar", true, false},
+		{"/data/bak.tar.gz", true, true},
+		{"/data/bak.tgz", true, true},
+		{"/data/bak.gz", false, false},
+	} {
+		if isTarball(tc.target) != tc.tarball || isGzip(tc.target) != tc.gzip {
+			t.Fatalf("%s: expect tarball=%v gzip=%v", tc.target, tc.tarball, tc.gzip)
+		}
+	}
+}
+
+// TestBackupRoundTrip 只备份目录中数字命名的 .log 文件，按备份点时的长度复制；备份点之后追加或者删除的文件不影响备份，
+// 展开后内容与修改时间与备份点一致
+func TestBackupRoundTrip(t *testing.T) {
+	// tar 包中的修改时间精确到秒
+	modTime := time.Unix(time.Now().Add(-time.Hour).Unix(), 0)
+	for _, target := range []string{"bak", "bak.tar", "bak.tar.gz", "bak.tgz"} {
+		t.Run(target, func(t *testing.T) {
+			root := t.TempDir()
+			writeSource(t, root, "binlog/0.log", "binlog-0", modTime)
+			writeSource(t, root, "binlog/5.log", "binlog-5", modTime)
+			writeSource(t, root, "binlog/meta.data", "ignored", modTime)
+			writeSource(t, root, "binlog/x.log", "ignored", modTime)
+			writeSource(t, root, "order/3.log", "order-3", modTime)
+			writeSource(t, root, "order/sub/4.log", "ignored", modTime)
+
+			p := takePoint(t, root)
+			// 备份点之后的修改
+			f, err := os.OpenFile(filepath.Join(root, "binlog", "5.log"), os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString("-after")
+			f.Close()
+			if err = os.Remove(filepath.Join(root, "order", "3.log")); err != nil {
+				t.Fatal(err)
+			}
+
+			dst := filepath.Join(t.TempDir(), target)
+			out, err := newSink(dst + tmpSuffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = p.output(out); err != nil {
+				t.Fatal(err)
+			}
+			if err = out.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err = os.Rename(dst+tmpSuffix, dst); err != nil {
+				t.Fatal(err)
+			}
+
+			restored := filepath.Join(t.TempDir(), "restored")
+			manifest, err := Extract(dst, restored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if manifest.EventId != 7 || len(manifest.Files) != 3 {
+				t.Fatalf("unexpected manifest %+v", manifest)
+			}
+			for name, content := range map[string]string{
+				"binlog/0.log": "binlog-0",
+				"binlog/5.log": "binlog-5",
+				"order/3.log":  "order-3",
+				MetaName:       "meta",
+			} {
+				p := filepath.Join(restored, filepath.FromSlash(name))
+				buf, err := os.ReadFile(p)
+				if err != nil || string(buf) != content {
+					t.Fatalf("%s: got %q %v, expect %q", name, buf, err, content)
+				}
+				if name == MetaName {
+					continue
+				}
+				if stat, _ := os.Stat(p); !stat.ModTime().Equal(modTime) {
+					t.Fatalf("%s: modTime %v, expect %v", name, stat.ModTime(), modTime)
+				}
+			}
+			if exist, _ := dir.PathExist(filepath.Join(restored, "order", "sub")); exist {
+				t.Fatal("nested dir should not be backed up")
+			}
+		})
+	}
+}
+
+// writeTarball 按 entries 写一个 tar 包，用于构造不合法的备份
+func writeTarball(t *testing.T, p string, entries []*tar.Header) {
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, h := range entries {
+		if err = tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			tw.Write(make([]byte, h.Size))
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestExtractRejects 恢复的目录必须为空，备份中的路径必须在恢复的目录内，tar 包中只能有普通文件
+func TestExtractRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		prepare func(t *testing.T, src, root string) string
+		invalid bool
+	}{
+		{"root not empty", func(t *testing.T, src, root string) string {
+			writeSource(t, root, "binlog/0.log", "x", time.Now())
+			bak := filepath.Join(src, "bak.tar")
+			writeTarball(t, bak, nil)
+			return bak
+		}, false},
+		{"tar path outside root", func(t *testing.T, src, root string) string {
+			bak := filepath.Join(src, "bak.tar")
+			writeTarball(t, bak, []*tar.Header{{Typeflag: tar.TypeReg, Name: "../escape.log", Size: 1, Mode: 0644}})
+			return bak
+		}, true},
+		{"tar symlink", func(t *testing.T, src, root string) string {
+			bak := filepath.Join(src, "bak.tar")
+			writeTarball(t, bak, []*tar.Header{{Typeflag: tar.TypeSymlink, Name: "binlog/0.log", Linkname: "/etc/passwd", Mode: 0644}})
+			return bak
+		}, true},
+		{"manifest path outside root", func(t *testing.T, src, root string) string {
+			bak := filepath.Join(src, "bak")
+			writeSource(t, bak, MetaName, "meta", time.Now())
+			writeSource(t, bak, ManifestName, `{"eventId":1,"files":[{"name":"../escape.log","size":1}]}`, time.Now())
+			return bak
+		}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, root := t.TempDir(), t.TempDir()
+			bak := tc.prepare(t, src, root)
+			_, err := Extract(bak, root)
+			if err == nil {
+				t.Fatal("expect error")
+			}
+			if errors.Is(err, invalidBackupErr) != tc.invalid || dir.IsBizErr(err) == tc.invalid {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if exist, _ := dir.PathExist(filepath.Join(filepath.Dir(root), "escape.log")); exist {
+				t.Fatal("file written outside root")
+			}
+		})
+	}
+}
+
+// loadMeta 只实现 LoadBackup
+type loadMeta struct {
+	store.ManagerMeta
+	loaded string
+	err    error
+}
+
+func (m *loadMeta) LoadBackup(r io.Reader) error {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.loaded = string(buf)
+	return m.err
+}
+
+// TestLoadMeta 加载成功后删除备份格式的 meta 与描述文件，失败时保留，可以重新加载
+func TestLoadMeta(t *testing.T) {
+	loadErr := errors.New("load failed")
+	for _, tc := range []struct {
+		name string
+		err  error
+		left bool
+	}{
+		{"loaded", nil, false},
+		{"load failed", loadErr, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeSource(t, root, MetaName, "meta", time.Now())
+			writeSource(t, root, ManifestName, "{}", time.Now())
+			meta := &loadMeta{err: tc.err}
+			if err := LoadMeta(root, meta); err != tc.err || meta.loaded != "meta" {
+				t.Fatalf("got %v loaded %q", err, meta.loaded)
+			}
+			for _, name := range []string{MetaName, ManifestName} {
+				if exist, _ := dir.PathExist(filepath.Join(root, name)); exist != tc.left {
+					t.Fatalf("%s exist=%v, expect %v", name, exist, tc.left)
+				}
+			}
+		})
+	}
+}
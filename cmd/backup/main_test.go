@@ -0,0 +1,12 @@
+package backup
+
+import (
+	"github.com/rolandhe/smss/pkg/logger"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitLogger("stderr")
+	os.Exit(m.Run())
+}
@@ -0,0 +1,145 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rolandhe/smss/pkg/dir"
+	"github.com/rolandhe/smss/store"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var invalidBackupErr = errors.New("invalid backup")
+
+// Extract 把备份展开到 root，root 不存在时创建，存在时必须是空目录。展开后 root 下的 meta 还是备份格式，需要通过 LoadMeta 加载
+func Extract(src, root string) (*Manifest, error) {
+	if err := checkEmptyDir(root); err != nil {
+		return nil, err
+	}
+	var err error
+	if isTarball(src) {
+		err = extractTarball(src, root)
+	} else {
+		err = extractDir(src, root)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readManifest(root)
+}
+
+// LoadMeta 加载 Extract 展开的 meta，完成后删除备份格式的 meta 和描述文件
+func LoadMeta(root string, meta store.ManagerMeta) error {
+	p := filepath.Join(root, MetaName)
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	err = meta.LoadBackup(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(root, ManifestName))
+}
+
+func readManifest(root string) (*Manifest, error) {
+	buf, err := os.ReadFile(filepath.Join(root, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err = json.Unmarshal(buf, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// extractDir 复制而不是硬链接，恢复后的实例会继续追加最后的文件，不能影响备份
+func extractDir(src, root string) error {
+	manifest, err := readManifest(src)
+	if err != nil {
+		return err
+	}
+	names := []string{ManifestName, MetaName}
+	for _, mf := range manifest.Files {
+		names = append(names, mf.Name)
+	}
+	for _, name := range names {
+		if err = copyFile(filepath.Join(src, filepath.FromSlash(name)), root, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, root, name string) error {
+	if !filepath.IsLocal(name) {
+		return invalidBackupErr
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(root, filepath.FromSlash(name)), f, stat.Size(), stat.ModTime())
+}
+
+func extractTarball(src, root string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if isGzip(src) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || !filepath.IsLocal(header.Name) {
+			return fmt.Errorf("%w: %s", invalidBackupErr, header.Name)
+		}
+		if err = writeFile(filepath.Join(root, filepath.FromSlash(header.Name)), tr, header.Size, header.ModTime); err != nil {
+			return err
+		}
+	}
+}
+
+// checkEmptyDir p 不存在时创建，存在时必须是空目录
+func checkEmptyDir(p string) error {
+	entries, err := os.ReadDir(p)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(p, os.ModePerm)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return dir.NewBizError(p + " is not empty")
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sink 备份的输出，目录或者 tar 包
+type sink interface {
+	write(name string, r io.Reader, size int64, modTime time.Time) error
+	io.Closer
+}
+
+func isTarball(p string) bool {
+	return strings.HasSuffix(p, ".tar") || isGzip(p)
+}
+
+func isGzip(p string) bool {
+	return strings.HasSuffix(p, ".tar.gz") || strings.HasSuffix(p, ".tgz")
+}
+
+// newSink 根据目标的后缀创建输出，tmp 是目标加上临时后缀
+func newSink(tmp string) (sink, error) {
+	target := strings.TrimSuffix(tmp, tmpSuffix)
+	if !isTarball(target) {
+		if err := os.MkdirAll(tmp, os.ModePerm); err != nil {
+			return nil, err
+		}
+		return &dirSink{root: tmp}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(tmp), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	ts := &tarSink{f: f}
+	var w io.Writer = f
+	if isGzip(target) {
+		ts.gz = gzip.NewWriter(f)
+		w = ts.gz
+	}
+	ts.tw = tar.NewWriter(w)
+	return ts, nil
+}
+
+type dirSink struct {
+	root string
+}
+
+func (ds *dirSink) write(name string, r io.Reader, size int64, modTime time.Time) error {
+	return writeFile(filepath.Join(ds.root, filepath.FromSlash(name)), r, size, modTime)
+}
+
+func (ds *dirSink) Close() error {
+	return nil
+}
+
+type tarSink struct {
+	f  *os.File
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (ts *tarSink) write(name string, r io.Reader, size int64, modTime time.Time) error {
+	err := ts.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(ts.tw, r, size)
+	return err
+}
+
+func (ts *tarSink) Close() error {
+	err := ts.tw.Close()
+	if ts.gz != nil {
+		if gErr := ts.gz.Close(); err == nil {
+			err = gErr
+		}
+	}
+	if sErr := ts.f.Sync(); err == nil {
+		err = sErr
+	}
+	if cErr := ts.f.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// writeFile 写入 size 字节并刷盘，保留原来的修改时间，过期文件的清理依赖它
+func writeFile(p string, r io.Reader, size int64, modTime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(f, r, size); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(p, modTime, modTime)
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/rolandhe/smss/cmd/backup"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/archive"
+	"github.com/rolandhe/smss/standard"
+	"github.com/rolandhe/smss/store"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func backupTo(addr, target string) error {
+	return call(addr, protocol.CommandBackup, "", func(header []byte) {
+		binary.LittleEndian.PutUint32(header[3:], uint32(len(target)))
+	}, []byte(target))
+}
+
+// TestBackupAndRestoreArchivedBinlog 备份只能写到 backup.root 下，文件是复制的，恢复时可以应用 gzip 归档的 binlog
+func TestBackupAndRestoreArchivedBinlog(t *testing.T) {
+	ports := freePorts(t, 1)
+	opts := DefaultServerOptions()
+	opts.Root = t.TempDir()
+	opts.Port = ports[0]
+	opts.Role = InstanceRole{Role: store.Master}
+	opts.MaxLogSize = 512
+	opts.BackupRoot = t.TempDir()
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := addrOf(ports[0])
+	if err = createTopic(addr, "a"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = pub(addr, "a", fmt.Sprintf("before-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, target := range []string{"../escape", "/tmp/abs", "a/../../escape", ""} {
+		if err = backupTo(addr, target); err == nil {
+			t.Fatalf("backup to %q should be rejected", target)
+		}
+	}
+	if err = backupTo(addr, "b1"); err != nil {
+		t.Fatal(err)
+	}
+	backupPath := filepath.Join(opts.BackupRoot, "b1")
+	data, err := os.ReadFile(filepath.Join(backupPath, backup.ManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := &backup.Manifest{}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range manifest.Files {
+		live, err := os.Stat(filepath.Join(opts.Root, filepath.FromSlash(f.Name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		copied, err := os.Stat(filepath.Join(backupPath, filepath.FromSlash(f.Name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(live, copied) {
+			t.Fatalf("%s is linked to the data dir", f.Name)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if err = pub(addr, "a", fmt.Sprintf("after-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := s.routers.LastEventId()
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 除了最后一个文件，binlog 都归档为 .log.gz
+	binlogRoot := path.Join(opts.Root, store.BinlogDir)
+	archived := t.TempDir()
+	entries, err := os.ReadDir(binlogRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextId, err := standard.ReadMaxFileId(binlogRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gzFiles int
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		src := path.Join(binlogRoot, name)
+		if name == fmt.Sprintf("%d.log", nextId-1) {
+			data, err := os.ReadFile(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = os.WriteFile(path.Join(archived, name), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err = archive.NewDirArchiver(archived).Archive(src, name); err != nil {
+			t.Fatal(err)
+		}
+		gzFiles++
+	}
+	if gzFiles == 0 {
+		t.Fatal("expect archived binlog files")
+	}
+
+	restored := path.Join(t.TempDir(), "restored")
+	if err = RestoreStore(restored, &RestoreOptions{Backup: backupPath, BinlogDir: archived}); err != nil {
+		t.Fatal(err)
+	}
+	report := fsckStore(t, restored, false)
+	if !report.OK() || report.LastEventId != last {
+		t.Fatalf("expect restored to eventId %d, got %+v", last, report)
+	}
+}
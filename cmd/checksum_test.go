@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/store"
+	"github.com/rolandhe/smss/store/fss"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSubRejectsCorruptTopicBlock 订阅读到校验和不一致的块时返回错误，不输出损坏的消息
+func TestSubRejectsCorruptTopicBlock(t *testing.T) {
+	ports := freePorts(t, 2)
+	opts := DefaultServerOptions()
+	opts.Root = t.TempDir()
+	opts.Port = ports[0]
+	opts.Role = InstanceRole{Role: store.Master}
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := addrOf(ports[0])
+	if err = createTopic(addr, "t"); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"m0", "m1", "m2"} {
+		if err = pub(addr, "t", content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 启动时只检查最后一个块，破坏第一个块中的消息内容
+	p := path.Join(fss.TopicPath(path.Join(opts.Root, store.TopicDir), "t"), "0.log")
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(data, []byte("m0"))
+	if i < 0 {
+		t.Fatal("message m0 not found in topic file")
+	}
+	data[i+1] ^= 0xff
+	if err = os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Port = ports[1]
+	s, err = NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+	})
+	conn, err := net.DialTimeout("tcp", addrOf(ports[1]), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	who := "checker"
+	req := make([]byte, protocol.HeaderSize)
+	req[0] = byte(protocol.CommandSub)
+	binary.LittleEndian.PutUint16(req[1:], 1)
+	req[3] = 1
+	req = append(req, 't')
+	req = binary.LittleEndian.AppendUint64(req, 0)
+	req = binary.LittleEndian.AppendUint32(req, uint32(len(who)))
+	req = append(req, who...)
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err = conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, protocol.RespHeaderSize)
+	if _, err = readFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	if code := binary.LittleEndian.Uint16(resp); code != protocol.ErrCode {
+		t.Fatalf("expect ErrCode for corrupt block, got %d", code)
+	}
+	msg := make([]byte, binary.LittleEndian.Uint16(resp[2:]))
+	if _, err = readFull(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(msg), "corrupt block") {
+		t.Fatalf("unexpected error %q", msg)
+	}
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rolandhe/smss/cluster"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/store"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// clusterCallback 把选举结果转换为实例的角色切换
+type clusterCallback struct {
+	s *Server
+}
+
+func (cb *clusterCallback) OnLeader(term int64) {
+	traceId := fmt.Sprintf("cluster-%d", term)
+	err := cb.s.Promote(traceId)
+	if err != nil && err != alreadyMasterErr {
+		logger.Infof("tid=%s,cluster promote err:%v", traceId, err)
+	}
+}
+
+func (cb *clusterCallback) OnFollower(leader cluster.Peer, term int64) {
+	traceId := fmt.Sprintf("cluster-%d", term)
+	host, portStr, err := net.SplitHostPort(leader.Addr)
+	if err != nil {
+		logger.Infof("tid=%s,invalid leader addr %s", traceId, leader.Addr)
+		return
+	}
+	port, _ := strconv.Atoi(portStr)
+	if cb.s.replicateFrom(host, port) {
+		return
+	}
+	if err = cb.s.Demote(host, port, traceId); err != nil {
+		logger.Infof("tid=%s,cluster demote to slave of %s err:%v", traceId, leader.Addr, err)
+	}
+}
+
+func (cb *clusterCallback) OnLeaderLost(term int64) {
+	traceId := fmt.Sprintf("cluster-%d", term)
+	if err := cb.s.Fence(traceId); err != nil {
+		logger.Infof("tid=%s,cluster fence err:%v", traceId, err)
+	}
+}
+
+// LastEventId binlog 与 leader 分叉的节点以 0 参与选举，不会当选，避免分叉的数据成为新的 master
+func (cb *clusterCallback) LastEventId() int64 {
+	if cb.s.repl.Diverged() {
+		return 0
+	}
+	return cb.s.routers.LastEventId()
+}
+
+// metaVoteStore 把选举的 term 与投票保存在 meta 中
+type metaVoteStore struct {
+	meta store.ManagerMeta
+}
+
+func (vs *metaVoteStore) LoadVote() (int64, string, error) {
+	return vs.meta.GetClusterVote()
+}
+
+func (vs *metaVoteStore) SaveVote(term int64, votedFor string) error {
+	return vs.meta.SetClusterVote(term, votedFor)
+}
+
+// replicateFrom 是否已经是 host:port 的 slave
+func (s *Server) replicateFrom(host string, port int) bool {
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+	return s.insRole.Role == store.Slave && s.replicator != nil && s.insRole.FromHost == host && s.insRole.FromPort == port
+}
+
+// WhoIsMaster 集群模式下返回选举出的 leader，否则返回本实例或者复制源
+func (s *Server) WhoIsMaster() *cluster.LeaderInfo {
+	if s.cluster != nil {
+		return s.cluster.Leader()
+	}
+	if s.routers.IsMaster() {
+		return &cluster.LeaderInfo{
+			Known: true,
+			Self:  true,
+		}
+	}
+	st := s.repl.GetSlaveStatus().Slave
+	return &cluster.LeaderInfo{
+		Known: st.MasterHost != "",
+		Addr:  net.JoinHostPort(st.MasterHost, strconv.Itoa(st.MasterPort)),
+	}
+}
+
+// startCluster 根据配置启动选举，peers 的格式是 id@host:port
+func (s *Server) startCluster() error {
+	opts := s.opts.Cluster
+	cfg := cluster.Config{
+		NodeId:       opts.NodeId,
+		Lease:        opts.Lease,
+		Heartbeat:    opts.Heartbeat,
+		PreferLeader: s.insRole.Role == store.Master,
+	}
+	for _, item := range opts.Peers {
+		id, addr, ok := strings.Cut(item, "@")
+		if !ok || id == "" || addr == "" {
+			return cluster.InvalidConfigErr
+		}
+		cfg.Peers = append(cfg.Peers, cluster.Peer{
+			Id:   id,
+			Addr: addr,
+		})
+	}
+	node, err := cluster.NewNode(cfg, &cluster.TcpTransport{Timeout: cfg.Heartbeat}, &metaVoteStore{meta: s.fstore.GetManagerMeta()}, &clusterCallback{s: s})
+	if err != nil {
+		return err
+	}
+	s.cluster = node
+	s.routers.InitCluster(node)
+	node.Start()
+	logger.Infof("cluster started, nodeId=%s, peers=%v", cfg.NodeId, opts.Peers)
+	return nil
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/logger"
+)
+
+// Reload 重新加载配置文件，conf 中已经生效的配置由各自的模块重新初始化，SIGHUP 与 CommandReload 调用
+func (s *Server) Reload(traceId string) (*conf.ReloadResult, error) {
+	result, err := conf.Reload(s.applyReload)
+	if err != nil {
+		logger.Infof("tid=%s,reload config err:%v", traceId, err)
+		return nil, err
+	}
+	logger.Infof("tid=%s,reload config ok,applied=%v,need restart=%v", traceId, result.Applied, result.Restart)
+	return result, nil
+}
+
+// applyReload 在 conf.Reload 持有锁时调用
+func (s *Server) applyReload(result *conf.ReloadResult) {
+	if result.Changed("store.clearInterval") {
+		s.cleaner.ResetClearInterval()
+	}
+	if result.Changed("store.flushLevel") {
+		s.worker.flushLevel.Store(conf.FlushLevel.Load())
+	}
+	if result.Changed("message.") {
+		s.routers.InitMessageLimit()
+	}
+	if result.Changed("rateLimit.") {
+		s.routers.InitRateLimit()
+	}
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/cmd/router"
+	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/dir"
+	"github.com/rolandhe/smss/pkg/nets"
+	"net"
+	"sort"
+	"time"
+)
+
+var tooManyConnsErr = dir.NewBizError("too many connections")
+var tooManyIpConnsErr = dir.NewBizError("too many connections from this ip")
+
+// rejectWriteTimeout 拒绝连接时输出错误的超时，client 不读取时不能长时间占用连接
+const rejectWriteTimeout = time.Millisecond * 100
+
+// rejectConn 超过连接数限制，输出 ServerBusyCode，调用方随后关闭连接，client 可以稍后重连
+func rejectConn(conn net.Conn, err error) {
+	nets.OutputErrCodeWithSeq(conn, protocol.ServerBusyCode, err.Error(), 0, rejectWriteTimeout)
+}
+
+// limitExempt 复制与集群节点之间的连接不受连接数限制，否则连接数满时 slave 不能复制，节点之间不能选举
+func limitExempt(cmd protocol.CommandEnum) bool {
+	return cmd == protocol.CommandReplica || cmd == protocol.CommandSnapshot || cmd == protocol.CommandCluster
+}
+
+// admitConn 在连接的第一个不豁免的命令时检查连接数限制，通过后计入限制
+func (s *Server) admitConn(state *connState) error {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	if conf.ConnMaxConns > 0 && s.limitedConns >= conf.ConnMaxConns {
+		return tooManyConnsErr
+	}
+	if conf.ConnMaxPerIp > 0 && s.ipConns[state.ip] >= conf.ConnMaxPerIp {
+		return tooManyIpConnsErr
+	}
+	state.limited = true
+	s.limitedConns++
+	s.ipConns[state.ip]++
+	return nil
+}
+
+// ListConns 按连接的 id 排序
+func (s *Server) ListConns() []*router.ConnInfo {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	ret := make([]*router.ConnInfo, 0, len(s.conns))
+	for conn, state := range s.conns {
+		info := &router.ConnInfo{
+			Id:           state.id,
+			Remote:       conn.RemoteAddr().String(),
+			CreatedAt:    state.createdAt,
+			LastActiveAt: state.lastActive.Load(),
+			LastCmd:      int(state.lastCmd.Load()),
+			Busy:         state.isBusy(),
+		}
+		if pc := state.pipeline.Load(); pc != nil {
+			if session := pc.Session(); session != nil {
+				info.Version = session.Version
+				info.Features = session.Features
+			}
+		}
+		ret = append(ret, info)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Id < ret[j].Id
+	})
+	return ret
+}
+
+// KillConns 关闭连接后由处理连接的 goroutine 退出并从注册表中删除
+func (s *Server) KillConns(id uint64, ip string) int {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	count := 0
+	for conn, state := range s.conns {
+		if (id > 0 && state.id == id) || (ip != "" && state.ip == ip) {
+			conn.Close()
+			count++
+		}
+	}
+	return count
+}
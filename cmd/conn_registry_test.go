@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/store"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialCmd 建立连接并发送一个没有 payload 的命令，返回连接与响应的 code
+func dialCmd(t *testing.T, addr string, cmd protocol.CommandEnum) (net.Conn, uint16) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	req := make([]byte, protocol.HeaderSize)
+	req[0] = byte(cmd)
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err = conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, protocol.RespHeaderSize)
+	if _, err = readFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	return conn, binary.LittleEndian.Uint16(resp)
+}
+
+// TestConnLimitExemptsReplication 连接数满时拒绝 client 的连接，复制的连接不受限制，也不占用限制
+func TestConnLimitExemptsReplication(t *testing.T) {
+	// 默认配置在 DefaultServerOptions 中加载，之后再修改，server 关闭后恢复
+	DefaultServerOptions()
+	oldMax := conf.ConnMaxConns
+	conf.ConnMaxConns = 1
+	t.Cleanup(func() {
+		conf.ConnMaxConns = oldMax
+	})
+	ports := freePorts(t, 1)
+	s := startTestServer(t, ports[0], InstanceRole{Role: store.Master}, nil)
+	addr := addrOf(ports[0])
+
+	// 还没有发送命令的连接不计入 conn.maxConns，只占用 conn.reservedConns 的预留
+	idle, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	snapshot, code := dialCmd(t, addr, protocol.CommandSnapshot)
+	if code != protocol.OkCode {
+		t.Fatalf("snapshot should not be limited, got code %d", code)
+	}
+	first, code := dialCmd(t, addr, protocol.CommandAlive)
+	if code != protocol.AliveCode {
+		t.Fatalf("first client should be accepted, got code %d", code)
+	}
+	rejected, code := dialCmd(t, addr, protocol.CommandAlive)
+	if code != protocol.ServerBusyCode {
+		t.Fatalf("expect ServerBusyCode, got %d", code)
+	}
+	rejected.SetReadDeadline(time.Now().Add(time.Second * 2))
+	body := make([]byte, 1024)
+	for {
+		if _, err = rejected.Read(body); err != nil {
+			break
+		}
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("rejected connection is not closed")
+	}
+
+	first.Close()
+	snapshot.Close()
+	waitFor(t, time.Second*5, "first client removed", func() bool {
+		s.connLock.Lock()
+		defer s.connLock.Unlock()
+		return s.limitedConns == 0
+	})
+	if _, code = dialCmd(t, addr, protocol.CommandAlive); code != protocol.AliveCode {
+		t.Fatalf("client should be accepted after the first one closed, got code %d", code)
+	}
+}
+
+// setConnLimit 在 DefaultServerOptions 加载默认配置后修改连接限制，server 关闭后恢复
+func setConnLimit(t *testing.T, maxConns, reserved int, firstCmdTimeout time.Duration) {
+	DefaultServerOptions()
+	oldMax, oldReserved, oldFirst := conf.ConnMaxConns, conf.ConnReservedConns, conf.ConnFirstCmdTimeout
+	conf.ConnMaxConns, conf.ConnReservedConns, conf.ConnFirstCmdTimeout = maxConns, reserved, firstCmdTimeout
+	t.Cleanup(func() {
+		conf.ConnMaxConns, conf.ConnReservedConns, conf.ConnFirstCmdTimeout = oldMax, oldReserved, oldFirst
+	})
+}
+
+// TestConnAcceptCapWithReservedHeadroom 注册的连接总数超过 maxConns+reservedConns 时 accept 后直接拒绝，预留的连接留给复制
+func TestConnAcceptCapWithReservedHeadroom(t *testing.T) {
+	setConnLimit(t, 1, 1, time.Second*10)
+	ports := freePorts(t, 1)
+	s := startTestServer(t, ports[0], InstanceRole{Role: store.Master}, nil)
+	addr := addrOf(ports[0])
+	registered := func(n int) func() bool {
+		return func() bool {
+			s.connLock.Lock()
+			defer s.connLock.Unlock()
+			return len(s.conns) == n
+		}
+	}
+
+	if _, code := dialCmd(t, addr, protocol.CommandAlive); code != protocol.AliveCode {
+		t.Fatalf("first client should be accepted, got code %d", code)
+	}
+	snapshot, code := dialCmd(t, addr, protocol.CommandSnapshot)
+	if code != protocol.OkCode {
+		t.Fatalf("snapshot should use the reserved headroom, got code %d", code)
+	}
+
+	// 不发送命令，accept 后直接返回 ServerBusyCode 并关闭
+	rejected, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	rejected.SetDeadline(time.Now().Add(time.Second * 5))
+	resp := make([]byte, protocol.RespHeaderSize)
+	if _, err = readFull(rejected, resp); err != nil {
+		t.Fatal(err)
+	}
+	if code = binary.LittleEndian.Uint16(resp); code != protocol.ServerBusyCode {
+		t.Fatalf("expect ServerBusyCode at accept, got %d", code)
+	}
+	if !registered(2)() {
+		t.Fatal("rejected connection should not be registered")
+	}
+
+	snapshot.Close()
+	waitFor(t, time.Second*5, "snapshot removed", registered(1))
+	if _, code = dialCmd(t, addr, protocol.CommandSnapshot); code != protocol.OkCode {
+		t.Fatalf("snapshot should be accepted after the headroom is released, got code %d", code)
+	}
+}
+
+// TestConnClosedWithoutFirstCmd 开启 maxConns 时，建立后不发送命令的连接在 firstCmdTimeout 后关闭，发送过命令的连接不受影响
+func TestConnClosedWithoutFirstCmd(t *testing.T) {
+	setConnLimit(t, 10, 1, time.Millisecond*500)
+	ports := freePorts(t, 1)
+	startTestServer(t, ports[0], InstanceRole{Role: store.Master}, nil)
+	addr := addrOf(ports[0])
+
+	active, code := dialCmd(t, addr, protocol.CommandAlive)
+	if code != protocol.AliveCode {
+		t.Fatalf("expect AliveCode, got %d", code)
+	}
+	silent, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	start := time.Now()
+	silent.SetReadDeadline(start.Add(time.Second * 3))
+	_, err = silent.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); err == nil || (ok && ne.Timeout()) {
+		t.Fatalf("silent connection should be closed, got %v", err)
+	}
+	if cost := time.Since(start); cost < time.Millisecond*400 {
+		t.Fatalf("silent connection closed too early, cost %v", cost)
+	}
+
+	req := make([]byte, protocol.HeaderSize)
+	req[0] = byte(protocol.CommandAlive)
+	if _, err = active.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, protocol.RespHeaderSize)
+	if _, err = readFull(active, resp); err != nil {
+		t.Fatalf("active connection should stay open, got %v", err)
+	}
+}
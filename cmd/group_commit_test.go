@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/cmd/transfer"
+	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/store"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestGroupCommitKeepsArrivalOrder 并发发布时 worker 合并写入，每条消息都写入，eventId 连续，同一个连接的消息保持发送的顺序，
+// 中间的 DDL 不能合并，留到下一轮处理
+func TestGroupCommitKeepsArrivalOrder(t *testing.T) {
+	ports := freePorts(t, 1)
+	opts := DefaultServerOptions()
+	opts.Root = t.TempDir()
+	opts.Port = ports[0]
+	opts.Role = InstanceRole{Role: store.Master}
+	opts.TransferRoot = t.TempDir()
+	// 默认配置在 DefaultServerOptions 中加载，之后再修改，server 关闭后恢复；等待一段时间凑齐一组
+	oldWait, oldSize := conf.WorkerGroupWait, conf.WorkerGroupMaxSize
+	conf.WorkerGroupWait = time.Millisecond * 2
+	conf.WorkerGroupMaxSize = 16
+	t.Cleanup(func() {
+		conf.WorkerGroupWait, conf.WorkerGroupMaxSize = oldWait, oldSize
+	})
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+	})
+	addr := addrOf(ports[0])
+	for _, topic := range []string{"a", "b"} {
+		if err = createTopic(addr, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const clients, perClient = 8, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, clients+1)
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			topic := []string{"a", "b"}[c%2]
+			for i := 0; i < perClient; i++ {
+				if err := pub(addr, topic, fmt.Sprintf("%d-%d", c, i)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(time.Millisecond * 5)
+		if err := createTopic(addr, "c"); err != nil {
+			errs <- err
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err = range errs {
+		t.Fatal(err)
+	}
+	if last := s.routers.LastEventId(); last != 3+clients*perClient {
+		t.Fatalf("expect eventId %d, got %d", 3+clients*perClient, last)
+	}
+
+	for _, topic := range []string{"a", "b"} {
+		file := topic + ".jsonl"
+		if err = transferCall(t, addr, protocol.CommandExport, topic, map[string]any{"file": file}); err != nil {
+			t.Fatal(err)
+		}
+		fr, err := transfer.NewReader(filepath.Join(opts.TransferRoot, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := map[int]int{}
+		var lastEventId int64
+		count := 0
+		for {
+			record, err := fr.Read()
+			if err != nil {
+				break
+			}
+			var c, i int
+			if _, err = fmt.Sscanf(string(record.Body), "%d-%d", &c, &i); err != nil {
+				t.Fatal(err)
+			}
+			if i != next[c] {
+				t.Fatalf("topic %s: message %d-%d out of order, expect %d", topic, c, i, next[c])
+			}
+			if record.EventId <= lastEventId {
+				t.Fatalf("topic %s: eventId %d after %d", topic, record.EventId, lastEventId)
+			}
+			next[c]++
+			lastEventId = record.EventId
+			count++
+		}
+		fr.Close()
+		if count != clients/2*perClient {
+			t.Fatalf("topic %s: expect %d messages, got %d", topic, clients/2*perClient, count)
+		}
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report := fsckStore(t, opts.Root, false)
+	if !report.OK() || report.TopicMessages != clients*perClient {
+		t.Fatalf("unexpected fsck report %+v", report)
+	}
+}
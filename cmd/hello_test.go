@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/codec"
+	"github.com/rolandhe/smss/store"
+	"net"
+	"testing"
+	"time"
+)
+
+// readOkEventId 读取成功的 pub 响应，响应体为空时返回 0
+func readOkEventId(t *testing.T, conn net.Conn) (uint32, int64) {
+	resp := make([]byte, protocol.RespHeaderSize)
+	if _, err := readFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	code, size := binary.LittleEndian.Uint16(resp), binary.LittleEndian.Uint32(resp[2:])
+	if code != protocol.OkCode {
+		body := make([]byte, size)
+		readFull(conn, body)
+		t.Fatalf("expect ok, got code %d %s", code, body)
+	}
+	if size == 0 {
+		return binary.LittleEndian.Uint32(resp[6:]), 0
+	}
+	body := make([]byte, size)
+	if _, err := readFull(conn, body); err != nil {
+		t.Fatal(err)
+	}
+	return binary.LittleEndian.Uint32(resp[6:]), int64(binary.LittleEndian.Uint64(body))
+}
+
+// TestHelloNegotiatedFeatures 协商了 FeatureEventId 的连接 pub 成功时带回 eventId，没有协商或者没有 HELLO 的连接响应体为空；
+// 协商后没有协商的特性被拒绝，连接可以继续使用
+func TestHelloNegotiatedFeatures(t *testing.T) {
+	ports := freePorts(t, 1)
+	s := startTestServer(t, ports[0], InstanceRole{Role: store.Master}, nil)
+	addr := addrOf(ports[0])
+	if err := createTopic(addr, "t"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		hello    bool
+		features uint32
+		eventId  bool
+		// rejected 没有协商 pipelined 与压缩时 pub 返回的错误
+		rejected string
+	}{
+		{"legacy", false, 0, false, ""},
+		{"all features", true, protocol.ServerFeatures, true, ""},
+		{"event id only", true, protocol.FeatureEventId, true, "compression is not negotiated"},
+		{"no features", true, 0, false, "compression is not negotiated"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.DialTimeout("tcp", addr, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second * 5))
+			if tc.hello {
+				if got := hello(t, conn, tc.features); got != tc.features&protocol.ServerFeatures {
+					t.Fatalf("negotiated features %d, expect %d", got, tc.features)
+				}
+			}
+			if _, err = conn.Write(pubRequest("t", "plain", 0, 0)); err != nil {
+				t.Fatal(err)
+			}
+			if _, eventId := readOkEventId(t, conn); (eventId != 0) != tc.eventId || (tc.eventId && eventId != s.routers.LastEventId()) {
+				t.Fatalf("got eventId %d, expect eventId in response %v, last %d", eventId, tc.eventId, s.routers.LastEventId())
+			}
+
+			if _, err = conn.Write(compressedPubRequest(t, "t", []byte("compressed"), codec.Gzip)); err != nil {
+				t.Fatal(err)
+			}
+			if tc.rejected != "" {
+				if code, _, body := readResp(t, conn); code != protocol.ErrCode || string(body) != tc.rejected {
+					t.Fatalf("expect %s, got code %d %s", tc.rejected, code, body)
+				}
+			} else {
+				readOkEventId(t, conn)
+			}
+
+			// 连接仍然可以使用
+			if _, err = conn.Write(pubRequest("t", "after", 0, 0)); err != nil {
+				t.Fatal(err)
+			}
+			readOkEventId(t, conn)
+		})
+	}
+}
+
+// TestLegacyConnWithoutHello 没有 HELLO 的连接按请求的 flags 处理，pipelined 与压缩的 pub 都可以使用，响应不带 eventId
+func TestLegacyConnWithoutHello(t *testing.T) {
+	ports := freePorts(t, 1)
+	s := startTestServer(t, ports[0], InstanceRole{Role: store.Master}, nil)
+	addr := addrOf(ports[0])
+	if err := createTopic(addr, "t"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	req := pubRequest("t", "m1", protocol.PubFlagPipelined, 11)
+	req = append(req, compressedPubRequest(t, "t", []byte("m2"), codec.Zstd)...)
+	req = append(req, pubRequest("t", "m3", protocol.PubFlagPipelined, 12)...)
+	if _, err = conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []uint32{11, 0, 12} {
+		if seq, eventId := readOkEventId(t, conn); seq != expect || eventId != 0 {
+			t.Fatalf("expect seq %d without eventId, got seq %d eventId %d", expect, seq, eventId)
+		}
+	}
+	if last := s.routers.LastEventId(); last != 4 {
+		t.Fatalf("expect eventId 4, got %d", last)
+	}
+}
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rolandhe/smss/cmd/repair"
+	"github.com/rolandhe/smss/pkg/archive"
+	"github.com/rolandhe/smss/store"
+	"io"
+	"path/filepath"
+)
+
+// InspectSegment 输出一个 binlog 或者 topic 文件中每个块的偏移、命令行和 payload 长度，p 可以是归档的 .log.gz 文件。
+// 所在目录名是 binlog 时按 binlog 解析，否则按 topic 文件解析
+func InspectSegment(p string, w io.Writer) error {
+	r, err := archive.Open(p)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	isBinlog := filepath.Base(filepath.Dir(p)) == store.BinlogDir
+	count := 0
+	err = repair.WalkSegment(r, isBinlog, func(pos int64, cmdBuf, payload []byte) bool {
+		fmt.Fprintf(w, "%d\t%d\t%s", pos, len(payload), cmdBuf)
+		count++
+		return true
+	})
+	fmt.Fprintf(w, "blocks: %d\n", count)
+	return err
+}
@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/codec"
+	"github.com/rolandhe/smss/store"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startLimitServer 启动限制 pub payload 长度的 server，并创建 topic t
+func startLimitServer(t *testing.T, maxBatchBytes, maxDrainBytes int64) (*Server, net.Conn) {
+	ports := freePorts(t, 1)
+	opts := DefaultServerOptions()
+	opts.Root = t.TempDir()
+	opts.Port = ports[0]
+	opts.Role = InstanceRole{Role: store.Master}
+	oldBatch, oldDrain := conf.MessageMaxBatchBytes.Load(), conf.MessageMaxDrainBytes.Load()
+	conf.MessageMaxBatchBytes.Store(maxBatchBytes)
+	conf.MessageMaxDrainBytes.Store(maxDrainBytes)
+	t.Cleanup(func() {
+		conf.MessageMaxBatchBytes.Store(oldBatch)
+		conf.MessageMaxDrainBytes.Store(oldDrain)
+	})
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+	})
+	addr := addrOf(ports[0])
+	if err = createTopic(addr, "t"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	return s, conn
+}
+
+// compressedPubRequest 整批压缩 content 的 pub 请求
+func compressedPubRequest(t *testing.T, topic string, content []byte, c byte) []byte {
+	raw := binary.LittleEndian.AppendUint32(nil, uint32(len(content)))
+	raw = binary.LittleEndian.AppendUint32(raw, 0)
+	raw = append(raw, content...)
+	payload, err := protocol.CompressPayload(raw, 1, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, protocol.HeaderSize)
+	buf[0] = byte(protocol.CommandPub)
+	binary.LittleEndian.PutUint16(buf[1:], uint16(len(topic)))
+	binary.LittleEndian.PutUint32(buf[3:], uint32(len(payload)))
+	buf[7] = protocol.PubFlagCompressed
+	buf[12] = c
+	buf = append(buf, topic...)
+	return append(buf, payload...)
+}
+
+// TestCompressedBombRejected 压缩后很小、解压后超过 maxBatchBytes 的 pub 返回 TooLargeCode，不写入，连接可以继续使用
+func TestCompressedBombRejected(t *testing.T) {
+	s, conn := startLimitServer(t, 64*1024, 1024*1024)
+	last := s.routers.LastEventId()
+	for _, c := range []byte{codec.Gzip, codec.Snappy, codec.Zstd} {
+		req := compressedPubRequest(t, "t", make([]byte, 1<<20), c)
+		if len(req) > 64*1024 {
+			t.Fatalf("%s: compressed request is too large %d", codec.Name(c), len(req))
+		}
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		if code, _, body := readResp(t, conn); code != protocol.TooLargeCode {
+			t.Fatalf("%s: expect TooLargeCode, got %d %s", codec.Name(c), code, body)
+		}
+	}
+	if s.routers.LastEventId() != last {
+		t.Fatal("rejected pub is written")
+	}
+	if _, err := conn.Write(compressedPubRequest(t, "t", make([]byte, 1024), codec.Zstd)); err != nil {
+		t.Fatal(err)
+	}
+	if code, _, body := readResp(t, conn); code != protocol.OkCode {
+		t.Fatalf("pub within the limit should succeed, got %d %s", code, body)
+	}
+}
+
+// TestTooLargeDrainOrClose 超过 maxBatchBytes 的 payload 不超过 maxDrainBytes 时读取并丢弃，连接继续使用，否则输出错误后关闭连接
+func TestTooLargeDrainOrClose(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		size   int
+		closed bool
+	}{
+		{"drain", 32 * 1024, false},
+		{"close", 128 * 1024, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, conn := startLimitServer(t, 16*1024, 64*1024)
+			req := pubRequest("t", string(make([]byte, tc.size)), 0, 0)
+			if !tc.closed {
+				if _, err := conn.Write(req); err != nil {
+					t.Fatal(err)
+				}
+			} else if _, err := conn.Write(req[:protocol.HeaderSize+1]); err != nil {
+				// 超过 maxDrainBytes 的 payload 不会被读取，只发送 header
+				t.Fatal(err)
+			}
+			if code, _, body := readResp(t, conn); code != protocol.TooLargeCode {
+				t.Fatalf("expect TooLargeCode, got %d %s", code, body)
+			}
+			if tc.closed {
+				if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+					t.Fatalf("conn should be closed, got %v", err)
+				}
+				return
+			}
+			if _, err := conn.Write(pubRequest("t", "small", 0, 0)); err != nil {
+				t.Fatal(err)
+			}
+			if code, _, body := readResp(t, conn); code != protocol.OkCode {
+				t.Fatalf("conn should be usable after drain, got %d %s", code, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/store"
+	"net"
+	"testing"
+	"time"
+)
+
+// pubRequest 一条消息的 pub 请求，flags 与 seq 见 PubProtoHeader
+func pubRequest(topic, content string, flags byte, seq uint32) []byte {
+	payload := binary.LittleEndian.AppendUint32(nil, uint32(len(content)))
+	payload = binary.LittleEndian.AppendUint32(payload, 0)
+	payload = append(payload, content...)
+	buf := make([]byte, protocol.HeaderSize)
+	buf[0] = byte(protocol.CommandPub)
+	binary.LittleEndian.PutUint16(buf[1:], uint16(len(topic)))
+	binary.LittleEndian.PutUint32(buf[3:], uint32(len(payload)))
+	buf[7] = flags
+	binary.LittleEndian.PutUint32(buf[8:], seq)
+	buf = append(buf, topic...)
+	return append(buf, payload...)
+}
+
+// hello 发送 HELLO，返回协商的特性
+func hello(t *testing.T, conn net.Conn, features uint32) uint32 {
+	req := make([]byte, protocol.HeaderSize)
+	req[0] = byte(protocol.CommandHello)
+	binary.LittleEndian.PutUint16(req[3:], protocol.ProtocolVersion)
+	binary.LittleEndian.PutUint32(req[5:], features)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, protocol.RespHeaderSize)
+	if _, err := readFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	if code := binary.LittleEndian.Uint16(resp); code != protocol.OkCode {
+		t.Fatalf("hello code %d", code)
+	}
+	return binary.LittleEndian.Uint32(resp[4:])
+}
+
+// readResp 读取一个响应，返回 code、seq 和响应体
+func readResp(t *testing.T, conn net.Conn) (uint16, uint32, []byte) {
+	resp := make([]byte, protocol.RespHeaderSize)
+	if _, err := readFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	code := binary.LittleEndian.Uint16(resp)
+	var body []byte
+	if code != protocol.OkCode {
+		body = make([]byte, binary.LittleEndian.Uint16(resp[2:]))
+		if _, err := readFull(conn, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return code, binary.LittleEndian.Uint32(resp[6:]), body
+}
+
+// TestPipelinedPubEchoesSeq 没有 HELLO 的连接可以连续发送 pipelined 的 pub，响应按请求的顺序带回 seq
+func TestPipelinedPubEchoesSeq(t *testing.T) {
+	ports := freePorts(t, 1)
+	s := startTestServer(t, ports[0], InstanceRole{Role: store.Master}, nil)
+	addr := addrOf(ports[0])
+	if err := createTopic(addr, "t"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	var reqs []byte
+	for i := 0; i < 20; i++ {
+		reqs = append(reqs, pubRequest("t", fmt.Sprintf("m%d", i), protocol.PubFlagPipelined, uint32(100+i))...)
+	}
+	// 一个不存在的 topic，worker 处理失败，错误的响应也带回 seq
+	reqs = append(reqs, pubRequest("none", "x", protocol.PubFlagPipelined, 200)...)
+	if _, err = conn.Write(reqs); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		code, seq, body := readResp(t, conn)
+		if code != protocol.OkCode || seq != uint32(100+i) {
+			t.Fatalf("expect ok with seq %d, got code %d seq %d %s", 100+i, code, seq, body)
+		}
+	}
+	if code, seq, _ := readResp(t, conn); code != protocol.ErrCode || seq != 200 {
+		t.Fatalf("expect error with seq 200, got code %d seq %d", code, seq)
+	}
+	if last := s.routers.LastEventId(); last != 21 {
+		t.Fatalf("expect eventId 21, got %d", last)
+	}
+}
+
+// TestPipelinedFlagWithoutNegotiation HELLO 没有协商 pipelined 时，带有 pipelined 标志的 pub 同步返回错误，之前的 pipelined 响应先输出，不会交叉
+func TestPipelinedFlagWithoutNegotiation(t *testing.T) {
+	ports := freePorts(t, 1)
+	startTestServer(t, ports[0], InstanceRole{Role: store.Master}, nil)
+	addr := addrOf(ports[0])
+	if err := createTopic(addr, "t"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	if features := hello(t, conn, protocol.FeatureEventId); features&protocol.FeaturePipelined != 0 {
+		t.Fatal("pipelined is not requested")
+	}
+	var reqs []byte
+	for i := 0; i < 5; i++ {
+		reqs = append(reqs, pubRequest("t", fmt.Sprintf("m%d", i), protocol.PubFlagPipelined, uint32(i+1))...)
+		reqs = append(reqs, pubRequest("t", fmt.Sprintf("n%d", i), 0, 0)...)
+	}
+	if _, err = conn.Write(reqs); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		code, seq, body := readResp(t, conn)
+		if code != protocol.ErrCode || seq != 0 || string(body) != "pipelined is not negotiated" {
+			t.Fatalf("expect synchronous error, got code %d seq %d %s", code, seq, body)
+		}
+		resp := make([]byte, protocol.RespHeaderSize+8)
+		if _, err = readFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		if code = binary.LittleEndian.Uint16(resp); code != protocol.OkCode {
+			t.Fatalf("expect ok, got code %d", code)
+		}
+	}
+}
@@ -9,10 +9,25 @@ import (
 
 // response code
 const (
-	OkCode     = 200
-	AliveCode  = 201
+	OkCode    = 200
+	AliveCode = 201
+	// SkipCode 复制时 master 跳过了不匹配 slave 过滤条件的块，header 后跟着最后跳过的块的 8 字节 eventId 与 8 字节写入时间，
+	// slave 记录为继续复制的位置
+	SkipCode   = 202
 	SubEndCode = 255
-	ErrCode    = 400
+	// ShutdownCode server正在关闭，订阅端与从库需要稍后重连
+	ShutdownCode = 254
+	ErrCode      = 400
+	// RedirectCode slave 不能处理该请求，header 的 [2:4] 是 master 地址的长度，后面跟着 host:port
+	RedirectCode = 302
+	// StorageFullCode 磁盘剩余空间或者数据大小超过水位，拒绝发布，恢复后可以重试
+	StorageFullCode = 507
+	// ServerBusyCode worker 的队列已满或者请求在队列中超过了截止时间，没有写入，client 可以稍后重试
+	ServerBusyCode = 503
+	// RateLimitedCode 超过了 topic 或者 client 的限流，header 的 [4:6] 是建议的重试等待时间，毫秒
+	RateLimitedCode = 429
+	// TooLargeCode 消息或者 batch 超过了大小限制，请求被丢弃
+	TooLargeCode = 413
 )
 
 const (
@@ -28,6 +43,40 @@ const (
 	RespHeaderSize     = 10
 )
 
+// pub header 中 flags 字节的定义
+const (
+	// PubFlagPipelined pipelined 发布，请求带 seq，响应原样带回 seq，client 不需要等待响应就可以发送下一个请求
+	PubFlagPipelined byte = 1
+	// PubFlagCompressed payload 已经被 producer 整批压缩，格式见 CompressPayload，压缩算法与 header 的 codec 字节相同
+	PubFlagCompressed byte = 2
+)
+
+// sub header 中 flags 字节的定义
+const (
+	// SubFlagAcceptCompressed 订阅端可以自行解压，smss 直接输出压缩的消息，否则输出解压后的消息
+	SubFlagAcceptCompressed byte = 1
+	// SubFlagAllowReplica 允许 slave 提供订阅，否则 slave 会重定向到 master
+	SubFlagAllowReplica byte = 2
+)
+
+// ProtocolVersion 当前的协议版本，没有发送 HELLO 的 client 视为版本 1
+const ProtocolVersion uint16 = 2
+
+// HELLO 中协商的特性，按位组合
+const (
+	// FeaturePipelined 允许 pipelined 发布
+	FeaturePipelined uint32 = 1
+	// FeatureCompression 允许 producer 压缩消息，订阅时直接输出压缩的消息，不需要再设置 SubFlagAcceptCompressed
+	FeatureCompression uint32 = 2
+	// FeatureEventId pub 成功的响应带回第一条消息的 eventId
+	FeatureEventId uint32 = 4
+
+	// ServerFeatures 本版本支持的所有特性
+	ServerFeatures = FeaturePipelined | FeatureCompression | FeatureEventId
+	// ServerAuthMethods smss 目前没有认证，不支持任何认证方式
+	ServerAuthMethods uint16 = 0
+)
+
 const (
 	CommandSub         CommandEnum = 0
 	CommandPub         CommandEnum = 1
@@ -36,15 +85,36 @@ const (
 
 	CommandDelay CommandEnum = 16
 	CommandAlive CommandEnum = 17
-
-	CommandReplica   CommandEnum = 64
-	CommandTopicInfo CommandEnum = 65
-	CommandValidList CommandEnum = 99
-	CommandList      CommandEnum = 100
+	// CommandHello 协商协议版本与特性，可选，没有发送 HELLO 的连接保持老的行为
+	CommandHello CommandEnum = 18
+
+	CommandReplica       CommandEnum = 64
+	CommandTopicInfo     CommandEnum = 65
+	CommandReplicaStatus CommandEnum = 66
+	CommandPromote       CommandEnum = 67
+	CommandDemote        CommandEnum = 68
+	CommandWhoIsMaster   CommandEnum = 69
+	CommandCluster       CommandEnum = 70
+	CommandSnapshot      CommandEnum = 71
+	CommandBackup        CommandEnum = 72
+	CommandExport        CommandEnum = 73
+	CommandImport        CommandEnum = 74
+	CommandServerStats   CommandEnum = 75
+	CommandRateLimit     CommandEnum = 76
+	CommandConnList      CommandEnum = 77
+	CommandConnKill      CommandEnum = 78
+	CommandReload        CommandEnum = 79
+	CommandValidList     CommandEnum = 99
+	CommandList          CommandEnum = 100
 
 	CommandDelayApply CommandEnum = 101
+	// CommandBarrier worker 内部使用，处理完之前投递的消息并强制刷盘，不写binlog
+	CommandBarrier CommandEnum = 102
 )
 
+// BarrierFunc 作为 CommandBarrier 消息的 Body 时，worker 在刷盘之后执行它，执行期间不会有其他写入
+type BarrierFunc func()
+
 const (
 	RawMessageBase    RawMessageSourceEnum = 0
 	RawMessageReplica RawMessageSourceEnum = 1
@@ -80,7 +150,10 @@ type PubProtoHeader struct {
 	// cmd 1 byte
 	// topic name len, 2
 	// payloadSize 4
-	// reserve 12
+	// flags 1
+	// seq 4, pipelined 时有效
+	// codec 1, compressed 时有效
+	// reserve 6
 	// traceId len 1
 	*CommonHeader
 }
@@ -90,13 +163,87 @@ func (ph *PubProtoHeader) GetPayloadSize() int {
 	return int(size)
 }
 
+func (ph *PubProtoHeader) IsPipelined() bool {
+	return ph.buf[7]&PubFlagPipelined != 0
+}
+
+func (ph *PubProtoHeader) GetSeq() uint32 {
+	return binary.LittleEndian.Uint32(ph.buf[8:])
+}
+
+func (ph *PubProtoHeader) IsCompressed() bool {
+	return ph.buf[7]&PubFlagCompressed != 0
+}
+
+func (ph *PubProtoHeader) GetCodec() byte {
+	return ph.buf[12]
+}
+
+type CreateTopicHeader struct {
+	// 20字节
+	// cmd 1 byte
+	// topic name len, 2
+	// codec 1, topic 的默认压缩算法，未压缩的 pub 消息会被 smss 按该算法压缩
+	// reserve 15
+	// traceId len 1
+
+	// next:
+	// expireAt,8
+	*CommonHeader
+}
+
+func (ch *CreateTopicHeader) GetCodec() byte {
+	return ch.buf[3]
+}
+
+// AdminHeader 管理命令的 header
+type AdminHeader struct {
+	// 20字节
+	// cmd 1 byte
+	// topic name len, 2, 不使用
+	// payloadSize 4
+	// reserve 12
+	// traceId len 1
+	*CommonHeader
+}
+
+func (ah *AdminHeader) GetPayloadSize() int {
+	return int(binary.LittleEndian.Uint32(ah.buf[3:]))
+}
+
+type HelloHeader struct {
+	// 20字节
+	// cmd 1 byte
+	// topic name len, 2, 不使用
+	// version 2, client 支持的最高版本
+	// features 4, client 支持的特性
+	// auth methods 2, client 支持的认证方式
+	// reserve 8
+	// traceId len 1
+	*CommonHeader
+}
+
+func (hh *HelloHeader) GetVersion() uint16 {
+	return binary.LittleEndian.Uint16(hh.buf[3:])
+}
+
+func (hh *HelloHeader) GetFeatures() uint32 {
+	return binary.LittleEndian.Uint32(hh.buf[5:])
+}
+
+func (hh *HelloHeader) GetAuthMethods() uint16 {
+	return binary.LittleEndian.Uint16(hh.buf[9:])
+}
+
 type SubHeader struct {
 	// 20字节
 	// pub/sub 1 byte
 	// topic name len, 2
 	// batchSize 1
 	// ack timeout flag 1
-	// reserve 14
+	// flags 1
+	// max lag ms 4, 允许 slave 落后 master 的最大时间，0 表示不限制
+	// reserve 9
 	// traceId len 1
 
 	// next:
@@ -117,11 +264,26 @@ func (sh *SubHeader) HasAckTimeoutFlag() bool {
 	return flag == 1
 }
 
+func (sh *SubHeader) AcceptCompressed() bool {
+	return sh.buf[5]&SubFlagAcceptCompressed != 0
+}
+
+func (sh *SubHeader) AllowReplica() bool {
+	return sh.buf[5]&SubFlagAllowReplica != 0
+}
+
+func (sh *SubHeader) GetMaxLagMs() int64 {
+	return int64(binary.LittleEndian.Uint32(sh.buf[6:]))
+}
+
 type SubInfo struct {
-	Who        string
-	EventId    int64
-	BatchSize  int
-	AckTimeout time.Duration
+	Who              string
+	EventId          int64
+	BatchSize        int
+	AckTimeout       time.Duration
+	AcceptCompressed bool
+	AllowReplica     bool
+	MaxLagMs         int64
 }
 
 type CommandEnum uint8
@@ -148,14 +310,26 @@ type ReplicaHeader struct {
 	// 20字节
 	// pub/sub 1 byte
 	// topic name len, 2
-	// reserve 17
+	// filter size 4, topic 过滤条件 json 的长度，0 表示复制所有 topic
+	// last write time 8, slave 最后应用的块在 master 上的写入时间，用于检查 binlog 是否分叉，0 表示不检查
+	// reserve 4
+	// trace id len 1
 
 	// next:
 	// messageId,8
+	// filter json
 
 	*CommonHeader
 }
 
+func (rh *ReplicaHeader) GetFilterSize() int {
+	return int(binary.LittleEndian.Uint32(rh.buf[3:]))
+}
+
+func (rh *ReplicaHeader) GetLastWriteTime() int64 {
+	return int64(binary.LittleEndian.Uint64(rh.buf[7:]))
+}
+
 type RawMessage struct {
 	Src       RawMessageSourceEnum
 	WriteTime int64
@@ -167,6 +341,13 @@ type RawMessage struct {
 	TraceId   string
 	Body      any
 	Skip      bool
+	// Deadline client 请求的截止时间，毫秒，worker 处理前已经过期的请求不写 binlog；0 表示内部消息，没有截止时间，队列满时等待
+	Deadline int64
+}
+
+// Expired 有截止时间并且已经过期
+func (rm *RawMessage) Expired(now int64) bool {
+	return rm.Deadline > 0 && now > rm.Deadline
 }
 
 func (rm *RawMessage) GetDelay() int64 {
@@ -180,11 +361,17 @@ func (rm *RawMessage) Cost() int64 {
 type DecodedRawMessage struct {
 	RawMessage
 	PayloadLen int
+	// pub 消息的压缩算法
+	Codec byte
+	// 命令行的最后一列是 crc，老版本写入的块没有
+	HasChecksum bool
 }
 
 type PubPayload struct {
 	Payload   []byte
 	BatchSize int
+	// payload 的压缩算法，压缩的 payload 格式见 CompressPayload
+	Codec byte
 }
 
 type DDLPayload struct {
@@ -2,12 +2,28 @@ package protocol
 
 import (
 	"encoding/binary"
+	"errors"
+	"github.com/rolandhe/smss/pkg/codec"
 	"github.com/rolandhe/smss/pkg/dir"
 	"github.com/rolandhe/smss/store"
 )
 
+// ParsePayload 未压缩的 payload 拆成多条 topic 消息，压缩的 payload 整批作为一条 topic 消息，eventId 是其中第一条消息的
 func ParsePayload(payload []byte, fileId, pos int64, startEventId int64) ([]*store.TopicMessage, error) {
+	if IsCompressedPayload(payload) {
+		content := make([]byte, len(payload)-CompressedHeaderSize)
+		copy(content, payload[CompressedHeaderSize:])
+		return []*store.TopicMessage{{
+			EventId:   startEventId,
+			SrcFileId: fileId,
+			SrcPos:    pos,
+			Codec:     payload[8],
+			Count:     int(binary.LittleEndian.Uint32(payload[4:])),
+			Content:   content,
+		}}, nil
+	}
 	var ret []*store.TopicMessage
+	index := 0
 	if len(payload) <= 8 {
 		return nil, dir.NewBizError("invalid message format")
 	}
@@ -25,13 +41,16 @@ func ParsePayload(payload []byte, fileId, pos int64, startEventId int64) ([]*sto
 		copy(content, payload[:oneMsgLen])
 
 		ret = append(ret, &store.TopicMessage{
-			EventId:   startEventId,
-			SrcFileId: fileId,
-			SrcPos:    pos,
-			Content:   content,
+			EventId:      startEventId,
+			SrcFileId:    fileId,
+			SrcPos:       pos,
+			IndexOfBatch: index,
+			Count:        1,
+			Content:      content,
 		})
 
 		startEventId++
+		index++
 
 		if restLen == oneMsgLen {
 			break
@@ -75,3 +94,88 @@ func CheckPayload(payload []byte) (bool, int) {
 
 	return true, count
 }
+
+// MaxContentSize 已经通过 CheckPayload 校验的 payload 中最长的一条消息的长度，包括消息 header
+func MaxContentSize(payload []byte) int {
+	maxSize := 0
+	for len(payload) > 8 {
+		contentSize := int(binary.LittleEndian.Uint32(payload))
+		maxSize = max(maxSize, contentSize)
+		payload = payload[8+contentSize:]
+	}
+	return maxSize
+}
+
+// 压缩的 pub payload 以 CompressedHeaderSize 字节的头开始：4个字节的0(未压缩的 payload 中消息长度不能为0，以此区分)，
+// 4个字节的消息数，1个字节的压缩算法，之后是整批消息一次压缩的结果，解压后与未压缩的 payload 格式相同
+const CompressedHeaderSize = 9
+
+// IsCompressedPayload payload 是否是 CompressPayload 的输出
+func IsCompressedPayload(payload []byte) bool {
+	return len(payload) > CompressedHeaderSize && binary.LittleEndian.Uint32(payload) == 0
+}
+
+// CompressPayload 整批压缩已经通过 CheckPayload 校验的 payload，count 是其中的消息数
+func CompressPayload(payload []byte, count int, c byte) ([]byte, error) {
+	compressed, err := codec.Compress(c, payload)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, CompressedHeaderSize, CompressedHeaderSize+len(compressed))
+	binary.LittleEndian.PutUint32(ret[4:], uint32(count))
+	ret[8] = c
+	return append(ret, compressed...), nil
+}
+
+// DecompressPayload 解压 CompressPayload 的输出，返回未压缩的 payload 及其中的消息数，并校验消息的格式。
+// maxSize 大于 0 时解压后超过 maxSize 返回 codec.TooLargeErr
+func DecompressPayload(payload []byte, maxSize int64) ([]byte, int, error) {
+	if !IsCompressedPayload(payload) {
+		return nil, 0, dir.NewBizError("invalid compressed payload")
+	}
+	raw, err := codec.Decompress(payload[8], payload[CompressedHeaderSize:], maxSize)
+	if errors.Is(err, codec.TooLargeErr) {
+		return nil, 0, err
+	}
+	if err != nil {
+		return nil, 0, dir.NewBizError("invalid compressed payload")
+	}
+	ok, count := CheckPayload(raw)
+	if !ok || count != int(binary.LittleEndian.Uint32(payload[4:])) {
+		return nil, 0, dir.NewBizError("invalid compressed payload")
+	}
+	return raw, count, nil
+}
+
+// PayloadCodec 压缩的 payload 返回其压缩算法，否则返回 codec.None
+func PayloadCodec(payload []byte) byte {
+	if IsCompressedPayload(payload) {
+		return payload[8]
+	}
+	return codec.None
+}
+
+// PayloadCount payload 中的消息数，压缩的 payload 从头中读取，不需要解压
+func PayloadCount(payload []byte) int {
+	if IsCompressedPayload(payload) {
+		return int(binary.LittleEndian.Uint32(payload[4:]))
+	}
+	_, count := CheckPayload(payload)
+	return count
+}
+
+// DecompressBatch 解压 topic 文件中一条压缩的记录，返回未压缩的 payload
+func DecompressBatch(content []byte, c byte) ([]byte, error) {
+	return codec.Decompress(c, content, 0)
+}
+
+// SplitPayload 把未压缩的 payload 拆成一条条消息，每条消息包括8个字节的消息头
+func SplitPayload(payload []byte) [][]byte {
+	var ret [][]byte
+	for len(payload) > 8 {
+		oneMsgLen := 8 + int(binary.LittleEndian.Uint32(payload))
+		ret = append(ret, payload[:oneMsgLen])
+		payload = payload[oneMsgLen:]
+	}
+	return ret
+}
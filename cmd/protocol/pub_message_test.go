@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/rolandhe/smss/pkg/codec"
+	"testing"
+)
+
+func buildPayload(contents ...string) []byte {
+	var buf []byte
+	for _, c := range contents {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(c)))
+		buf = binary.LittleEndian.AppendUint32(buf, 0)
+		buf = append(buf, c...)
+	}
+	return buf
+}
+
+func TestCompressPayloadRoundTrip(t *testing.T) {
+	raw := buildPayload(`{"a":1}`, `{"a":2}`, `{"a":3}`)
+	for _, c := range []byte{codec.Gzip, codec.Snappy, codec.Zstd} {
+		compressed, err := CompressPayload(raw, 3, c)
+		if err != nil {
+			t.Fatalf("codec %d: %v", c, err)
+		}
+		if !IsCompressedPayload(compressed) || PayloadCodec(compressed) != c || PayloadCount(compressed) != 3 {
+			t.Fatalf("codec %d: bad header %v", c, compressed[:CompressedHeaderSize])
+		}
+		got, count, err := DecompressPayload(compressed, int64(len(raw)))
+		if err != nil || count != 3 || !bytes.Equal(got, raw) {
+			t.Fatalf("codec %d: decompress got count=%d err=%v", c, count, err)
+		}
+		if _, _, err = DecompressPayload(compressed, int64(len(raw))-1); err != codec.TooLargeErr {
+			t.Fatalf("codec %d: expect TooLargeErr above limit, got %v", c, err)
+		}
+	}
+	if IsCompressedPayload(raw) || PayloadCount(raw) != 3 || PayloadCodec(raw) != codec.None {
+		t.Fatal("raw payload is treated as compressed")
+	}
+}
+
+func TestDecompressPayloadRejectsWrongCount(t *testing.T) {
+	raw := buildPayload("x", "y")
+	compressed, _ := CompressPayload(raw, 3, codec.Snappy)
+	if _, _, err := DecompressPayload(compressed, 0); err == nil {
+		t.Fatal("expect error for wrong count")
+	}
+}
+
+func TestParseCompressedPayload(t *testing.T) {
+	raw := buildPayload("m1", "m2", "m3", "m4")
+	compressed, _ := CompressPayload(raw, 4, codec.Zstd)
+	msgs, err := ParsePayload(compressed, 2, 100, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].EventId != 10 || msgs[0].Count != 4 || msgs[0].Codec != codec.Zstd {
+		t.Fatalf("unexpected topic messages %+v", msgs)
+	}
+	content, err := DecompressBatch(msgs[0].Content, msgs[0].Codec)
+	if err != nil || !bytes.Equal(content, raw) {
+		t.Fatalf("decompress batch err:%v", err)
+	}
+	items := SplitPayload(content)
+	if len(items) != 4 || string(items[3][8:]) != "m4" {
+		t.Fatalf("unexpected split %q", items)
+	}
+
+	msgs, _ = ParsePayload(raw, 2, 100, 10)
+	if len(msgs) != 4 || msgs[3].EventId != 13 || msgs[3].IndexOfBatch != 3 {
+		t.Fatalf("unexpected raw messages %+v", msgs)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/rolandhe/smss/binlog"
 	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/checksum"
 	"github.com/rolandhe/smss/pkg/logger"
 	"github.com/rolandhe/smss/standard"
 	"github.com/rolandhe/smss/store"
@@ -53,6 +54,7 @@ func ensureLogFile(ppath string) (string, int64, int64, error) {
 type extractLog[C, T any] interface {
 	extractCmd(cmdBuf []byte) (*C, int)
 	extractRet(cmd *C, pos int64, payload []byte) *T
+	hasChecksum(cmd *C) bool
 }
 
 type lastBinlog struct {
@@ -72,6 +74,9 @@ func (ext *extractBinlog) extractCmd(cmdBuf []byte) (*protocol.DecodedRawMessage
 	cmd := binlog.CmdDecoder(cmdBuf)
 	return cmd, cmd.PayloadLen
 }
+func (ext *extractBinlog) hasChecksum(cmd *protocol.DecodedRawMessage) bool {
+	return cmd.HasChecksum
+}
 func (ext *extractBinlog) extractRet(cmd *protocol.DecodedRawMessage, pos int64, payload []byte) *lastBinlog {
 	last := &lastBinlog{
 		fileId:         ext.fileId,
@@ -104,6 +109,9 @@ func (ext *extractTopicLog) extractCmd(cmdBuf []byte) (*fss.TopicMessageCommand,
 	}
 	return cmd, cmd.GetPayloadSize()
 }
+func (ext *extractTopicLog) hasChecksum(cmd *fss.TopicMessageCommand) bool {
+	return cmd != nil && cmd.HasChecksum()
+}
 func (ext *extractTopicLog) extractRet(cmd *fss.TopicMessageCommand, pos int64, payload []byte) *lastTopicLog {
 	last := &lastTopicLog{
 		id:           cmd.GetId(),
@@ -179,6 +187,11 @@ func readLastLogBlock[C, T any](startPosition int64, p string, fileSize int64, e
 					return nil, err
 				}
 			}
+			// 最后一个块可能写入不完整
+			if extractor.hasChecksum(cmdLine) && !checksum.Verify(cBuf, lastPayload) {
+				logger.Infof("last block of %s is corrupt,offset=%d", p, pos)
+				return nil, checksum.NewCorruptBlockErr(p, pos)
+			}
 			break
 		}
 
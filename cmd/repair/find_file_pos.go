@@ -16,33 +16,51 @@ import (
 	"path"
 )
 
+// EventIdExpiredErr eventId 所在的文件已经过期或者被删除，新的 slave 需要通过快照初始化
+var EventIdExpiredErr = errors.New("found event id,but expired")
+
 func FindBinlogPosByEventId(ppath string, eventId int64, lastFileId int64) (int64, int64, error) {
-	return findPosByEventId(ppath, eventId, lastFileId, func(cmdBuf []byte) (int64, int) {
+	fileId, pos, _, err := FindBinlogBlockByEventId(ppath, eventId, lastFileId)
+	return fileId, pos, err
+}
+
+// FindBinlogBlockByEventId 与 FindBinlogPosByEventId 相同，同时返回 eventId 所在块的写入时间，用于判断两个实例的 binlog 是否一致
+func FindBinlogBlockByEventId(ppath string, eventId int64, lastFileId int64) (int64, int64, int64, error) {
+	fileId, pos, cmdBuf, err := findPosByEventId(ppath, eventId, lastFileId, func(cmdBuf []byte) (int64, int64, int) {
 		cmd := binlog.CmdDecoder(cmdBuf)
-		return cmd.EventId, cmd.PayloadLen
+		return cmd.EventId, cmd.EventId, cmd.PayloadLen
 	})
+	if err != nil || cmdBuf == nil {
+		return fileId, pos, 0, err
+	}
+	return fileId, pos, binlog.CmdDecoder(cmdBuf).WriteTime, nil
 }
 
+// FindTopicPosByEventId 返回 eventId 之后的位置，eventId 在一条压缩的记录中间时返回该记录的开始位置，读取时需要跳过已经消费的消息
 func FindTopicPosByEventId(ppath string, eventId int64, lastFileId int64) (int64, int64, error) {
-	return findPosByEventId(ppath, eventId, lastFileId, func(cmdBuf []byte) (int64, int) {
+	fileId, pos, _, err := findPosByEventId(ppath, eventId, lastFileId, func(cmdBuf []byte) (int64, int64, int) {
 		cmd := &fss.TopicMessageCommand{}
 		err := fss.ReadTopicMessageCmd(cmdBuf[:len(cmdBuf)-1], cmd)
 		if err != nil {
 			logger.Infof("FindTopicPosByEventId for %d err:%v", eventId, err)
-			return -1, -1
+			return -1, -1, -1
 		}
-		return cmd.GetId(), cmd.GetPayloadSize()
+		return cmd.GetId(), cmd.GetLastId(), cmd.GetPayloadSize()
 	})
+	return fileId, pos, err
 }
 
-func findPosByEventId(ppath string, eventId int64, lastFileId int64, cmdExtractFunc func(cmdBuf []byte) (int64, int)) (int64, int64, error) {
+// cmdExtractFunc 返回块中第一条和最后一条消息的 eventId 以及 payload 的长度，同时返回 eventId 所在块的 cmd。
+// eventId 不是块的边界时返回它之后第一个块的位置，比如重启的 slave 使用的最后一条消息的 eventId、只复制部分 topic 的 slave
+// 没有复制的块，这时返回的 cmd 是 eventId 之前的最后一个块
+func findPosByEventId(ppath string, eventId int64, lastFileId int64, cmdExtractFunc func(cmdBuf []byte) (int64, int64, int)) (int64, int64, []byte, error) {
 	maxLogFileId, err := standard.ReadMaxFileId(ppath)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, nil, err
 	}
 	maxLogFileId--
 	if maxLogFileId < 0 {
-		return 0, 0, nil
+		return 0, 0, nil, nil
 	}
 
 	nowDate := tm.NowDate()
@@ -53,33 +71,33 @@ func findPosByEventId(ppath string, eventId int64, lastFileId int64, cmdExtractF
 		p := path.Join(ppath, fmt.Sprintf("%d.log", curFileId))
 		stat, err := os.Stat(p)
 		if err != nil && os.IsNotExist(err) {
-			return 0, 0, errors.New("can't find event id,because file not exist")
+			return 0, 0, nil, errors.New("can't find event id,because file not exist")
 		}
 		if err != nil {
-			return 0, 0, err
+			return 0, 0, nil, err
 		}
 
 		modDate := tm.ToDate(stat.ModTime())
-		expired := tm.DiffDays(nowDate, modDate) > conf.StoreMaxDays
+		expired := int64(tm.DiffDays(nowDate, modDate)) > conf.StoreMaxDays.Load()
 
-		found, findPos, err := findInFile(p, eventId, cmdExtractFunc)
+		found, findPos, cmdBuf, err := findInFile(p, eventId, cmdExtractFunc)
 		if err != nil {
-			return 0, 0, err
+			return 0, 0, nil, err
 		}
 		if found == okFound {
 			if expired {
 				if lastExpired {
-					return 0, 0, errors.New("found event id,but expired")
+					return 0, 0, nil, EventIdExpiredErr
 				}
 				if lastFileId > curFileId && findPos != stat.Size() {
-					return 0, 0, errors.New("found event id,but expired")
+					return 0, 0, nil, EventIdExpiredErr
 				}
 			}
-			return curFileId, findPos, nil
+			return curFileId, findPos, cmdBuf, nil
 		}
 		lastExpired = expired
 	}
-	return 0, 0, errors.New("can't find event id")
+	return 0, 0, nil, errors.New("can't find event id")
 }
 
 type foundEnum int
@@ -90,10 +108,10 @@ const (
 	needNext     foundEnum = 2
 )
 
-func findInFile(p string, eventId int64, extractCmd func(cmdBuf []byte) (int64, int)) (foundEnum, int64, error) {
+func findInFile(p string, eventId int64, extractCmd func(cmdBuf []byte) (int64, int64, int)) (foundEnum, int64, []byte, error) {
 	f, err := os.Open(p)
 	if err != nil {
-		return defaultFound, 0, err
+		return defaultFound, 0, nil, err
 	}
 	defer f.Close()
 	r := bufio.NewReader(f)
@@ -101,11 +119,18 @@ func findInFile(p string, eventId int64, extractCmd func(cmdBuf []byte) (int64,
 	buf := make([]byte, cmdCommonSize)
 
 	var nextPos int64
-	first := true
+	var prevCmd []byte
 
 	for {
 		if _, err = io.ReadFull(r, buf[:4]); err != nil {
-			return defaultFound, 0, err
+			// 文件中所有的块都在 eventId 之前，从文件末尾开始
+			if err == io.EOF && prevCmd != nil {
+				return okFound, nextPos, prevCmd, nil
+			}
+			if err == io.EOF {
+				return needNext, 0, nil, nil
+			}
+			return defaultFound, 0, nil, err
 		}
 		cmdLen := int(binary.LittleEndian.Uint32(buf))
 		var cBuf []byte
@@ -117,31 +142,35 @@ func findInFile(p string, eventId int64, extractCmd func(cmdBuf []byte) (int64,
 
 		_, err = io.ReadFull(r, cBuf)
 		if err != nil {
-			return defaultFound, 0, err
+			return defaultFound, 0, nil, err
 		}
 
-		idInCmd, payloadLen := extractCmd(cBuf)
+		idInCmd, lastIdInCmd, payloadLen := extractCmd(cBuf)
+		blockPos := nextPos
 		nextPos += int64(cmdLen + 4 + payloadLen)
-		if idInCmd == eventId {
-			return okFound, nextPos, nil
+		if lastIdInCmd == eventId {
+			return okFound, nextPos, append([]byte(nil), cBuf...), nil
+		}
+		if idInCmd <= eventId && eventId < lastIdInCmd {
+			return okFound, blockPos, append([]byte(nil), cBuf...), nil
 		}
 
-		if first {
-			first = false
-			if idInCmd > eventId {
-				return needNext, 0, nil
+		if idInCmd > eventId {
+			if prevCmd == nil {
+				return needNext, 0, nil, nil
 			}
+			return okFound, blockPos, prevCmd, nil
 		}
+		prevCmd = append(prevCmd[:0], cBuf...)
 		var discard int
 		discard, err = r.Discard(payloadLen)
 		if err != nil {
-			return defaultFound, 0, err
+			return defaultFound, 0, nil, err
 		}
 		if discard != payloadLen {
 			logger.Infof("invalid file:%s, expect:%d,but  discard %d err", p, payloadLen, discard)
-			return defaultFound, 0, errors.New("invalid file")
+			return defaultFound, 0, nil, errors.New("invalid file")
 		}
 
 	}
-	return defaultFound, 0, errors.New("can't find event id")
 }
@@ -0,0 +1,71 @@
+package repair
+
+import (
+	"github.com/rolandhe/smss/binlog"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/logger"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitLogger("stderr")
+	os.Exit(m.Run())
+}
+
+func pubPayload(n int) []byte {
+	var buf []byte
+	for i := 0; i < n; i++ {
+		buf = append(buf, 1, 0, 0, 0, 0, 0, 0, 0, 'x')
+	}
+	return buf
+}
+
+// writeBinlog 写入 0.log，返回每个块的开始位置与文件长度
+func writeBinlog(t *testing.T, root string, msgs ...*protocol.RawMessage) ([]int64, int64) {
+	var data []byte
+	var starts []int64
+	for _, msg := range msgs {
+		starts = append(starts, int64(len(data)))
+		if msg.Command == protocol.CommandPub {
+			data = append(data, binlog.PubEncoder(msg).Bytes()...)
+		} else {
+			data = append(data, binlog.DDLEncoder(msg).Bytes()...)
+		}
+	}
+	if err := os.WriteFile(path.Join(root, "0.log"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return starts, int64(len(data))
+}
+
+func TestFindBinlogBlockByMessageEventId(t *testing.T) {
+	root := t.TempDir()
+	starts, size := writeBinlog(t, root,
+		&protocol.RawMessage{Command: protocol.CommandCreateTopic, EventId: 1, WriteTime: 100, TopicName: "a"},
+		&protocol.RawMessage{Command: protocol.CommandPub, EventId: 2, WriteTime: 200, TopicName: "a", Body: &protocol.PubPayload{Payload: pubPayload(3)}},
+		// eventId 5、6 的块只在 master 上，过滤复制的 slave 没有
+		&protocol.RawMessage{Command: protocol.CommandPub, EventId: 7, WriteTime: 300, TopicName: "a", Body: &protocol.PubPayload{Payload: pubPayload(2)}},
+	)
+	for _, tc := range []struct {
+		eventId   int64
+		pos       int64
+		writeTime int64
+	}{
+		{1, starts[1], 100},
+		{2, starts[2], 200},
+		// 重启的 slave 使用块中最后一条消息的 eventId
+		{4, starts[2], 200},
+		{5, starts[2], 200},
+		{8, size, 300},
+	} {
+		fileId, pos, writeTime, err := FindBinlogBlockByEventId(root, tc.eventId, -1)
+		if err != nil {
+			t.Fatalf("eventId=%d:%v", tc.eventId, err)
+		}
+		if fileId != 0 || pos != tc.pos || writeTime != tc.writeTime {
+			t.Fatalf("eventId=%d, expect pos=%d writeTime=%d, got pos=%d writeTime=%d", tc.eventId, tc.pos, tc.writeTime, pos, writeTime)
+		}
+	}
+}
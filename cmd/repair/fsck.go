@@ -0,0 +1,802 @@
+package repair
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/rolandhe/smss/binlog"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/archive"
+	"github.com/rolandhe/smss/pkg/checksum"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/standard"
+	"github.com/rolandhe/smss/store"
+	"github.com/rolandhe/smss/store/fss"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// fsckMaxCmdLen 命令行的最大长度，超过时认为长度被损坏
+const fsckMaxCmdLen = 64 * 1024
+
+// FsckProblem 检查发现的一处不一致
+type FsckProblem struct {
+	File   string `json:"file,omitempty"`
+	Offset int64  `json:"offset"`
+	Desc   string `json:"desc"`
+}
+
+// FsckReport 离线检查的结果
+type FsckReport struct {
+	BinlogFiles   int            `json:"binlogFiles"`
+	BinlogBlocks  int64          `json:"binlogBlocks"`
+	FirstEventId  int64          `json:"firstEventId"`
+	LastEventId   int64          `json:"lastEventId"`
+	Topics        int            `json:"topics"`
+	TopicMessages int64          `json:"topicMessages"`
+	Delays        int            `json:"delays"`
+	Problems      []*FsckProblem `json:"problems"`
+	// Repaired 修复时执行的动作
+	Repaired []string `json:"repaired,omitempty"`
+}
+
+func (r *FsckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *FsckReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "binlog: %d files, %d blocks, eventId %d-%d\n", r.BinlogFiles, r.BinlogBlocks, r.FirstEventId, r.LastEventId)
+	fmt.Fprintf(w, "topic: %d topics, %d messages\n", r.Topics, r.TopicMessages)
+	fmt.Fprintf(w, "delay: %d messages\n", r.Delays)
+	for _, p := range r.Problems {
+		if p.File == "" {
+			fmt.Fprintf(w, "PROBLEM: %s\n", p.Desc)
+			continue
+		}
+		fmt.Fprintf(w, "PROBLEM: %s:%d %s\n", p.File, p.Offset, p.Desc)
+	}
+	for _, action := range r.Repaired {
+		fmt.Fprintf(w, "REPAIRED: %s\n", action)
+	}
+	if r.OK() {
+		fmt.Fprintln(w, "OK")
+	}
+}
+
+// Fsck 离线检查数据目录：binlog 和 topic 文件的每个块是否完整、校验和是否正确，eventId 是否递增，topic 中的每条消息是否
+// 有对应的 binlog 记录，binlog 中的 pub 是否都写入了 topic，延迟消息与 meta 是否一致。
+// fix 为 true 时把 binlog 和 topic 截断到最后一个一致的位置，并删除 meta 中多余的 topic 和延迟消息。不能在 smss 运行时执行。
+// binlog 按文件检查，每个文件检查完后对照各个 topic 中来自该文件的消息，内存中只保留一个 binlog 文件的 pub 记录
+func Fsck(root string, meta store.Meta, fix bool) (*FsckReport, error) {
+	f := &fsck{
+		binlogRoot: path.Join(root, store.BinlogDir),
+		dataRoot:   path.Join(root, store.TopicDir),
+		meta:       meta,
+		report:     &FsckReport{},
+		delays:     map[string]*delayRef{},
+		applied:    map[string]bool{},
+		topicCuts:  map[string]*logPos{},
+	}
+	topics, err := meta.GetTopicSimpleInfoList()
+	if err != nil {
+		return nil, err
+	}
+	valid := map[string]*store.TopicInfo{}
+	var walks []*topicWalk
+	for _, info := range topics {
+		if info.State != store.TopicStateNormal {
+			continue
+		}
+		valid[info.Name] = info
+		w, err := f.openTopic(info)
+		if err != nil {
+			return nil, err
+		}
+		walks = append(walks, w)
+	}
+	if err = f.walkBinlog(walks); err != nil {
+		return nil, err
+	}
+	// 剩余的消息来自 binlog 截断点之后或者没有对应的 binlog 文件
+	for _, w := range walks {
+		if err = f.advanceTopic(w, -1, nil); err != nil {
+			return nil, err
+		}
+	}
+	if err = f.checkTopicDirs(valid); err != nil {
+		return nil, err
+	}
+	if err = f.checkDelays(valid); err != nil {
+		return nil, err
+	}
+	if fix {
+		if err = f.fix(valid); err != nil {
+			return f.report, err
+		}
+	}
+	return f.report, nil
+}
+
+type logPos struct {
+	fileId int64
+	pos    int64
+}
+
+func (p logPos) before(o logPos) bool {
+	return p.fileId < o.fileId || (p.fileId == o.fileId && p.pos < o.pos)
+}
+
+// pubRef binlog 中的 pub 或者 delayApply 记录，count 是包含的消息数
+type pubRef struct {
+	at      logPos
+	topic   string
+	eventId int64
+	count   int
+	matched int
+}
+
+// filePubs 一个 binlog 文件中的 pub 记录，按位置排列
+type filePubs struct {
+	fileId int64
+	byPos  map[int64]*pubRef
+	refs   []*pubRef
+}
+
+// topicWalk 一个 topic 的检查进度，topic 中的消息按 binlog 文件分段检查
+type topicWalk struct {
+	info       *store.TopicInfo
+	topicPath  string
+	fileId     int64
+	lastFileId int64
+	pos        int64
+	firstId    int64
+	lastId     int64
+	done       bool
+	// reported 已经报告过 binlog 中有该 topic 缺失的 pub，只报告第一个
+	reported bool
+}
+
+type delayRef struct {
+	at      logPos
+	topic   string
+	eventId int64
+}
+
+type fsck struct {
+	binlogRoot string
+	dataRoot   string
+	meta       store.Meta
+	report     *FsckReport
+
+	firstBinlogFileId int64
+	lastEventId       int64
+	// binlog 需要截断的位置，nil 表示不需要
+	cut        *logPos
+	cutEventId int64
+
+	// delays 还没有触发的延迟消息，applied 是 binlog 中触发了但是延迟消息在 binlog 之前的
+	delays  map[string]*delayRef
+	applied map[string]bool
+	// topic 自身损坏时需要截断的位置
+	topicCuts map[string]*logPos
+}
+
+func (f *fsck) problem(file string, offset int64, format string, args ...any) {
+	f.report.Problems = append(f.report.Problems, &FsckProblem{
+		File:   file,
+		Offset: offset,
+		Desc:   fmt.Sprintf(format, args...),
+	})
+}
+
+// cutBinlog binlog 从 at 开始不一致，保留最靠前的截断点
+func (f *fsck) cutBinlog(at logPos, eventId int64) {
+	if f.cut == nil || at.before(*f.cut) {
+		f.cut = &at
+		f.cutEventId = eventId
+	}
+}
+
+func (f *fsck) walkBinlog(walks []*topicWalk) error {
+	first, last, err := logFileRange(f.binlogRoot)
+	if err != nil {
+		return err
+	}
+	f.firstBinlogFileId = first
+	byName := map[string]*topicWalk{}
+	for _, w := range walks {
+		byName[w.info.Name] = w
+	}
+	for fileId := first; fileId <= last; fileId++ {
+		p := path.Join(f.binlogRoot, fmt.Sprintf("%d.log", fileId))
+		f.report.BinlogFiles++
+		pubs := &filePubs{
+			fileId: fileId,
+			byPos:  map[int64]*pubRef{},
+		}
+		stop := false
+		err = walkLogFile(p, binlogPayloadLen, func(pos int64, cmdBuf, payload []byte) bool {
+			if !f.onBinlogBlock(p, logPos{fileId, pos}, cmdBuf, payload, pubs) {
+				stop = true
+				return false
+			}
+			return true
+		})
+		var bad *badBlockErr
+		if errors.As(err, &bad) {
+			f.problem(p, bad.offset, "%s", bad.desc)
+			f.cutBinlog(logPos{fileId, bad.offset}, f.lastEventId+1)
+			stop = true
+		} else if err != nil {
+			return err
+		}
+		for _, w := range walks {
+			if err = f.advanceTopic(w, fileId, pubs); err != nil {
+				return err
+			}
+		}
+		f.checkPubs(pubs, byName)
+		if stop {
+			return nil
+		}
+	}
+	return nil
+}
+
+// checkPubs binlog 中已经写入的 pub 在 topic 中都要存在，topic 较早的文件可能已经过期删除
+func (f *fsck) checkPubs(pubs *filePubs, byName map[string]*topicWalk) {
+	for _, ref := range pubs.refs {
+		w := byName[ref.topic]
+		if w == nil || w.reported || ref.eventId <= w.info.CreateEventId || ref.matched == ref.count {
+			continue
+		}
+		if w.firstId > 0 && ref.eventId+int64(ref.count) <= w.firstId {
+			continue
+		}
+		f.problem(path.Join(f.binlogRoot, fmt.Sprintf("%d.log", ref.at.fileId)), ref.at.pos, "eventId %d of topic %s has %d messages, but %d in topic", ref.eventId, w.info.Name, ref.count, ref.matched)
+		f.cutBinlog(ref.at, ref.eventId)
+		w.reported = true
+	}
+}
+
+// WalkBinlog 按顺序遍历 binlogRoot 中的每个块，block 是包括 4 字节长度的完整块，fn 返回 false 时停止。
+// 文件可以是 {fileId}.log，也可以是归档的 {fileId}.log.gz。
+// 最后一个文件末尾不完整的块认为是没有写完，忽略它，其他位置的损坏返回错误
+func WalkBinlog(binlogRoot string, fn func(cmd *protocol.DecodedRawMessage, block []byte) bool) error {
+	segments, err := binlogSegments(binlogRoot)
+	if err != nil {
+		return err
+	}
+	for i, p := range segments {
+		stop := false
+		err = walkSegmentFile(p, func(pos int64, cmdBuf, payload []byte) bool {
+			block := make([]byte, 4+len(cmdBuf)+len(payload))
+			binary.LittleEndian.PutUint32(block, uint32(len(cmdBuf)))
+			copy(block[4:], cmdBuf)
+			copy(block[4+len(cmdBuf):], payload)
+			if !fn(binlog.CmdDecoder(cmdBuf), block) {
+				stop = true
+				return false
+			}
+			return true
+		})
+		var bad *badBlockErr
+		if errors.As(err, &bad) {
+			if i == len(segments)-1 && bad.desc == "incomplete block" {
+				logger.Infof("ignore incomplete block at %s:%d", p, bad.offset)
+				return nil
+			}
+			return fmt.Errorf("%s at %s:%d", bad.desc, p, bad.offset)
+		}
+		if err != nil || stop {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkSegmentFile 读取 binlog 文件，归档的文件解压后读取
+func walkSegmentFile(p string, fn func(pos int64, cmdBuf, payload []byte) bool) error {
+	r, err := archive.Open(p)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return walkLogReader(r, 0, binlogPayloadLen, fn)
+}
+
+// binlogSegments 返回从最大的 fileId 向前连续的 binlog 文件，同一个 fileId 同时存在 .log 和 .log.gz 时使用 .log
+func binlogSegments(root string) ([]string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	files := map[int64]string{}
+	var maxId int64 = -1
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		idStr, ok := strings.CutSuffix(name, ".log")
+		if !ok {
+			if idStr, ok = strings.CutSuffix(name, ".log"+archive.Suffix); !ok {
+				continue
+			}
+		}
+		fileId, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil || fileId < 0 {
+			continue
+		}
+		if _, exist := files[fileId]; exist && strings.HasSuffix(name, archive.Suffix) {
+			continue
+		}
+		files[fileId] = path.Join(root, name)
+		maxId = max(maxId, fileId)
+	}
+	var segments []string
+	for fileId := maxId; fileId >= 0; fileId-- {
+		p, ok := files[fileId]
+		if !ok {
+			break
+		}
+		segments = append(segments, p)
+	}
+	slices.Reverse(segments)
+	return segments, nil
+}
+
+func binlogPayloadLen(cmdBuf []byte) (int, bool, error) {
+	if bytes.Count(cmdBuf, []byte{'\t'}) < 5 {
+		return 0, false, errors.New("invalid cmd line")
+	}
+	cmd := binlog.CmdDecoder(cmdBuf)
+	return cmd.PayloadLen, cmd.HasChecksum, nil
+}
+
+func (f *fsck) onBinlogBlock(p string, at logPos, cmdBuf, payload []byte, pubs *filePubs) bool {
+	cmd := binlog.CmdDecoder(cmdBuf)
+	if cmd.EventId <= f.lastEventId {
+		f.problem(p, at.pos, "eventId %d is not greater than %d", cmd.EventId, f.lastEventId)
+		f.cutBinlog(at, f.lastEventId+1)
+		return false
+	}
+	count := 1
+	if cmd.Command == protocol.CommandPub || cmd.Command == protocol.CommandDelayApply {
+		msgs := payload
+		if cmd.Command == protocol.CommandDelayApply && len(msgs) > 16 {
+			msgs = msgs[16:]
+		}
+		var ok bool
+		if ok, count = payloadCount(msgs[:max(len(msgs)-1, 0)]); !ok {
+			f.problem(p, at.pos, "invalid payload of eventId %d", cmd.EventId)
+			f.cutBinlog(at, cmd.EventId)
+			return false
+		}
+		ref := &pubRef{
+			at:      at,
+			topic:   cmd.TopicName,
+			eventId: cmd.EventId,
+			count:   count,
+		}
+		pubs.byPos[at.pos] = ref
+		pubs.refs = append(pubs.refs, ref)
+	}
+	if cmd.Command == protocol.CommandDelay || cmd.Command == protocol.CommandDelayApply {
+		if len(payload) < 16 {
+			f.problem(p, at.pos, "invalid delay payload of eventId %d", cmd.EventId)
+			f.cutBinlog(at, cmd.EventId)
+			return false
+		}
+		key := string(store.DelayKeyFromPayload(cmd.TopicName, payload))
+		if cmd.Command == protocol.CommandDelay {
+			f.delays[key] = &delayRef{
+				at:      at,
+				topic:   cmd.TopicName,
+				eventId: cmd.EventId,
+			}
+		} else if f.delays[key] != nil {
+			// 已经触发的延迟消息不再需要检查
+			delete(f.delays, key)
+		} else {
+			f.applied[key] = true
+		}
+	}
+	if f.report.FirstEventId == 0 {
+		f.report.FirstEventId = cmd.EventId
+	}
+	f.lastEventId = cmd.EventId + int64(count) - 1
+	f.report.LastEventId = f.lastEventId
+	f.report.BinlogBlocks++
+	return true
+}
+
+// openTopic 读取 topic 的第一条消息，判断 binlog 中的 pub 是否因为 topic 文件过期而不存在
+func (f *fsck) openTopic(info *store.TopicInfo) (*topicWalk, error) {
+	topicPath := fss.TopicPath(f.dataRoot, info.Name)
+	first, last, err := logFileRange(topicPath)
+	if err != nil {
+		return nil, err
+	}
+	f.report.Topics++
+	w := &topicWalk{
+		info:       info,
+		topicPath:  topicPath,
+		fileId:     first,
+		lastFileId: last,
+	}
+	for fileId := first; fileId <= last && w.firstId == 0; fileId++ {
+		_ = walkLogFile(path.Join(topicPath, fmt.Sprintf("%d.log", fileId)), topicPayloadLen, func(pos int64, cmdBuf, payload []byte) bool {
+			cmd := &fss.TopicMessageCommand{}
+			_ = fss.ReadTopicMessageCmd(cmdBuf[:len(cmdBuf)-1], cmd)
+			w.firstId = cmd.GetId()
+			return false
+		})
+	}
+	return w, nil
+}
+
+// advanceTopic 检查 topic 中来自 binlog 文件 pubs.fileId 及之前的消息，遇到来自之后文件的消息时暂停。pubs 为 nil 时检查剩余的所有消息
+func (f *fsck) advanceTopic(w *topicWalk, binlogFileId int64, pubs *filePubs) error {
+	for !w.done && w.fileId <= w.lastFileId {
+		p := path.Join(w.topicPath, fmt.Sprintf("%d.log", w.fileId))
+		paused := false
+		err := walkLogFileFrom(p, w.pos, topicPayloadLen, func(pos int64, cmdBuf, payload []byte) bool {
+			cmd := &fss.TopicMessageCommand{}
+			_ = fss.ReadTopicMessageCmd(cmdBuf[:len(cmdBuf)-1], cmd)
+			id := cmd.GetId()
+			if id <= w.lastId {
+				f.problem(p, pos, "eventId %d is not greater than %d", id, w.lastId)
+				f.topicCuts[w.info.Name] = &logPos{w.fileId, pos}
+				w.done = true
+				return false
+			}
+			src := logPos{cmd.SrcFileId, cmd.SrcPos}
+			if src.fileId >= f.firstBinlogFileId && (f.cut == nil || src.before(*f.cut)) {
+				if pubs != nil && src.fileId > binlogFileId {
+					paused = true
+					return false
+				}
+				var ref *pubRef
+				if pubs != nil && src.fileId == pubs.fileId {
+					ref = pubs.byPos[src.pos]
+				}
+				if ref == nil || ref.topic != w.info.Name || id < ref.eventId || cmd.GetLastId() >= ref.eventId+int64(ref.count) || int64(cmd.IndexOfBatch) != id-ref.eventId {
+					f.problem(p, pos, "message %d has no binlog record at %d:%d", id, src.fileId, src.pos)
+					f.topicCuts[w.info.Name] = &logPos{w.fileId, pos}
+					w.done = true
+					return false
+				}
+				ref.matched += max(cmd.Count, 1)
+			}
+			w.lastId = cmd.GetLastId()
+			w.pos = pos + int64(4+len(cmdBuf)+len(payload))
+			f.report.TopicMessages += int64(max(cmd.Count, 1))
+			return true
+		})
+		var bad *badBlockErr
+		if errors.As(err, &bad) {
+			f.problem(p, bad.offset, "%s", bad.desc)
+			f.topicCuts[w.info.Name] = &logPos{w.fileId, bad.offset}
+			w.done = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if paused || w.done {
+			return nil
+		}
+		w.fileId++
+		w.pos = 0
+	}
+	w.done = true
+	return nil
+}
+
+// payloadCount 校验 pub 的 payload 并返回消息数，压缩的 payload 需要解压后校验
+func payloadCount(payload []byte) (bool, int) {
+	if protocol.IsCompressedPayload(payload) {
+		_, count, err := protocol.DecompressPayload(payload, 0)
+		return err == nil, count
+	}
+	return protocol.CheckPayload(payload)
+}
+
+func topicPayloadLen(cmdBuf []byte) (int, bool, error) {
+	cmd := &fss.TopicMessageCommand{}
+	if err := fss.ReadTopicMessageCmd(cmdBuf[:len(cmdBuf)-1], cmd); err != nil {
+		return 0, false, err
+	}
+	return cmd.GetPayloadSize(), cmd.HasChecksum(), nil
+}
+
+// checkTopicDirs topic 目录必须在 meta 中存在
+func (f *fsck) checkTopicDirs(valid map[string]*store.TopicInfo) error {
+	l1, err := os.ReadDir(f.dataRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e1 := range l1 {
+		if !e1.IsDir() {
+			continue
+		}
+		l2, err := os.ReadDir(path.Join(f.dataRoot, e1.Name()))
+		if err != nil {
+			return err
+		}
+		for _, e2 := range l2 {
+			if !e2.IsDir() {
+				continue
+			}
+			p := path.Join(f.dataRoot, e1.Name(), e2.Name())
+			names, err := os.ReadDir(p)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				if !name.IsDir() {
+					continue
+				}
+				if _, ok := valid[name.Name()]; !ok {
+					f.problem(path.Join(p, name.Name()), 0, "topic dir without meta")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkDelays 没有触发的延迟消息必须在 meta 中，meta 中的延迟消息必须有 binlog 记录
+func (f *fsck) checkDelays(valid map[string]*store.TopicInfo) error {
+	for key, ref := range f.delays {
+		if f.applied[key] || valid[ref.topic] == nil {
+			continue
+		}
+		exist, err := f.meta.ExistDelay([]byte(key))
+		if err != nil {
+			return err
+		}
+		if !exist {
+			f.problem(path.Join(f.binlogRoot, fmt.Sprintf("%d.log", ref.at.fileId)), ref.at.pos, "delay eventId %d of topic %s not in meta", ref.eventId, ref.topic)
+			f.cutBinlog(ref.at, ref.eventId)
+		}
+	}
+	return f.meta.WalkDelays(func(item *store.DelayItem) error {
+		f.report.Delays++
+		if orphan, eventId := f.orphanDelay(item); orphan {
+			f.problem("", 0, "delay eventId %d of topic %s in meta has no binlog record", eventId, item.TopicName)
+		}
+		return nil
+	})
+}
+
+func (f *fsck) orphanDelay(item *store.DelayItem) (bool, int64) {
+	if len(item.Payload) < 16 {
+		return true, 0
+	}
+	eventId := int64(binary.LittleEndian.Uint64(item.Payload[8:]))
+	key := string(store.DelayKeyFromPayload(item.TopicName, item.Payload))
+	if f.applied[key] {
+		return true, eventId
+	}
+	if f.report.FirstEventId == 0 || eventId < f.report.FirstEventId {
+		return false, eventId
+	}
+	return f.delays[key] == nil, eventId
+}
+
+func (f *fsck) fix(valid map[string]*store.TopicInfo) error {
+	if f.cut != nil {
+		p := path.Join(f.binlogRoot, fmt.Sprintf("%d.log", f.cut.fileId))
+		if err := truncateLogs(f.binlogRoot, *f.cut); err != nil {
+			return err
+		}
+		f.report.Repaired = append(f.report.Repaired, fmt.Sprintf("truncate %s to %d, eventId from %d removed", p, f.cut.pos, f.cutEventId))
+	}
+	for name, info := range valid {
+		topicPath := fss.TopicPath(f.dataRoot, name)
+		if f.cut != nil && info.CreateEventId >= f.cutEventId {
+			if err := os.RemoveAll(topicPath); err != nil {
+				return err
+			}
+			if _, err := f.meta.DeleteTopic(name, true); err != nil {
+				return err
+			}
+			f.report.Repaired = append(f.report.Repaired, fmt.Sprintf("remove topic %s created after eventId %d", name, f.cutEventId))
+			continue
+		}
+		cut := f.topicCuts[name]
+		if f.cut != nil {
+			at, err := findTopicCut(topicPath, *f.cut)
+			if err != nil {
+				return err
+			}
+			if at != nil && (cut == nil || at.before(*cut)) {
+				cut = at
+			}
+		}
+		if cut == nil {
+			continue
+		}
+		if err := truncateLogs(topicPath, *cut); err != nil {
+			return err
+		}
+		f.report.Repaired = append(f.report.Repaired, fmt.Sprintf("truncate %s to %d", path.Join(topicPath, fmt.Sprintf("%d.log", cut.fileId)), cut.pos))
+	}
+	return f.meta.WalkDelays(func(item *store.DelayItem) error {
+		orphan, eventId := f.orphanDelay(item)
+		if !orphan && (f.cut == nil || eventId < f.cutEventId) {
+			return nil
+		}
+		f.report.Repaired = append(f.report.Repaired, fmt.Sprintf("remove delay eventId %d of topic %s", eventId, item.TopicName))
+		return f.meta.RemoveDelay(item.Key)
+	})
+}
+
+// findTopicCut topic 中第一条来自 binlog 截断点之后的消息的位置
+func findTopicCut(topicPath string, binlogCut logPos) (*logPos, error) {
+	first, last, err := logFileRange(topicPath)
+	if err != nil {
+		return nil, err
+	}
+	for fileId := first; fileId <= last; fileId++ {
+		var at *logPos
+		p := path.Join(topicPath, fmt.Sprintf("%d.log", fileId))
+		err = walkLogFile(p, topicPayloadLen, func(pos int64, cmdBuf, payload []byte) bool {
+			cmd := &fss.TopicMessageCommand{}
+			_ = fss.ReadTopicMessageCmd(cmdBuf[:len(cmdBuf)-1], cmd)
+			if !(logPos{cmd.SrcFileId, cmd.SrcPos}).before(binlogCut) {
+				at = &logPos{fileId, pos}
+				return false
+			}
+			return true
+		})
+		if at != nil {
+			return at, nil
+		}
+		var bad *badBlockErr
+		if errors.As(err, &bad) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// truncateLogs 把 at 所在的文件截断到 at.pos，并删除之后的文件
+func truncateLogs(root string, at logPos) error {
+	_, last, err := logFileRange(root)
+	if err != nil {
+		return err
+	}
+	for fileId := last; fileId > at.fileId; fileId-- {
+		if err = os.Remove(path.Join(root, fmt.Sprintf("%d.log", fileId))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Truncate(path.Join(root, fmt.Sprintf("%d.log", at.fileId)), at.pos)
+}
+
+// logFileRange 目录中连续存在的日志文件的最小和最大 id，没有文件时 first > last
+func logFileRange(root string) (int64, int64, error) {
+	maxId, err := standard.ReadMaxFileId(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, -1, nil
+		}
+		return 0, 0, err
+	}
+	last := maxId - 1
+	first := last + 1
+	for first > 0 {
+		if _, err = os.Stat(path.Join(root, fmt.Sprintf("%d.log", first-1))); err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return 0, 0, err
+		}
+		first--
+	}
+	return first, last, nil
+}
+
+type badBlockErr struct {
+	offset int64
+	desc   string
+}
+
+func (e *badBlockErr) Error() string {
+	return e.desc + " at " + strconv.FormatInt(e.offset, 10)
+}
+
+// walkLogFile 顺序读取文件中的所有块，fn 返回 false 时停止。块不完整、长度异常或者校验和不一致时返回 badBlockErr，offset 是该块的开始位置
+func walkLogFile(p string, payloadLen func(cmdBuf []byte) (int, bool, error), fn func(pos int64, cmdBuf, payload []byte) bool) error {
+	return walkLogFileFrom(p, 0, payloadLen, fn)
+}
+
+// walkLogFileFrom 与 walkLogFile 相同，从块的开始位置 offset 开始读取
+func walkLogFileFrom(p string, offset int64, payloadLen func(cmdBuf []byte) (int, bool, error), fn func(pos int64, cmdBuf, payload []byte) bool) error {
+	file, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	return walkLogReader(file, offset, payloadLen, fn)
+}
+
+// WalkSegment 顺序读取一个 binlog 或者 topic 文件的所有块，r 可以是解压后的归档文件，用于查看文件内容
+func WalkSegment(r io.Reader, isBinlog bool, fn func(pos int64, cmdBuf, payload []byte) bool) error {
+	payloadLen := topicPayloadLen
+	if isBinlog {
+		payloadLen = binlogPayloadLen
+	}
+	err := walkLogReader(r, 0, payloadLen, fn)
+	var bad *badBlockErr
+	if errors.As(err, &bad) {
+		return fmt.Errorf("%s at offset %d", bad.desc, bad.offset)
+	}
+	return err
+}
+
+// walkLogReader offset 是 src 在文件中的开始位置
+func walkLogReader(src io.Reader, offset int64, payloadLen func(cmdBuf []byte) (int, bool, error), fn func(pos int64, cmdBuf, payload []byte) bool) error {
+	r := bufio.NewReaderSize(src, ioBufferSize)
+
+	lenBuf := make([]byte, 4)
+	pos := offset
+	var err error
+	for {
+		// start 是块的开始位置，块损坏时报告它，而不是已经读取的位置
+		start := pos
+		if _, err = io.ReadFull(r, lenBuf); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return &badBlockErr{start, "incomplete block"}
+		}
+		cmdLen := int(binary.LittleEndian.Uint32(lenBuf))
+		if cmdLen <= 1 || cmdLen > fsckMaxCmdLen {
+			return &badBlockErr{start, "invalid cmd length"}
+		}
+		cmdBuf := make([]byte, cmdLen)
+		if _, err = io.ReadFull(r, cmdBuf); err != nil {
+			return &badBlockErr{start, "incomplete block"}
+		}
+		if cmdBuf[cmdLen-1] != '\n' {
+			return &badBlockErr{start, "invalid cmd line"}
+		}
+		size, hasChecksum, err := payloadLen(cmdBuf)
+		if err != nil || size < 0 {
+			return &badBlockErr{start, "invalid cmd line"}
+		}
+		payload := make([]byte, size)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			return &badBlockErr{start, "incomplete block"}
+		}
+		if hasChecksum && !checksum.Verify(cmdBuf, payload) {
+			return &badBlockErr{start, "checksum mismatch"}
+		}
+		if !fn(start, cmdBuf, payload) {
+			return nil
+		}
+		pos = start + int64(4+cmdLen+size)
+	}
+}
@@ -0,0 +1,43 @@
+package repair
+
+import (
+	"errors"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"os"
+	"path"
+	"testing"
+)
+
+// corruptPayload 修改块的 payload，命令行不变，读取时校验和不一致
+func corruptPayload(t *testing.T, p string, blockEnd int64) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[blockEnd-2] ^= 0xff
+	if err = os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestChecksumMismatchOffsetIsBlockStart 校验和不一致时报告块的开始位置，fix 从这里截断
+func TestChecksumMismatchOffsetIsBlockStart(t *testing.T) {
+	root := t.TempDir()
+	starts, size := writeBinlog(t, root,
+		&protocol.RawMessage{Command: protocol.CommandPub, EventId: 1, WriteTime: 100, TopicName: "a", Body: &protocol.PubPayload{Payload: pubPayload(2)}},
+		&protocol.RawMessage{Command: protocol.CommandPub, EventId: 3, WriteTime: 200, TopicName: "a", Body: &protocol.PubPayload{Payload: pubPayload(2)}},
+	)
+	p := path.Join(root, "0.log")
+	corruptPayload(t, p, size)
+
+	err := walkLogFile(p, binlogPayloadLen, func(pos int64, cmdBuf, payload []byte) bool {
+		return true
+	})
+	var bad *badBlockErr
+	if !errors.As(err, &bad) || bad.desc != "checksum mismatch" {
+		t.Fatalf("expect checksum mismatch, got %v", err)
+	}
+	if bad.offset != starts[1] {
+		t.Fatalf("expect offset %d, got %d", starts[1], bad.offset)
+	}
+}
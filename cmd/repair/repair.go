@@ -1,9 +1,12 @@
 package repair
 
 import (
+	"fmt"
 	"github.com/rolandhe/smss/cmd/protocol"
 	"github.com/rolandhe/smss/pkg/dir"
+	"github.com/rolandhe/smss/standard"
 	"github.com/rolandhe/smss/store"
+	"os"
 	"path"
 )
 
@@ -14,7 +17,7 @@ func CheckLogAndFix(root string, meta store.Meta) (int64, error) {
 		return 0, err
 	}
 	if !exist {
-		return 1, nil
+		return firstEventId(meta)
 	}
 	dataRoot := path.Join(root, store.TopicDir)
 	exist, err = dir.PathExist(dataRoot)
@@ -22,14 +25,14 @@ func CheckLogAndFix(root string, meta store.Meta) (int64, error) {
 		return 0, err
 	}
 	if !exist {
-		return 1, nil
+		return firstEventId(meta)
 	}
 	p, maxLogFileId, fileSize, err := ensureLogFile(binlogRoot)
 	if err != nil {
 		return 0, err
 	}
 	if p == "" {
-		return 1, nil
+		return firstEventId(meta)
 	}
 
 	extractor := &extractBinlog{
@@ -65,10 +68,51 @@ func getNextEventId(lBinlog *lastBinlog) int64 {
 		payload = payload[16:]
 	}
 
-	ok, count := protocol.CheckPayload(payload[:len(payload)-1])
-	if !ok {
+	count := protocol.PayloadCount(payload[:len(payload)-1])
+	if count == 0 {
 		panic("invalid payload")
 	}
 
 	return lBinlog.messageEventId + int64(count)
 }
+
+// firstEventId binlog 为空时的下一个 eventId，通过快照初始化的实例从快照的下一个开始
+func firstEventId(meta store.ManagerMeta) (int64, error) {
+	snapshotEventId, err := meta.GetSnapshotEventId()
+	if err != nil {
+		return 0, err
+	}
+	return snapshotEventId + 1, nil
+}
+
+// ReadNextEventId 读取binlog中最后一个完整的块，计算下一个 eventId。与 CheckLogAndFix 不同，它只读不修复，
+// 用于运行中的实例在线切换为 master，最后一个块不完整时返回错误
+func ReadNextEventId(root string, meta store.ManagerMeta) (int64, error) {
+	binlogRoot := path.Join(root, store.BinlogDir)
+	maxLogFileId, err := standard.ReadMaxFileId(binlogRoot)
+	if err != nil {
+		return 0, err
+	}
+	for fileId := maxLogFileId - 1; fileId >= 0; fileId-- {
+		p := path.Join(binlogRoot, fmt.Sprintf("%d.log", fileId))
+		info, err := os.Stat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return 0, err
+		}
+		if info.Size() == 0 {
+			continue
+		}
+		extractor := &extractBinlog{
+			fileId: fileId,
+		}
+		lBinlog, err := readLastLogBlock[protocol.DecodedRawMessage, lastBinlog](0, p, info.Size(), extractor)
+		if err != nil {
+			return 0, err
+		}
+		return getNextEventId(lBinlog), nil
+	}
+	return firstEventId(meta)
+}
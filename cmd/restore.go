@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rolandhe/smss/cmd/backgroud"
+	"github.com/rolandhe/smss/cmd/backup"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/cmd/repair"
+	"github.com/rolandhe/smss/cmd/router"
+	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/replica"
+	"github.com/rolandhe/smss/store"
+	"github.com/rolandhe/smss/store/fss"
+)
+
+// RestoreOptions 从备份恢复的参数
+type RestoreOptions struct {
+	// Backup 备份的目录或者 tar 包
+	Backup string
+	// BinlogDir 归档的 binlog 目录，为空时只恢复到备份点
+	BinlogDir string
+	// UntilEventId 恢复到包含该 eventId 的块为止，0 表示不限制
+	UntilEventId int64
+	// UntilTime 恢复到该时间(毫秒)之前发布的消息为止，0 表示不限制
+	UntilTime int64
+}
+
+// RestoreStore 用备份重建数据目录 root，再以 slave 的方式应用归档的 binlog，直到指定的 eventId 或者时间。
+// root 必须不存在或者是空目录，恢复时不监听端口，也不启动延迟消息与 topic 过期的后台线程
+func RestoreStore(root string, opts *RestoreOptions) error {
+	manifest, err := backup.Extract(opts.Backup, root)
+	if err != nil {
+		return err
+	}
+	if opts.UntilEventId > 0 && opts.UntilEventId < manifest.EventId {
+		return fmt.Errorf("backup eventId %d is after %d", manifest.EventId, opts.UntilEventId)
+	}
+	meta, err := fss.NewMeta(root)
+	if err != nil {
+		return err
+	}
+	if err = backup.LoadMeta(root, meta); err != nil {
+		meta.Close()
+		return err
+	}
+	fmt.Printf("restore backup of eventId %d to %s\n", manifest.EventId, root)
+	if opts.BinlogDir == "" {
+		return meta.Close()
+	}
+	nextEventId, err := repair.CheckLogAndFix(root, meta)
+	if err != nil {
+		meta.Close()
+		return err
+	}
+	routers := router.NewRouters(replica.NewReplication(root))
+	routers.InitCommonInfo(nextEventId, store.Slave)
+	w, fstore, err := newWriter(root, meta, conf.MaxLogSize, routers)
+	if err != nil {
+		meta.Close()
+		return err
+	}
+	s := &Server{
+		root:    root,
+		insRole: &InstanceRole{Role: store.Slave},
+		routers: routers,
+		fstore:  fstore,
+	}
+	if s.worker, err = startBack(conf.WorkerBuffSize, int(conf.FlushLevel.Load()), w, fstore, routers); err != nil {
+		fstore.Close()
+		return err
+	}
+	s.delExec = backgroud.StartTopicFileDelete(fstore)
+	routers.InitDelay(fstore, nil)
+	routers.Init(fstore, nil, s.delExec)
+	defer s.release()
+
+	_, err = replica.ReplayBinlog(opts.BinlogDir, manifest.EventId, func(cmd *protocol.DecodedRawMessage) bool {
+		return (opts.UntilEventId > 0 && cmd.EventId > opts.UntilEventId) || (opts.UntilTime > 0 && cmd.Timestamp > opts.UntilTime)
+	}, s.worker, fstore)
+	if err != nil {
+		logger.Infof("replay binlog from %s err:%v", opts.BinlogDir, err)
+		return err
+	}
+	fmt.Printf("replay binlog from %s to eventId %d\n", opts.BinlogDir, routers.LastEventId())
+	return nil
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"github.com/rolandhe/smss/cmd/backgroud"
+	"github.com/rolandhe/smss/cmd/repair"
+	"github.com/rolandhe/smss/pkg/dir"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/replica"
+	"github.com/rolandhe/smss/store"
+)
+
+var alreadyMasterErr = dir.NewBizError("instance is already master")
+var filteredReplicaErr = dir.NewBizError("filtered replica can't be promoted")
+
+// Promote slave 在线切换为 master：停止复制线程，等待 worker 处理完复制过来的消息并刷盘，
+// 从本地binlog读取下一个 eventId，启动延迟消息与生命周期线程，开始接收发布。任何一步失败都会从停止的位置重新开始复制
+func (s *Server) Promote(traceId string) error {
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+	if s.shuttingDown.Load() {
+		return ServerClosedErr
+	}
+	if s.insRole.Role == store.Master {
+		return alreadyMasterErr
+	}
+	// 只复制了部分 topic 的 slave 数据不完整，不能成为 master
+	if filter, err := s.fstore.GetManagerMeta().GetReplicaFilter(); err != nil {
+		return err
+	} else if len(filter) > 0 {
+		return filteredReplicaErr
+	}
+	logger.Infof("tid=%s,promote to master, stop replica from %s:%d", traceId, s.insRole.FromHost, s.insRole.FromPort)
+	resume := s.stopReplica()
+	nextEventId, err := s.readNextEventId()
+	if err == nil {
+		err = s.fstore.GetManagerMeta().SetInstanceRole(store.Master)
+	}
+	if err != nil {
+		logger.Infof("tid=%s,promote err, resume replica:%v", traceId, err)
+		resume(traceId)
+		return err
+	}
+	s.insRole = &InstanceRole{
+		Role: store.Master,
+	}
+	s.startMaster(nextEventId)
+	logger.Infof("tid=%s,promoted to master, next eventId=%d", traceId, nextEventId)
+	return nil
+}
+
+// Demote 切换为 host:port 的 slave。master 先拒绝新的发布并停止延迟消息与生命周期线程，等待 worker 处理完已经接收的消息，
+// 然后从本地最后一个 eventId 开始复制；已经是 slave 时只是指向新的 master。复制启动成功后才保存新的角色，任何一步失败都恢复原来的角色
+func (s *Server) Demote(host string, port int, traceId string) error {
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+	if s.shuttingDown.Load() {
+		return ServerClosedErr
+	}
+	wasMaster := s.insRole.Role == store.Master
+	if wasMaster {
+		logger.Infof("tid=%s,demote to slave of %s:%d, stop accepting pub", traceId, host, port)
+		s.stopMaster()
+	}
+	resume := s.stopReplica()
+	nextEventId, err := s.readNextEventId()
+	var sr *replica.SlaveReplicator
+	if err == nil {
+		if sr, err = s.repl.SlaveReplica(host, port, nextEventId-1, false, s.worker, s.fstore); err != nil {
+			logger.Infof("tid=%s,demote start replica from %s:%d err:%v", traceId, host, port, err)
+		}
+	}
+	if err == nil {
+		if err = s.fstore.GetManagerMeta().SetInstanceRole(store.Slave); err != nil {
+			sr.Stop()
+		}
+	}
+	if err != nil {
+		logger.Infof("tid=%s,demote err, keep the old role:%v", traceId, err)
+		if wasMaster {
+			s.startMaster(s.routers.LastEventId() + 1)
+		} else {
+			resume(traceId)
+		}
+		return err
+	}
+	s.replicator = sr
+	s.insRole = &InstanceRole{
+		Role:     store.Slave,
+		FromHost: host,
+		FromPort: port,
+		EventId:  nextEventId - 1,
+	}
+	logger.Infof("tid=%s,demoted to slave of %s:%d, replica from eventId=%d", traceId, host, port, nextEventId-1)
+	return nil
+}
+
+// readNextEventId 等待 worker 处理完已经接收的消息并刷盘，然后从本地 binlog 读取下一个 eventId，调用者持有 roleLock
+func (s *Server) readNextEventId() (int64, error) {
+	if err := s.worker.Barrier(); err != nil {
+		return 0, err
+	}
+	return repair.ReadNextEventId(s.root, s.fstore.GetManagerMeta())
+}
+
+// stopReplica 停止复制线程，返回的函数用于切换失败时从停止的位置重新开始复制，调用者持有 roleLock
+func (s *Server) stopReplica() func(traceId string) {
+	sr := s.replicator
+	if sr == nil {
+		return func(string) {}
+	}
+	sr.Stop()
+	s.replicator = nil
+	host, port := s.insRole.FromHost, s.insRole.FromPort
+	return func(traceId string) {
+		var err error
+		if s.replicator, err = s.repl.SlaveReplica(host, port, sr.EventId(), false, s.worker, s.fstore); err != nil {
+			logger.Infof("tid=%s,resume replica from %s:%d err:%v", traceId, host, port, err)
+		}
+	}
+}
+
+// startMaster 启动延迟消息与生命周期线程，路由切换为 master，调用者持有 roleLock
+func (s *Server) startMaster(nextEventId int64) {
+	s.delayCtrl = backgroud.StartDelay(s.fstore, s.worker)
+	s.lifeCtrl = backgroud.StartLife(s.fstore, s.worker)
+	s.routers.SwitchRole(store.Master, nextEventId, s.fstore, s.delayCtrl, s.lifeCtrl, s.delExec, s.worker.writer.StdMsgWriter)
+}
+
+// Fence master 停止接收发布，但不指定新的 master，用于集群中 leader 失去租约。实例以没有复制源的 slave 运行，
+// 直到新的 leader 产生后调用 Demote
+func (s *Server) Fence(traceId string) error {
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+	if s.shuttingDown.Load() {
+		return ServerClosedErr
+	}
+	if s.insRole.Role != store.Master {
+		return nil
+	}
+	logger.Infof("tid=%s,fence master, stop accepting pub", traceId)
+	s.stopMaster()
+	if err := s.worker.Barrier(); err != nil {
+		return err
+	}
+	if err := s.fstore.GetManagerMeta().SetInstanceRole(store.Slave); err != nil {
+		return err
+	}
+	s.insRole = &InstanceRole{
+		Role: store.Slave,
+	}
+	return nil
+}
+
+// stopMaster 路由切换为 slave 并停止延迟消息与生命周期线程，调用者持有 roleLock
+func (s *Server) stopMaster() {
+	s.routers.SwitchRole(store.Slave, 0, s.fstore, nil, nil, s.delExec, s.worker.writer.StdMsgWriter)
+	if s.delayCtrl != nil {
+		s.delayCtrl.Stop()
+		s.delayCtrl = nil
+	}
+	if s.lifeCtrl != nil {
+		s.lifeCtrl.Stop()
+		s.lifeCtrl = nil
+	}
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rolandhe/smss/store"
+	"testing"
+	"time"
+)
+
+// TestDemoteKeepsRoleWhenReplicaFails 复制源连接失败时 demote 失败，master 继续接收发布，slave 继续从原来的 master 复制，保存的角色不变
+func TestDemoteKeepsRoleWhenReplicaFails(t *testing.T) {
+	ports := freePorts(t, 3)
+	master := startTestServer(t, ports[0], InstanceRole{Role: store.Master}, nil)
+	slave := startTestServer(t, ports[1], InstanceRole{
+		Role:     store.Slave,
+		FromHost: "127.0.0.1",
+		FromPort: ports[0],
+	}, nil)
+	addr := addrOf(ports[0])
+	if err := createTopic(addr, "t"); err != nil {
+		t.Fatal(err)
+	}
+
+	// ports[2] 没有监听
+	if err := master.Demote("127.0.0.1", ports[2], "test"); err == nil {
+		t.Fatal("demote to an unreachable master should fail")
+	}
+	if !master.routers.IsMaster() || master.insRole.Role != store.Master {
+		t.Fatal("master should keep the master role")
+	}
+	if role, _ := master.Store().GetManagerMeta().GetInstanceRole(); role != store.Master {
+		t.Fatalf("stored role is changed to %d", role)
+	}
+	for i := 0; i < 3; i++ {
+		if err := pub(addr, "t", fmt.Sprintf("m%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := slave.Demote("127.0.0.1", ports[2], "test"); err == nil {
+		t.Fatal("demote to an unreachable master should fail")
+	}
+	if slave.insRole.FromPort != ports[0] || slave.replicator == nil {
+		t.Fatal("slave should keep replicating from the old master")
+	}
+	if err := pub(addr, "t", "after"); err != nil {
+		t.Fatal(err)
+	}
+	last := master.routers.LastEventId()
+	waitFor(t, time.Second*10, "replicated after the failed demote", func() bool {
+		return slave.routers.LastEventId() == last
+	})
+}
@@ -0,0 +1,136 @@
+package router
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/rolandhe/smss/cluster"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/pkg/nets"
+	"github.com/rolandhe/smss/standard"
+	"net"
+	"strconv"
+)
+
+// RoleSwitcher 在线切换实例角色，由 server 实现
+type RoleSwitcher interface {
+	// Promote slave 停止复制，切换为 master
+	Promote(traceId string) error
+	// Demote master 停止接收发布，切换为 host:port 的 slave
+	Demote(host string, port int, traceId string) error
+}
+
+// MasterLocator 回答当前的 master，集群模式下是选举出的 leader
+type MasterLocator interface {
+	WhoIsMaster() *cluster.LeaderInfo
+}
+
+func (rs *Routers) InitAdmin(switcher RoleSwitcher, locator MasterLocator) {
+	rs.masterLocator = locator
+	rs.routerMap[protocol.CommandPromote] = &promoteRouter{
+		switcher: switcher,
+	}
+	rs.routerMap[protocol.CommandDemote] = &demoteRouter{
+		switcher: switcher,
+	}
+	rs.routerMap[protocol.CommandWhoIsMaster] = &whoIsMasterRouter{
+		locator: locator,
+	}
+}
+
+// InitCluster 开启集群模式时注册节点之间通信的命令
+func (rs *Routers) InitCluster(node *cluster.Node) {
+	rs.cluster = node
+	rs.routerMap[protocol.CommandCluster] = &clusterRouter{
+		node: node,
+	}
+}
+
+type promoteRouter struct {
+	switcher RoleSwitcher
+	noBinlog
+}
+
+func (r *promoteRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
+	if err := r.switcher.Promote(commHeader.TraceId); err != nil {
+		logger.Infof("tid=%s,promote err:%v", commHeader.TraceId, err)
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
+	return nets.OutputOk(conn, NetWriteTimeout)
+}
+
+type demoteRouter struct {
+	switcher RoleSwitcher
+	noBinlog
+}
+
+// Router demote 的 payload 是新 master 的地址，host:port
+func (r *demoteRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
+	header := &protocol.AdminHeader{
+		CommonHeader: commHeader,
+	}
+	size := header.GetPayloadSize()
+	if size <= 0 || size > 1024 {
+		return nets.OutputRecoverErr(conn, "invalid master address", NetWriteTimeout)
+	}
+	buf := make([]byte, size)
+	if err := nets.ReadAll(conn, buf, NetReadTimeout); err != nil {
+		return err
+	}
+	host, portStr, err := net.SplitHostPort(string(buf))
+	if err != nil {
+		return nets.OutputRecoverErr(conn, "invalid master address", NetWriteTimeout)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 {
+		return nets.OutputRecoverErr(conn, "invalid master address", NetWriteTimeout)
+	}
+	if err = r.switcher.Demote(host, port, commHeader.TraceId); err != nil {
+		logger.Infof("tid=%s,demote to slave of %s err:%v", commHeader.TraceId, string(buf), err)
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
+	return nets.OutputOk(conn, NetWriteTimeout)
+}
+
+type whoIsMasterRouter struct {
+	locator MasterLocator
+	noBinlog
+}
+
+func (r *whoIsMasterRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
+	return outputJson(conn, r.locator.WhoIsMaster())
+}
+
+type clusterRouter struct {
+	node *cluster.Node
+	noBinlog
+}
+
+func (r *clusterRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
+	header := &protocol.AdminHeader{
+		CommonHeader: commHeader,
+	}
+	size := header.GetPayloadSize()
+	if size <= 0 || size > 4096 {
+		return nets.OutputRecoverErr(conn, "invalid cluster message", NetWriteTimeout)
+	}
+	buf := make([]byte, size)
+	if err := nets.ReadAll(conn, buf, NetReadTimeout); err != nil {
+		return err
+	}
+	req := &cluster.Message{}
+	if err := json.Unmarshal(buf, req); err != nil {
+		return nets.OutputRecoverErr(conn, "invalid cluster message", NetWriteTimeout)
+	}
+	return outputJson(conn, r.node.Handle(req))
+}
+
+// outputJson 输出 OkCode 和 json，json 的长度写在 response header 的 2-6 字节
+func outputJson(conn net.Conn, v any) error {
+	jBuff, _ := json.Marshal(v)
+	outBuff := make([]byte, len(jBuff)+protocol.RespHeaderSize)
+	binary.LittleEndian.PutUint16(outBuff, protocol.OkCode)
+	binary.LittleEndian.PutUint32(outBuff[2:], uint32(len(jBuff)))
+	copy(outBuff[protocol.RespHeaderSize:], jBuff)
+	return nets.WriteAll(conn, outBuff, NetWriteTimeout)
+}
@@ -0,0 +1,57 @@
+package router
+
+import (
+	"github.com/rolandhe/smss/cmd/backup"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/dir"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/pkg/nets"
+	"github.com/rolandhe/smss/standard"
+	"github.com/rolandhe/smss/store"
+	"net"
+)
+
+// backupRouter 在线备份到本机的目录或者 tar 包，payload 是相对 backupRoot 的目标路径
+type backupRouter struct {
+	root       string
+	backupRoot string
+	fstore     store.Store
+	rs         *Routers
+	noBinlog
+}
+
+type backupResult struct {
+	Target  string `json:"target"`
+	EventId int64  `json:"eventId"`
+	Files   int    `json:"files"`
+}
+
+func (r *backupRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
+	header := &protocol.AdminHeader{
+		CommonHeader: commHeader,
+	}
+	size := header.GetPayloadSize()
+	if size <= 0 || size > 4096 {
+		return nets.OutputRecoverErr(conn, "invalid backup target", NetWriteTimeout)
+	}
+	buf := make([]byte, size)
+	if err := nets.ReadAll(conn, buf, NetReadTimeout); err != nil {
+		return err
+	}
+	// 目标来自网络，只能写到 backupRoot 下
+	target, err := dir.ResolveUnder(r.backupRoot, string(buf))
+	if err != nil {
+		logger.Infof("tid=%s,backup to %s err:%v", commHeader.TraceId, string(buf), err)
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
+	manifest, err := backup.Take(r.root, target, r.fstore, worker, r.rs.LastEventId, commHeader.TraceId)
+	if err != nil {
+		logger.Infof("tid=%s,backup to %s err:%v", commHeader.TraceId, target, err)
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
+	return outputJson(conn, &backupResult{
+		Target:  target,
+		EventId: manifest.EventId,
+		Files:   len(manifest.Files),
+	})
+}
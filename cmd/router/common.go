@@ -3,12 +3,14 @@ package router
 import (
 	"github.com/rolandhe/smss/binlog"
 	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/conf"
 	"github.com/rolandhe/smss/pkg/logger"
 	"github.com/rolandhe/smss/pkg/nets"
+	"github.com/rolandhe/smss/replica"
 	"github.com/rolandhe/smss/standard"
 	"github.com/rolandhe/smss/store"
+	"io"
 	"net"
-	"os"
 	"time"
 )
 
@@ -16,30 +18,78 @@ const NetReadTimeout = time.Millisecond * 5000
 const NetHeaderTimeout = time.Millisecond * 5000
 const NetWriteTimeout = time.Millisecond * 5000
 
-var nextEventId int64
-var curInsRole store.InstanceRoleEnum
+// InitCommonInfo 初始化初始event id和实例角色，id 为 0 时保持不变
+func (rs *Routers) InitCommonInfo(id int64, role store.InstanceRoleEnum) {
+	if id > 0 {
+		rs.nextEventId.Store(id)
+		logger.Infof("init next event id:%d", id)
+	}
+	rs.insRole.Store(int32(role))
+}
+
+func (rs *Routers) IsMaster() bool {
+	return store.InstanceRoleEnum(rs.insRole.Load()) == store.Master
+}
 
-// InitCommonInfo 初始化初始event id和实例角色
-func InitCommonInfo(id int64, role store.InstanceRoleEnum) {
-	if role == store.Master {
-		nextEventId = id
-		logger.Infof("init next event id:%d", nextEventId)
+// isWritableMaster 是否可以接收写入，集群模式下 master 还需要持有 leader 的租约，租约过期后立即拒绝，不等待 fence 切换角色
+func (rs *Routers) isWritableMaster() bool {
+	if !rs.IsMaster() {
+		return false
 	}
-	curInsRole = role
+	return rs.cluster == nil || rs.cluster.HoldsLease()
 }
 
-func setupRawMessageEventIdAndWriteTime(msg *protocol.RawMessage, count int) {
+// setupRawMessageEventIdAndWriteTime 在 worker 中调用，复制过来的消息保留原来的 eventId，只推进 nextEventId
+func (rs *Routers) setupRawMessageEventIdAndWriteTime(msg *protocol.RawMessage, count int) {
 	if msg.Src == protocol.RawMessageReplica {
+		rs.nextEventId.Store(msg.EventId + int64(count))
 		return
 	}
 	msg.WriteTime = time.Now().UnixMilli()
-	msg.EventId = nextEventId
-	nextEventId += int64(count)
+	msg.EventId = rs.nextEventId.Load()
+	rs.nextEventId.Store(msg.EventId + int64(count))
+}
+
+// RollbackEventId 在 worker 中调用，group commit 时回滚已经分配给写入失败的消息的 eventId，重新处理时复用这些 eventId
+func (rs *Routers) RollbackEventId(eventId int64) {
+	rs.nextEventId.Store(eventId)
+	logger.Infof("rollback next event id:%d", eventId)
+}
+
+// LastEventId 本实例 binlog 中最新的 eventId，slave 上是已经复制的最新 eventId，可以在 worker 之外的线程调用
+func (rs *Routers) LastEventId() int64 {
+	return rs.nextEventId.Load() - 1
+}
+
+// Replication 本实例的复制状态
+func (rs *Routers) Replication() *replica.Replication {
+	return rs.repl
+}
+
+// requestDeadline client 请求的截止时间，见 worker.requestTimeoutMs
+func requestDeadline(now int64) int64 {
+	if conf.WorkerRequestTimeout <= 0 {
+		return 0
+	}
+	return now + conf.WorkerRequestTimeout.Milliseconds()
+}
+
+// waitSlaveAck 半同步复制，master 上发布的消息写库成功后等待从库确认再返回
+func (rs *Routers) waitSlaveAck(msg *protocol.RawMessage) {
+	if !rs.IsMaster() {
+		return
+	}
+	rs.repl.WaitSlaveAck(msg.EventId, msg.TraceId)
 }
 
 func ReadHeader(conn net.Conn) (*protocol.CommonHeader, error) {
+	return ReadHeaderWithTimeout(conn, NetHeaderTimeout)
+}
+
+// ReadHeaderWithTimeout 等待 header 的超时为 timeout，读取 topic 与 traceId 仍然使用 NetReadTimeout
+func ReadHeaderWithTimeout(conn net.Conn, timeout time.Duration) (*protocol.CommonHeader, error) {
 	buff := make([]byte, protocol.HeaderSize)
-	if err := nets.ReadAll(conn, buff, NetHeaderTimeout); err != nil {
+	if err := nets.ReadAll(conn, buff, timeout); err != nil {
 		return nil, err
 	}
 	header := protocol.NewCommonHeader(buff)
@@ -66,20 +116,32 @@ type ddlRouter struct {
 }
 
 func (ddl *ddlRouter) router(conn net.Conn, msg *protocol.RawMessage, worker standard.MessageWorking) error {
+	msg.Deadline = requestDeadline(msg.Timestamp)
 	err := worker.Work(msg)
 	if err != nil {
-		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+		return outputErrWithSeq(conn, err, 0)
 	}
 	return nets.OutputOk(conn, NetWriteTimeout)
 }
 
-func (ddl *ddlRouter) doBinlog(f *os.File, msg *protocol.RawMessage) (int64, error) {
+func (ddl *ddlRouter) doBinlog(f io.Writer, msg *protocol.RawMessage) (int64, error) {
 	buff := binlog.DDLEncoder(msg)
 	return buff.WriteTo(f)
 }
 
+// routerSampleLogger 按 conf.LogSample 采样，修改配置后立即生效，只在 worker 中调用
 type routerSampleLogger struct {
-	logger.SampleLoggerSupport
+	count int64
+}
+
+func (sl *routerSampleLogger) CanLogger() bool {
+	sample := conf.LogSample.Load()
+	if sample <= 0 {
+		sample = logger.DefaultSampleCount
+	}
+	can := sl.count%sample == 0
+	sl.count++
+	return can
 }
 
 func (sl *routerSampleLogger) sampleLog(scene string, msg *protocol.RawMessage, err error) {
@@ -0,0 +1,79 @@
+package router
+
+import (
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/pkg/nets"
+	"github.com/rolandhe/smss/standard"
+	"net"
+)
+
+// ConnInfo 一个客户端连接的状态，时间都是毫秒
+type ConnInfo struct {
+	Id           uint64 `json:"id"`
+	Remote       string `json:"remote"`
+	CreatedAt    int64  `json:"createdAt"`
+	LastActiveAt int64  `json:"lastActiveAt"`
+	// LastCmd 最近一次执行的命令，-1 表示还没有命令
+	LastCmd int  `json:"lastCmd"`
+	Busy    bool `json:"busy"`
+	// Version HELLO 协商的版本，0 表示没有发送 HELLO
+	Version  uint16 `json:"version"`
+	Features uint32 `json:"features"`
+}
+
+// ConnManager 连接的注册表，由 server 实现
+type ConnManager interface {
+	ListConns() []*ConnInfo
+	// KillConns 关闭 id 或者 ip 匹配的连接，返回关闭的个数
+	KillConns(id uint64, ip string) int
+}
+
+func (rs *Routers) InitConns(manager ConnManager) {
+	rs.routerMap[protocol.CommandConnList] = &connListRouter{
+		manager: manager,
+	}
+	rs.routerMap[protocol.CommandConnKill] = &connKillRouter{
+		manager: manager,
+	}
+}
+
+type connListRouter struct {
+	manager ConnManager
+	noBinlog
+}
+
+func (r *connListRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
+	return outputJson(conn, r.manager.ListConns())
+}
+
+// connKillOptions id 与 ip 至少指定一个
+type connKillOptions struct {
+	Id uint64 `json:"id"`
+	Ip string `json:"ip"`
+}
+
+type connKillResult struct {
+	Closed int `json:"closed"`
+}
+
+// connKillRouter 关闭指定的连接，payload 是 connKillOptions 的 json
+type connKillRouter struct {
+	manager ConnManager
+	noBinlog
+}
+
+func (r *connKillRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
+	opts := &connKillOptions{}
+	if ok, err := readAdminOptions(conn, commHeader, opts); !ok {
+		return err
+	}
+	if opts.Id == 0 && opts.Ip == "" {
+		return nets.OutputRecoverErr(conn, "id or ip is required", NetWriteTimeout)
+	}
+	closed := r.manager.KillConns(opts.Id, opts.Ip)
+	logger.Infof("tid=%s,kill conns,id=%d,ip=%s,closed=%d", commHeader.TraceId, opts.Id, opts.Ip, closed)
+	return outputJson(conn, &connKillResult{
+		Closed: closed,
+	})
+}
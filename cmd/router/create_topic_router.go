@@ -3,14 +3,15 @@ package router
 import (
 	"encoding/binary"
 	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/codec"
 	"github.com/rolandhe/smss/pkg/dir"
 	"github.com/rolandhe/smss/pkg/logger"
 	"github.com/rolandhe/smss/pkg/nets"
 	"github.com/rolandhe/smss/pkg/tc"
 	"github.com/rolandhe/smss/standard"
 	"github.com/rolandhe/smss/store"
+	"io"
 	"net"
-	"os"
 	"strings"
 	"time"
 )
@@ -18,6 +19,7 @@ import (
 type createTopicRouter struct {
 	fstore store.Store
 	lc     *tc.TimeTriggerControl
+	rs     *Routers
 	ddlRouter
 }
 
@@ -32,8 +34,8 @@ func (r *createTopicRouter) Router(conn net.Conn, header *protocol.CommonHeader,
 		logger.Infof("tid=%s,create %s error, topic name MUST be less than 128 char and NOT contains space/enter/tab", header.TraceId, header.TopicName)
 		return nets.OutputRecoverErr(conn, "topic name MUST be less than 128 char and NOT contains space/enter/tab", NetWriteTimeout)
 	}
-	if curInsRole != store.Master {
-		return nets.OutputRecoverErr(conn, "just master can manage topic", NetWriteTimeout)
+	if !r.rs.isWritableMaster() {
+		return outputErrWithSeq(conn, r.rs.newNotMasterErr("just master can manage topic"), 0)
 	}
 
 	expireAt := int64(binary.LittleEndian.Uint64(buf))
@@ -42,20 +44,29 @@ func (r *createTopicRouter) Router(conn net.Conn, header *protocol.CommonHeader,
 		return nets.OutputRecoverErr(conn, "expire MUST more than 10s", NetWriteTimeout)
 	}
 
+	c := (&protocol.CreateTopicHeader{CommonHeader: header}).GetCodec()
+	if !codec.Valid(c) {
+		return nets.OutputRecoverErr(conn, codec.InvalidCodecErr.Error(), NetWriteTimeout)
+	}
+	// 不压缩时保持老的格式，兼容老版本的从库
+	if c != codec.None {
+		buf = append(buf, c)
+	}
+
 	msg := &protocol.RawMessage{
 		Command:   header.GetCmd(),
 		TopicName: header.TopicName,
 		Timestamp: time.Now().UnixMilli(),
 		TraceId:   header.TraceId,
 		Body: &protocol.DDLPayload{
-			// 生命周期，unix时间戳，即在什么时候过期
+			// 生命周期，unix时间戳，即在什么时候过期, 后面可选1个字节的 codec
 			Payload: buf,
 		},
 	}
 	return r.router(conn, msg, worker)
 }
 
-func (r *createTopicRouter) DoBinlog(f *os.File, msg *protocol.RawMessage) (int64, error) {
+func (r *createTopicRouter) DoBinlog(f io.Writer, msg *protocol.RawMessage) (int64, error) {
 	info, err := r.fstore.GetTopicInfoReader().GetTopicInfo(msg.TopicName)
 	if err != nil {
 		return 0, err
@@ -78,7 +89,7 @@ func (r *createTopicRouter) DoBinlog(f *os.File, msg *protocol.RawMessage) (int6
 		}
 	}
 
-	setupRawMessageEventIdAndWriteTime(msg, 1)
+	r.rs.setupRawMessageEventIdAndWriteTime(msg, 1)
 	return r.doBinlog(f, msg)
 }
 func (r *createTopicRouter) AfterBinlog(msg *protocol.RawMessage, fileId, pos int64) (int, error) {
@@ -88,7 +99,11 @@ func (r *createTopicRouter) AfterBinlog(msg *protocol.RawMessage, fileId, pos in
 	payload := msg.Body.(*protocol.DDLPayload)
 	buf := payload.Payload
 	lf := binary.LittleEndian.Uint64(buf)
-	err := r.fstore.CreateTopic(msg.TopicName, int64(lf), msg.EventId)
+	c := codec.None
+	if len(buf) > 8 {
+		c = buf[8]
+	}
+	err := r.fstore.CreateTopic(msg.TopicName, int64(lf), msg.EventId, c)
 	if err == nil && msg.Src != protocol.RawMessageReplica && lf > 0 {
 		r.lc.Set(int64(lf), true)
 	}
@@ -8,20 +8,21 @@ import (
 	"github.com/rolandhe/smss/pkg/logger"
 	"github.com/rolandhe/smss/standard"
 	"github.com/rolandhe/smss/store"
+	"io"
 	"net"
-	"os"
 )
 
 type delayApplyRouter struct {
 	fstore store.Store
 	*routerSampleLogger
+	rs *Routers
 }
 
 func (r *delayApplyRouter) Router(conn net.Conn, header *protocol.CommonHeader, worker standard.MessageWorking) error {
 	return errors.New("don't support this action")
 }
 
-func (r *delayApplyRouter) DoBinlog(f *os.File, msg *protocol.RawMessage) (int64, error) {
+func (r *delayApplyRouter) DoBinlog(f io.Writer, msg *protocol.RawMessage) (int64, error) {
 	info, err := r.fstore.GetTopicInfoReader().GetTopicInfo(msg.TopicName)
 	if err != nil {
 		logger.Infof("tid=%s,delayApplyRouter.DoBinlog call topic %s info error:%v", msg.TraceId, msg.TopicName, err)
@@ -39,11 +40,11 @@ func (r *delayApplyRouter) DoBinlog(f *os.File, msg *protocol.RawMessage) (int64
 	return r.outBinlog(f, msg)
 }
 
-func (r *delayApplyRouter) outBinlog(f *os.File, msg *protocol.RawMessage) (int64, error) {
+func (r *delayApplyRouter) outBinlog(f io.Writer, msg *protocol.RawMessage) (int64, error) {
 	payload := msg.Body.(*protocol.DelayApplyPayload)
-	_, count := protocol.CheckPayload(payload.Payload[16:])
+	count := protocol.PayloadCount(payload.Payload[16:])
 
-	setupRawMessageEventIdAndWriteTime(msg, count)
+	r.rs.setupRawMessageEventIdAndWriteTime(msg, count)
 
 	buff := binlog.DelayApplyEncoder(msg)
 
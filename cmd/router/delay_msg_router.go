@@ -4,13 +4,15 @@ import (
 	"encoding/binary"
 	"github.com/rolandhe/smss/binlog"
 	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/codec"
 	"github.com/rolandhe/smss/pkg/dir"
+	"github.com/rolandhe/smss/pkg/logger"
 	"github.com/rolandhe/smss/pkg/nets"
 	"github.com/rolandhe/smss/pkg/tc"
 	"github.com/rolandhe/smss/standard"
 	"github.com/rolandhe/smss/store"
+	"io"
 	"net"
-	"os"
 	"time"
 )
 
@@ -21,6 +23,7 @@ import (
 type delayRouter struct {
 	fstore   store.Store
 	delayCtl *tc.TimeTriggerControl
+	rs       *Routers
 }
 
 func (r *delayRouter) Router(conn net.Conn, header *protocol.CommonHeader, worker standard.MessageWorking) error {
@@ -30,13 +33,30 @@ func (r *delayRouter) Router(conn net.Conn, header *protocol.CommonHeader, worke
 	// delayTime + pub message
 	// 最终存储在binlog的格式
 	// delayTime + eventId  + pub message
+	limit := r.rs.getMessageLimit(header.TopicName)
+	if err := limit.checkBatchBytes(pubHeader.GetPayloadSize()); err != nil {
+		output := func(err error) error {
+			return outputErrWithSeq(conn, err, 0)
+		}
+		if e := r.rs.rejectTooLarge(conn, 8+int64(pubHeader.GetPayloadSize()), err, header.TraceId, output); e != nil {
+			return e
+		}
+		return nil
+	}
 	buf := make([]byte, 8+pubHeader.GetPayloadSize())
 	if err := nets.ReadAll(conn, buf, NetReadTimeout); err != nil {
 		return err
 	}
 
-	if curInsRole != store.Master {
-		return nets.OutputRecoverErr(conn, "just master can pub message", NetWriteTimeout)
+	if !r.rs.isWritableMaster() {
+		return outputErrWithSeq(conn, r.rs.newNotMasterErr("just master can pub message"), 0)
+	}
+	if err := r.rs.checkStorage(); err != nil {
+		return outputErrWithSeq(conn, err, 0)
+	}
+	if err := r.rs.checkRateLimit(conn, header.TopicName, 1, int64(len(buf)-8)); err != nil {
+		logger.Infof("tid=%s,delay pub %s err:%v", header.TraceId, header.TopicName, err)
+		return outputErrWithSeq(conn, err, 0)
 	}
 
 	if pubHeader.GetPayloadSize() <= 8 {
@@ -46,32 +66,65 @@ func (r *delayRouter) Router(conn net.Conn, header *protocol.CommonHeader, worke
 	if delayTime < 1000 {
 		return nets.OutputRecoverErr(conn, "delay time must be more than 1 second", NetWriteTimeout)
 	}
-	ok, _ := protocol.CheckPayload(buf[8:])
+	raw, err := uncompressedPayload(pubHeader, buf[8:], limit)
+	if err != nil {
+		logger.Infof("tid=%s,invalid compressed delay payload:%v", header.TraceId, err)
+		return outputErrWithSeq(conn, err, 0)
+	}
+	ok, count := protocol.CheckPayload(raw)
 	if !ok {
 		return nets.OutputRecoverErr(conn, "invalid delay request", NetWriteTimeout)
 	}
+	if err = limit.checkMessages(count, protocol.MaxContentSize(raw)); err != nil {
+		logger.Infof("tid=%s,reject request:%v", header.TraceId, err)
+		return outputErrWithSeq(conn, err, 0)
+	}
+	if buf, err = r.compress(pubHeader, buf, count); err != nil {
+		logger.Infof("tid=%s,compress delay payload err:%v", header.TraceId, err)
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
 
-	triggerTime := time.Now().Add(time.Millisecond * time.Duration(delayTime)).UnixMilli()
+	now := time.Now()
+	triggerTime := now.Add(time.Millisecond * time.Duration(delayTime)).UnixMilli()
 	// 把时间间隔给出具体的执行时间
 	binary.LittleEndian.PutUint64(buf, uint64(triggerTime))
 	msg := &protocol.RawMessage{
 		Command:   header.GetCmd(),
 		TopicName: header.TopicName,
-		Timestamp: time.Now().UnixMilli(),
+		Timestamp: now.UnixMilli(),
 		TraceId:   header.TraceId,
 		Body: &protocol.DelayPayload{
 			// 原始的带delayTime的数据, 是毫秒，不是一个具体触发的时间戳
 			Payload: buf,
 		},
+		Deadline: requestDeadline(now.UnixMilli()),
 	}
-	err := worker.Work(msg)
-	if err != nil {
-		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	if err = worker.Work(msg); err != nil {
+		return outputErrWithSeq(conn, err, 0)
 	}
+	r.rs.waitSlaveAck(msg)
 	return nets.OutputOk(conn, NetWriteTimeout)
 }
 
-func (r *delayRouter) DoBinlog(f *os.File, msg *protocol.RawMessage) (int64, error) {
+// compress 与 pub 相同，没有被 producer 压缩的延迟消息按 topic 的默认压缩算法整批压缩，buf 的前8个字节是 delayTime
+func (r *delayRouter) compress(header *protocol.PubProtoHeader, buf []byte, count int) ([]byte, error) {
+	if header.IsCompressed() {
+		return buf, nil
+	}
+	c, err := topicCodec(r.fstore, header.TopicName)
+	if err != nil || c == codec.None {
+		return buf, nil
+	}
+	compressed, err := protocol.CompressPayload(buf[8:], count, c)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, 8, 8+len(compressed))
+	copy(ret, buf[:8])
+	return append(ret, compressed...), nil
+}
+
+func (r *delayRouter) DoBinlog(f io.Writer, msg *protocol.RawMessage) (int64, error) {
 	info, err := r.fstore.GetTopicInfoReader().GetTopicInfo(msg.TopicName)
 	if err != nil {
 		return 0, err
@@ -87,8 +140,8 @@ func (r *delayRouter) DoBinlog(f *os.File, msg *protocol.RawMessage) (int64, err
 	return r.outBinlog(f, msg)
 }
 
-func (r *delayRouter) outBinlog(f *os.File, msg *protocol.RawMessage) (int64, error) {
-	setupRawMessageEventIdAndWriteTime(msg, 1)
+func (r *delayRouter) outBinlog(f io.Writer, msg *protocol.RawMessage) (int64, error) {
+	r.rs.setupRawMessageEventIdAndWriteTime(msg, 1)
 	if msg.Src != protocol.RawMessageReplica {
 		storeMsg := msg.Body.(*protocol.DelayPayload)
 		payload := storeMsg.Payload
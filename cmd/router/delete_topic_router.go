@@ -5,11 +5,10 @@ import (
 	"github.com/rolandhe/smss/cmd/protocol"
 	"github.com/rolandhe/smss/pkg/dir"
 	"github.com/rolandhe/smss/pkg/logger"
-	"github.com/rolandhe/smss/pkg/nets"
 	"github.com/rolandhe/smss/standard"
 	"github.com/rolandhe/smss/store"
+	"io"
 	"net"
-	"os"
 	"time"
 )
 
@@ -17,11 +16,12 @@ type deleteTopicRouter struct {
 	fstore store.Store
 	ddlRouter
 	delExecutor protocol.DelTopicFileExecutor
+	rs          *Routers
 }
 
 func (r *deleteTopicRouter) Router(conn net.Conn, header *protocol.CommonHeader, worker standard.MessageWorking) error {
-	if curInsRole != store.Master {
-		return nets.OutputRecoverErr(conn, "just master can manage topic", NetWriteTimeout)
+	if !r.rs.isWritableMaster() {
+		return outputErrWithSeq(conn, r.rs.newNotMasterErr("just master can manage topic"), 0)
 	}
 	msg := &protocol.RawMessage{
 		Command:   header.GetCmd(),
@@ -32,7 +32,7 @@ func (r *deleteTopicRouter) Router(conn net.Conn, header *protocol.CommonHeader,
 	return r.router(conn, msg, worker)
 }
 
-func (r *deleteTopicRouter) DoBinlog(f *os.File, msg *protocol.RawMessage) (int64, error) {
+func (r *deleteTopicRouter) DoBinlog(f io.Writer, msg *protocol.RawMessage) (int64, error) {
 	info, err := r.fstore.GetTopicInfoReader().GetTopicInfo(msg.TopicName)
 	if err != nil {
 		return 0, err
@@ -44,7 +44,7 @@ func (r *deleteTopicRouter) DoBinlog(f *os.File, msg *protocol.RawMessage) (int6
 		}
 		return 0, dir.NewBizError("topic not exist")
 	}
-	setupRawMessageEventIdAndWriteTime(msg, 1)
+	r.rs.setupRawMessageEventIdAndWriteTime(msg, 1)
 	return r.doBinlog(f, msg)
 }
 func (r *deleteTopicRouter) AfterBinlog(msg *protocol.RawMessage, fileId, pos int64) (int, error) {
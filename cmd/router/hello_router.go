@@ -0,0 +1,94 @@
+package router
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/pkg/nets"
+	"github.com/rolandhe/smss/standard"
+	"net"
+)
+
+var pipelinedNotNegotiatedErr = errors.New("pipelined is not negotiated")
+var compressionNotNegotiatedErr = errors.New("compression is not negotiated")
+
+// Session HELLO 协商的结果，没有发送 HELLO 的连接为 nil，按请求中的 flags 处理，保持老的行为
+type Session struct {
+	Version     uint16
+	Features    uint32
+	AuthMethods uint16
+}
+
+// has 协商了该特性
+func (s *Session) has(feature uint32) bool {
+	return s != nil && s.Features&feature != 0
+}
+
+// allow 没有 HELLO 或者协商了该特性
+func (s *Session) allow(feature uint32) bool {
+	return s == nil || s.Features&feature != 0
+}
+
+// acceptCompressed 协商后由 FeatureCompression 决定订阅时是否输出压缩的消息，忽略 sub 的 flags
+func (s *Session) acceptCompressed(flag bool) bool {
+	if s == nil {
+		return flag
+	}
+	return s.has(protocol.FeatureCompression)
+}
+
+// checkPub 协商后不能使用没有协商的特性
+func (s *Session) checkPub(header *protocol.PubProtoHeader) error {
+	if header.IsPipelined() && !s.allow(protocol.FeaturePipelined) {
+		return pipelinedNotNegotiatedErr
+	}
+	if header.IsCompressed() && !s.allow(protocol.FeatureCompression) {
+		return compressionNotNegotiatedErr
+	}
+	return nil
+}
+
+func getSession(conn net.Conn) *Session {
+	if pc, ok := conn.(*PipelineConn); ok {
+		return pc.Session()
+	}
+	return nil
+}
+
+// helloRouter 版本取双方的最小值，特性与认证方式取交集，同一个连接可以重新协商
+type helloRouter struct {
+	noBinlog
+}
+
+func (r *helloRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
+	header := &protocol.HelloHeader{
+		CommonHeader: commHeader,
+	}
+	if header.GetVersion() == 0 {
+		return nets.OutputRecoverErr(conn, "invalid protocol version", NetWriteTimeout)
+	}
+	pc, ok := conn.(*PipelineConn)
+	if !ok {
+		return nets.OutputRecoverErr(conn, "don't support hello", NetWriteTimeout)
+	}
+	session := &Session{
+		Version:     min(header.GetVersion(), protocol.ProtocolVersion),
+		Features:    header.GetFeatures() & protocol.ServerFeatures,
+		AuthMethods: header.GetAuthMethods() & protocol.ServerAuthMethods,
+	}
+	pc.session.Store(session)
+	logger.Infof("tid=%s,hello,client version=%d,features=%d,agreed version=%d,features=%d,authMethods=%d", commHeader.TraceId,
+		header.GetVersion(), header.GetFeatures(), session.Version, session.Features, session.AuthMethods)
+	return outputHello(conn, session)
+}
+
+// outputHello response header 的 [2:4] 是协商的版本，[4:8] 是特性，[8:10] 是认证方式
+func outputHello(conn net.Conn, session *Session) error {
+	buf := make([]byte, protocol.RespHeaderSize)
+	binary.LittleEndian.PutUint16(buf, protocol.OkCode)
+	binary.LittleEndian.PutUint16(buf[2:], session.Version)
+	binary.LittleEndian.PutUint32(buf[4:], session.Features)
+	binary.LittleEndian.PutUint16(buf[8:], session.AuthMethods)
+	return nets.WriteAll(conn, buf, NetWriteTimeout)
+}
@@ -0,0 +1,99 @@
+package router
+
+import (
+	"encoding/binary"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/nets"
+	"github.com/rolandhe/smss/replica"
+	"net"
+	"testing"
+	"time"
+)
+
+func helloHeader(version uint16, features uint32, authMethods uint16) *protocol.CommonHeader {
+	buf := make([]byte, protocol.HeaderSize)
+	buf[0] = byte(protocol.CommandHello)
+	binary.LittleEndian.PutUint16(buf[3:], version)
+	binary.LittleEndian.PutUint32(buf[5:], features)
+	binary.LittleEndian.PutUint16(buf[9:], authMethods)
+	return protocol.NewCommonHeader(buf)
+}
+
+// TestHelloNegotiation 版本取双方的最小值，特性与认证方式取交集，协商的结果保存在连接上，重新 HELLO 时覆盖
+func TestHelloNegotiation(t *testing.T) {
+	rs := NewRouters(replica.NewReplication(t.TempDir()))
+	server, client := net.Pipe()
+	defer client.Close()
+	pc := rs.NewPipelineConn(server)
+	defer pc.StopPipeline()
+	r := &helloRouter{}
+	for _, tc := range []struct {
+		name   string
+		header *protocol.CommonHeader
+		expect Session
+	}{
+		{"newer client", helloHeader(protocol.ProtocolVersion+1, 0xff, 0xff), Session{Version: protocol.ProtocolVersion, Features: protocol.ServerFeatures, AuthMethods: protocol.ServerAuthMethods}},
+		{"older client", helloHeader(1, protocol.FeatureEventId, 0), Session{Version: 1, Features: protocol.FeatureEventId}},
+		{"unknown features", helloHeader(protocol.ProtocolVersion, 0x100|protocol.FeaturePipelined, 0), Session{Version: protocol.ProtocolVersion, Features: protocol.FeaturePipelined}},
+		{"no features", helloHeader(protocol.ProtocolVersion, 0, 0), Session{Version: protocol.ProtocolVersion}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- r.Router(pc, tc.header, nil)
+			}()
+			resp := make([]byte, protocol.RespHeaderSize)
+			if err := nets.ReadAll(client, resp, time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errCh; err != nil {
+				t.Fatal(err)
+			}
+			got := Session{
+				Version:     binary.LittleEndian.Uint16(resp[2:]),
+				Features:    binary.LittleEndian.Uint32(resp[4:]),
+				AuthMethods: binary.LittleEndian.Uint16(resp[8:]),
+			}
+			if code := binary.LittleEndian.Uint16(resp); code != protocol.OkCode || got != tc.expect {
+				t.Fatalf("got code %d %+v, expect %+v", code, got, tc.expect)
+			}
+			if session := pc.Session(); session == nil || *session != tc.expect {
+				t.Fatalf("session on conn %+v, expect %+v", session, tc.expect)
+			}
+		})
+	}
+}
+
+// TestSessionRules 没有 HELLO 的连接按请求的 flags 处理；HELLO 后只能使用协商的特性，订阅是否压缩由 FeatureCompression 决定
+func TestSessionRules(t *testing.T) {
+	pubFlags := func(flags byte) *protocol.PubProtoHeader {
+		return &protocol.PubProtoHeader{CommonHeader: pubHeader(flags, 1)}
+	}
+	all := &Session{Version: protocol.ProtocolVersion, Features: protocol.ServerFeatures}
+	none := &Session{Version: protocol.ProtocolVersion}
+	for _, tc := range []struct {
+		name       string
+		session    *Session
+		flags      byte
+		pubErr     error
+		subFlag    bool
+		compressed bool
+	}{
+		{"legacy plain", nil, 0, nil, false, false},
+		{"legacy pipelined and compressed", nil, protocol.PubFlagPipelined | protocol.PubFlagCompressed, nil, true, true},
+		{"negotiated all", all, protocol.PubFlagPipelined | protocol.PubFlagCompressed, nil, false, true},
+		{"pipelined not negotiated", none, protocol.PubFlagPipelined, pipelinedNotNegotiatedErr, true, false},
+		{"compression not negotiated", none, protocol.PubFlagCompressed, compressionNotNegotiatedErr, true, false},
+		{"plain without features", none, 0, nil, false, false},
+	} {
+		if err := tc.session.checkPub(pubFlags(tc.flags)); err != tc.pubErr {
+			t.Fatalf("%s: checkPub expect %v, got %v", tc.name, tc.pubErr, err)
+		}
+		if got := tc.session.acceptCompressed(tc.subFlag); got != tc.compressed {
+			t.Fatalf("%s: acceptCompressed expect %v, got %v", tc.name, tc.compressed, got)
+		}
+	}
+	if getSession(nil) != nil {
+		t.Fatal("plain conn has no session")
+	}
+}
@@ -0,0 +1,142 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/logger"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// messageLimit 消息大小的限制，0 表示不限制
+type messageLimit struct {
+	maxSize       int64
+	maxBatchCount int
+	maxBatchBytes int64
+}
+
+type messageLimitTable struct {
+	global messageLimit
+	topics map[string]messageLimit
+	// maxDrainBytes 见 conf.MessageMaxDrainBytes
+	maxDrainBytes int64
+}
+
+// tooLargeError 请求超过了大小限制
+type tooLargeError struct {
+	msg string
+}
+
+func (e *tooLargeError) Error() string {
+	return e.msg
+}
+
+// tooLargeCloseErr 超过限制的 payload 太大，不再读取，关闭连接
+var tooLargeCloseErr = errors.New("request too large,close conn")
+
+// InitMessageLimit 使用配置初始化全局与每个 topic 的消息大小限制，重新加载配置后再次调用
+func (rs *Routers) InitMessageLimit() {
+	table := &messageLimitTable{
+		global: messageLimit{
+			maxSize:       conf.MessageMaxSize.Load(),
+			maxBatchCount: int(conf.MessageMaxBatchCount.Load()),
+			maxBatchBytes: conf.MessageMaxBatchBytes.Load(),
+		},
+		topics:        map[string]messageLimit{},
+		maxDrainBytes: conf.MessageMaxDrainBytes.Load(),
+	}
+	rules, _ := conf.MessageTopics.Load().([]string)
+	for _, rule := range rules {
+		name, limit, err := parseMessageLimit(rule, table.global)
+		if err != nil {
+			logger.Infof("ignore message limit rule %s:%v", rule, err)
+			continue
+		}
+		table.topics[name] = limit
+		logger.Infof("message limit %s,maxSize=%d,maxBatchCount=%d,maxBatchBytes=%d", name, limit.maxSize, limit.maxBatchCount, limit.maxBatchBytes)
+	}
+	rs.messageLimits.Store(table)
+}
+
+// parseMessageLimit 格式 name:maxSize:maxBatchCount:maxBatchBytes，name 可能包含冒号，从右边解析，0 使用全局的限制
+func parseMessageLimit(rule string, global messageLimit) (string, messageLimit, error) {
+	items := strings.Split(rule, ":")
+	l := len(items)
+	if l < 4 {
+		return "", messageLimit{}, errors.New("format is name:maxSize:maxBatchCount:maxBatchBytes")
+	}
+	var values [3]int64
+	for i := range values {
+		v, err := strconv.ParseInt(items[l-3+i], 10, 64)
+		if err != nil || v < 0 {
+			return "", messageLimit{}, errors.New("limit must be a non-negative number")
+		}
+		values[i] = v
+	}
+	limit := global
+	if values[0] > 0 {
+		limit.maxSize = values[0]
+	}
+	if values[1] > 0 {
+		limit.maxBatchCount = int(values[1])
+	}
+	if values[2] > 0 {
+		limit.maxBatchBytes = values[2]
+	}
+	return strings.Join(items[:l-3], ":"), limit, nil
+}
+
+func (rs *Routers) getMessageLimit(topicName string) messageLimit {
+	table := rs.messageLimits.Load()
+	if limit, ok := table.topics[topicName]; ok {
+		return limit
+	}
+	return table.global
+}
+
+// checkBatchBytes 在分配内存之前检查 payload 的长度
+func (l messageLimit) checkBatchBytes(size int) error {
+	if l.maxBatchBytes > 0 && int64(size) > l.maxBatchBytes {
+		return &tooLargeError{msg: fmt.Sprintf("payload size %d exceeds %d", size, l.maxBatchBytes)}
+	}
+	return nil
+}
+
+// checkMessages payload 已经通过 CheckPayload 校验，count 是消息数，maxSize 是最长的一条消息
+func (l messageLimit) checkMessages(count int, maxSize int) error {
+	if l.maxBatchCount > 0 && count > l.maxBatchCount {
+		return &tooLargeError{msg: fmt.Sprintf("batch count %d exceeds %d", count, l.maxBatchCount)}
+	}
+	if l.maxSize > 0 && int64(maxSize) > l.maxSize {
+		return &tooLargeError{msg: fmt.Sprintf("message size %d exceeds %d", maxSize, l.maxSize)}
+	}
+	return nil
+}
+
+// drainPayload 超过限制的 payload 不超过 maxDrainBytes 时读取并丢弃，连接上的下一个请求可以正常处理，
+// 否则返回 tooLargeCloseErr，输出错误后关闭连接
+func (rs *Routers) drainPayload(conn net.Conn, size int64) error {
+	if size > rs.messageLimits.Load().maxDrainBytes {
+		return tooLargeCloseErr
+	}
+	conn.SetReadDeadline(time.Now().Add(NetReadTimeout))
+	_, err := io.CopyN(io.Discard, conn, size)
+	return err
+}
+
+// rejectTooLarge 丢弃 size 字节的 payload 后通过 output 输出 err，payload 太大时输出后返回 tooLargeCloseErr
+func (rs *Routers) rejectTooLarge(conn net.Conn, size int64, err error, traceId string, output func(err error) error) error {
+	logger.Infof("tid=%s,reject request:%v", traceId, err)
+	dErr := rs.drainPayload(conn, size)
+	if dErr != nil && !errors.Is(dErr, tooLargeCloseErr) {
+		return dErr
+	}
+	if oErr := output(err); oErr != nil {
+		return oErr
+	}
+	return dErr
+}
@@ -0,0 +1,192 @@
+package router
+
+import (
+	"errors"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/pkg/nets"
+	"github.com/rolandhe/smss/standard"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// pipelineMaxInFlight 一个连接上最多未响应的 pipelined 请求数，超过后不再读取新的请求
+const pipelineMaxInFlight = 1024
+
+var pipelineOutputErr = errors.New("pipeline output error")
+
+// PipelineConn 支持 pipelined 发布的连接。pipelined 的 pub 请求投递给 worker 后立即返回，继续读取下一个请求，
+// 由独立的 goroutine 按请求的顺序等待 worker 处理完成，输出带 seq 的响应
+type PipelineConn struct {
+	net.Conn
+	rs        *Routers
+	startOnce sync.Once
+	items     chan *pipelineItem
+	done      chan struct{}
+	inFlight  sync.WaitGroup
+	pending   atomic.Int32
+	failed    atomic.Bool
+	session   atomic.Pointer[Session]
+}
+
+type pipelineItem struct {
+	seq     uint32
+	traceId string
+	future  *standard.FutureMsg[protocol.RawMessage]
+	err     error
+	// eventId 协商了 FeatureEventId，成功的响应带回 eventId
+	eventId bool
+}
+
+func (rs *Routers) NewPipelineConn(conn net.Conn) *PipelineConn {
+	return &PipelineConn{
+		Conn: conn,
+		rs:   rs,
+	}
+}
+
+// Pipelined 请求是否按 pipelined 处理，目前只有 pub 支持。header 带有 pipelined 标志，并且连接没有 HELLO 或者 HELLO 协商了 FeaturePipelined，
+// 连接的读取线程与 pub 都按协商的结果判断，没有协商时请求同步处理，输出前需要 Flush
+func (pc *PipelineConn) Pipelined(header *protocol.CommonHeader) bool {
+	if header.GetCmd() != protocol.CommandPub {
+		return false
+	}
+	return (&protocol.PubProtoHeader{CommonHeader: header}).IsPipelined() && pc.Session().allow(protocol.FeaturePipelined)
+}
+
+// Flush 等待已经提交的 pipelined 请求都输出响应，非 pipelined 的请求输出前需要调用，保证连接上的输出不会交叉
+func (pc *PipelineConn) Flush() {
+	pc.inFlight.Wait()
+}
+
+// Pending 还没有输出响应的 pipelined 请求数
+func (pc *PipelineConn) Pending() int {
+	return int(pc.pending.Load())
+}
+
+// Session HELLO 协商的结果，没有协商时返回 nil
+func (pc *PipelineConn) Session() *Session {
+	return pc.session.Load()
+}
+
+// StopPipeline 输出完所有已提交请求的响应后停止输出线程
+func (pc *PipelineConn) StopPipeline() {
+	if pc.items == nil {
+		return
+	}
+	close(pc.items)
+	<-pc.done
+}
+
+func (pc *PipelineConn) submit(item *pipelineItem) error {
+	pc.startOnce.Do(func() {
+		pc.items = make(chan *pipelineItem, pipelineMaxInFlight)
+		pc.done = make(chan struct{})
+		go pc.output()
+	})
+	if pc.failed.Load() {
+		return pipelineOutputErr
+	}
+	pc.inFlight.Add(1)
+	pc.pending.Add(1)
+	pc.items <- item
+	return nil
+}
+
+func (pc *PipelineConn) output() {
+	defer close(pc.done)
+	for item := range pc.items {
+		err := item.err
+		if item.future != nil {
+			item.future.Wait()
+			err = item.future.GetErr()
+			if err == nil {
+				pc.rs.waitSlaveAck(item.future.Msg)
+			}
+		}
+		if !pc.failed.Load() {
+			var e error
+			if err != nil {
+				e = outputErrWithSeq(pc.Conn, err, item.seq)
+			} else if item.eventId {
+				e = nets.OutputOkEventIdWithSeq(pc.Conn, item.future.Msg.EventId, item.seq, NetWriteTimeout)
+			} else {
+				e = nets.OutputOkWithSeq(pc.Conn, item.seq, NetWriteTimeout)
+			}
+			if e != nil {
+				logger.Infof("tid=%s,pipeline output seq %d err:%v", item.traceId, item.seq, e)
+				pc.failed.Store(true)
+				pc.Conn.Close()
+			}
+		}
+		pc.pending.Add(-1)
+		pc.inFlight.Done()
+	}
+}
+
+// pubResponder 普通模式下同步等待 worker 并直接输出响应，pipelined 模式下把响应交给 PipelineConn 按顺序输出
+type pubResponder struct {
+	rs      *Routers
+	conn    net.Conn
+	pc      *PipelineConn
+	seq     uint32
+	traceId string
+	eventId bool
+}
+
+func (rs *Routers) newPubResponder(conn net.Conn, header *protocol.PubProtoHeader) *pubResponder {
+	r := &pubResponder{
+		rs:      rs,
+		conn:    conn,
+		traceId: header.TraceId,
+	}
+	if pc, ok := conn.(*PipelineConn); ok {
+		if pc.Pipelined(header.CommonHeader) {
+			r.pc = pc
+			r.seq = header.GetSeq()
+		}
+		r.eventId = pc.Session().has(protocol.FeatureEventId)
+	}
+	return r
+}
+
+func (r *pubResponder) outputErr(errMsg string) error {
+	return r.outputError(errors.New(errMsg))
+}
+
+func (r *pubResponder) outputError(err error) error {
+	if r.pc != nil {
+		return r.pc.submit(&pipelineItem{
+			seq:     r.seq,
+			traceId: r.traceId,
+			err:     err,
+		})
+	}
+	return outputErrWithSeq(r.conn, err, 0)
+}
+
+func (r *pubResponder) work(worker standard.MessageWorking, msg *protocol.RawMessage) error {
+	if r.pc != nil {
+		future, err := worker.WorkAsync(msg)
+		if err != nil {
+			logger.Infof("tid=%s,pub to call WorkAsync err:%v", r.traceId, err)
+			return r.outputError(err)
+		}
+		return r.pc.submit(&pipelineItem{
+			seq:     r.seq,
+			traceId: r.traceId,
+			future:  future,
+			eventId: r.eventId,
+		})
+	}
+	if err := worker.Work(msg); err != nil {
+		logger.Infof("tid=%s,pub to call Work err:%v", r.traceId, err)
+		return outputErrWithSeq(r.conn, err, 0)
+	}
+	r.rs.waitSlaveAck(msg)
+	if r.eventId {
+		return nets.OutputOkEventIdWithSeq(r.conn, msg.EventId, 0, NetWriteTimeout)
+	}
+	return nets.OutputOk(r.conn, NetWriteTimeout)
+}
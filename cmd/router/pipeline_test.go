@@ -0,0 +1,98 @@
+package router
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/nets"
+	"github.com/rolandhe/smss/replica"
+	"github.com/rolandhe/smss/standard"
+	"net"
+	"testing"
+	"time"
+)
+
+func pubHeader(flags byte, seq uint32) *protocol.CommonHeader {
+	buf := make([]byte, protocol.HeaderSize)
+	buf[0] = byte(protocol.CommandPub)
+	buf[7] = flags
+	binary.LittleEndian.PutUint32(buf[8:], seq)
+	return protocol.NewCommonHeader(buf)
+}
+
+// TestPipelinedDecidedBySession 连接没有 HELLO 时按 header 的标志处理，HELLO 后只有协商了 FeaturePipelined 才按 pipelined 处理
+func TestPipelinedDecidedBySession(t *testing.T) {
+	rs := NewRouters(replica.NewReplication(t.TempDir()))
+	pc := rs.NewPipelineConn(nil)
+	for _, tc := range []struct {
+		name    string
+		session *Session
+		header  *protocol.CommonHeader
+		expect  bool
+	}{
+		{"no hello without flag", nil, pubHeader(0, 1), false},
+		{"no hello with flag", nil, pubHeader(protocol.PubFlagPipelined, 1), true},
+		{"negotiated", &Session{Version: 1, Features: protocol.FeaturePipelined}, pubHeader(protocol.PubFlagPipelined, 1), true},
+		{"not negotiated", &Session{Version: 1, Features: protocol.FeatureEventId}, pubHeader(protocol.PubFlagPipelined, 1), false},
+		{"not pub", nil, protocol.NewCommonHeader(append([]byte{byte(protocol.CommandCreateTopic)}, make([]byte, protocol.HeaderSize-1)...)), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pc.session.Store(tc.session)
+			if got := pc.Pipelined(tc.header); got != tc.expect {
+				t.Fatalf("expect %v, got %v", tc.expect, got)
+			}
+		})
+	}
+}
+
+// TestPipelineOutputsInRequestOrder worker 完成的顺序与请求的顺序不同时，响应仍然按请求的顺序输出，header 的 [6:10] 带回各自的 seq
+func TestPipelineOutputsInRequestOrder(t *testing.T) {
+	rs := NewRouters(replica.NewReplication(t.TempDir()))
+	server, client := net.Pipe()
+	defer client.Close()
+	pc := rs.NewPipelineConn(server)
+	defer pc.StopPipeline()
+
+	var futures []*standard.FutureMsg[protocol.RawMessage]
+	for i, seq := range []uint32{7, 8, 9} {
+		f := standard.NewFutureMsg(&protocol.RawMessage{EventId: int64(i + 1)})
+		futures = append(futures, f)
+		if err := pc.submit(&pipelineItem{seq: seq, future: f}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pc.submit(&pipelineItem{seq: 10, err: errors.New("invalid pub payload")}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		// 最后一个请求先完成，第二个请求失败
+		futures[2].Complete(nil)
+		time.Sleep(time.Millisecond * 20)
+		futures[1].Complete(standard.ServerBusyErr)
+		time.Sleep(time.Millisecond * 20)
+		futures[0].Complete(nil)
+	}()
+
+	for _, expect := range []struct {
+		seq  uint32
+		code uint16
+	}{{7, protocol.OkCode}, {8, protocol.ServerBusyCode}, {9, protocol.OkCode}, {10, protocol.ErrCode}} {
+		resp := make([]byte, protocol.RespHeaderSize)
+		if err := nets.ReadAll(client, resp, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		code, seq := binary.LittleEndian.Uint16(resp), binary.LittleEndian.Uint32(resp[6:])
+		if code != expect.code || seq != expect.seq {
+			t.Fatalf("expect code %d seq %d, got code %d seq %d", expect.code, expect.seq, code, seq)
+		}
+		if code != protocol.OkCode {
+			if err := nets.ReadAll(client, make([]byte, binary.LittleEndian.Uint16(resp[2:])), time.Second); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	pc.Flush()
+	if pc.Pending() != 0 {
+		t.Fatalf("expect no pending response, got %d", pc.Pending())
+	}
+}
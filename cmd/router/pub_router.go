@@ -1,53 +1,71 @@
 package router
 
 import (
+	"errors"
+	"fmt"
 	"github.com/rolandhe/smss/binlog"
 	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/codec"
 	"github.com/rolandhe/smss/pkg/dir"
 	"github.com/rolandhe/smss/pkg/logger"
 	"github.com/rolandhe/smss/pkg/nets"
 	"github.com/rolandhe/smss/standard"
 	"github.com/rolandhe/smss/store"
+	"io"
 	"net"
-	"os"
 	"time"
 )
 
 type pubRouter struct {
 	fstore store.Store
 	*routerSampleLogger
+	rs *Routers
 }
 
 func (r *pubRouter) Router(conn net.Conn, header *protocol.CommonHeader, worker standard.MessageWorking) error {
-	pubPayload, err := readPubPayload(conn, &protocol.PubProtoHeader{
+	pubHeader := &protocol.PubProtoHeader{
 		CommonHeader: header,
-	})
+	}
+	responder := r.rs.newPubResponder(conn, pubHeader)
+	pubPayload, err := r.readPubPayload(conn, pubHeader, responder)
 	if err != nil {
 		logger.Infof("tid=%s,readPubPayload err:%v", header.TraceId, err)
 		return err
 	}
 
-	if curInsRole != store.Master {
-		return nets.OutputRecoverErr(conn, "just master can pub message", NetWriteTimeout)
+	if err = getSession(conn).checkPub(pubHeader); err != nil {
+		return responder.outputError(err)
+	}
+	if !r.rs.isWritableMaster() {
+		return responder.outputError(r.rs.newNotMasterErr("just master can pub message"))
+	}
+	if err = r.rs.checkStorage(); err != nil {
+		return responder.outputError(err)
+	}
+	if err = r.rs.checkRateLimit(conn, header.TopicName, int64(pubPayload.BatchSize), int64(len(pubPayload.Payload))); err != nil {
+		logger.Infof("tid=%s,pub %s err:%v", header.TraceId, header.TopicName, err)
+		return responder.outputError(err)
+	}
+
+	if err = r.compress(pubHeader, pubPayload); err != nil {
+		logger.Infof("tid=%s,compress pub payload err:%v", header.TraceId, err)
+		return responder.outputErr(err.Error())
 	}
 
+	now := time.Now().UnixMilli()
 	msg := &protocol.RawMessage{
 		Command:   header.GetCmd(),
 		TopicName: header.TopicName,
 		TraceId:   header.TraceId,
-		Timestamp: time.Now().UnixMilli(),
+		Timestamp: now,
 		Body:      pubPayload,
+		Deadline:  requestDeadline(now),
 	}
 
-	if err = worker.Work(msg); err != nil {
-		logger.Infof("tid=%s,pub to call Work err:%v", header.TraceId, err)
-		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
-	}
-
-	return nets.OutputOk(conn, NetWriteTimeout)
+	return responder.work(worker, msg)
 }
 
-func (r *pubRouter) DoBinlog(f *os.File, msg *protocol.RawMessage) (int64, error) {
+func (r *pubRouter) DoBinlog(f io.Writer, msg *protocol.RawMessage) (int64, error) {
 	info, err := r.fstore.GetTopicInfoReader().GetTopicInfo(msg.TopicName)
 	if err != nil {
 		logger.Infof("tid=%s,pubRouter.DoBinlog call topic %s info error:%v", msg.TraceId, msg.TopicName, err)
@@ -65,10 +83,10 @@ func (r *pubRouter) DoBinlog(f *os.File, msg *protocol.RawMessage) (int64, error
 	return r.outputBinlog(f, msg)
 }
 
-func (r *pubRouter) outputBinlog(f *os.File, msg *protocol.RawMessage) (int64, error) {
+func (r *pubRouter) outputBinlog(f io.Writer, msg *protocol.RawMessage) (int64, error) {
 	payload := msg.Body.(*protocol.PubPayload)
 
-	setupRawMessageEventIdAndWriteTime(msg, payload.BatchSize)
+	r.rs.setupRawMessageEventIdAndWriteTime(msg, payload.BatchSize)
 	buff := binlog.PubEncoder(msg)
 
 	return buff.WriteTo(f)
@@ -87,16 +105,95 @@ func (r *pubRouter) AfterBinlog(msg *protocol.RawMessage, fileId, pos int64) (in
 	return syncFd, err
 }
 
-func readPubPayload(conn net.Conn, header *protocol.PubProtoHeader) (*protocol.PubPayload, error) {
+// AfterBinlogBatch 同一个topic的多条pub消息合并成一次写入
+func (r *pubRouter) AfterBinlogBatch(msgs []*protocol.RawMessage, fileId int64, positions []int64) (int, error) {
+	var messages []*store.TopicMessage
+	for i, msg := range msgs {
+		if msg.Src == protocol.RawMessageReplica && msg.Skip {
+			continue
+		}
+		payload := msg.Body.(*protocol.PubPayload)
+		batch, _ := protocol.ParsePayload(payload.Payload, fileId, positions[i], msg.EventId)
+		messages = append(messages, batch...)
+	}
+	if len(messages) == 0 {
+		return standard.SyncFdIgnore, nil
+	}
+	syncFd, err := r.fstore.Save(msgs[0].TopicName, messages)
+
+	for _, msg := range msgs {
+		r.sampleLog("pubRouter.AfterBinlogBatch", msg, err)
+	}
+
+	return syncFd, err
+}
+
+// compress producer 已经压缩的消息直接保存，否则按 topic 的默认压缩算法整批压缩，压缩在连接的线程中完成，不占用 worker
+func (r *pubRouter) compress(header *protocol.PubProtoHeader, payload *protocol.PubPayload) error {
+	if header.IsCompressed() {
+		payload.Codec = protocol.PayloadCodec(payload.Payload)
+		return nil
+	}
+	c, err := topicCodec(r.fstore, header.TopicName)
+	if err != nil || c == codec.None {
+		// topic 不存在等错误留给 worker 处理
+		return nil
+	}
+	var compressed []byte
+	if compressed, err = protocol.CompressPayload(payload.Payload, payload.BatchSize, c); err != nil {
+		return err
+	}
+	payload.Payload = compressed
+	payload.Codec = c
+	return nil
+}
+
+// topicCodec topic 的默认压缩算法，topic 不存在时返回 codec.None
+func topicCodec(fstore store.Store, topicName string) (byte, error) {
+	info, err := fstore.GetTopicInfoReader().GetTopicInfo(topicName)
+	if err != nil || info == nil {
+		return codec.None, err
+	}
+	return info.Codec, nil
+}
+
+// uncompressedPayload producer 压缩的 payload 解压后用于校验格式和限制，解压失败或者与 header 中的压缩算法不一致时返回错误，
+// 解压后超过 maxBatchBytes 时返回 tooLargeError，不会解压出超过限制的内容
+func uncompressedPayload(header *protocol.PubProtoHeader, payload []byte, limit messageLimit) ([]byte, error) {
+	if !header.IsCompressed() {
+		return payload, nil
+	}
+	if !codec.Valid(header.GetCodec()) || header.GetCodec() == codec.None {
+		return nil, codec.InvalidCodecErr
+	}
+	if protocol.PayloadCodec(payload) != header.GetCodec() {
+		return nil, dir.NewBizError("codec in payload is different from header")
+	}
+	raw, _, err := protocol.DecompressPayload(payload, limit.maxBatchBytes)
+	if errors.Is(err, codec.TooLargeErr) {
+		return nil, &tooLargeError{msg: fmt.Sprintf("uncompressed payload exceeds %d", limit.maxBatchBytes)}
+	}
+	return raw, err
+}
+
+func (r *pubRouter) readPubPayload(conn net.Conn, header *protocol.PubProtoHeader, responder *pubResponder) (*protocol.PubPayload, error) {
 	payloadSize := header.GetPayloadSize()
 	if payloadSize <= 8 {
 		logger.Infof("tid=%s,invalid request, payload size must be more than 8", header.TraceId)
-		if e := nets.OutputRecoverErr(conn, "invalid request, payload size must be more than 8", NetWriteTimeout); e != nil {
+		if e := responder.outputErr("invalid request, payload size must be more than 8"); e != nil {
 			return nil, e
 		}
 		return nil, dir.NewBizError("invalid pub payload")
 	}
 
+	limit := r.rs.getMessageLimit(header.TopicName)
+	if err := limit.checkBatchBytes(payloadSize); err != nil {
+		if e := r.rs.rejectTooLarge(conn, int64(payloadSize), err, header.TraceId, responder.outputError); e != nil {
+			return nil, e
+		}
+		return nil, dir.NewBizError(err.Error())
+	}
+
 	buf := make([]byte, payloadSize)
 	var err error
 
@@ -104,14 +201,29 @@ func readPubPayload(conn net.Conn, header *protocol.PubProtoHeader) (*protocol.P
 		return nil, err
 	}
 
-	ok, count := protocol.CheckPayload(buf)
+	raw, err := uncompressedPayload(header, buf, limit)
+	if err != nil {
+		logger.Infof("tid=%s,invalid compressed payload:%v", header.TraceId, err)
+		if e := responder.outputError(err); e != nil {
+			return nil, e
+		}
+		return nil, dir.NewBizError(err.Error())
+	}
+	ok, count := protocol.CheckPayload(raw)
 	if !ok {
-		if e := nets.OutputRecoverErr(conn, "invalid pub payload", NetWriteTimeout); e != nil {
+		if e := responder.outputErr("invalid pub payload"); e != nil {
 			return nil, e
 		}
 
 		return nil, dir.NewBizError("invalid pub payload")
 	}
+	if err = limit.checkMessages(count, protocol.MaxContentSize(raw)); err != nil {
+		logger.Infof("tid=%s,reject request:%v", header.TraceId, err)
+		if e := responder.outputError(err); e != nil {
+			return nil, e
+		}
+		return nil, dir.NewBizError(err.Error())
+	}
 
 	return &protocol.PubPayload{
 		Payload:   buf,
@@ -0,0 +1,153 @@
+package router
+
+import (
+	"fmt"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/pkg/nets"
+	"github.com/rolandhe/smss/pkg/ratelimit"
+	"github.com/rolandhe/smss/standard"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitScopeTopic  = "topic"
+	rateLimitScopeClient = "client"
+)
+
+// rateLimitedError 超过限流，retryAfter 后令牌足够
+type rateLimitedError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited,retry after %dms", e.retryAfter.Milliseconds())
+}
+
+// pubQuotas topic 与 client 的发布限流，两者都满足时才取走令牌
+type pubQuotas struct {
+	lock     sync.Mutex
+	topics   *ratelimit.Limiter
+	clients  *ratelimit.Limiter
+	maxDelay time.Duration
+}
+
+func newPubQuotas() *pubQuotas {
+	return &pubQuotas{
+		topics:  ratelimit.NewLimiter(),
+		clients: ratelimit.NewLimiter(),
+	}
+}
+
+// InitRateLimit 使用配置中的规则重新初始化限流，启动与重新加载配置时调用，运行时通过 CommandRateLimit 修改的规则会被覆盖
+func (rs *Routers) InitRateLimit() {
+	q := newPubQuotas()
+	q.maxDelay = time.Duration(conf.RateLimitMaxDelay.Load())
+	topics, _ := conf.RateLimitTopics.Load().([]string)
+	clients, _ := conf.RateLimitClients.Load().([]string)
+	loadRateLimitRules(q.topics, topics, rateLimitScopeTopic)
+	loadRateLimitRules(q.clients, clients, rateLimitScopeClient)
+	rs.quotas.Store(q)
+}
+
+func loadRateLimitRules(limiter *ratelimit.Limiter, rules []string, scope string) {
+	for _, rule := range rules {
+		name, limit, err := ratelimit.ParseRule(rule)
+		if err != nil {
+			logger.Infof("ignore %s rate limit rule %s:%v", scope, rule, err)
+			continue
+		}
+		limiter.Set(name, limit)
+		logger.Infof("%s rate limit %s,msgs=%d,bytes=%d", scope, name, limit.Msgs, limit.Bytes)
+	}
+}
+
+// acquire 在 worker.Work 之前调用，需要等待的时间不超过 maxDelay 时取走令牌并等待，否则返回 rateLimitedError
+func (q *pubQuotas) acquire(topicName, client string, msgs, bytes int64) error {
+	q.lock.Lock()
+	now := time.Now()
+	wait := max(q.topics.Wait(topicName, msgs, bytes, now), q.clients.Wait(client, msgs, bytes, now))
+	if wait > q.maxDelay {
+		q.lock.Unlock()
+		return &rateLimitedError{retryAfter: wait}
+	}
+	q.topics.Take(topicName, msgs, bytes)
+	q.clients.Take(client, msgs, bytes)
+	q.lock.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return nil
+}
+
+// checkRateLimit client 使用连接的 ip 标识
+func (rs *Routers) checkRateLimit(conn net.Conn, topicName string, msgs, bytes int64) error {
+	return rs.quotas.Load().acquire(topicName, nets.RemoteIp(conn), msgs, bytes)
+}
+
+// rateLimitOptions scope 为空时不修改规则，否则修改 name 的限制，Delete 为 true 时删除；MaxDelayMs 不为空时修改最多等待的时间
+type rateLimitOptions struct {
+	Scope      string `json:"scope"`
+	Name       string `json:"name"`
+	Msgs       int64  `json:"msgs"`
+	Bytes      int64  `json:"bytes"`
+	Delete     bool   `json:"delete"`
+	MaxDelayMs *int64 `json:"maxDelayMs"`
+}
+
+type rateLimitResult struct {
+	MaxDelayMs int64                      `json:"maxDelayMs"`
+	Topics     map[string]ratelimit.Limit `json:"topics"`
+	Clients    map[string]ratelimit.Limit `json:"clients"`
+}
+
+// rateLimitRouter 运行时查询与修改限流规则，payload 是 rateLimitOptions 的 json，修改只在内存中生效
+type rateLimitRouter struct {
+	rs *Routers
+	noBinlog
+}
+
+func (r *rateLimitRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
+	opts := &rateLimitOptions{}
+	if ok, err := readAdminOptions(conn, commHeader, opts); !ok {
+		return err
+	}
+	if opts.Scope != "" && opts.Scope != rateLimitScopeTopic && opts.Scope != rateLimitScopeClient {
+		return nets.OutputRecoverErr(conn, "invalid scope", NetWriteTimeout)
+	}
+	if opts.Scope != "" && opts.Name == "" {
+		return nets.OutputRecoverErr(conn, "name is empty", NetWriteTimeout)
+	}
+	result := r.rs.quotas.Load().update(opts)
+	if opts.Scope != "" || opts.MaxDelayMs != nil {
+		logger.Infof("tid=%s,update rate limit,scope=%s,name=%s,msgs=%d,bytes=%d,delete=%v,maxDelayMs=%d", commHeader.TraceId, opts.Scope, opts.Name, opts.Msgs, opts.Bytes, opts.Delete, result.MaxDelayMs)
+	}
+	return outputJson(conn, result)
+}
+
+func (q *pubQuotas) update(opts *rateLimitOptions) *rateLimitResult {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if opts.Scope != "" {
+		limiter := q.topics
+		if opts.Scope == rateLimitScopeClient {
+			limiter = q.clients
+		}
+		if opts.Delete {
+			limiter.Delete(opts.Name)
+		} else {
+			limiter.Set(opts.Name, ratelimit.Limit{Msgs: opts.Msgs, Bytes: opts.Bytes})
+		}
+	}
+	if opts.MaxDelayMs != nil {
+		q.maxDelay = time.Duration(*opts.MaxDelayMs) * time.Millisecond
+	}
+	return &rateLimitResult{
+		MaxDelayMs: q.maxDelay.Milliseconds(),
+		Topics:     q.topics.Limits(),
+		Clients:    q.clients.Limits(),
+	}
+}
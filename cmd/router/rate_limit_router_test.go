@@ -0,0 +1,83 @@
+package router
+
+import (
+	"errors"
+	"github.com/rolandhe/smss/pkg/ratelimit"
+	"github.com/rolandhe/smss/replica"
+	"net"
+	"testing"
+	"time"
+)
+
+// addrConn 只提供对端地址的连接
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func clientConn(ip string, port int) net.Conn {
+	return &addrConn{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: port}}
+}
+
+// TestAcquireMaxDelay 需要等待的时间不超过 maxDelay 时等待后放行，否则返回 rateLimitedError，不取走令牌
+func TestAcquireMaxDelay(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		maxDelay time.Duration
+		limited  bool
+	}{
+		{"reject without delay", 0, true},
+		{"reject above max delay", time.Millisecond * 50, true},
+		{"wait within max delay", time.Millisecond * 300, false},
+	} {
+		q := newPubQuotas()
+		q.maxDelay = tc.maxDelay
+		q.topics.Set("order", ratelimit.Limit{Msgs: 5})
+		if err := q.acquire("order", "10.0.0.1", 5, 0); err != nil {
+			t.Fatalf("%s: first batch should pass, got %v", tc.name, err)
+		}
+		start := time.Now()
+		err := q.acquire("order", "10.0.0.1", 1, 0)
+		var rle *rateLimitedError
+		if limited := errors.As(err, &rle); limited != tc.limited {
+			t.Fatalf("%s: limited=%v, expect %v, err %v", tc.name, limited, tc.limited, err)
+		}
+		if tc.limited {
+			if rle.retryAfter < time.Millisecond*150 || rle.retryAfter > time.Millisecond*200 {
+				t.Fatalf("%s: unexpected retryAfter %v", tc.name, rle.retryAfter)
+			}
+			continue
+		}
+		if cost := time.Since(start); cost < time.Millisecond*150 {
+			t.Fatalf("%s: should wait for the token, cost %v", tc.name, cost)
+		}
+	}
+}
+
+// TestRateLimitPerClientIp client 按连接的 ip 限流，同一个 ip 的不同连接共享令牌，不同 ip 各自计数
+func TestRateLimitPerClientIp(t *testing.T) {
+	rs := NewRouters(replica.NewReplication(t.TempDir()))
+	q := newPubQuotas()
+	q.clients.Set(ratelimit.DefaultName, ratelimit.Limit{Msgs: 2})
+	rs.quotas.Store(q)
+
+	for _, step := range []struct {
+		conn    net.Conn
+		limited bool
+	}{
+		{clientConn("10.0.0.1", 4001), false},
+		{clientConn("10.0.0.1", 4002), false},
+		{clientConn("10.0.0.1", 4003), true},
+		{clientConn("10.0.0.2", 4001), false},
+	} {
+		err := rs.checkRateLimit(step.conn, "order", 1, 10)
+		var rle *rateLimitedError
+		if limited := errors.As(err, &rle); limited != step.limited {
+			t.Fatalf("%s: limited=%v, expect %v", step.conn.RemoteAddr(), limited, step.limited)
+		}
+	}
+}
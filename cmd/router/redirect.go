@@ -0,0 +1,89 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/nets"
+	"github.com/rolandhe/smss/replica"
+	"github.com/rolandhe/smss/standard"
+	"github.com/rolandhe/smss/store"
+	"net"
+)
+
+// notMasterError slave 不能处理的请求，带上 master 的地址，client 可以据此重定向
+type notMasterError struct {
+	msg        string
+	masterAddr string
+}
+
+func (e *notMasterError) Error() string {
+	return e.msg
+}
+
+func (rs *Routers) newNotMasterErr(msg string) error {
+	err := &notMasterError{
+		msg: msg,
+	}
+	if rs.masterLocator == nil {
+		return err
+	}
+	if info := rs.masterLocator.WhoIsMaster(); info != nil && info.Known && !info.Self {
+		err.masterAddr = info.Addr
+	}
+	return err
+}
+
+// outputErrWithSeq 知道 master 地址时输出 RedirectCode，超过限流时输出 RateLimitedCode，超过大小限制时输出 TooLargeCode，存储已满时输出 StorageFullCode，worker 过载时输出 ServerBusyCode，否则输出普通的错误
+func outputErrWithSeq(conn net.Conn, err error, seq uint32) error {
+	var nme *notMasterError
+	if errors.As(err, &nme) && nme.masterAddr != "" {
+		return nets.OutputRedirectWithSeq(conn, nme.masterAddr, seq, NetWriteTimeout)
+	}
+	var rle *rateLimitedError
+	if errors.As(err, &rle) {
+		// 向上取整，避免 client 过早重试
+		return nets.OutputRateLimitedWithSeq(conn, rle.Error(), rle.retryAfter.Milliseconds()+1, seq, NetWriteTimeout)
+	}
+	var tle *tooLargeError
+	if errors.As(err, &tle) {
+		return nets.OutputErrCodeWithSeq(conn, protocol.TooLargeCode, err.Error(), seq, NetWriteTimeout)
+	}
+	if errors.Is(err, storageFullErr) {
+		return outputStorageFull(conn, seq)
+	}
+	if errors.Is(err, standard.ServerBusyErr) || errors.Is(err, standard.RequestExpiredErr) {
+		return nets.OutputErrCodeWithSeq(conn, protocol.ServerBusyCode, err.Error(), seq, NetWriteTimeout)
+	}
+	return nets.OutputRecoverErrWithSeq(conn, err.Error(), seq, NetWriteTimeout)
+}
+
+// checkReplicaSub 设置了 SubFlagAllowReplica 的订阅，slave 只有在复制了该 topic 并且落后 master 不超过 MaxLagMs 时才提供订阅。
+// 老版本的订阅端不设置该标志，也不认识 RedirectCode，配置 replica.redirectSub 之前仍然由 slave 提供订阅
+func (rs *Routers) checkReplicaSub(fstore store.Store, topicName string, info *protocol.SubInfo) error {
+	if !info.AllowReplica {
+		if !conf.ReplicaRedirectSub {
+			return nil
+		}
+		return rs.newNotMasterErr("just master can serve sub")
+	}
+	ok, err := replica.TopicReplicated(fstore.GetManagerMeta(), topicName)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return rs.newNotMasterErr("topic not replicated to this slave")
+	}
+	if info.MaxLagMs <= 0 {
+		return nil
+	}
+	lag, connected := rs.repl.LagMs()
+	if !connected {
+		return errors.New("slave not connected to master")
+	}
+	if lag > info.MaxLagMs {
+		return fmt.Errorf("slave lag %dms exceeds %dms", lag, info.MaxLagMs)
+	}
+	return nil
+}
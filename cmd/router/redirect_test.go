@@ -0,0 +1,27 @@
+package router
+
+import (
+	"errors"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/replica"
+	"testing"
+)
+
+// TestReplicaSubWithoutFlag 老版本的订阅端没有设置 SubFlagAllowReplica，默认仍然由 slave 提供订阅
+func TestReplicaSubWithoutFlag(t *testing.T) {
+	rs := NewRouters(replica.NewReplication(t.TempDir()))
+	info := &protocol.SubInfo{Who: "old-client"}
+	if err := rs.checkReplicaSub(nil, "order", info); err != nil {
+		t.Fatalf("slave should serve the sub without flag:%v", err)
+	}
+
+	conf.ReplicaRedirectSub = true
+	defer func() {
+		conf.ReplicaRedirectSub = false
+	}()
+	var nme *notMasterError
+	if err := rs.checkReplicaSub(nil, "order", info); !errors.As(err, &nme) {
+		t.Fatalf("expect redirect when replica.redirectSub is set, got %v", err)
+	}
+}
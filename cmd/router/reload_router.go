@@ -0,0 +1,34 @@
+package router
+
+import (
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/nets"
+	"github.com/rolandhe/smss/standard"
+	"net"
+)
+
+// ConfigReloader 重新加载配置文件，由 server 实现
+type ConfigReloader interface {
+	Reload(traceId string) (*conf.ReloadResult, error)
+}
+
+func (rs *Routers) InitReload(reloader ConfigReloader) {
+	rs.routerMap[protocol.CommandReload] = &reloadRouter{
+		reloader: reloader,
+	}
+}
+
+// reloadRouter 与 SIGHUP 相同，返回已经生效与需要重启的配置
+type reloadRouter struct {
+	reloader ConfigReloader
+	noBinlog
+}
+
+func (r *reloadRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
+	result, err := r.reloader.Reload(commHeader.TraceId)
+	if err != nil {
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
+	return outputJson(conn, result)
+}
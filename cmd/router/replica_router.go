@@ -2,16 +2,62 @@ package router
 
 import (
 	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/pkg/nets"
 	"github.com/rolandhe/smss/replica"
 	"github.com/rolandhe/smss/standard"
+	"github.com/rolandhe/smss/store"
 	"net"
 )
 
 type replicaRouter struct {
+	fstore       store.Store
 	binlogWriter *standard.StdMsgWriter[protocol.RawMessage]
+	rs           *Routers
 	noBinlog
 }
 
 func (r *replicaRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
-	return replica.MasterHandle(conn, commHeader, r.binlogWriter, NetReadTimeout, NetWriteTimeout)
+	baseEventId, err := r.fstore.GetManagerMeta().GetSnapshotEventId()
+	if err != nil {
+		logger.Infof("tid=%s,replica get snapshot eventId err:%v", commHeader.TraceId, err)
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
+	return r.rs.repl.MasterHandle(conn, commHeader, r.binlogWriter, baseEventId, r.rs.LastEventId(), NetReadTimeout, NetWriteTimeout)
+}
+
+// snapshotRouter 向 binlog 已经过期的新 slave 输出快照
+type snapshotRouter struct {
+	fstore store.Store
+	locker *protocol.DelFileLock
+	rs     *Routers
+	noBinlog
+}
+
+func (r *snapshotRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
+	return replica.MasterSnapshot(conn, commHeader, r.fstore, worker, r.locker, r.rs.LastEventId, NetReadTimeout, NetWriteTimeout)
+}
+
+// replicaStatusRouter 输出复制状态，master 上输出已连接的 slave 及其落后情况，slave 上输出自己的复制进度，
+// 作为中继的 slave 同时输出下游 slave
+type replicaStatusRouter struct {
+	binlogWriter *standard.StdMsgWriter[protocol.RawMessage]
+	rs           *Routers
+	noBinlog
+}
+
+func (r *replicaStatusRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
+	var status *replica.ReplicaStatus
+	repl := r.rs.repl
+	if r.rs.IsMaster() && r.binlogWriter != nil {
+		status = repl.GetMasterStatus(r.binlogWriter, r.rs.LastEventId())
+	} else {
+		status = repl.GetSlaveStatus()
+		if r.binlogWriter != nil {
+			if downstream := repl.GetMasterStatus(r.binlogWriter, r.rs.LastEventId()).Master; len(downstream.Slaves) > 0 {
+				status.Master = downstream
+			}
+		}
+	}
+	return outputJson(conn, status)
 }
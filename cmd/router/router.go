@@ -1,28 +1,66 @@
 package router
 
 import (
+	"github.com/rolandhe/smss/cluster"
 	"github.com/rolandhe/smss/cmd/protocol"
-	"github.com/rolandhe/smss/conf"
-	"github.com/rolandhe/smss/pkg/logger"
 	"github.com/rolandhe/smss/pkg/tc"
+	"github.com/rolandhe/smss/replica"
 	"github.com/rolandhe/smss/standard"
 	"github.com/rolandhe/smss/store"
+	"io"
 	"net"
-	"os"
+	"sync"
+	"sync/atomic"
 )
 
-var routerMap = map[protocol.CommandEnum]CmdRouter{}
+// Routers 一个 server 的命令路由，以及路由共享的 eventId、实例角色、限流、消息大小限制与复制状态，
+// 每个 server 一个，同一进程内的多个 server 互不影响
+type Routers struct {
+	routerMap map[protocol.CommandEnum]CmdRouter
+	// routerLock 启动后只有 SwitchRole 会修改 routerMap
+	routerLock sync.RWMutex
+
+	nextEventId atomic.Int64
+	// insRole 实例角色，promote/demote 时会在线修改
+	insRole atomic.Int32
+
+	quotas        atomic.Pointer[pubQuotas]
+	messageLimits atomic.Pointer[messageLimitTable]
+	storageGuard  StorageGuard
+	masterLocator MasterLocator
+	repl          *replica.Replication
+	// cluster 集群模式下的选举节点，启动监听之前设置
+	cluster *cluster.Node
+}
+
+func NewRouters(repl *replica.Replication) *Routers {
+	rs := &Routers{
+		routerMap: map[protocol.CommandEnum]CmdRouter{},
+		repl:      repl,
+	}
+	rs.quotas.Store(newPubQuotas())
+	rs.messageLimits.Store(&messageLimitTable{
+		topics: map[string]messageLimit{},
+	})
+	return rs
+}
 
 type CmdRouter interface {
 	Router(conn net.Conn, header *protocol.CommonHeader, worker standard.MessageWorking) error
-	DoBinlog(f *os.File, msg *protocol.RawMessage) (int64, error)
+	DoBinlog(f io.Writer, msg *protocol.RawMessage) (int64, error)
 	AfterBinlog(msg *protocol.RawMessage, fileId, pos int64) (int, error)
 }
 
+// BatchCmdRouter 支持把同一个topic的多条消息合并成一次写入，worker 做 group commit 时使用
+type BatchCmdRouter interface {
+	CmdRouter
+	AfterBinlogBatch(msgs []*protocol.RawMessage, fileId int64, positions []int64) (int, error)
+}
+
 type noBinlog struct {
 }
 
-func (h *noBinlog) DoBinlog(f *os.File, msg *protocol.RawMessage) (int64, error) {
+func (h *noBinlog) DoBinlog(f io.Writer, msg *protocol.RawMessage) (int64, error) {
 	return 0, nil
 }
 
@@ -30,58 +68,134 @@ func (h *noBinlog) AfterBinlog(msg *protocol.RawMessage, fileId, pos int64) (int
 	return standard.SyncFdIgnore, nil
 }
 
-func Init(fstore store.Store, lc *tc.TimeTriggerControl, delExec protocol.DelTopicFileExecutor) {
-	sampleLogger := &routerSampleLogger{
-		SampleLoggerSupport: logger.NewSampleLoggerSupport(conf.LogSample),
-	}
-	routerMap[protocol.CommandSub] = &subRouter{
+func (rs *Routers) Init(fstore store.Store, lc *tc.TimeTriggerControl, delExec protocol.DelTopicFileExecutor) {
+	sampleLogger := &routerSampleLogger{}
+	rs.routerMap[protocol.CommandSub] = &subRouter{
 		fstore: fstore,
+		rs:     rs,
 	}
-	routerMap[protocol.CommandPub] = &pubRouter{
+	rs.routerMap[protocol.CommandPub] = &pubRouter{
 		fstore:             fstore,
 		routerSampleLogger: sampleLogger,
+		rs:                 rs,
 	}
 
-	routerMap[protocol.CommandCreateTopic] = &createTopicRouter{
+	rs.routerMap[protocol.CommandCreateTopic] = &createTopicRouter{
 		fstore: fstore,
 		lc:     lc,
+		rs:     rs,
 	}
 
-	routerMap[protocol.CommandDeleteTopic] = &deleteTopicRouter{
+	rs.routerMap[protocol.CommandDeleteTopic] = &deleteTopicRouter{
 		fstore:      fstore,
 		delExecutor: delExec,
+		rs:          rs,
 	}
 
-	routerMap[protocol.CommandTopicInfo] = &topicInfoRouter{
+	rs.routerMap[protocol.CommandTopicInfo] = &topicInfoRouter{
 		fstore: fstore,
 	}
 
-	routerMap[protocol.CommandList] = &topicListRouter{
+	rs.routerMap[protocol.CommandList] = &topicListRouter{
 		fstore: fstore,
 	}
 
-	routerMap[protocol.CommandValidList] = &validListRouter{
+	rs.routerMap[protocol.CommandValidList] = &validListRouter{
 		fstore: fstore,
 	}
 
-	routerMap[protocol.CommandDelayApply] = &delayApplyRouter{
+	rs.routerMap[protocol.CommandReplicaStatus] = &replicaStatusRouter{
+		rs: rs,
+	}
+
+	rs.routerMap[protocol.CommandServerStats] = &serverStatsRouter{
+		rs: rs,
+	}
+
+	rs.routerMap[protocol.CommandRateLimit] = &rateLimitRouter{
+		rs: rs,
+	}
+
+	rs.routerMap[protocol.CommandHello] = &helloRouter{}
+
+	rs.routerMap[protocol.CommandDelayApply] = &delayApplyRouter{
 		fstore:             fstore,
 		routerSampleLogger: sampleLogger,
+		rs:                 rs,
 	}
 }
-func InitDelay(fstore store.Store, delayCtrl *tc.TimeTriggerControl) {
-	routerMap[protocol.CommandDelay] = &delayRouter{
+func (rs *Routers) InitDelay(fstore store.Store, delayCtrl *tc.TimeTriggerControl) {
+	rs.routerMap[protocol.CommandDelay] = &delayRouter{
 		fstore:   fstore,
 		delayCtl: delayCtrl,
+		rs:       rs,
+	}
+}
+
+// InitBackup root 是数据目录，备份中的文件使用相对它的路径；backupRoot 是备份目标所在的目录
+func (rs *Routers) InitBackup(root, backupRoot string, fstore store.Store) {
+	rs.routerMap[protocol.CommandBackup] = &backupRouter{
+		root:       root,
+		backupRoot: backupRoot,
+		fstore:     fstore,
+		rs:         rs,
 	}
 }
 
-func InitReplica(binlogWriter *standard.StdMsgWriter[protocol.RawMessage]) {
-	routerMap[protocol.CommandReplica] = &replicaRouter{
+// InitTransfer transferRoot 是导出与导入文件所在的目录
+func (rs *Routers) InitTransfer(transferRoot string, fstore store.Store) {
+	rs.routerMap[protocol.CommandExport] = &exportRouter{
+		root:   transferRoot,
+		fstore: fstore,
+	}
+	rs.routerMap[protocol.CommandImport] = &importRouter{
+		root:   transferRoot,
+		fstore: fstore,
+		rs:     rs,
+	}
+}
+
+// InitReplica 注册复制相关的命令，master 和 slave 都可以作为复制源，slave 使用自己的 binlog 为下游 slave 提供复制
+func (rs *Routers) InitReplica(fstore store.Store, delExec protocol.DelTopicFileExecutor, binlogWriter *standard.StdMsgWriter[protocol.RawMessage]) {
+	rs.routerMap[protocol.CommandReplica] = &replicaRouter{
+		fstore:       fstore,
 		binlogWriter: binlogWriter,
+		rs:           rs,
 	}
+	rs.routerMap[protocol.CommandSnapshot] = &snapshotRouter{
+		fstore: fstore,
+		locker: delExec.GetDeleteFileLocker(),
+		rs:     rs,
+	}
+	rs.routerMap[protocol.CommandReplicaStatus] = &replicaStatusRouter{
+		binlogWriter: binlogWriter,
+		rs:           rs,
+	}
+}
+
+// SwitchRole 在线切换角色后重新初始化与角色相关的路由，id 是切换为 master 后的下一个 eventId
+func (rs *Routers) SwitchRole(role store.InstanceRoleEnum, id int64, fstore store.Store, delayCtrl, lifeCtrl *tc.TimeTriggerControl,
+	delExec protocol.DelTopicFileExecutor, binlogWriter *standard.StdMsgWriter[protocol.RawMessage]) {
+	rs.routerLock.Lock()
+	defer rs.routerLock.Unlock()
+	rs.InitDelay(fstore, delayCtrl)
+	rs.Init(fstore, lifeCtrl, delExec)
+	rs.InitReplica(fstore, delExec, binlogWriter)
+	rs.InitCommonInfo(id, role)
+}
+
+func (rs *Routers) GetRouter(cmd protocol.CommandEnum) CmdRouter {
+	rs.routerLock.RLock()
+	defer rs.routerLock.RUnlock()
+	return rs.routerMap[cmd]
 }
 
-func GetRouter(cmd protocol.CommandEnum) CmdRouter {
-	return routerMap[cmd]
+// GetBatchRouter 返回支持批量写入的router，不支持返回nil
+func (rs *Routers) GetBatchRouter(cmd protocol.CommandEnum) BatchCmdRouter {
+	rs.routerLock.RLock()
+	defer rs.routerLock.RUnlock()
+	if r, ok := rs.routerMap[cmd].(BatchCmdRouter); ok {
+		return r
+	}
+	return nil
 }
@@ -0,0 +1,29 @@
+package router
+
+import (
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/standard"
+	"net"
+)
+
+// ServerStats 服务端的运行状态，用于监控过载
+type ServerStats struct {
+	Worker      *standard.WorkerStats `json:"worker,omitempty"`
+	StorageFull bool                  `json:"storageFull"`
+}
+
+// serverStatsRouter 输出 worker 队列的深度、拒绝与过期的请求数，以及存储是否已满
+type serverStatsRouter struct {
+	rs *Routers
+	noBinlog
+}
+
+func (r *serverStatsRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
+	stats := &ServerStats{
+		StorageFull: r.rs.checkStorage() != nil,
+	}
+	if reporter, ok := worker.(standard.WorkerStatsReporter); ok {
+		stats.Worker = reporter.Stats()
+	}
+	return outputJson(conn, stats)
+}
@@ -0,0 +1,31 @@
+package router
+
+import (
+	"errors"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/nets"
+	"net"
+)
+
+// StorageGuard 磁盘水位检查，存储已满时拒绝发布，订阅不受影响
+type StorageGuard interface {
+	StorageFull() bool
+}
+
+var storageFullErr = errors.New("storage full")
+
+func (rs *Routers) InitStorageGuard(guard StorageGuard) {
+	rs.storageGuard = guard
+}
+
+// checkStorage 存储已满时返回 storageFullErr，通过 outputErrWithSeq 输出 StorageFullCode
+func (rs *Routers) checkStorage() error {
+	if rs.storageGuard != nil && rs.storageGuard.StorageFull() {
+		return storageFullErr
+	}
+	return nil
+}
+
+func outputStorageFull(conn net.Conn, seq uint32) error {
+	return nets.OutputErrCodeWithSeq(conn, protocol.StorageFullCode, storageFullErr.Error(), seq, NetWriteTimeout)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/rolandhe/smss/cmd/protocol"
 	"github.com/rolandhe/smss/cmd/repair"
+	"github.com/rolandhe/smss/pkg/codec"
 	"github.com/rolandhe/smss/pkg/logger"
 	"github.com/rolandhe/smss/pkg/nets"
 	"github.com/rolandhe/smss/standard"
@@ -16,19 +17,75 @@ import (
 const (
 	PayloadSizePosInHeader = 4
 	OneMsgHeaderSize       = 32
+	// MaxMessagesPerOutput response header 的第3个字节是消息数，一次最多输出255条
+	MaxMessagesPerOutput = 255
 )
 
 type subRouter struct {
 	fstore store.Store
+	rs     *Routers
 	noBinlog
 }
 
 type subLongtimeReader struct {
 	store.TopicBlockReader
+	acceptCompressed bool
+	// skipEventId 订阅的 eventId 在一条压缩的记录中间时，第一次输出需要跳过该记录中已经消费的消息
+	skipEventId int64
+	// pending 压缩的记录解压后超过一次能输出的消息数，剩下的消息在下次读取时输出
+	pending []*store.ReadMessage
+}
+
+func (lr *subLongtimeReader) Read(clientClosedNotify *store.ClientClosedNotifyEquipment) ([]*store.ReadMessage, error) {
+	if len(lr.pending) > 0 {
+		msgs := lr.pending
+		lr.pending = nil
+		return msgs, nil
+	}
+	for {
+		msgs, err := lr.TopicBlockReader.Read(clientClosedNotify)
+		if err != nil || lr.skipEventId == 0 {
+			return msgs, err
+		}
+		if msgs, err = skipConsumed(msgs, lr.skipEventId); err != nil {
+			return nil, err
+		}
+		lr.skipEventId = 0
+		if len(msgs) > 0 {
+			return msgs, nil
+		}
+	}
 }
 
 func (lr *subLongtimeReader) Output(conn net.Conn, msgs []*store.ReadMessage) error {
-	return batchMessageOut(conn, msgs)
+	msgs, c, err := unifyCodec(msgs, lr.acceptCompressed)
+	if err != nil {
+		return err
+	}
+	if len(msgs) > MaxMessagesPerOutput {
+		lr.pending = msgs[MaxMessagesPerOutput:]
+		msgs = msgs[:MaxMessagesPerOutput]
+	}
+	return nets.WriteAll(conn, packageMessages(msgs, c), NetWriteTimeout)
+}
+
+// skipConsumed 解压第一条包含已经消费的消息的压缩记录，去掉 eventId 不大于 skipEventId 的消息
+func skipConsumed(msgs []*store.ReadMessage, skipEventId int64) ([]*store.ReadMessage, error) {
+	first := msgs[0]
+	if first.Codec == codec.None || first.EventId > skipEventId {
+		return msgs, nil
+	}
+	expanded, err := expandMessage(first)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*store.ReadMessage
+	for _, msg := range expanded {
+		if msg.EventId > skipEventId {
+			ret = append(ret, msg)
+		}
+	}
+	return append(ret, msgs[1:]...), nil
 }
 
 func (r *subRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
@@ -41,12 +98,19 @@ func (r *subRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, wor
 		logger.Infof("readSubInfo err,topic is %s,error is %v", header.TopicName, err)
 		return err
 	}
+	info.AcceptCompressed = getSession(conn).acceptCompressed(info.AcceptCompressed)
 	if info.BatchSize <= 0 {
 		info.BatchSize = protocol.DefaultSubBatchSize
 	}
 	tid := fmt.Sprintf("%s-%s", header.TopicName, info.Who)
 
 	logger.Infof("tid=%s,recv subinfo,eventId: %d", tid, info.EventId)
+	if !r.rs.IsMaster() {
+		if err = r.rs.checkReplicaSub(r.fstore, header.TopicName, info); err != nil {
+			logger.Infof("tid=%s,slave can't serve sub:%v", tid, err)
+			return outputErrWithSeq(conn, err, 0)
+		}
+	}
 	var topicInfo *store.TopicInfo
 	topicInfo, err = r.fstore.GetTopicInfoReader().GetTopicInfo(header.TopicName)
 	if err != nil {
@@ -77,6 +141,8 @@ func (r *subRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, wor
 	logger.Infof("tid=%s,subinfo check ok,start to send messages,eventId: %d", tid, info.EventId)
 	return nets.LongTimeRun[store.ReadMessage](conn, "sub", tid, info.AckTimeout, NetWriteTimeout, &subLongtimeReader{
 		TopicBlockReader: reader,
+		acceptCompressed: info.AcceptCompressed,
+		skipEventId:      info.EventId,
 	})
 }
 
@@ -128,23 +194,85 @@ func readSubInfo(conn net.Conn, header *protocol.SubHeader) (*protocol.SubInfo,
 	}
 
 	return &protocol.SubInfo{
-		Who:        string(whoBuff),
-		EventId:    eventId,
-		BatchSize:  header.GetBatchSize(),
-		AckTimeout: ackTimeout,
+		Who:              string(whoBuff),
+		EventId:          eventId,
+		BatchSize:        header.GetBatchSize(),
+		AckTimeout:       ackTimeout,
+		AcceptCompressed: header.AcceptCompressed(),
+		AllowReplica:     header.AllowReplica(),
+		MaxLagMs:         header.GetMaxLagMs(),
 	}, nil
 }
 
-func batchMessageOut(conn net.Conn, messages []*store.ReadMessage) error {
-	buff := packageMessages(messages)
-	return nets.WriteAll(conn, buff, NetWriteTimeout)
+// unifyCodec 一次输出的消息使用同一个压缩算法，写在 response header 的第4个字节。订阅端能够自行解压且所有消息的压缩算法相同时
+// 直接输出压缩的记录，每条记录是整批压缩的多条消息，否则解压后逐条输出
+func unifyCodec(messages []*store.ReadMessage, acceptCompressed bool) ([]*store.ReadMessage, byte, error) {
+	c := messages[0].Codec
+	if acceptCompressed {
+		same := true
+		for _, msg := range messages {
+			if msg.Codec != c {
+				same = false
+				break
+			}
+		}
+		if same {
+			return messages, c, nil
+		}
+	}
+	if c == codec.None && !hasCompressed(messages) {
+		return messages, codec.None, nil
+	}
+	ret := make([]*store.ReadMessage, 0, len(messages))
+	for _, msg := range messages {
+		expanded, err := expandMessage(msg)
+		if err != nil {
+			return nil, 0, err
+		}
+		ret = append(ret, expanded...)
+	}
+	return ret, codec.None, nil
+}
+
+func hasCompressed(messages []*store.ReadMessage) bool {
+	for _, msg := range messages {
+		if msg.Codec != codec.None {
+			return true
+		}
+	}
+	return false
+}
+
+// expandMessage 解压一条压缩的记录，拆成多条消息，eventId 依次递增，位点都是该记录之后的位点
+func expandMessage(msg *store.ReadMessage) ([]*store.ReadMessage, error) {
+	if msg.Codec == codec.None {
+		return []*store.ReadMessage{msg}, nil
+	}
+	payload, err := protocol.DecompressBatch(msg.PayLoad, msg.Codec)
+	if err != nil {
+		logger.Infof("decompress message %d err:%v", msg.EventId, err)
+		return nil, err
+	}
+	items := protocol.SplitPayload(payload)
+	ret := make([]*store.ReadMessage, len(items))
+	for i, item := range items {
+		ret[i] = &store.ReadMessage{
+			Ts:      msg.Ts,
+			EventId: msg.EventId + int64(i),
+			Count:   1,
+			PayLoad: item,
+			NextPos: msg.NextPos,
+		}
+	}
+	return ret, nil
 }
 
-func packageMessages(messages []*store.ReadMessage) []byte {
+func packageMessages(messages []*store.ReadMessage, c byte) []byte {
 	size := calPackageSize(messages)
 	buf := make([]byte, size)
 	binary.LittleEndian.PutUint16(buf[:2], protocol.OkCode)
 	buf[2] = byte(len(messages))
+	buf[3] = c
 	nextBuf := buf[protocol.RespHeaderSize:]
 
 	payloadSize := 0
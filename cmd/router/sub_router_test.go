@@ -0,0 +1,144 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/codec"
+	"github.com/rolandhe/smss/store"
+	"net"
+	"testing"
+)
+
+type sliceReader struct {
+	batches [][]*store.ReadMessage
+}
+
+func (r *sliceReader) Read(*store.ClientClosedNotifyEquipment) ([]*store.ReadMessage, error) {
+	msgs := r.batches[0]
+	r.batches = r.batches[1:]
+	return msgs, nil
+}
+
+func (r *sliceReader) Init(func(lastFileId int64) (int64, int64, error)) error {
+	return nil
+}
+
+func (r *sliceReader) Close() error {
+	return nil
+}
+
+func compressedRecord(t *testing.T, eventId int64, count int, c byte) *store.ReadMessage {
+	var raw []byte
+	for i := 0; i < count; i++ {
+		content := fmt.Sprintf("msg-%d", eventId+int64(i))
+		raw = binary.LittleEndian.AppendUint32(raw, uint32(len(content)))
+		raw = binary.LittleEndian.AppendUint32(raw, 0)
+		raw = append(raw, content...)
+	}
+	payload, err := protocol.CompressPayload(raw, count, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &store.ReadMessage{
+		EventId: eventId,
+		Codec:   c,
+		Count:   count,
+		PayLoad: payload[protocol.CompressedHeaderSize:],
+	}
+}
+
+// readOutput 读取 Output 写出的一个响应，返回消息数、压缩算法和每条消息的 eventId
+func readOutput(t *testing.T, conn net.Conn) (int, byte, []int64) {
+	header := make([]byte, protocol.RespHeaderSize)
+	if _, err := conn.Read(header); err != nil {
+		t.Fatal(err)
+	}
+	size := int(binary.LittleEndian.Uint32(header[PayloadSizePosInHeader:]))
+	body := make([]byte, size)
+	for n := 0; n < size; {
+		m, err := conn.Read(body[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += m
+	}
+	var ids []int64
+	for len(body) > 0 {
+		ids = append(ids, int64(binary.LittleEndian.Uint64(body[8:])))
+		msgLen := int(binary.LittleEndian.Uint32(body[OneMsgHeaderSize:]))
+		body = body[OneMsgHeaderSize+8+msgLen:]
+	}
+	return int(header[2]), header[3], ids
+}
+
+func TestSubSkipsConsumedMessagesOfCompressedRecord(t *testing.T) {
+	lr := &subLongtimeReader{
+		TopicBlockReader: &sliceReader{batches: [][]*store.ReadMessage{
+			{compressedRecord(t, 10, 5, codec.Snappy), compressedRecord(t, 15, 2, codec.Snappy)},
+		}},
+		acceptCompressed: true,
+		skipEventId:      12,
+	}
+	msgs, err := lr.Read(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go lr.Output(server, msgs)
+	count, c, ids := readOutput(t, client)
+	if count != 4 || c != codec.None || fmt.Sprint(ids) != "[13 14 15 16]" {
+		t.Fatalf("got count=%d codec=%d ids=%v", count, c, ids)
+	}
+}
+
+func TestSubOutputsCompressedRecordsAsIs(t *testing.T) {
+	lr := &subLongtimeReader{
+		TopicBlockReader: &sliceReader{batches: [][]*store.ReadMessage{
+			{compressedRecord(t, 10, 5, codec.Zstd), compressedRecord(t, 15, 2, codec.Zstd)},
+		}},
+		acceptCompressed: true,
+	}
+	msgs, _ := lr.Read(nil)
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go lr.Output(server, msgs)
+	header := make([]byte, protocol.RespHeaderSize)
+	if _, err := client.Read(header); err != nil {
+		t.Fatal(err)
+	}
+	if header[2] != 2 || header[3] != codec.Zstd {
+		t.Fatalf("expect 2 compressed records, got %d codec %d", header[2], header[3])
+	}
+}
+
+func TestSubSplitsLargeExpandedOutput(t *testing.T) {
+	lr := &subLongtimeReader{
+		TopicBlockReader: &sliceReader{batches: [][]*store.ReadMessage{
+			{compressedRecord(t, 1, 300, codec.Gzip)},
+		}},
+	}
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	var all []int64
+	for i := 0; i < 2; i++ {
+		msgs, err := lr.Read(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go lr.Output(server, msgs)
+		count, _, ids := readOutput(t, client)
+		if count != len(ids) {
+			t.Fatalf("count %d but %d messages", count, len(ids))
+		}
+		all = append(all, ids...)
+	}
+	if len(all) != 300 || all[0] != 1 || all[299] != 300 {
+		t.Fatalf("unexpected ids, len=%d", len(all))
+	}
+}
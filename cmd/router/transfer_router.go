@@ -0,0 +1,363 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/cmd/repair"
+	"github.com/rolandhe/smss/cmd/transfer"
+	"github.com/rolandhe/smss/pkg/codec"
+	"github.com/rolandhe/smss/pkg/dir"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/pkg/nets"
+	"github.com/rolandhe/smss/standard"
+	"github.com/rolandhe/smss/store"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	exportBatchSize = 64
+	// importBatchBytes 导入时一个 pub 请求的最大字节数
+	importBatchBytes = 1024 * 1024
+)
+
+// exportOptions 导出的范围，eventId 和时间都是包含的，0 表示不限制
+type exportOptions struct {
+	File        string `json:"file"`
+	FromEventId int64  `json:"fromEventId"`
+	ToEventId   int64  `json:"toEventId"`
+	FromTime    int64  `json:"fromTime"`
+	ToTime      int64  `json:"toTime"`
+}
+
+type exportResult struct {
+	File         string `json:"file"`
+	Count        int64  `json:"count"`
+	FirstEventId int64  `json:"firstEventId"`
+	LastEventId  int64  `json:"lastEventId"`
+}
+
+type importOptions struct {
+	File string `json:"file"`
+	// KeepTimestamp 把原始的时间和 eventId 作为消息 header 保留
+	KeepTimestamp bool `json:"keepTimestamp"`
+}
+
+type importResult struct {
+	Topic string `json:"topic"`
+	Count int64  `json:"count"`
+}
+
+// exportRouter 把 topic 的一段消息导出到本机的文件，topic 是 header 中的名称，payload 是 exportOptions 的 json。
+// 导出的终点是开始导出时 topic 文件的末尾，之后写入的消息不导出
+type exportRouter struct {
+	root   string
+	fstore store.Store
+	noBinlog
+}
+
+func (r *exportRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
+	opts := &exportOptions{}
+	if ok, err := readAdminOptions(conn, commHeader, opts); !ok {
+		return err
+	}
+	file, err := dir.ResolveUnder(r.root, opts.File)
+	if err != nil {
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
+	topicName := commHeader.TopicName
+	info, err := r.fstore.GetTopicInfoReader().GetTopicInfo(topicName)
+	if err != nil {
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
+	if info == nil || info.IsInvalid() {
+		return nets.OutputRecoverErr(conn, "topic not exist", NetWriteTimeout)
+	}
+	if err = os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
+	topicPath := r.fstore.GetTopicPath(topicName)
+	var endFileId, endPos int64
+	var endErr error
+	err = worker.Work(&protocol.RawMessage{
+		Command:   protocol.CommandBarrier,
+		Timestamp: time.Now().UnixMilli(),
+		TraceId:   commHeader.TraceId,
+		Body: protocol.BarrierFunc(func() {
+			endFileId, endPos, endErr = topicEnd(topicPath)
+		}),
+	})
+	if err == nil {
+		err = endErr
+	}
+	if err != nil {
+		logger.Infof("tid=%s,export %s err:%v", commHeader.TraceId, topicName, err)
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
+
+	// 不覆盖已经存在的文件
+	fw, err := transfer.NewWriter(file, &transfer.FileHeader{
+		Topic:       topicName,
+		FromEventId: opts.FromEventId,
+		ToEventId:   opts.ToEventId,
+		FromTime:    opts.FromTime,
+		ToTime:      opts.ToTime,
+		ExportTime:  time.Now().UnixMilli(),
+	})
+	if os.IsExist(err) {
+		return nets.OutputRecoverErr(conn, "export file exists", NetWriteTimeout)
+	}
+	if err != nil {
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
+	result := &exportResult{
+		File: opts.File,
+	}
+	if endFileId >= 0 {
+		who := fmt.Sprintf("export-%s", conn.RemoteAddr())
+		err = r.export(topicName, topicPath, who, opts, endFileId, endPos, fw, result)
+	}
+	if cErr := fw.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(file)
+		logger.Infof("tid=%s,export %s to %s err:%v", commHeader.TraceId, topicName, file, err)
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
+	logger.Infof("tid=%s,export %s to %s,count=%d,eventId %d-%d", commHeader.TraceId, topicName, file, result.Count, result.FirstEventId, result.LastEventId)
+	return outputJson(conn, result)
+}
+
+// export 通过 StdMsgBlockReader 读取，读到终点或者超过范围时结束
+func (r *exportRouter) export(topicName, topicPath, who string, opts *exportOptions, endFileId, endPos int64, fw *transfer.Writer, result *exportResult) error {
+	reader, err := r.fstore.GetReader(topicName, who, func(lastFileId int64) (int64, int64, error) {
+		// 订阅的位点是已经消费的 eventId，FromEventId-1 不在该 topic 中时从头开始读取，跳过之前的消息
+		if opts.FromEventId > 1 {
+			if fileId, pos, err := repair.FindTopicPosByEventId(topicPath, opts.FromEventId-1, lastFileId); err == nil {
+				return fileId, pos, nil
+			}
+		}
+		return getSubPos(0, topicPath, lastFileId)
+	}, exportBatchSize)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	notify := &store.ClientClosedNotifyEquipment{
+		ClientClosedNotifyChan: make(chan struct{}),
+	}
+	for {
+		msgs, err := reader.Read(notify)
+		if errors.Is(err, standard.WaitNewTimeoutErr) {
+			// 起点之后没有消息
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			var end bool
+			if end, err = exportMessage(fw, msg, opts, result); err != nil || end {
+				return err
+			}
+			if msg.NextPos.FileId > endFileId || (msg.NextPos.FileId == endFileId && msg.NextPos.Pos >= endPos) {
+				return nil
+			}
+		}
+	}
+}
+
+// exportMessage 压缩的记录解压后逐条导出，超过范围时返回 true
+func exportMessage(fw *transfer.Writer, msg *store.ReadMessage, opts *exportOptions, result *exportResult) (bool, error) {
+	messages, err := expandMessage(msg)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range messages {
+		if (opts.ToEventId > 0 && m.EventId > opts.ToEventId) || (opts.ToTime > 0 && m.Ts > opts.ToTime) {
+			return true, nil
+		}
+		if m.EventId < opts.FromEventId || m.Ts < opts.FromTime {
+			continue
+		}
+		record, err := transfer.NewRecord(m.EventId, m.Ts, m.PayLoad)
+		if err != nil {
+			return false, err
+		}
+		if err = fw.Write(record); err != nil {
+			return false, err
+		}
+		if result.Count == 0 {
+			result.FirstEventId = m.EventId
+		}
+		result.LastEventId = m.EventId
+		result.Count++
+	}
+	return false, nil
+}
+
+// topicEnd 在 worker 中执行，返回最后一个不为空的文件及其长度，没有数据时 fileId 为 -1
+func topicEnd(topicPath string) (int64, int64, error) {
+	maxId, err := standard.ReadMaxFileId(topicPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return -1, 0, nil
+		}
+		return 0, 0, err
+	}
+	for fileId := maxId - 1; fileId >= 0; fileId-- {
+		stat, err := os.Stat(path.Join(topicPath, fmt.Sprintf("%d.log", fileId)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return 0, 0, err
+		}
+		if stat.Size() > 0 {
+			return fileId, stat.Size(), nil
+		}
+	}
+	return -1, 0, nil
+}
+
+// importRouter 把导出的文件通过 worker 重新发布到 topic，topic 是 header 中的名称，为空时使用导出时的 topic，
+// payload 是 importOptions 的 json。消息会分配新的 eventId 和时间
+type importRouter struct {
+	root   string
+	fstore store.Store
+	rs     *Routers
+	noBinlog
+}
+
+func (r *importRouter) Router(conn net.Conn, commHeader *protocol.CommonHeader, worker standard.MessageWorking) error {
+	opts := &importOptions{}
+	if ok, err := readAdminOptions(conn, commHeader, opts); !ok {
+		return err
+	}
+	if !r.rs.IsMaster() {
+		return outputErrWithSeq(conn, r.rs.newNotMasterErr("just master can import"), 0)
+	}
+	if err := r.rs.checkStorage(); err != nil {
+		return outputErrWithSeq(conn, err, 0)
+	}
+	file, err := dir.ResolveUnder(r.root, opts.File)
+	if err != nil {
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
+	fr, err := transfer.NewReader(file)
+	if err != nil {
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
+	defer fr.Close()
+	topicName := commHeader.TopicName
+	if topicName == "" {
+		topicName = fr.Header.Topic
+	}
+	info, err := r.fstore.GetTopicInfoReader().GetTopicInfo(topicName)
+	if err != nil {
+		return nets.OutputRecoverErr(conn, err.Error(), NetWriteTimeout)
+	}
+	if info == nil || info.IsInvalid() {
+		return nets.OutputRecoverErr(conn, "topic not exist", NetWriteTimeout)
+	}
+	result := &importResult{
+		Topic: topicName,
+	}
+	err = r.importMessages(fr, topicName, info.Codec, opts.KeepTimestamp, commHeader.TraceId, worker, result)
+	if err != nil {
+		logger.Infof("tid=%s,import %s to %s err:%v,imported=%d", commHeader.TraceId, opts.File, topicName, err, result.Count)
+		return outputErrWithSeq(conn, err, 0)
+	}
+	logger.Infof("tid=%s,import %s to %s,count=%d", commHeader.TraceId, opts.File, topicName, result.Count)
+	return outputJson(conn, result)
+}
+
+func (r *importRouter) importMessages(fr *transfer.Reader, topicName string, c byte, keepTimestamp bool, traceId string, worker standard.MessageWorking, result *importResult) error {
+	var buf []byte
+	batchSize := 0
+	flush := func() error {
+		if batchSize == 0 {
+			return nil
+		}
+		// 导入过程中存储满了就停止，已经导入的消息保留
+		if err := r.rs.checkStorage(); err != nil {
+			return err
+		}
+		payload := &protocol.PubPayload{
+			Payload:   buf,
+			BatchSize: batchSize,
+		}
+		if c != codec.None {
+			compressed, err := protocol.CompressPayload(buf, batchSize, c)
+			if err != nil {
+				return err
+			}
+			payload.Payload = compressed
+			payload.Codec = c
+		}
+		msg := &protocol.RawMessage{
+			Command:   protocol.CommandPub,
+			TopicName: topicName,
+			TraceId:   traceId,
+			Timestamp: time.Now().UnixMilli(),
+			Body:      payload,
+		}
+		if err := worker.Work(msg); err != nil {
+			return err
+		}
+		r.rs.waitSlaveAck(msg)
+		result.Count += int64(batchSize)
+		buf = nil
+		batchSize = 0
+		return nil
+	}
+	for {
+		record, err := fr.Read()
+		if errors.Is(err, io.EOF) {
+			return flush()
+		}
+		if err != nil {
+			return err
+		}
+		header := record.Header
+		if keepTimestamp {
+			header = append([]byte{}, header...)
+			header = transfer.AppendHeader(header, transfer.HeaderSrcTimestamp, strconv.FormatInt(record.Ts, 10))
+			header = transfer.AppendHeader(header, transfer.HeaderSrcEventId, strconv.FormatInt(record.EventId, 10))
+		}
+		buf = record.AppendMessage(buf, header)
+		batchSize++
+		if len(buf) >= importBatchBytes {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readAdminOptions 读取管理命令 payload 中的 json，失败时已经输出了错误，返回 false 和需要返回给调用方的错误
+func readAdminOptions(conn net.Conn, commHeader *protocol.CommonHeader, v any) (bool, error) {
+	header := &protocol.AdminHeader{
+		CommonHeader: commHeader,
+	}
+	size := header.GetPayloadSize()
+	if size <= 0 || size > 4096 {
+		return false, nets.OutputRecoverErr(conn, "invalid options", NetWriteTimeout)
+	}
+	buf := make([]byte, size)
+	if err := nets.ReadAll(conn, buf, NetReadTimeout); err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return false, nets.OutputRecoverErr(conn, "invalid options", NetWriteTimeout)
+	}
+	return true, nil
+}
@@ -1,21 +1,30 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/rolandhe/smss/cluster"
 	"github.com/rolandhe/smss/cmd/backgroud"
 	"github.com/rolandhe/smss/cmd/protocol"
 	"github.com/rolandhe/smss/cmd/repair"
 	"github.com/rolandhe/smss/cmd/router"
 	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/archive"
 	"github.com/rolandhe/smss/pkg/dir"
 	"github.com/rolandhe/smss/pkg/logger"
 	"github.com/rolandhe/smss/pkg/nets"
 	"github.com/rolandhe/smss/pkg/tc"
 	"github.com/rolandhe/smss/replica"
-	"github.com/rolandhe/smss/standard"
 	"github.com/rolandhe/smss/store"
 	"github.com/rolandhe/smss/store/fss"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type InstanceRole struct {
@@ -25,119 +34,549 @@ type InstanceRole struct {
 	EventId  int64
 }
 
+// ServerOptions 构建server的参数，使用 DefaultServerOptions 获取默认值后再修改
+type ServerOptions struct {
+	// Root 数据存储目录
+	Root string
+	// Port 监听端口，0 表示由系统分配，通过 Server.Addr 获取
+	Port           int
+	FlushLevel     int
+	MaxLogSize     int64
+	WorkerBuffSize int
+	// NoCache 进程内所有 server 共用，以最后启动的 server 为准
+	NoCache bool
+	// LogPath 如果日志还没有初始化，使用该路径初始化日志
+	LogPath string
+	Role    InstanceRole
+	// Archiver 过期的文件删除前先归档，nil 表示直接删除，可以替换为上传到对象存储等实现
+	Archiver archive.Archiver
+	// BackupRoot CommandBackup 的目标都解析到该目录下，为空时不能在线备份
+	BackupRoot string
+	// TransferRoot CommandExport 与 CommandImport 的文件都解析到该目录下，为空时不能导出与导入
+	TransferRoot string
+	// Cluster 集群模式的参数，nil 表示不开启
+	Cluster *ClusterOptions
+}
+
+// ClusterOptions 集群模式的参数
+type ClusterOptions struct {
+	NodeId string
+	// Peers 集群所有节点，格式 id@host:port，包括自己
+	Peers     []string
+	Lease     time.Duration
+	Heartbeat time.Duration
+}
+
+var defaultConfOnce sync.Once
+
+// DefaultServerOptions 不读取配置文件，使用默认配置构建参数，用于内嵌模式。默认配置只加载一次，不会影响已经运行的server
+func DefaultServerOptions() *ServerOptions {
+	defaultConfOnce.Do(conf.InitDefault)
+	return optionsFromConf()
+}
+
+func optionsFromConf() *ServerOptions {
+	opts := &ServerOptions{
+		Root:           conf.MainStorePath,
+		Port:           conf.Port,
+		FlushLevel:     int(conf.FlushLevel.Load()),
+		MaxLogSize:     conf.MaxLogSize,
+		WorkerBuffSize: conf.WorkerBuffSize,
+		NoCache:        conf.NoCache,
+		LogPath:        conf.LogPath,
+		BackupRoot:     conf.BackupRoot,
+		TransferRoot:   conf.TransferRoot,
+		Role: InstanceRole{
+			Role: store.Master,
+		},
+	}
+	if conf.StoreArchiveEnable {
+		opts.Archiver = archive.NewDirArchiver(conf.StoreArchivePath)
+	}
+	if conf.ClusterEnable {
+		opts.Cluster = &ClusterOptions{
+			NodeId:    conf.ClusterNodeId,
+			Peers:     conf.ClusterPeers,
+			Lease:     conf.ClusterLease,
+			Heartbeat: conf.ClusterHeartbeat,
+		}
+	}
+	return opts
+}
+
+// Server 一个运行中的smss实例，路由、复制与后台线程的状态都属于 server，同一进程内可以运行多个 server
+type Server struct {
+	root     string
+	opts     ServerOptions
+	insRole  *InstanceRole
+	archiver archive.Archiver
+
+	routers *router.Routers
+	repl    *replica.Replication
+	cleaner *backgroud.OldFilesCleaner
+
+	fstore     store.Store
+	worker     *backWorker
+	delExec    protocol.DelTopicFileExecutor
+	delayCtrl  *tc.TimeTriggerControl
+	lifeCtrl   *tc.TimeTriggerControl
+	watermark  *backgroud.WatermarkGuard
+	replicator *replica.SlaveReplicator
+	// 保护 insRole、replicator 和后台线程，promote/demote 时会修改
+	roleLock sync.Mutex
+	// cluster 开启集群模式时的选举节点
+	cluster *cluster.Node
+
+	ln       net.Listener
+	connLock sync.Mutex
+	conns    map[net.Conn]*connState
+	// limitedConns 计入连接数限制的连接数，复制与集群节点之间的连接不计入
+	limitedConns int
+	// ipConns 每个 ip 计入限制的连接数
+	ipConns map[string]int
+	connSeq uint64
+	connWg  sync.WaitGroup
+
+	shuttingDown atomic.Bool
+	closeOnce    sync.Once
+	closeErr     error
+	done         chan struct{}
+}
+
+type connState struct {
+	id        uint64
+	ip        string
+	createdAt int64
+	// lastActive 最近一次收到请求或者请求执行完成的时间，毫秒
+	lastActive atomic.Int64
+	lastCmd    atomic.Int32
+	// limited 已经计入连接数限制，在连接的第一个不豁免的命令时设置
+	limited bool
+	// 正在执行命令，比如订阅、复制或者等待 worker 返回
+	busy atomic.Bool
+	// pipelined 发布时还没有输出的响应
+	pipeline atomic.Pointer[router.PipelineConn]
+}
+
+func (state *connState) isBusy() bool {
+	if state.busy.Load() {
+		return true
+	}
+	pc := state.pipeline.Load()
+	return pc != nil && pc.Pending() > 0
+}
+
+// StartServer 使用全局配置启动server，阻塞直到收到 SIGTERM/SIGINT 并优雅关闭，收到 SIGHUP 时重新加载配置
 func StartServer(root string, insRole *InstanceRole) {
+	opts := optionsFromConf()
+	opts.Root = root
+	opts.Role = *insRole
+	s, err := NewServer(opts)
+	if err != nil {
+		logger.Infof("start server err:%v", err)
+		return
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				s.Reload(fmt.Sprintf("sighup-%d", time.Now().UnixMilli()))
+				continue
+			}
+			logger.Infof("recv signal %v, to shutdown server", sig)
+		case <-s.done:
+			logger.Infof("server stop accept, to shutdown server")
+		}
+		break
+	}
+	if err = s.Close(); err != nil {
+		logger.Infof("shutdown server err:%v", err)
+	}
+}
+
+// NewServer 根据参数构建server并开始监听，返回时已经可以接收连接
+func NewServer(opts *ServerOptions) (*Server, error) {
+	conf.NoCache = opts.NoCache
+	if !logger.Initialized() {
+		logger.InitLogger(opts.LogPath)
+	}
+	repl := replica.NewReplication(opts.Root)
+	role := opts.Role
+	s := &Server{
+		root:     opts.Root,
+		opts:     *opts,
+		insRole:  &role,
+		archiver: opts.Archiver,
+		repl:     repl,
+		routers:  router.NewRouters(repl),
+		conns:    map[net.Conn]*connState{},
+		ipConns:  map[string]int{},
+		done:     make(chan struct{}),
+	}
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) init() error {
+	root := s.root
+	insRole := s.insRole
 	meta, err := fss.NewMeta(root)
 	if err != nil {
 		logger.Infof("meta err:%v", err)
-		return
+		return err
 	}
 
 	var storedRole store.InstanceRoleEnum
 	storedRole, err = meta.GetInstanceRole()
 	if err != nil {
 		logger.Infof("get role error:%v", err)
-		return
+		meta.Close()
+		return err
 	}
 
 	if storedRole != insRole.Role {
 		if err = meta.SetInstanceRole(insRole.Role); err != nil {
 			logger.Infof("set role error:%v", err)
-			return
+			meta.Close()
+			return err
 		}
 	}
 
 	var nextEventId int64
 	if nextEventId, err = repair.CheckLogAndFix(root, meta); err != nil {
 		meta.Close()
-		return
+		return err
 	}
-	router.InitCommonInfo(nextEventId, insRole.Role)
-	w, fstore, err := newWriter(root, meta)
+	s.routers.InitCommonInfo(nextEventId, insRole.Role)
+	w, fstore, err := newWriter(root, meta, s.opts.MaxLogSize, s.routers)
 	if err != nil {
 		meta.Close()
 		logger.Infof("create writer err:%v", err)
-		return
+		return err
 	}
+	s.fstore = fstore
 
-	worker, err := startBack(conf.WorkerBuffSize, w, fstore)
+	s.worker, err = startBack(s.opts.WorkerBuffSize, s.opts.FlushLevel, w, fstore, s.routers)
 	if err != nil {
-		return
+		fstore.Close()
+		return err
 	}
 
-	startBgAndInitRouter(root, fstore, worker, insRole.Role)
-	if insRole.Role == store.Master {
-		router.InitReplica(w.StdMsgWriter)
-	} else {
+	s.startBgAndInitRouter()
+	s.routers.InitReplica(fstore, s.delExec, w.StdMsgWriter)
+	if insRole.Role == store.Slave {
 		eventId := insRole.EventId
 		needSync := true
 		if nextEventId-1 > eventId {
 			eventId = nextEventId - 1
 			needSync = false
 		}
-		if err = replica.SlaveReplica(insRole.FromHost, insRole.FromPort, eventId, needSync, worker, fstore); err != nil {
+		if s.replicator, err = s.repl.SlaveReplica(insRole.FromHost, insRole.FromPort, eventId, needSync, s.worker, fstore); err != nil {
 			logger.Infof("SlaveReplica err:%v", err)
-			return
+			s.release()
+			return err
 		}
 	}
 
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", conf.Port))
+	lc := net.ListenConfig{
+		KeepAlive: conf.ConnKeepAlive,
+	}
+	s.ln, err = lc.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", s.opts.Port))
 	if err != nil {
 		logger.Errorf("listen err:%v", err)
-		return
+		s.release()
+		return err
+	}
+	if s.opts.Cluster != nil {
+		if err = s.startCluster(); err != nil {
+			logger.Infof("start cluster err:%v", err)
+			s.ln.Close()
+			s.release()
+			return err
+		}
 	}
-	logger.Infof("started server:%d", conf.Port)
+	logger.Infof("started server:%s", s.ln.Addr())
+	return nil
+}
+
+func (s *Server) serve() {
+	defer close(s.done)
 	for {
-		var conn net.Conn
-		conn, err = ln.Accept()
+		conn, err := s.ln.Accept()
 		if err != nil {
 			logger.Infof("accept conn err,end server:%v", err)
 			return
 		}
-		go handleConnection(conn, worker)
+		state, err := s.addConn(conn)
+		if err != nil {
+			logger.Infof("reject conn %s:%v", conn.RemoteAddr(), err)
+			go func() {
+				rejectConn(conn, err)
+				conn.Close()
+			}()
+			continue
+		}
+		if state == nil {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer s.removeConn(conn)
+			s.handleConnection(conn, state)
+		}()
+	}
+}
+
+// Addr server实际监听的地址
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Store server使用的存储
+func (s *Server) Store() store.Store {
+	return s.fstore
+}
+
+// Wait 阻塞直到server停止接收连接
+func (s *Server) Wait() {
+	<-s.done
+}
+
+// Close 使用配置的 timeout.server.shutdown 优雅关闭server
+func (s *Server) Close() error {
+	return s.Shutdown(conf.ServerShutdownTimeout)
+}
+
+// Shutdown 优雅关闭server，依次：停止接收连接；拒绝新的发布；等待 worker 处理完积压的消息；强制刷盘；
+// 通知订阅端与从库server关闭；关闭badger。超过 timeout 仍未完成则返回错误，不再等待
+func (s *Server) Shutdown(timeout time.Duration) error {
+	s.closeOnce.Do(func() {
+		finished := make(chan struct{})
+		deadline := time.Now().Add(timeout)
+		go func() {
+			defer close(finished)
+			s.shutdown(deadline)
+		}()
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-finished:
+			logger.Infof("server closed")
+		case <-timer.C:
+			logger.Infof("server shutdown timeout %v, give up waiting", timeout)
+			s.closeErr = errors.New("shutdown timeout")
+		}
+	})
+	return s.closeErr
+}
+
+func (s *Server) shutdown(deadline time.Time) {
+	s.shuttingDown.Store(true)
+	s.ln.Close()
+	<-s.done
+	if s.cluster != nil {
+		s.cluster.Stop()
 	}
-	backgroud.StopClear()
+	s.stopProducers()
+	// 拒绝新的消息，处理完积压的消息后强制刷盘
+	s.worker.Close()
+	s.fstore.ShutdownNotify()
+	s.worker.writer.ShutdownNotify()
+	s.waitBusyConns(deadline)
+	s.closeConns()
+	s.closeStore()
 }
 
-func startBgAndInitRouter(root string, fstore store.Store, worker standard.MessageWorking, role store.InstanceRoleEnum) {
-	delExec := backgroud.StartTopicFileDelete(fstore)
-	backgroud.StartClearOldFiles(root, fstore, worker, delExec)
-	var lc *tc.TimeTriggerControl
-	if role == store.Master {
-		delayCtrl := backgroud.StartDelay(fstore, worker)
-		router.InitDelay(fstore, delayCtrl)
-		lc = backgroud.StartLife(fstore, worker)
+// release 初始化失败时释放已经创建的资源
+func (s *Server) release() {
+	s.stopProducers()
+	s.worker.Close()
+	s.closeStore()
+}
+
+// stopProducers 停止复制线程与后台线程，它们会向 worker 投递消息
+func (s *Server) stopProducers() {
+	s.roleLock.Lock()
+	defer s.roleLock.Unlock()
+	if s.replicator != nil {
+		s.replicator.Stop()
+	}
+	s.watermark.Stop()
+	s.cleaner.Stop()
+	if s.delayCtrl != nil {
+		s.delayCtrl.Stop()
+	}
+	if s.lifeCtrl != nil {
+		s.lifeCtrl.Stop()
+	}
+}
+
+func (s *Server) closeStore() {
+	backgroud.StopTopicFileDelete(s.delExec)
+	if err := s.fstore.Close(); err != nil {
+		logger.Infof("close store err:%v", err)
+	}
+}
+
+// waitBusyConns 等待正在执行命令的连接结束，订阅与复制连接会在输出 ShutdownCode 后结束
+func (s *Server) waitBusyConns(deadline time.Time) {
+	for time.Now().Before(deadline) {
+		busy := 0
+		s.connLock.Lock()
+		for _, state := range s.conns {
+			if state.isBusy() {
+				busy++
+			}
+		}
+		s.connLock.Unlock()
+		if busy == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+// addConn 关闭时返回 nil，按 ip 与不豁免连接的限制在读到命令后由 admitConn 检查，
+// 这里只限制注册的连接总数，超过 ConnMaxConns+ConnReservedConns 时返回 tooManyConnsErr
+func (s *Server) addConn(conn net.Conn) (*connState, error) {
+	ip := nets.RemoteIp(conn)
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	if s.conns == nil {
+		return nil, nil
+	}
+	if conf.ConnMaxConns > 0 && len(s.conns) >= conf.ConnMaxConns+conf.ConnReservedConns {
+		return nil, tooManyConnsErr
+	}
+	s.connSeq++
+	now := time.Now().UnixMilli()
+	state := &connState{
+		id:        s.connSeq,
+		ip:        ip,
+		createdAt: now,
+	}
+	state.lastActive.Store(now)
+	state.lastCmd.Store(-1)
+	s.conns[conn] = state
+	s.connWg.Add(1)
+	return state, nil
+}
+
+func (s *Server) removeConn(conn net.Conn) {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	if s.conns != nil {
+		if state, ok := s.conns[conn]; ok {
+			delete(s.conns, conn)
+			if state.limited {
+				s.limitedConns--
+				if s.ipConns[state.ip]--; s.ipConns[state.ip] <= 0 {
+					delete(s.ipConns, state.ip)
+				}
+			}
+		}
+	}
+	s.connWg.Done()
+}
+
+func (s *Server) closeConns() {
+	s.connLock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+	s.connLock.Unlock()
+	s.connWg.Wait()
+}
+
+func (s *Server) startBgAndInitRouter() {
+	fstore := s.fstore
+	worker := s.worker
+	s.delExec = backgroud.StartTopicFileDelete(fstore)
+	s.cleaner = backgroud.StartClearOldFiles(s.root, fstore, worker, s.delExec, s.archiver)
+	s.watermark = backgroud.StartWatermarkGuard(s.root, s.cleaner)
+	rs := s.routers
+	rs.InitStorageGuard(s.watermark)
+	rs.InitRateLimit()
+	rs.InitMessageLimit()
+	if s.insRole.Role == store.Master {
+		s.delayCtrl = backgroud.StartDelay(fstore, worker)
+		rs.InitDelay(fstore, s.delayCtrl)
+		s.lifeCtrl = backgroud.StartLife(fstore, worker)
 	} else {
-		router.InitDelay(fstore, nil)
+		rs.InitDelay(fstore, nil)
 	}
 
-	router.Init(fstore, lc, delExec)
+	rs.Init(fstore, s.lifeCtrl, s.delExec)
+	rs.InitAdmin(s, s)
+	rs.InitConns(s)
+	rs.InitReload(s)
+	rs.InitBackup(s.root, s.opts.BackupRoot, fstore)
+	rs.InitTransfer(s.opts.TransferRoot, fstore)
+}
 
+// firstCmdLeft 连接还没有发送命令时距离 ConnFirstCmdTimeout 的剩余时间，只在开启 ConnMaxConns 时检查，不检查时返回 0
+func firstCmdLeft(state *connState) time.Duration {
+	if conf.ConnMaxConns <= 0 || conf.ConnFirstCmdTimeout <= 0 || state.lastCmd.Load() >= 0 {
+		return 0
+	}
+	left := conf.ConnFirstCmdTimeout - time.Duration(time.Now().UnixMilli()-state.createdAt)*time.Millisecond
+	if left <= 0 {
+		// 已经超时，只需要再检查一次是否有数据
+		return time.Millisecond
+	}
+	return left
 }
 
-func handleConnection(conn net.Conn, worker *backWorker) {
+func (s *Server) handleConnection(rawConn net.Conn, state *connState) {
 	var cmd protocol.CommandEnum
+	conn := s.routers.NewPipelineConn(rawConn)
+	state.pipeline.Store(conn)
 	defer func() {
+		conn.StopPipeline()
 		conn.Close()
 		logger.Infof("handleConnection close with cmd:%d", cmd)
 	}()
-	continuesTimeoutCount := 0
 	for {
-		header, err := router.ReadHeader(conn)
+		timeout, left := router.NetHeaderTimeout, firstCmdLeft(state)
+		if left > 0 && left < timeout {
+			timeout = left
+		}
+		header, err := router.ReadHeaderWithTimeout(conn, timeout)
 		if err != nil {
 			if nets.IsTimeoutError(err) {
-				continuesTimeoutCount++
-				if continuesTimeoutCount == 360 {
-					logger.Infof("handleConnection no cmd more than 30 mins:%v", err)
+				if left > 0 && left <= timeout {
+					logger.Infof("handleConnection %s no command in %v,close", conn.RemoteAddr(), conf.ConnFirstCmdTimeout)
+					return
+				}
+				if idle := time.Now().UnixMilli() - state.lastActive.Load(); conf.ConnIdleTimeout > 0 && idle >= conf.ConnIdleTimeout.Milliseconds() {
+					logger.Infof("handleConnection idle %d ms,close", idle)
 					return
 				}
-				logger.Infof("handleConnection times=%d, read header err:%v", continuesTimeoutCount, err)
 				continue
 			}
 			logger.Infof("handleConnection read header err:%v", err)
 			return
 		}
-		continuesTimeoutCount = 0
 		cmd = header.GetCmd()
+		state.lastActive.Store(time.Now().UnixMilli())
+		state.lastCmd.Store(int32(cmd))
+		if !conn.Pipelined(header) {
+			conn.Flush()
+		}
+		if !state.limited && !limitExempt(cmd) {
+			if err = s.admitConn(state); err != nil {
+				logger.Infof("tid=%s,reject conn %s:%v", header.TraceId, conn.RemoteAddr(), err)
+				rejectConn(conn, err)
+				return
+			}
+		}
 
 		if header.GetCmd() > protocol.CommandList {
 			err = nets.OutputRecoverErr(conn, "don't support action", router.NetWriteTimeout)
@@ -155,7 +594,7 @@ func handleConnection(conn net.Conn, worker *backWorker) {
 			continue
 		}
 
-		handler := router.GetRouter(header.GetCmd())
+		handler := s.routers.GetRouter(header.GetCmd())
 		if handler == nil {
 			logger.Infof("tid=%s,don't support action:%d", header.TraceId, header.GetCmd())
 			err = nets.OutputRecoverErr(conn, "don't support action", router.NetWriteTimeout)
@@ -164,12 +603,18 @@ func handleConnection(conn net.Conn, worker *backWorker) {
 			}
 			continue
 		}
-		err = handler.Router(conn, header, worker)
+		state.busy.Store(true)
+		err = handler.Router(conn, header, s.worker)
+		state.busy.Store(false)
+		state.lastActive.Store(time.Now().UnixMilli())
 		if err != nil {
 			logger.Infof("tid=%s,cmd=%d,router error:%v", header.TraceId, header.GetCmd(), err)
 		}
 		if err != nil && !dir.IsBizErr(err) {
 			return
 		}
+		if s.shuttingDown.Load() {
+			return
+		}
 	}
 }
@@ -0,0 +1,531 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/store"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitLogger("stderr")
+	os.Exit(m.Run())
+}
+
+// freePorts 预先分配端口，集群的节点启动前需要知道所有节点的地址
+func freePorts(t *testing.T, count int) []int {
+	var ports []int
+	for i := 0; i < count; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, ln.Addr().(*net.TCPAddr).Port)
+		ln.Close()
+	}
+	return ports
+}
+
+func startTestServer(t *testing.T, port int, role InstanceRole, cluster *ClusterOptions) *Server {
+	opts := DefaultServerOptions()
+	opts.Root = t.TempDir()
+	opts.Port = port
+	opts.Role = role
+	opts.Cluster = cluster
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+	})
+	return s
+}
+
+// call 发送一个请求并读取响应，返回错误时响应的 code 不是 OkCode
+func call(addr string, cmd protocol.CommandEnum, topic string, headerFn func(header []byte), payload []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	buf := make([]byte, protocol.HeaderSize, protocol.HeaderSize+len(topic)+len(payload))
+	buf[0] = byte(cmd)
+	binary.LittleEndian.PutUint16(buf[1:], uint16(len(topic)))
+	if headerFn != nil {
+		headerFn(buf)
+	}
+	buf = append(buf, topic...)
+	buf = append(buf, payload...)
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err = conn.Write(buf); err != nil {
+		return err
+	}
+	resp := make([]byte, protocol.RespHeaderSize)
+	if _, err = readFull(conn, resp); err != nil {
+		return err
+	}
+	if code := binary.LittleEndian.Uint16(resp); code != protocol.OkCode {
+		return fmt.Errorf("code %d", code)
+	}
+	return nil
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func createTopic(addr, topic string) error {
+	return call(addr, protocol.CommandCreateTopic, topic, nil, make([]byte, 8))
+}
+
+func pub(addr, topic string, contents ...string) error {
+	var payload []byte
+	for _, c := range contents {
+		payload = binary.LittleEndian.AppendUint32(payload, uint32(len(c)))
+		payload = binary.LittleEndian.AppendUint32(payload, 0)
+		payload = append(payload, c...)
+	}
+	return call(addr, protocol.CommandPub, topic, func(header []byte) {
+		binary.LittleEndian.PutUint32(header[3:], uint32(len(payload)))
+	}, payload)
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+func addrOf(port int) string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+func TestServersInOneProcess(t *testing.T) {
+	ports := freePorts(t, 2)
+	a := startTestServer(t, ports[0], InstanceRole{Role: store.Master}, nil)
+	b := startTestServer(t, ports[1], InstanceRole{Role: store.Master}, nil)
+	if err := createTopic(addrOf(ports[0]), "only-a"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := pub(addrOf(ports[0]), "only-a", fmt.Sprintf("m%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.routers.LastEventId() != 4 || b.routers.LastEventId() != 0 {
+		t.Fatalf("servers share eventId, a=%d b=%d", a.routers.LastEventId(), b.routers.LastEventId())
+	}
+	if info, _ := b.Store().GetTopicInfoReader().GetTopicInfo("only-a"); info != nil {
+		t.Fatal("topic of server a is visible in server b")
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+	ports := freePorts(t, 3)
+	var peers []string
+	for i, port := range ports {
+		peers = append(peers, fmt.Sprintf("n%d@%s", i, addrOf(port)))
+	}
+	clusterOpts := func(i int) *ClusterOptions {
+		return &ClusterOptions{
+			NodeId:    fmt.Sprintf("n%d", i),
+			Peers:     peers,
+			Lease:     time.Millisecond * 800,
+			Heartbeat: time.Millisecond * 150,
+		}
+	}
+	servers := []*Server{startTestServer(t, ports[0], InstanceRole{Role: store.Master}, clusterOpts(0))}
+	for i := 1; i < 3; i++ {
+		servers = append(servers, startTestServer(t, ports[i], InstanceRole{
+			Role:     store.Slave,
+			FromHost: "127.0.0.1",
+			FromPort: ports[0],
+		}, clusterOpts(i)))
+	}
+	leaderOf := func(group []*Server) *Server {
+		for _, s := range group {
+			if info := s.WhoIsMaster(); info.Known && info.Self && s.routers.IsMaster() {
+				return s
+			}
+		}
+		return nil
+	}
+	waitFor(t, time.Second*5, "first leader", func() bool {
+		return leaderOf(servers) == servers[0]
+	})
+
+	leaderAddr := addrOf(ports[0])
+	if err := createTopic(leaderAddr, "order"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := pub(leaderAddr, "order", fmt.Sprintf("order-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := servers[0].routers.LastEventId()
+	waitFor(t, time.Second*10, "replicated to followers", func() bool {
+		return servers[1].routers.LastEventId() == last && servers[2].routers.LastEventId() == last
+	})
+
+	if err := servers[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	rest := servers[1:]
+	var newLeader *Server
+	waitFor(t, time.Second*10, "new leader", func() bool {
+		newLeader = leaderOf(rest)
+		return newLeader != nil
+	})
+	follower := rest[0]
+	if follower == newLeader {
+		follower = rest[1]
+	}
+	newAddr := newLeader.Addr().String()
+	if err := pub(newAddr, "order", "after-failover"); err != nil {
+		t.Fatal(err)
+	}
+	if newLeader.routers.LastEventId() != last+1 {
+		t.Fatalf("new leader should continue from eventId %d, got %d", last+1, newLeader.routers.LastEventId())
+	}
+	waitFor(t, time.Second*10, "replicated from the new leader", func() bool {
+		return follower.routers.LastEventId() == last+1
+	})
+	if follower.repl.Diverged() {
+		t.Fatal("follower of the same history should not diverge")
+	}
+}
+
+// TestClusterMasterWithoutLeaseRejectsWrite 集群模式下没有持有 leader 租约的 master 同步拒绝写入，不等待 fence 切换角色
+func TestClusterMasterWithoutLeaseRejectsWrite(t *testing.T) {
+	ports := freePorts(t, 3)
+	var peers []string
+	for i, port := range ports {
+		peers = append(peers, fmt.Sprintf("n%d@%s", i, addrOf(port)))
+	}
+	// 其他节点没有启动，n0 得不到多数票，一直不能当选
+	s := startTestServer(t, ports[0], InstanceRole{Role: store.Master}, &ClusterOptions{
+		NodeId:    "n0",
+		Peers:     peers,
+		Lease:     time.Millisecond * 800,
+		Heartbeat: time.Millisecond * 150,
+	})
+	addr := addrOf(ports[0])
+	if !s.routers.IsMaster() {
+		t.Fatal("should start as master")
+	}
+	if err := createTopic(addr, "order"); err == nil {
+		t.Fatal("create topic should be rejected without the lease")
+	}
+	if err := pub(addr, "order", "no-lease"); err == nil {
+		t.Fatal("pub should be rejected without the lease")
+	}
+	if s.routers.LastEventId() != 0 {
+		t.Fatalf("nothing should be written, last eventId %d", s.routers.LastEventId())
+	}
+}
+
+// TestDivergedSlaveStopsReplica 两个各自写入的 master，一个 demote 为另一个的 slave 时 binlog 已经分叉，不能继续复制
+func TestDivergedSlaveStopsReplica(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		aPubs int
+		bPubs int
+	}{
+		{"same eventId with different blocks", 3, 5},
+		{"slave ahead of master", 5, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ports := freePorts(t, 2)
+			a := startTestServer(t, ports[0], InstanceRole{Role: store.Master}, nil)
+			startTestServer(t, ports[1], InstanceRole{Role: store.Master}, nil)
+			for i, n := range []int{tc.aPubs, tc.bPubs} {
+				addr := addrOf(ports[i])
+				if err := createTopic(addr, "t"); err != nil {
+					t.Fatal(err)
+				}
+				for j := 0; j < n; j++ {
+					// 错开写入时间，两边同一个 eventId 的块写入时间不同
+					time.Sleep(time.Millisecond * 5)
+					if err := pub(addr, "t", fmt.Sprintf("%d-%d", i, j)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := a.Demote("127.0.0.1", ports[1], "test"); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, time.Second*5, "diverged", a.repl.Diverged)
+			if !a.repl.GetSlaveStatus().Slave.Diverged {
+				t.Fatal("status should report diverged")
+			}
+			if (&clusterCallback{s: a}).LastEventId() != 0 {
+				t.Fatal("diverged node should not win an election")
+			}
+		})
+	}
+}
+
+// readSnapshotFrame 读取快照的一个输出帧，返回帧的类型
+func readSnapshotFrame(conn net.Conn, timeout time.Duration) (byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	header := make([]byte, protocol.RespHeaderSize)
+	if _, err := readFull(conn, header); err != nil {
+		return 0, err
+	}
+	if code := binary.LittleEndian.Uint16(header); code != protocol.OkCode {
+		return 0, fmt.Errorf("code %d", code)
+	}
+	body := make([]byte, binary.LittleEndian.Uint32(header[2:]))
+	if _, err := readFull(conn, body); err != nil {
+		return 0, err
+	}
+	return body[0], nil
+}
+
+// TestCascadingReplicaChain master -> 中继 -> 下游 slave，下游从中继的 binlog 复制，eventId 与 master 相同，发布重定向到上游
+func TestCascadingReplicaChain(t *testing.T) {
+	ports := freePorts(t, 3)
+	master := startTestServer(t, ports[0], InstanceRole{Role: store.Master}, nil)
+	relay := startTestServer(t, ports[1], InstanceRole{
+		Role:     store.Slave,
+		FromHost: "127.0.0.1",
+		FromPort: ports[0],
+	}, nil)
+	leaf := startTestServer(t, ports[2], InstanceRole{
+		Role:     store.Slave,
+		FromHost: "127.0.0.1",
+		FromPort: ports[1],
+	}, nil)
+
+	masterAddr := addrOf(ports[0])
+	if err := createTopic(masterAddr, "order"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := pub(masterAddr, "order", fmt.Sprintf("order-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := master.routers.LastEventId()
+	waitFor(t, time.Second*10, "replicated through the relay", func() bool {
+		return relay.routers.LastEventId() == last && leaf.routers.LastEventId() == last
+	})
+	if err := pub(addrOf(ports[2]), "order", "to-leaf"); err == nil || err.Error() != fmt.Sprintf("code %d", protocol.RedirectCode) {
+		t.Fatalf("pub on the leaf should be redirected, got %v", err)
+	}
+
+	if err := leaf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report := fsckStore(t, leaf.root, false)
+	if !report.OK() || report.LastEventId != last || report.TopicMessages != 5 {
+		t.Fatalf("unexpected fsck report of the leaf %+v", report)
+	}
+}
+
+// TestSnapshotWaitsForTopicDeleteLock 输出 topic 文件时需要持有 topic 的删除锁，删除锁被占用时不能输出文件
+func TestSnapshotWaitsForTopicDeleteLock(t *testing.T) {
+	ports := freePorts(t, 1)
+	s := startTestServer(t, ports[0], InstanceRole{Role: store.Master}, nil)
+	addr := addrOf(ports[0])
+	if err := createTopic(addr, "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub(addr, "t", "m0"); err != nil {
+		t.Fatal(err)
+	}
+	unlock, _ := s.delExec.GetDeleteFileLocker().Lock("t", "test", "tid")
+	if unlock == nil {
+		t.Fatal("lock topic failed")
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := make([]byte, protocol.HeaderSize)
+	req[0] = byte(protocol.CommandSnapshot)
+	if _, err = conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		frame, err := readSnapshotFrame(conn, time.Millisecond*500)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			t.Fatal(err)
+		}
+		if frame != 1 {
+			t.Fatalf("frame %d is output while the topic is locked", frame)
+		}
+	}
+
+	unlock()
+	var files int
+	for {
+		frame, err := readSnapshotFrame(conn, time.Second*5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame == 2 {
+			files++
+		}
+		if frame == 3 {
+			break
+		}
+	}
+	if files == 0 {
+		t.Fatal("topic files are not output after unlock")
+	}
+}
+
+// TestServerCloseAndReopen 端口为 0 时由系统分配，Close 后不再接收连接，同一个目录重新启动后 eventId 与 topic 继续有效
+func TestServerCloseAndReopen(t *testing.T) {
+	opts := DefaultServerOptions()
+	opts.Root = t.TempDir()
+	opts.Port = 0
+	opts.Role = InstanceRole{Role: store.Master}
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.Addr().String()
+	if s.Addr().(*net.TCPAddr).Port == 0 {
+		t.Fatal("port is not bound")
+	}
+	if err = createTopic(addr, "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err = pub(addr, "t", "m0", "m1"); err != nil {
+		t.Fatal(err)
+	}
+	last := s.routers.LastEventId()
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal("close twice should return the same result")
+	}
+	if err = createTopic(addr, "other"); err == nil {
+		t.Fatal("closed server should not accept commands")
+	}
+
+	s, err = NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+	})
+	if s.routers.LastEventId() != last {
+		t.Fatalf("expect eventId %d after reopen, got %d", last, s.routers.LastEventId())
+	}
+	if info, _ := s.Store().GetTopicInfoReader().GetTopicInfo("t"); info == nil {
+		t.Fatal("topic is lost after reopen")
+	}
+	if err = pub(s.Addr().String(), "t", "m2"); err != nil {
+		t.Fatal(err)
+	}
+	if s.routers.LastEventId() != last+1 {
+		t.Fatalf("expect eventId %d, got %d", last+1, s.routers.LastEventId())
+	}
+}
+
+// subscribe 从 eventId 之后开始订阅，返回订阅的连接
+func subscribe(t *testing.T, addr, topic string, eventId int64) net.Conn {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	who := "tester"
+	req := make([]byte, protocol.HeaderSize)
+	req[0] = byte(protocol.CommandSub)
+	binary.LittleEndian.PutUint16(req[1:], uint16(len(topic)))
+	req[3] = 1
+	req = append(req, topic...)
+	req = binary.LittleEndian.AppendUint64(req, uint64(eventId))
+	req = binary.LittleEndian.AppendUint32(req, uint32(len(who)))
+	req = append(req, who...)
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// TestGracefulShutdownNotifiesSubscribers 关闭时等待积压的消息写入并刷盘，等待新消息的订阅端收到 ShutdownCode
+func TestGracefulShutdownNotifiesSubscribers(t *testing.T) {
+	opts := DefaultServerOptions()
+	opts.Root = t.TempDir()
+	opts.Port = 0
+	opts.Role = InstanceRole{Role: store.Master}
+	// 定时刷盘，关闭时需要强制刷盘
+	opts.FlushLevel = 1
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.Addr().String()
+	if err = createTopic(addr, "t"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err = pub(addr, "t", fmt.Sprintf("m%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := s.routers.LastEventId()
+	conn := subscribe(t, addr, "t", last)
+	// 等待订阅开始等待新消息
+	time.Sleep(time.Millisecond * 200)
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	resp := make([]byte, protocol.RespHeaderSize)
+	for {
+		if _, err = readFull(conn, resp); err != nil {
+			t.Fatalf("subscriber is not notified: %v", err)
+		}
+		code := binary.LittleEndian.Uint16(resp)
+		if code == protocol.AliveCode {
+			continue
+		}
+		if code != protocol.ShutdownCode {
+			t.Fatalf("expect ShutdownCode, got %d", code)
+		}
+		break
+	}
+
+	report := fsckStore(t, opts.Root, false)
+	if !report.OK() || report.LastEventId != last || report.TopicMessages != 20 {
+		t.Fatalf("unexpected fsck report after shutdown %+v", report)
+	}
+}
@@ -0,0 +1,179 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/rolandhe/smss/pkg/dir"
+	"io"
+	"os"
+)
+
+// topic 导出文件使用 JSON Lines 格式，第一行是 FileHeader，之后每行一条消息 Record。
+// 消息内容是解压后的，header 和 body 都是 base64 编码，与集群的压缩配置无关
+
+const (
+	Format  = "smss-topic"
+	Version = 1
+
+	// 导入时保留原始时间和 eventId 的消息 header 名称
+	HeaderSrcTimestamp = "smss-src-timestamp"
+	HeaderSrcEventId   = "smss-src-event-id"
+
+	maxLineSize = 64 * 1024 * 1024
+)
+
+var InvalidFileErr = dir.NewBizError("invalid export file")
+
+type FileHeader struct {
+	Format      string `json:"format"`
+	Version     int    `json:"version"`
+	Topic       string `json:"topic"`
+	FromEventId int64  `json:"fromEventId"`
+	ToEventId   int64  `json:"toEventId"`
+	FromTime    int64  `json:"fromTime"`
+	ToTime      int64  `json:"toTime"`
+	ExportTime  int64  `json:"exportTime"`
+}
+
+type Record struct {
+	EventId int64 `json:"eventId"`
+	// Ts 消息写入时的时间，毫秒
+	Ts     int64  `json:"ts"`
+	Header []byte `json:"header,omitempty"`
+	Body   []byte `json:"body"`
+}
+
+// NewRecord content 是解压后的一条消息，前 4 字节是长度，之后 4 字节是 header 的长度
+func NewRecord(eventId, ts int64, content []byte) (*Record, error) {
+	if len(content) < 8 {
+		return nil, InvalidFileErr
+	}
+	hLen := int(binary.LittleEndian.Uint32(content[4:]))
+	if hLen > len(content)-8 {
+		return nil, InvalidFileErr
+	}
+	return &Record{
+		EventId: eventId,
+		Ts:      ts,
+		Header:  content[8 : 8+hLen],
+		Body:    content[8+hLen:],
+	}, nil
+}
+
+// AppendMessage 把消息按 pub 的格式追加到 buf
+func (r *Record) AppendMessage(buf []byte, header []byte) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(header)+len(r.Body)))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(header)))
+	buf = append(buf, header...)
+	return append(buf, r.Body...)
+}
+
+// AppendHeader 追加一个消息 header，2 字节名称长度 + 名称 + 2 字节值长度 + 值
+func AppendHeader(buf []byte, name, value string) []byte {
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(name)))
+	buf = append(buf, name...)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(value)))
+	return append(buf, value...)
+}
+
+type Writer struct {
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+// NewWriter 创建导出文件，文件必须不存在
+func NewWriter(p string, header *FileHeader) (*Writer, error) {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	fw := &Writer{
+		f:   f,
+		w:   w,
+		enc: json.NewEncoder(w),
+	}
+	header.Format = Format
+	header.Version = Version
+	if err = fw.enc.Encode(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fw, nil
+}
+
+func (fw *Writer) Write(r *Record) error {
+	return fw.enc.Encode(r)
+}
+
+func (fw *Writer) Close() error {
+	err := fw.w.Flush()
+	if err == nil {
+		err = fw.f.Sync()
+	}
+	if cErr := fw.f.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+type Reader struct {
+	f       *os.File
+	scanner *bufio.Scanner
+	Header  *FileHeader
+}
+
+func NewReader(p string) (*Reader, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	fr := &Reader{
+		f:       f,
+		scanner: scanner,
+		Header:  &FileHeader{},
+	}
+	if err = fr.next(fr.Header); err != nil {
+		f.Close()
+		if errors.Is(err, io.EOF) {
+			return nil, InvalidFileErr
+		}
+		return nil, err
+	}
+	if fr.Header.Format != Format || fr.Header.Version != Version {
+		f.Close()
+		return nil, InvalidFileErr
+	}
+	return fr, nil
+}
+
+// Read 读取下一条消息，结束时返回 io.EOF
+func (fr *Reader) Read() (*Record, error) {
+	r := &Record{}
+	if err := fr.next(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (fr *Reader) next(v any) error {
+	if !fr.scanner.Scan() {
+		if err := fr.scanner.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	if err := json.Unmarshal(fr.scanner.Bytes(), v); err != nil {
+		return InvalidFileErr
+	}
+	return nil
+}
+
+func (fr *Reader) Close() error {
+	return fr.f.Close()
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/store"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func transferCall(t *testing.T, addr string, cmd protocol.CommandEnum, topic string, opts any) error {
+	payload, err := json.Marshal(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return call(addr, cmd, topic, func(header []byte) {
+		binary.LittleEndian.PutUint32(header[3:], uint32(len(payload)))
+	}, payload)
+}
+
+// TestTransferFileUnderRoot 导出与导入的文件只能在 transfer.root 下，导出不覆盖已经存在的文件
+func TestTransferFileUnderRoot(t *testing.T) {
+	ports := freePorts(t, 1)
+	opts := DefaultServerOptions()
+	opts.Root = t.TempDir()
+	opts.Port = ports[0]
+	opts.Role = InstanceRole{Role: store.Master}
+	opts.TransferRoot = t.TempDir()
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+	})
+	addr := addrOf(ports[0])
+	for _, topic := range []string{"a", "b"} {
+		if err = createTopic(addr, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = pub(addr, "a", "m0", "m1", "m2"); err != nil {
+		t.Fatal(err)
+	}
+
+	outside := filepath.Join(t.TempDir(), "outside.jsonl")
+	for _, file := range []string{"", "../escape.jsonl", outside, "sub/../../escape.jsonl"} {
+		if err = transferCall(t, addr, protocol.CommandExport, "a", map[string]any{"file": file}); err == nil {
+			t.Fatalf("export to %q should be rejected", file)
+		}
+		if err = transferCall(t, addr, protocol.CommandImport, "b", map[string]any{"file": file}); err == nil {
+			t.Fatalf("import from %q should be rejected", file)
+		}
+	}
+	if _, err = os.Stat(outside); !os.IsNotExist(err) {
+		t.Fatal("file outside transfer.root is written")
+	}
+
+	existing := filepath.Join(opts.TransferRoot, "existing.jsonl")
+	if err = os.WriteFile(existing, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = transferCall(t, addr, protocol.CommandExport, "a", map[string]any{"file": "existing.jsonl"}); err == nil {
+		t.Fatal("export should not overwrite an existing file")
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "keep" {
+		t.Fatalf("existing file is changed: %q", data)
+	}
+
+	if err = transferCall(t, addr, protocol.CommandExport, "a", map[string]any{"file": "sub/a.jsonl"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(opts.TransferRoot, "sub", "a.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	before := s.routers.LastEventId()
+	if err = transferCall(t, addr, protocol.CommandImport, "b", map[string]any{"file": "sub/a.jsonl"}); err != nil {
+		t.Fatal(err)
+	}
+	if imported := s.routers.LastEventId() - before; imported != 3 {
+		t.Fatalf("expect 3 messages imported, got %d", imported)
+	}
+}
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"errors"
+	"github.com/rolandhe/smss/cmd/repair"
+	"github.com/rolandhe/smss/store/fss"
+	"os"
+)
+
+var inconsistentErr = errors.New("data is inconsistent")
+
+// VerifyStore 离线检查数据目录并输出报告，fix 为 true 时截断到最后一个一致的位置。smss 运行时 meta 被锁定，不能检查
+func VerifyStore(root string, fix bool) error {
+	meta, err := fss.NewMeta(root)
+	if err != nil {
+		return err
+	}
+	defer meta.Close()
+	report, err := repair.Fsck(root, meta, fix)
+	if report != nil {
+		report.Print(os.Stdout)
+	}
+	if err != nil {
+		return err
+	}
+	if !report.OK() && !fix {
+		return inconsistentErr
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rolandhe/smss/cmd/repair"
+	"github.com/rolandhe/smss/store"
+	"github.com/rolandhe/smss/store/fss"
+	"os"
+	"path"
+	"testing"
+)
+
+// writeTestStore 写入两个 topic，binlog 与 topic 文件都很小，检查需要跨多个文件
+func writeTestStore(t *testing.T) string {
+	ports := freePorts(t, 1)
+	opts := DefaultServerOptions()
+	opts.Root = t.TempDir()
+	opts.Port = ports[0]
+	opts.Role = InstanceRole{Role: store.Master}
+	opts.MaxLogSize = 512
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := addrOf(ports[0])
+	for _, topic := range []string{"a", "b"} {
+		if err = createTopic(addr, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 30; i++ {
+		topic := "a"
+		if i%3 == 0 {
+			topic = "b"
+		}
+		if err = pub(addr, topic, fmt.Sprintf("msg-%d", i), fmt.Sprintf("msg-%d-2", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return opts.Root
+}
+
+func fsckStore(t *testing.T, root string, fix bool) *repair.FsckReport {
+	meta, err := fss.NewMeta(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer meta.Close()
+	report, err := repair.Fsck(root, meta, fix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestFsckAcrossFiles(t *testing.T) {
+	root := writeTestStore(t)
+	report := fsckStore(t, root, false)
+	if !report.OK() {
+		t.Fatalf("unexpected problems %+v", report.Problems[0])
+	}
+	if report.BinlogFiles < 3 || report.Topics != 2 || report.TopicMessages != 60 || report.LastEventId != 62 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestFsckFixesCorruptTopicFile(t *testing.T) {
+	root := writeTestStore(t)
+	// 破坏 topic a 第二个文件的最后一个字节，它是最后一个块 payload 末尾的 \n
+	p := path.Join(fss.TopicPath(path.Join(root, store.TopicDir), "a"), "1.log")
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-2] ^= 0xff
+	if err = os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	report := fsckStore(t, root, true)
+	if report.OK() || len(report.Repaired) == 0 {
+		t.Fatalf("corruption is not found or repaired: %+v", report)
+	}
+	if after := fsckStore(t, root, false); !after.OK() {
+		t.Fatalf("still inconsistent after fix: %+v", after.Problems[0])
+	}
+}
@@ -3,6 +3,7 @@ package conf
 import (
 	"github.com/spf13/viper"
 	"log"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,12 +12,40 @@ var DefaultIoWriteTimeout time.Duration
 var WorkerBuffSize int
 var WorkerWaitMsgTimeout time.Duration
 var WorkerWaitMsgTimeoutLogSample int64
+var WorkerGroupMaxSize int
+var WorkerGroupWait time.Duration
+
+// WorkerRequestTimeout client 请求从进入队列开始的截止时间，0 表示没有截止时间，队列满时等待
+var WorkerRequestTimeout time.Duration
 var MainStorePath string
 var MaxLogSize int64
 
-var StoreMaxDays int
+// StoreMaxDays 可以在线修改，见 Reload
+var StoreMaxDays atomic.Int64
+
+// StoreClearInterval 回收过期文件的间隔，单位s，可以在线修改
+var StoreClearInterval atomic.Int64
+
+// StoreArchiveEnable 过期的文件先归档再删除
+var StoreArchiveEnable bool
+var StoreArchivePath string
+
+// BackupRoot CommandBackup 的目标都解析到该目录下，为空时不能在线备份
+var BackupRoot string
+
+// TransferRoot CommandExport 与 CommandImport 的文件都解析到该目录下，为空时不能导出与导入
+var TransferRoot string
+
+// StoreWatermarkInterval 检查磁盘剩余空间与数据大小的间隔
+var StoreWatermarkInterval time.Duration
 
-var StoreClearInterval int
+// StoreMinFreeBytes 磁盘剩余空间低于该值时拒绝发布，恢复到 StoreResumeFreeBytes 以上时恢复，0 表示不检查
+var StoreMinFreeBytes int64
+var StoreResumeFreeBytes int64
+
+// StoreMaxDataBytes 数据目录大小超过该值时拒绝发布，降到 StoreResumeDataBytes 以下时恢复，0 表示不检查
+var StoreMaxDataBytes int64
+var StoreResumeDataBytes int64
 
 var DefaultScanSecond int64
 
@@ -24,17 +53,22 @@ var FistExecDelaySecond int64
 
 var WaitFileDeleteLockerTimeout time.Duration
 
-var ServerAliveTimeout time.Duration
+// ServerAliveTimeout 订阅没有新消息时发送 AliveCode 的间隔，time.Duration，可以在线修改
+var ServerAliveTimeout atomic.Int64
+
+var ServerShutdownTimeout time.Duration
 
 var LogPath string
 
-var LogSample int64
+// LogSample 可以在线修改
+var LogSample atomic.Int64
 
 var TopicFolderCount uint64
 
 var NoCache bool
 
-var FlushLevel int
+// FlushLevel 可以在线修改，worker 在处理下一个消息之前切换刷盘方式
+var FlushLevel atomic.Int64
 
 var LogRotateMaxSize int
 var LogRotateMaxBackups int
@@ -42,7 +76,74 @@ var LogRotateMaxAge int
 
 var LogWithGid bool
 
+// ReplicaSemiSyncAckSlaves 半同步复制需要确认的从库数，0 表示异步复制
+var ReplicaSemiSyncAckSlaves int
+var ReplicaSemiSyncTimeout time.Duration
+
+// ReplicaFilterInclude slave 只复制匹配的 topic，为空表示所有 topic
+var ReplicaFilterInclude []string
+
+// ReplicaFilterExclude slave 不复制匹配的 topic
+var ReplicaFilterExclude []string
+
+// ReplicaRedirectSub slave 是否把没有设置 SubFlagAllowReplica 的订阅重定向到 master，默认 false，与老版本一样由 slave 提供订阅
+var ReplicaRedirectSub bool
+
+// ClusterEnable 集群模式，节点之间自动选主
+var ClusterEnable bool
+var ClusterNodeId string
+
+// ClusterPeers 集群所有节点，格式 id@host:port，包括自己
+var ClusterPeers []string
+var ClusterLease time.Duration
+var ClusterHeartbeat time.Duration
+
+// ConnMaxConns 最大连接数，包括订阅的连接，不包括复制与集群节点之间的连接，0 表示不限制
+var ConnMaxConns int
+
+// ConnMaxPerIp 同一个 ip 的最大连接数，0 表示不限制
+var ConnMaxPerIp int
+
+// ConnReservedConns 为复制与集群节点之间的连接预留的数量，开启 ConnMaxConns 时 accept 后注册的连接总数不超过 ConnMaxConns+ConnReservedConns
+var ConnReservedConns int
+
+// ConnFirstCmdTimeout 开启 ConnMaxConns 时，连接建立后超过该时间没有发送命令则关闭，避免空连接占满预留的连接，0 表示不限制
+var ConnFirstCmdTimeout time.Duration
+
+// ConnIdleTimeout 连接上超过该时间没有请求时关闭，执行中的订阅与复制不算空闲
+var ConnIdleTimeout time.Duration
+
+// ConnKeepAlive tcp keepalive 探测的间隔，0 使用默认的 15s，小于 0 表示关闭 keepalive
+var ConnKeepAlive time.Duration
+
+// message 与 rateLimit 的配置可以在线修改，重新加载时与 router 的初始化并发读取，都是原子变量
+
+// MessageMaxSize 一条消息的最大长度，包括消息 header，0 表示不限制
+var MessageMaxSize atomic.Int64
+
+// MessageMaxBatchCount 一个 pub 请求最多包含的消息数，0 表示不限制
+var MessageMaxBatchCount atomic.Int64
+
+// MessageMaxBatchBytes 一个 pub 请求 payload 的最大长度，在分配内存之前检查，0 表示不限制
+var MessageMaxBatchBytes atomic.Int64
+
+// MessageMaxDrainBytes 超过限制的请求不超过该长度时读取并丢弃 payload，连接可以继续使用，否则关闭连接
+var MessageMaxDrainBytes atomic.Int64
+
+// MessageTopics 每个 topic 的限制，[]string，格式 name:maxSize:maxBatchCount:maxBatchBytes，0 表示使用全局的限制
+var MessageTopics atomic.Value
+
+// RateLimitMaxDelay 发布超过限流时最多等待的时间，time.Duration，需要等待更久时拒绝，0 表示直接拒绝
+var RateLimitMaxDelay atomic.Int64
+
+// RateLimitTopics 每个 topic 的限流规则，[]string，格式 name:msgsPerSecond:bytesPerSecond，name 为 * 表示默认规则
+var RateLimitTopics atomic.Value
+
+// RateLimitClients 每个 client 的限流规则，[]string，name 是 client 的 ip
+var RateLimitClients atomic.Value
+
 func Init() {
+	setDefaults(viper.GetViper())
 	viper.SetConfigName("config")
 	// 设置配置文件类型
 	viper.SetConfigType("yaml")
@@ -52,34 +153,169 @@ func Init() {
 		log.Printf("fatal error config file: %v", err)
 		panic(err)
 	}
+	load()
+}
+
+// InitDefault 不读取配置文件，全部使用默认配置，用于内嵌模式
+func InitDefault() {
+	setDefaults(viper.GetViper())
+	load()
+}
+
+// defaults 默认值与 config/config.yaml 保持一致，Reload 按这里的 key 比较配置的变化
+var defaults = []struct {
+	key   string
+	value any
+}{
+	{"port", 12301},
+	{"log.path", "stdout"},
+	{"log.sample", 10000},
+	{"log.withGid", true},
+	{"log.rotate.maxSize", 500},
+	{"log.rotate.maxBackups", 10},
+	{"log.rotate.maxAge", 14},
+	{"store.path", "data"},
+	{"store.maxLogSize", 1073741824},
+	{"store.flushLevel", 1},
+	{"store.maxDays", 7},
+	{"store.clearInterval", 7200},
+	{"store.waitDelLockTimeoutMs", 3000},
+	{"store.noCache", false},
+	{"store.folderCount", 10},
+	{"store.archive.enable", false},
+	{"store.archive.path", "archive"},
+	{"backup.root", "backup"},
+	{"transfer.root", "transfer"},
+	{"store.watermark.checkInterval", 5},
+	{"store.watermark.minFreeMB", 0},
+	{"store.watermark.resumeFreeMB", 0},
+	{"store.watermark.maxDataMB", 0},
+	{"store.watermark.resumeDataMB", 0},
+	{"worker.buffSize", 1000},
+	{"worker.waitMsgTimeout", 1000},
+	{"worker.waitMsgTimeoutLogSample", 30},
+	{"worker.groupMaxSize", 128},
+	{"worker.groupWaitMicros", 0},
+	{"worker.requestTimeoutMs", 0},
+	{"timeout.net.write", 1000},
+	{"timeout.server.alive", 30000},
+	{"timeout.server.shutdown", 10000},
+	{"background.defaultScanSecond", 7200},
+	{"background.firstExecSecond", 1},
+	{"replica.semiSync.ackSlaves", 0},
+	{"replica.semiSync.timeoutMs", 1000},
+	{"replica.filter.include", []string{}},
+	{"replica.filter.exclude", []string{}},
+	{"replica.redirectSub", false},
+	{"cluster.enable", false},
+	{"cluster.nodeId", ""},
+	{"cluster.peers", []string{}},
+	{"cluster.leaseMs", 3000},
+	{"cluster.heartbeatMs", 500},
+	{"conn.maxConns", 0},
+	{"conn.maxPerIp", 0},
+	{"conn.reservedConns", 16},
+	{"conn.firstCmdTimeoutSec", 10},
+	{"conn.idleTimeoutSec", 1800},
+	{"conn.keepAliveSec", 15},
+	{"message.maxSize", 0},
+	{"message.maxBatchCount", 0},
+	{"message.maxBatchBytes", 67108864},
+	{"message.maxDrainBytes", 16777216},
+	{"message.topics", []string{}},
+	{"rateLimit.maxDelayMs", 0},
+	{"rateLimit.topics", []string{}},
+	{"rateLimit.clients", []string{}},
+}
+
+func setDefaults(v *viper.Viper) {
+	for _, d := range defaults {
+		v.SetDefault(d.key, d.value)
+	}
+}
 
+func load() {
 	Port = viper.GetInt("port")
 	DefaultIoWriteTimeout = time.Duration(viper.GetInt64("timeout.net.write")) * time.Millisecond
-	ServerAliveTimeout = time.Duration(viper.GetInt64("timeout.server.alive")) * time.Millisecond
+	ServerShutdownTimeout = time.Duration(viper.GetInt64("timeout.server.shutdown")) * time.Millisecond
 
 	WorkerBuffSize = viper.GetInt("worker.buffSize")
 	WorkerWaitMsgTimeout = time.Duration(viper.GetInt64("worker.waitMsgTimeout")) * time.Millisecond
 	WorkerWaitMsgTimeoutLogSample = viper.GetInt64("worker.waitMsgTimeoutLogSample")
+	WorkerGroupMaxSize = viper.GetInt("worker.groupMaxSize")
+	WorkerGroupWait = time.Duration(viper.GetInt64("worker.groupWaitMicros")) * time.Microsecond
+	WorkerRequestTimeout = time.Duration(viper.GetInt64("worker.requestTimeoutMs")) * time.Millisecond
 	MainStorePath = viper.GetString("store.path")
 	MaxLogSize = viper.GetInt64("store.maxLogSize")
-	StoreMaxDays = viper.GetInt("store.maxDays")
-	StoreClearInterval = viper.GetInt("store.clearInterval")
+	StoreArchiveEnable = viper.GetBool("store.archive.enable")
+	StoreArchivePath = viper.GetString("store.archive.path")
+	BackupRoot = viper.GetString("backup.root")
+	TransferRoot = viper.GetString("transfer.root")
+	StoreWatermarkInterval = time.Duration(viper.GetInt64("store.watermark.checkInterval")) * time.Second
+	StoreMinFreeBytes = viper.GetInt64("store.watermark.minFreeMB") * 1024 * 1024
+	StoreResumeFreeBytes = viper.GetInt64("store.watermark.resumeFreeMB") * 1024 * 1024
+	// 恢复的水位不能比拒绝的水位更严格，否则不会恢复
+	if StoreResumeFreeBytes < StoreMinFreeBytes {
+		StoreResumeFreeBytes = StoreMinFreeBytes
+	}
+	StoreMaxDataBytes = viper.GetInt64("store.watermark.maxDataMB") * 1024 * 1024
+	StoreResumeDataBytes = viper.GetInt64("store.watermark.resumeDataMB") * 1024 * 1024
+	if StoreResumeDataBytes <= 0 || StoreResumeDataBytes > StoreMaxDataBytes {
+		StoreResumeDataBytes = StoreMaxDataBytes
+	}
 	DefaultScanSecond = viper.GetInt64("background.defaultScanSecond")
 
 	FistExecDelaySecond = viper.GetInt64("background.firstExecSecond")
 	WaitFileDeleteLockerTimeout = time.Duration(viper.GetInt64("store.waitDelLockTimeoutMs")) * time.Millisecond
 
 	LogPath = viper.GetString("log.path")
-	LogSample = viper.GetInt64("log.sample")
 
 	TopicFolderCount = viper.GetUint64("store.folderCount")
 	NoCache = viper.GetBool("store.noCache")
 
-	FlushLevel = viper.GetInt("store.flushLevel")
-
 	LogRotateMaxSize = viper.GetInt("log.rotate.maxSize")
 	LogRotateMaxBackups = viper.GetInt("log.rotate.maxBackups")
 	LogRotateMaxAge = viper.GetInt("log.rotate.maxAge")
 
 	LogWithGid = viper.GetBool("log.withGid")
+
+	ReplicaSemiSyncAckSlaves = viper.GetInt("replica.semiSync.ackSlaves")
+	ReplicaSemiSyncTimeout = time.Duration(viper.GetInt64("replica.semiSync.timeoutMs")) * time.Millisecond
+	ReplicaFilterInclude = viper.GetStringSlice("replica.filter.include")
+	ReplicaFilterExclude = viper.GetStringSlice("replica.filter.exclude")
+	ReplicaRedirectSub = viper.GetBool("replica.redirectSub")
+
+	ClusterEnable = viper.GetBool("cluster.enable")
+	ClusterNodeId = viper.GetString("cluster.nodeId")
+	ClusterPeers = viper.GetStringSlice("cluster.peers")
+	ClusterLease = time.Duration(viper.GetInt64("cluster.leaseMs")) * time.Millisecond
+	ClusterHeartbeat = time.Duration(viper.GetInt64("cluster.heartbeatMs")) * time.Millisecond
+
+	ConnMaxConns = viper.GetInt("conn.maxConns")
+	ConnMaxPerIp = viper.GetInt("conn.maxPerIp")
+	ConnReservedConns = viper.GetInt("conn.reservedConns")
+	ConnFirstCmdTimeout = time.Duration(viper.GetInt64("conn.firstCmdTimeoutSec")) * time.Second
+	ConnIdleTimeout = time.Duration(viper.GetInt64("conn.idleTimeoutSec")) * time.Second
+	ConnKeepAlive = time.Duration(viper.GetInt64("conn.keepAliveSec")) * time.Second
+
+	loadLive(viper.GetViper())
+}
+
+// loadLive 读取可以在线修改的配置，message 与 rateLimit 的配置由 router 重新初始化后生效，见 Reload 的 apply
+func loadLive(v *viper.Viper) {
+	LogSample.Store(v.GetInt64("log.sample"))
+	StoreMaxDays.Store(v.GetInt64("store.maxDays"))
+	StoreClearInterval.Store(v.GetInt64("store.clearInterval"))
+	ServerAliveTimeout.Store(int64(time.Duration(v.GetInt64("timeout.server.alive")) * time.Millisecond))
+	FlushLevel.Store(v.GetInt64("store.flushLevel"))
+
+	MessageMaxSize.Store(v.GetInt64("message.maxSize"))
+	MessageMaxBatchCount.Store(v.GetInt64("message.maxBatchCount"))
+	MessageMaxBatchBytes.Store(v.GetInt64("message.maxBatchBytes"))
+	MessageMaxDrainBytes.Store(v.GetInt64("message.maxDrainBytes"))
+	MessageTopics.Store(v.GetStringSlice("message.topics"))
+
+	RateLimitMaxDelay.Store(int64(time.Duration(v.GetInt64("rateLimit.maxDelayMs")) * time.Millisecond))
+	RateLimitTopics.Store(v.GetStringSlice("rateLimit.topics"))
+	RateLimitClients.Store(v.GetStringSlice("rateLimit.clients"))
 }
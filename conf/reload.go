@@ -0,0 +1,111 @@
+package conf
+
+import (
+	"errors"
+	"github.com/spf13/viper"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// liveKeys 可以在线修改的配置，以 . 结尾的表示该前缀下的所有配置，其他配置修改后需要重启
+var liveKeys = []string{
+	"log.sample",
+	"store.maxDays",
+	"store.clearInterval",
+	"store.flushLevel",
+	"timeout.server.alive",
+	"message.",
+	"rateLimit.",
+}
+
+var reloadLock sync.Mutex
+
+// ReloadResult 配置文件中有变化的配置
+type ReloadResult struct {
+	// Applied 已经生效的配置
+	Applied []string `json:"applied"`
+	// Restart 需要重启才能生效的配置，重启之前每次重新加载都会输出
+	Restart []string `json:"restart"`
+}
+
+// Changed 以 prefix 开头的配置是否在本次生效
+func (r *ReloadResult) Changed(prefix string) bool {
+	for _, key := range r.Applied {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload 重新读取配置文件，校验通过后应用可以在线修改的配置，校验失败时不做任何修改。
+// apply 在持有锁时调用，由各模块按新的配置重新初始化，并发的重新加载不会以旧的配置覆盖新的配置。
+// 内嵌模式没有配置文件，不支持重新加载
+func Reload(apply func(result *ReloadResult)) (*ReloadResult, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		return nil, errors.New("no config file to reload")
+	}
+	v := viper.New()
+	setDefaults(v)
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	if err := validate(v); err != nil {
+		return nil, err
+	}
+	result := &ReloadResult{
+		Applied: []string{},
+		Restart: []string{},
+	}
+	for _, d := range defaults {
+		value := v.Get(d.key)
+		if reflect.DeepEqual(value, viper.Get(d.key)) {
+			continue
+		}
+		if !isLive(d.key) {
+			result.Restart = append(result.Restart, d.key)
+			continue
+		}
+		result.Applied = append(result.Applied, d.key)
+		viper.Set(d.key, value)
+	}
+	loadLive(viper.GetViper())
+	if apply != nil {
+		apply(result)
+	}
+	return result, nil
+}
+
+func isLive(key string) bool {
+	for _, k := range liveKeys {
+		if key == k || (strings.HasSuffix(k, ".") && strings.HasPrefix(key, k)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate 检查可以在线修改的配置，message 与 rateLimit 中格式错误的规则与启动时一样忽略并打印日志
+func validate(v *viper.Viper) error {
+	if v.GetInt64("log.sample") < 0 {
+		return errors.New("log.sample must not be negative")
+	}
+	if v.GetInt64("store.maxDays") < 0 {
+		return errors.New("store.maxDays must not be negative")
+	}
+	if v.GetInt64("store.clearInterval") <= 0 {
+		return errors.New("store.clearInterval must be positive")
+	}
+	if level := v.GetInt64("store.flushLevel"); level < 0 || level > 2 {
+		return errors.New("store.flushLevel must be 0, 1 or 2")
+	}
+	if v.GetInt64("timeout.server.alive") <= 0 {
+		return errors.New("timeout.server.alive must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package conf
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func writeConfig(t *testing.T, file string, maxSize int) {
+	content := fmt.Sprintf("message:\n  maxSize: %d\n  topics: [\"t%d:%d:0:0\"]\n", maxSize, maxSize, maxSize)
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReloadAppliesUnderLock apply 在持有锁时执行，并发的重新加载与读取不会读到不一致的配置
+func TestReloadAppliesUnderLock(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, file, 100)
+	t.Cleanup(viper.Reset)
+	setDefaults(viper.GetViper())
+	viper.SetConfigFile(file)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	load()
+
+	writeConfig(t, file, 200)
+	var applied bool
+	result, err := Reload(func(result *ReloadResult) {
+		if reloadLock.TryLock() {
+			reloadLock.Unlock()
+			t.Error("apply should run under the reload lock")
+		}
+		if MessageMaxSize.Load() != 200 {
+			t.Errorf("apply should see the new config, got %d", MessageMaxSize.Load())
+		}
+		applied = result.Changed("message.")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !applied || len(result.Applied) == 0 {
+		t.Fatalf("message config should be applied, got %+v", result)
+	}
+
+	// 重新加载的同时读取在线修改的配置，go test -race 可以发现没有同步的读写
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			topics, _ := MessageTopics.Load().([]string)
+			_ = MessageMaxSize.Load() + StoreClearInterval.Load() + RateLimitMaxDelay.Load() + int64(len(topics))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		size := 300 + i
+		writeConfig(t, file, size)
+		if _, err = Reload(nil); err != nil {
+			t.Fatal(err)
+		}
+		topics, _ := MessageTopics.Load().([]string)
+		if MessageMaxSize.Load() != int64(size) || len(topics) != 1 || topics[0] != fmt.Sprintf("t%d:%d:0:0", size, size) {
+			t.Fatalf("unexpected config, maxSize=%d topics=%v", MessageMaxSize.Load(), topics)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/rolandhe/smss/cmd"
 	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/archive"
 	"github.com/rolandhe/smss/pkg/logger"
 	"github.com/rolandhe/smss/store"
+	"os"
 )
 
 var (
@@ -13,11 +16,26 @@ var (
 	host    = flag.String("host", "", "master host")
 	port    = flag.Int("port", 12301, "master port")
 	eventId = flag.Int64("event", 0, "replica event id")
+	verify  = flag.Bool("verify", false, "离线检查数据目录后退出")
+	fix     = flag.Bool("repair", false, "与 -verify 一起使用，截断到最后一个一致的位置")
+
+	restore    = flag.String("restore", "", "从备份目录或者 tar 包重建数据目录后退出")
+	binlogDir  = flag.String("binlog", "", "与 -restore 一起使用，归档的 binlog 目录")
+	untilEvent = flag.Int64("until-event", 0, "与 -binlog 一起使用，恢复到的 eventId")
+	untilTime  = flag.Int64("until-time", 0, "与 -binlog 一起使用，恢复到的时间，毫秒")
+
+	inspect   = flag.String("inspect", "", "输出 binlog 或者 topic 文件(包括归档的 .log.gz)中的每个块后退出")
+	unarchive = flag.String("unarchive", "", "把归档目录中的文件解压到 -out 目录后退出")
+	out       = flag.String("out", "", "与 -unarchive 一起使用，解压的目标目录")
 )
 
 // main
 // master mode: ./smss -role master
 // slave mode: ./smss -role slave -host 127.0.0.1 -port 12301 -event 0
+// verify mode: ./smss -verify [-repair]
+// inspect mode: ./smss -inspect archive/binlog/3.log.gz
+// unarchive mode: ./smss -unarchive archive -out /tmp/unarchived
+// restore mode: ./smss -restore /backup/b1.tar.gz [-binlog /archive/binlog] [-until-event 1000 | -until-time 1700000000000]
 func main() {
 	conf.Init()
 	logger.InitLogger(conf.LogPath)
@@ -25,6 +43,52 @@ func main() {
 
 	flag.Parse()
 
+	if *verify {
+		if err := cmd.VerifyStore(conf.MainStorePath, *fix); err != nil {
+			fmt.Println(err)
+			logger.Sync()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *inspect != "" {
+		if err := cmd.InspectSegment(*inspect, os.Stdout); err != nil {
+			fmt.Println(err)
+			logger.Sync()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *unarchive != "" {
+		if *out == "" {
+			fmt.Println("-out is required")
+			os.Exit(1)
+		}
+		if err := archive.Extract(*unarchive, *out); err != nil {
+			fmt.Println(err)
+			logger.Sync()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *restore != "" {
+		err := cmd.RestoreStore(conf.MainStorePath, &cmd.RestoreOptions{
+			Backup:       *restore,
+			BinlogDir:    *binlogDir,
+			UntilEventId: *untilEvent,
+			UntilTime:    *untilTime,
+		})
+		if err != nil {
+			fmt.Println(err)
+			logger.Sync()
+			os.Exit(1)
+		}
+		return
+	}
+
 	roleValue := store.Master
 	if *role == "slave" {
 		roleValue = store.Slave
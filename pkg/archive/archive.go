@@ -0,0 +1,165 @@
+package archive
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 过期的 binlog 与 topic 文件在删除前先归档，name 是相对归档根目录的路径：binlog/{fileId}.log 或者 topic/{topic名称}/{创建的eventId}/{fileId}.log。
+// 本地归档用 gzip 压缩后保存为 name + ".gz"，其他的归档方式(比如对象存储)实现 Archiver 即可
+
+// Suffix 本地归档文件的后缀
+const Suffix = ".gz"
+
+// Archiver 归档一个已经过期的文件，返回 nil 后调用方删除原文件。name 已经归档过时不能覆盖，返回错误
+type Archiver interface {
+	Archive(src string, name string) error
+}
+
+type dirArchiver struct {
+	root string
+}
+
+// NewDirArchiver 归档到本地目录
+func NewDirArchiver(root string) Archiver {
+	return &dirArchiver{
+		root: root,
+	}
+}
+
+// ExistErr 归档的目标已经存在
+var ExistErr = errors.New("archive exists")
+
+func (a *dirArchiver) Archive(src string, name string) error {
+	dst := filepath.Join(a.root, filepath.FromSlash(name)) + Suffix
+	if _, err := os.Stat(dst); err == nil {
+		return ExistErr
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	// 先写临时文件，避免进程退出时留下不完整的归档
+	tmp := dst + ".tmp"
+	if err = compressTo(tmp, in); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Chtimes(tmp, stat.ModTime(), stat.ModTime()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// 硬链接在目标存在时失败，不会覆盖期间出现的同名归档
+	err = os.Link(tmp, dst)
+	os.Remove(tmp)
+	if os.IsExist(err) {
+		return ExistErr
+	}
+	return err
+}
+
+func compressTo(p string, r io.Reader) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	if _, err = io.Copy(gz, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (gf *gzipFile) Close() error {
+	gf.Reader.Close()
+	return gf.f.Close()
+}
+
+// Open 打开一个文件，归档的文件会被解压，没有归档的文件原样读取
+func Open(p string) (io.ReadCloser, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(p, Suffix) {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipFile{
+		Reader: gz,
+		f:      f,
+	}, nil
+}
+
+// Extract 把归档目录 src 中的文件解压到 dst，保持相对路径，比如把 binlog 解压后用于恢复
+func Extract(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, Suffix) {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		out := filepath.Join(dst, strings.TrimSuffix(rel, Suffix))
+		if err = os.MkdirAll(filepath.Dir(out), os.ModePerm); err != nil {
+			return err
+		}
+		return extractFile(p, out)
+	})
+}
+
+func extractFile(p, out string) error {
+	r, err := Open(p)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	stat, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(out, stat.ModTime(), stat.ModTime())
+}
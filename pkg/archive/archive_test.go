@@ -0,0 +1,42 @@
+package archive
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirArchiverDoesNotOverwrite(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(t.TempDir(), "0.log")
+	if err := os.WriteFile(src, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a := NewDirArchiver(root)
+	if err := a.Archive(src, "topic/t/1/0.log"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src, []byte("second"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Archive(src, "topic/t/1/0.log"); !errors.Is(err, ExistErr) {
+		t.Fatalf("expect ExistErr, got %v", err)
+	}
+	r, err := Open(filepath.Join(root, "topic", "t", "1", "0.log"+Suffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first" {
+		t.Fatalf("archive is overwritten: %q", data)
+	}
+	if _, err = os.Stat(filepath.Join(root, "topic", "t", "1", "0.log"+Suffix+".tmp")); !os.IsNotExist(err) {
+		t.Fatal("tmp file is left")
+	}
+}
@@ -0,0 +1,63 @@
+package checksum
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+)
+
+// binlog 和 topic 文件中每个块的命令行最后一列是 CRC32C，覆盖该列之前的命令行(不包括4字节长度)和命令行之后的 payload，
+// 老版本写入的块没有该列，读取时不校验
+
+var table = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptBlockErr 块的校验和不一致，可能是磁盘损坏或者写入不完整
+type CorruptBlockErr struct {
+	File   string
+	Offset int64
+}
+
+func (e *CorruptBlockErr) Error() string {
+	return fmt.Sprintf("corrupt block in %s at offset %d", e.File, e.Offset)
+}
+
+func NewCorruptBlockErr(file string, offset int64) error {
+	return &CorruptBlockErr{
+		File:   file,
+		Offset: offset,
+	}
+}
+
+// Sum cmd 是不包含 crc 列的命令行，payload 是命令行之后存储的数据，包括末尾的 \n
+func Sum(cmd []byte, payload ...[]byte) uint32 {
+	crc := crc32.Update(0, table, cmd)
+	for _, p := range payload {
+		crc = crc32.Update(crc, table, p)
+	}
+	return crc
+}
+
+// AppendColumn 在命令行后追加 crc 列，buf 以 4 字节长度开始，不包含末尾的 \n
+func AppendColumn(buf *bytes.Buffer, payload ...[]byte) {
+	crc := Sum(buf.Bytes()[4:], payload...)
+	buf.WriteRune('\t')
+	buf.WriteString(strconv.FormatUint(uint64(crc), 10))
+}
+
+// Verify cmdBuf 是包含末尾 \n 的命令行，最后一列是 crc
+func Verify(cmdBuf []byte, payload []byte) bool {
+	line := cmdBuf
+	if len(line) > 0 && line[len(line)-1] == '\n' {
+		line = line[:len(line)-1]
+	}
+	i := bytes.LastIndexByte(line, '\t')
+	if i < 0 {
+		return false
+	}
+	crc, err := strconv.ParseUint(string(line[i+1:]), 10, 32)
+	if err != nil {
+		return false
+	}
+	return Sum(line[:i], payload) == uint32(crc)
+}
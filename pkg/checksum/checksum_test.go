@@ -0,0 +1,41 @@
+package checksum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestSumIsCRC32C(t *testing.T) {
+	// CRC32C(Castagnoli) 的标准测试向量
+	if crc := Sum([]byte("1234"), []byte("56789")); crc != 0xE3069283 {
+		t.Fatalf("expect 0xE3069283, got %#x", crc)
+	}
+}
+
+func TestVerifyDetectsCorruption(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	buf.WriteString("1\t100\torder\t5")
+	payload := []byte("hello\n")
+	AppendColumn(&buf, payload)
+	binary.LittleEndian.PutUint32(buf.Bytes(), uint32(buf.Len()-4+1))
+	buf.WriteByte('\n')
+	cmdBuf := buf.Bytes()[4:]
+	if !Verify(cmdBuf, payload) {
+		t.Fatal("valid block should pass")
+	}
+	corrupt := append([]byte{}, payload...)
+	corrupt[1] ^= 0xff
+	if Verify(cmdBuf, corrupt) {
+		t.Fatal("corrupt payload should fail")
+	}
+	cmdCorrupt := append([]byte{}, cmdBuf...)
+	cmdCorrupt[0] = '2'
+	if Verify(cmdCorrupt, payload) {
+		t.Fatal("corrupt cmd line should fail")
+	}
+	if Verify([]byte("1\t100\torder\t5\n"), payload) {
+		t.Fatal("cmd line without a matching crc column should fail")
+	}
+}
@@ -0,0 +1,169 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"sync"
+)
+
+// 消息压缩算法，值会写入协议头、binlog 和 topic 文件中，不能修改
+const (
+	None   byte = 0
+	Gzip   byte = 1
+	Snappy byte = 2
+	Zstd   byte = 3
+)
+
+var InvalidCodecErr = errors.New("invalid codec")
+
+// TooLargeErr 解压后的长度超过了限制
+var TooLargeErr = errors.New("decompressed size exceeds limit")
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+
+	// zstdLimited 限制解压长度的 decoder，key 是限制的长度，限制的种类只有全局与各个 topic 的配置，数量很少
+	zstdLimited sync.Map
+)
+
+func Valid(c byte) bool {
+	return c <= Zstd
+}
+
+func Name(c byte) string {
+	switch c {
+	case None:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Snappy:
+		return "snappy"
+	case Zstd:
+		return "zstd"
+	}
+	return "unknown"
+}
+
+func Compress(c byte, src []byte) ([]byte, error) {
+	switch c {
+	case None:
+		return src, nil
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(src); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Snappy:
+		return s2.EncodeSnappy(nil, src), nil
+	case Zstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(src, nil), nil
+	}
+	return nil, InvalidCodecErr
+}
+
+// Decompress maxSize 大于 0 时解压后的长度不能超过 maxSize，否则返回 TooLargeErr，并且不会分配超过 maxSize 太多的内存，
+// 用于解压 client 提交的数据，避免很小的压缩数据解压出巨大的内容
+func Decompress(c byte, src []byte, maxSize int64) ([]byte, error) {
+	switch c {
+	case None:
+		if maxSize > 0 && int64(len(src)) > maxSize {
+			return nil, TooLargeErr
+		}
+		return src, nil
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		if maxSize <= 0 {
+			return io.ReadAll(r)
+		}
+		raw, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(raw)) > maxSize {
+			return nil, TooLargeErr
+		}
+		return raw, nil
+	case Snappy:
+		if maxSize > 0 {
+			// snappy 的数据以解压后的长度开头
+			size, err := s2.DecodedLen(src)
+			if err != nil {
+				return nil, err
+			}
+			if int64(size) > maxSize {
+				return nil, TooLargeErr
+			}
+		}
+		return s2.Decode(nil, src)
+	case Zstd:
+		dec, err := zstdDecoderOf(maxSize)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := dec.DecodeAll(src, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return nil, TooLargeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		if maxSize > 0 && int64(len(raw)) > maxSize {
+			return nil, TooLargeErr
+		}
+		return raw, nil
+	}
+	return nil, InvalidCodecErr
+}
+
+// zstdDecoderOf 返回解压长度不超过 maxSize 的 decoder，帧头中有原始长度时不需要解压就能拒绝，否则解压超过限制时停止
+func zstdDecoderOf(maxSize int64) (*zstd.Decoder, error) {
+	if err := initZstd(); err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 {
+		return zstdDecoder, nil
+	}
+	if dec, ok := zstdLimited.Load(maxSize); ok {
+		return dec.(*zstd.Decoder), nil
+	}
+	// zstd 的窗口最小是 MinWindowSize，限制更小时 decoder 按 MinWindowSize 限制，解压后再检查长度
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(max(maxSize, zstd.MinWindowSize))))
+	if err != nil {
+		return nil, err
+	}
+	if actual, loaded := zstdLimited.LoadOrStore(maxSize, dec); loaded {
+		dec.Close()
+		return actual.(*zstd.Decoder), nil
+	}
+	return dec, nil
+}
+
+// initZstd zstd 的 EncodeAll/DecodeAll 可以并发使用，全局共享一份
+func initZstd() error {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
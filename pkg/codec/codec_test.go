@@ -0,0 +1,66 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	src := bytes.Repeat([]byte(`{"id":1,"name":"order"}`), 100)
+	for _, c := range []byte{None, Gzip, Snappy, Zstd} {
+		compressed, err := Compress(c, src)
+		if err != nil {
+			t.Fatalf("%s: %v", Name(c), err)
+		}
+		raw, err := Decompress(c, compressed, 0)
+		if err != nil || !bytes.Equal(raw, src) {
+			t.Fatalf("%s: round trip err:%v", Name(c), err)
+		}
+	}
+	if _, err := Compress(Zstd+1, src); err != InvalidCodecErr {
+		t.Fatalf("expect InvalidCodecErr, got %v", err)
+	}
+	if _, err := Decompress(Zstd+1, src, 0); err != InvalidCodecErr {
+		t.Fatalf("expect InvalidCodecErr, got %v", err)
+	}
+}
+
+// TestDecompressLimit 解压后超过 maxSize 时返回 TooLargeErr，等于 maxSize 时正常返回，0 表示不限制
+func TestDecompressLimit(t *testing.T) {
+	src := bytes.Repeat([]byte("abcdefgh"), 512)
+	// 很小的压缩数据解压出 16MB
+	bomb := make([]byte, 16<<20)
+	for _, c := range []byte{None, Gzip, Snappy, Zstd} {
+		for _, tc := range []struct {
+			name    string
+			src     []byte
+			maxSize int64
+			err     error
+		}{
+			{"unlimited", src, 0, nil},
+			{"equal to limit", src, int64(len(src)), nil},
+			{"above limit", src, int64(len(src)) - 1, TooLargeErr},
+			{"bomb", bomb, 1 << 20, TooLargeErr},
+		} {
+			compressed, err := Compress(c, tc.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := Decompress(c, compressed, tc.maxSize)
+			if err != tc.err {
+				t.Fatalf("%s %s: expect %v, got %v", Name(c), tc.name, tc.err, err)
+			}
+			if err == nil && !bytes.Equal(raw, tc.src) {
+				t.Fatalf("%s %s: content mismatch", Name(c), tc.name)
+			}
+		}
+	}
+}
+
+func TestDecompressCorruptData(t *testing.T) {
+	for _, c := range []byte{Gzip, Snappy, Zstd} {
+		if _, err := Decompress(c, []byte("not compressed data"), 1024); err == nil || err == TooLargeErr {
+			t.Fatalf("%s: expect decode error, got %v", Name(c), err)
+		}
+	}
+}
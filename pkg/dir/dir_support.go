@@ -4,7 +4,9 @@ import (
 	"errors"
 	"github.com/rolandhe/smss/pkg/logger"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 func EnsurePathExist(p string) error {
@@ -61,3 +63,19 @@ func NewBizError(msg string) error {
 		message: msg,
 	}
 }
+
+// ResolveUnder 把网络上传来的相对路径解析到 base 目录下，拒绝绝对路径以及包含 .. 的路径
+func ResolveUnder(base, name string) (string, error) {
+	if base == "" {
+		return "", NewBizError("base dir is not configured")
+	}
+	if !filepath.IsLocal(name) {
+		return "", NewBizError("path must be relative: " + name)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(name), "/") {
+		if elem == ".." {
+			return "", NewBizError("path must not contain ..: " + name)
+		}
+	}
+	return filepath.Join(base, name), nil
+}
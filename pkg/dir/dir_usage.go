@@ -0,0 +1,37 @@
+package dir
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// FreeSpaceUnsupportedErr 当前平台无法获取文件系统的剩余空间
+var FreeSpaceUnsupportedErr = errors.New("free space not supported")
+
+// DirSize p 目录下所有文件实际占用的磁盘空间之和，badger 预分配的稀疏文件按实际分配的块计算，扫描过程中被删除的文件忽略
+func DirSize(p string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		size += diskUsage(info)
+		return nil
+	})
+	return size, err
+}
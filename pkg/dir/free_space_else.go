@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package dir
+
+import "io/fs"
+
+// FreeSpace 当前平台不支持，调用方需要忽略剩余空间的检查
+func FreeSpace(p string) (int64, error) {
+	return 0, FreeSpaceUnsupportedErr
+}
+
+func diskUsage(info fs.FileInfo) int64 {
+	return info.Size()
+}
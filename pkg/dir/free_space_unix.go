@@ -0,0 +1,24 @@
+//go:build linux || darwin
+
+package dir
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// FreeSpace p 所在文件系统中非 root 用户可用的字节数
+func FreeSpace(p string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(p, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+func diskUsage(info fs.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512
+	}
+	return info.Size()
+}
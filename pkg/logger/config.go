@@ -66,6 +66,11 @@ func InitLogger(ppath string) {
 	core = zap.New(ccore, zap.AddCaller()).Sugar()
 }
 
+// Initialized 是否已经调用过 InitLogger
+func Initialized() bool {
+	return core != nil
+}
+
 func Sync() {
 	if core != nil {
 		core.Sync()
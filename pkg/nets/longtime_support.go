@@ -69,7 +69,7 @@ func LongTimeRun[T any](conn net.Conn, biz, tid string, ackTimeout, writeTimeout
 		var msgs []*T
 		msgs, err = reader.Read(clientClosedNotify)
 
-		if logCounter%conf.LogSample == 0 {
+		if sample := conf.LogSample.Load(); sample > 0 && logCounter%sample == 0 {
 			logger.Infof("tid=%s,after-sub-read,err:%v", tid, err)
 		}
 		logCounter++
@@ -124,6 +124,10 @@ func LongTimeRun[T any](conn net.Conn, biz, tid string, ackTimeout, writeTimeout
 			logger.Infof("tid=%s,PeerClosedErr:%v", tid, err)
 			return err
 		}
+		if errors.Is(err, standard.ServerShutdownErr) {
+			logger.Infof("tid=%s,ServerShutdownErr:%v", tid, err)
+			return OutShutdown(conn, writeTimeout)
+		}
 		if errors.Is(err, standard.TopicWriterTermiteErr) {
 			logger.Infof("tid=%s,TopicWriterTermiteErr:%v", tid, err)
 			return OutSubEnd(conn, writeTimeout)
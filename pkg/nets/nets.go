@@ -30,6 +30,21 @@ func ReadAll(conn net.Conn, buff []byte, timeout time.Duration) error {
 	return nil
 }
 
+// ReadFull 与 ReadAll 相同，但是返回已经读取的字节数，超时时调用者保留已经读取的部分，下次从 buff[n:] 继续读取，
+// 用于以超时轮询的方式读取定长的帧，避免丢弃读了一半的帧
+func ReadFull(conn net.Conn, buff []byte, timeout time.Duration) (int, error) {
+	all := 0
+	for all < len(buff) {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buff[all:])
+		all += n
+		if err != nil {
+			return all, err
+		}
+	}
+	return all, nil
+}
+
 func WriteAll(conn net.Conn, buf []byte, timeout time.Duration) error {
 	for {
 		l := len(buf)
@@ -46,8 +61,19 @@ func WriteAll(conn net.Conn, buf []byte, timeout time.Duration) error {
 }
 
 func OutputRecoverErr(conn net.Conn, errMsg string, timeout time.Duration) error {
+	return OutputRecoverErrWithSeq(conn, errMsg, 0, timeout)
+}
+
+// OutputRecoverErrWithSeq 输出错误，header 的 [6:10] 带回 pipelined 请求的 seq
+func OutputRecoverErrWithSeq(conn net.Conn, errMsg string, seq uint32, timeout time.Duration) error {
+	return OutputErrCodeWithSeq(conn, protocol.ErrCode, errMsg, seq, timeout)
+}
+
+// OutputErrCodeWithSeq 使用指定的响应码输出错误，格式与 ErrCode 相同
+func OutputErrCodeWithSeq(conn net.Conn, code uint16, errMsg string, seq uint32, timeout time.Duration) error {
 	buf := make([]byte, protocol.RespHeaderSize)
-	binary.LittleEndian.PutUint16(buf, protocol.ErrCode)
+	binary.LittleEndian.PutUint16(buf, code)
+	binary.LittleEndian.PutUint32(buf[6:], seq)
 	l := len(errMsg)
 	binary.LittleEndian.PutUint16(buf[2:], uint16(l))
 	buf = append(buf, []byte(errMsg)...)
@@ -59,9 +85,46 @@ func OutputRecoverErr(conn net.Conn, errMsg string, timeout time.Duration) error
 	return nil
 }
 
+// OutputRateLimitedWithSeq 输出 RateLimitedCode，header 的 [4:6] 是重试等待的毫秒数，最大 65535
+func OutputRateLimitedWithSeq(conn net.Conn, errMsg string, retryAfterMs int64, seq uint32, timeout time.Duration) error {
+	buf := make([]byte, protocol.RespHeaderSize)
+	binary.LittleEndian.PutUint16(buf, protocol.RateLimitedCode)
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(errMsg)))
+	binary.LittleEndian.PutUint16(buf[4:], uint16(min(retryAfterMs, 65535)))
+	binary.LittleEndian.PutUint32(buf[6:], seq)
+	buf = append(buf, []byte(errMsg)...)
+
+	if err := WriteAll(conn, buf, timeout); err != nil {
+		logger.Infof("outputRateLimited,write to conn err,%v", err)
+		return err
+	}
+	return nil
+}
+
+// OutputRedirectWithSeq 输出 master 的地址，client 需要把请求发送到 master
+func OutputRedirectWithSeq(conn net.Conn, masterAddr string, seq uint32, timeout time.Duration) error {
+	buf := make([]byte, protocol.RespHeaderSize)
+	binary.LittleEndian.PutUint16(buf, protocol.RedirectCode)
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(masterAddr)))
+	binary.LittleEndian.PutUint32(buf[6:], seq)
+	buf = append(buf, []byte(masterAddr)...)
+
+	if err := WriteAll(conn, buf, timeout); err != nil {
+		logger.Infof("outputRedirect,write to redirect conn err,%v", err)
+		return err
+	}
+	return nil
+}
+
 func OutputOk(conn net.Conn, timeout time.Duration) error {
+	return OutputOkWithSeq(conn, 0, timeout)
+}
+
+// OutputOkWithSeq 输出成功，header 的 [6:10] 带回 pipelined 请求的 seq
+func OutputOkWithSeq(conn net.Conn, seq uint32, timeout time.Duration) error {
 	buf := make([]byte, protocol.RespHeaderSize)
 	binary.LittleEndian.PutUint16(buf, protocol.OkCode)
+	binary.LittleEndian.PutUint32(buf[6:], seq)
 	if err := WriteAll(conn, buf, timeout); err != nil {
 		logger.Infof("outputRecoverErr,write code to conn err,%v", err)
 		return err
@@ -69,6 +132,20 @@ func OutputOk(conn net.Conn, timeout time.Duration) error {
 	return nil
 }
 
+// OutputOkEventIdWithSeq 输出成功并带回 eventId，header 的 [2:6] 是后面 eventId 的长度，[6:10] 是 seq
+func OutputOkEventIdWithSeq(conn net.Conn, eventId int64, seq uint32, timeout time.Duration) error {
+	buf := make([]byte, protocol.RespHeaderSize+8)
+	binary.LittleEndian.PutUint16(buf, protocol.OkCode)
+	binary.LittleEndian.PutUint32(buf[2:], 8)
+	binary.LittleEndian.PutUint32(buf[6:], seq)
+	binary.LittleEndian.PutUint64(buf[protocol.RespHeaderSize:], uint64(eventId))
+	if err := WriteAll(conn, buf, timeout); err != nil {
+		logger.Infof("outputOkEventId,write to conn err,%v", err)
+		return err
+	}
+	return nil
+}
+
 func OutAlive(conn net.Conn, timeout time.Duration) error {
 	buf := make([]byte, protocol.RespHeaderSize)
 	binary.LittleEndian.PutUint16(buf, protocol.AliveCode)
@@ -81,6 +158,12 @@ func OutSubEnd(conn net.Conn, timeout time.Duration) error {
 	return WriteAll(conn, buf, timeout)
 }
 
+func OutShutdown(conn net.Conn, timeout time.Duration) error {
+	buf := make([]byte, protocol.RespHeaderSize)
+	binary.LittleEndian.PutUint16(buf, protocol.ShutdownCode)
+	return WriteAll(conn, buf, timeout)
+}
+
 func InputAck(conn net.Conn, timeout time.Duration) (int, error) {
 	buf := make([]byte, 2)
 	if err := ReadAll(conn, buf, timeout); err != nil {
@@ -99,3 +182,13 @@ func IsTimeoutError(err error) bool {
 	}
 	return false
 }
+
+// RemoteIp 连接对端的 ip，解析失败时返回完整的地址
+func RemoteIp(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
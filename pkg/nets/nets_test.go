@@ -0,0 +1,41 @@
+package nets
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadFullKeepsPartialFrameOnTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		client.Write([]byte{1, 2, 3})
+		time.Sleep(time.Millisecond * 100)
+		client.Write([]byte{4, 5, 6, 7, 8})
+	}()
+
+	buf := make([]byte, 8)
+	filled := 0
+	timeouts := 0
+	for filled < len(buf) {
+		n, err := ReadFull(server, buf[filled:], time.Millisecond*20)
+		filled += n
+		if err != nil {
+			if !IsTimeoutError(err) {
+				t.Fatal(err)
+			}
+			timeouts++
+		}
+	}
+	if timeouts == 0 {
+		t.Fatal("expect at least one timeout between the two writes")
+	}
+	for i, b := range buf {
+		if b != byte(i+1) {
+			t.Fatalf("frame misaligned: %v", buf)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package ratelimit
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 令牌桶限流，每个名称(topic 或者 client)一组桶，分别限制每秒的消息数与字节数，桶的容量是 1 秒的量。
+// 名称为 DefaultName 的限制作用于所有没有单独配置的名称，每个名称各自计数
+
+// DefaultName 默认限制的名称
+const DefaultName = "*"
+
+// maxIdleBuckets 使用默认限制的桶超过该数量时，清理已经装满的桶
+const maxIdleBuckets = 4096
+
+var InvalidRuleErr = errors.New("invalid rate limit rule, format is name:msgsPerSecond:bytesPerSecond")
+
+// Limit 每秒的消息数与字节数，0 表示不限制
+type Limit struct {
+	Msgs  int64 `json:"msgs"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (l Limit) unlimited() bool {
+	return l.Msgs <= 0 && l.Bytes <= 0
+}
+
+// ParseRule 解析配置中的规则 name:msgs:bytes，name 可能包含冒号，从右边解析
+func ParseRule(rule string) (string, Limit, error) {
+	items := strings.Split(rule, ":")
+	if len(items) < 3 {
+		return "", Limit{}, InvalidRuleErr
+	}
+	l := len(items)
+	msgs, err := strconv.ParseInt(items[l-2], 10, 64)
+	if err != nil {
+		return "", Limit{}, InvalidRuleErr
+	}
+	bytes, err := strconv.ParseInt(items[l-1], 10, 64)
+	if err != nil {
+		return "", Limit{}, InvalidRuleErr
+	}
+	name := strings.Join(items[:l-2], ":")
+	if name == "" {
+		return "", Limit{}, InvalidRuleErr
+	}
+	return name, Limit{Msgs: msgs, Bytes: bytes}, nil
+}
+
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64, now time.Time) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   now,
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+		b.last = now
+	}
+}
+
+// wait 取走 n 个令牌需要等待的时间，超过桶容量的请求只需要等到桶满
+func (b *bucket) wait(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	if n > b.rate {
+		n = b.rate
+	}
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take 令牌可以为负，等待的请求提前取走令牌，后面的请求需要等待更久
+func (b *bucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+func (b *bucket) full() bool {
+	return b == nil || b.tokens >= b.rate
+}
+
+type buckets struct {
+	msgs  *bucket
+	bytes *bucket
+}
+
+// Limiter 一组名称的限流，不是并发安全的，调用方需要加锁
+type Limiter struct {
+	limits  map[string]Limit
+	buckets map[string]*buckets
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		limits:  map[string]Limit{},
+		buckets: map[string]*buckets{},
+	}
+}
+
+// Set 修改 name 的限制，已有的计数被重置
+func (l *Limiter) Set(name string, limit Limit) {
+	l.limits[name] = limit
+	l.reset(name)
+}
+
+func (l *Limiter) Delete(name string) {
+	delete(l.limits, name)
+	l.reset(name)
+}
+
+// Limits 当前所有的限制
+func (l *Limiter) Limits() map[string]Limit {
+	ret := make(map[string]Limit, len(l.limits))
+	for k, v := range l.limits {
+		ret[k] = v
+	}
+	return ret
+}
+
+func (l *Limiter) reset(name string) {
+	if name != DefaultName {
+		delete(l.buckets, name)
+		return
+	}
+	for k := range l.buckets {
+		if _, ok := l.limits[k]; !ok {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Wait name 发送 msgs 条、共 bytes 字节的消息需要等待的时间，不取走令牌
+func (l *Limiter) Wait(name string, msgs, bytes int64, now time.Time) time.Duration {
+	b := l.get(name, now)
+	if b == nil {
+		return 0
+	}
+	return max(b.msgs.wait(float64(msgs), now), b.bytes.wait(float64(bytes), now))
+}
+
+// Take 取走令牌，需要先调用 Wait
+func (l *Limiter) Take(name string, msgs, bytes int64) {
+	if b := l.buckets[name]; b != nil {
+		b.msgs.take(float64(msgs))
+		b.bytes.take(float64(bytes))
+	}
+}
+
+func (l *Limiter) get(name string, now time.Time) *buckets {
+	if b, ok := l.buckets[name]; ok {
+		return b
+	}
+	limit, ok := l.limits[name]
+	if !ok {
+		if limit, ok = l.limits[DefaultName]; !ok {
+			return nil
+		}
+	}
+	if limit.unlimited() {
+		return nil
+	}
+	if len(l.buckets) >= maxIdleBuckets {
+		l.prune(now)
+	}
+	b := &buckets{
+		msgs:  newBucket(limit.Msgs, now),
+		bytes: newBucket(limit.Bytes, now),
+	}
+	l.buckets[name] = b
+	return b
+}
+
+// prune 已经装满的桶与新建的桶没有区别，可以删除
+func (l *Limiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if b.msgs != nil {
+			b.msgs.refill(now)
+		}
+		if b.bytes != nil {
+			b.bytes.refill(now)
+		}
+		if b.msgs.full() && b.bytes.full() {
+			delete(l.buckets, k)
+		}
+	}
+}
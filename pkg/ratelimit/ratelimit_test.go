@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseRule(t *testing.T) {
+	for _, tc := range []struct {
+		rule  string
+		name  string
+		limit Limit
+		err   error
+	}{
+		{"order:100:1024", "order", Limit{Msgs: 100, Bytes: 1024}, nil},
+		{"*:10:0", DefaultName, Limit{Msgs: 10}, nil},
+		{"::1:0:2048", "::1", Limit{Bytes: 2048}, nil},
+		{"order:100", "", Limit{}, InvalidRuleErr},
+		{":100:1024", "", Limit{}, InvalidRuleErr},
+		{"order:x:1024", "", Limit{}, InvalidRuleErr},
+		{"order:100:y", "", Limit{}, InvalidRuleErr},
+	} {
+		name, limit, err := ParseRule(tc.rule)
+		if name != tc.name || limit != tc.limit || err != tc.err {
+			t.Fatalf("%s: got %s %+v %v, expect %s %+v %v", tc.rule, name, limit, err, tc.name, tc.limit, tc.err)
+		}
+	}
+}
+
+// TestLimiterRefill 桶的容量是 1 秒的量，按时间补充令牌，令牌不足时返回需要等待的时间，超过容量的请求只需要等到桶满
+func TestLimiterRefill(t *testing.T) {
+	start := time.Now()
+	l := NewLimiter()
+	l.Set("order", Limit{Msgs: 10, Bytes: 1000})
+	for i, step := range []struct {
+		name    string
+		elapsed time.Duration
+		msgs    int64
+		bytes   int64
+		take    bool
+		wait    time.Duration
+	}{
+		{"full bucket", 0, 10, 800, true, 0},
+		{"msgs used up", 0, 1, 0, false, time.Millisecond * 100},
+		{"half refilled", time.Millisecond * 500, 5, 0, false, 0},
+		{"bytes limit", time.Millisecond * 500, 1, 1000, false, time.Millisecond * 300},
+		{"larger than bucket waits until full", time.Millisecond * 500, 20, 0, true, time.Millisecond * 500},
+		{"negative tokens after take", time.Millisecond * 500, 1, 0, false, time.Millisecond * 1600},
+		{"refill never exceeds bucket", time.Second * 10, 10, 1000, false, 0},
+	} {
+		now := start.Add(step.elapsed)
+		wait := l.Wait("order", step.msgs, step.bytes, now)
+		if diff := wait - step.wait; diff > time.Millisecond || diff < -time.Millisecond {
+			t.Fatalf("step %d %s: wait %v, expect %v", i, step.name, wait, step.wait)
+		}
+		if step.take {
+			l.Take("order", step.msgs, step.bytes)
+		}
+	}
+}
+
+// TestLimiterDefaultNameKeys 没有单独配置的名称使用默认限制，每个名称各自计数；单独配置的名称不受默认限制影响
+func TestLimiterDefaultNameKeys(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter()
+	l.Set(DefaultName, Limit{Msgs: 1})
+	l.Set("10.0.0.9", Limit{})
+	for _, name := range []string{"10.0.0.1", "10.0.0.2"} {
+		if wait := l.Wait(name, 1, 0, now); wait != 0 {
+			t.Fatalf("%s should have its own bucket, wait %v", name, wait)
+		}
+		l.Take(name, 1, 0)
+	}
+	if wait := l.Wait("10.0.0.1", 1, 0, now); wait != time.Second {
+		t.Fatalf("10.0.0.1 used up its bucket, wait %v", wait)
+	}
+	for i := 0; i < 3; i++ {
+		if wait := l.Wait("10.0.0.9", 1, 0, now); wait != 0 {
+			t.Fatalf("unlimited name should not wait, got %v", wait)
+		}
+		l.Take("10.0.0.9", 1, 0)
+	}
+
+	// 修改默认限制后没有单独配置的名称重新计数
+	l.Set(DefaultName, Limit{Msgs: 2})
+	if wait := l.Wait("10.0.0.1", 2, 0, now); wait != 0 {
+		t.Fatalf("bucket should be reset after the default limit changes, wait %v", wait)
+	}
+	l.Delete(DefaultName)
+	if wait := l.Wait("10.0.0.3", 100, 0, now); wait != 0 {
+		t.Fatalf("no limit after the default is deleted, wait %v", wait)
+	}
+}
+
+// TestLimiterPruneFullBuckets 使用默认限制的桶过多时，删除已经装满的桶
+func TestLimiterPruneFullBuckets(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter()
+	l.Set(DefaultName, Limit{Msgs: 1})
+	l.Wait("busy", 1, 0, now)
+	l.Take("busy", 1, 0)
+	for i := 0; len(l.buckets) < maxIdleBuckets; i++ {
+		l.Wait(fmt.Sprintf("idle-%d", i), 1, 0, now)
+	}
+	l.Wait("new", 1, 0, now.Add(time.Millisecond*10))
+	if len(l.buckets) != 2 || l.buckets["busy"] == nil || l.buckets["new"] == nil {
+		t.Fatalf("only full buckets should be pruned, left %d", len(l.buckets))
+	}
+}
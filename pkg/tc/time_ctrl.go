@@ -18,6 +18,7 @@ func NewTimeTriggerControl(fstore store.Store, name string, firstRunDelayMs int6
 	}
 	return &TimeTriggerControl{
 		quickAlive: make(chan struct{}, 1),
+		quit:       make(chan struct{}),
 		recent:     time.Now().UnixMilli() + firstRunDelayMs,
 		fstore:     fstore,
 		doBiz:      doBiz,
@@ -28,6 +29,8 @@ func NewTimeTriggerControl(fstore store.Store, name string, firstRunDelayMs int6
 type TimeTriggerControl struct {
 	sync.Mutex
 	quickAlive chan struct{}
+	quit       chan struct{}
+	stopOnce   sync.Once
 	recent     int64
 	fstore     store.Store
 
@@ -77,8 +80,29 @@ func (lc *TimeTriggerControl) dry() {
 
 	}
 }
+
+// Stop 停止 Process, 正在执行的 doBiz 会执行完
+func (lc *TimeTriggerControl) Stop() {
+	lc.stopOnce.Do(func() {
+		close(lc.quit)
+	})
+}
+
+func (lc *TimeTriggerControl) isStopped() bool {
+	select {
+	case <-lc.quit:
+		return true
+	default:
+		return false
+	}
+}
+
 func (lc *TimeTriggerControl) Process() {
 	for {
+		if lc.isStopped() {
+			logger.Infof("%s, stopped", lc.name)
+			return
+		}
 		waitDurationMs, currentRecent := lc.since()
 		if waitDurationMs == 0 {
 			logger.Infof("%s, immediate to doBiz", lc.name)
@@ -116,6 +140,8 @@ func (lc *TimeTriggerControl) waitNext(waitTimeMs int64) bool {
 	select {
 	case <-lc.quickAlive:
 		return true
+	case <-lc.quit:
+		return true
 	case <-timer.C:
 		return false
 	}
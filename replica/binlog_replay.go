@@ -0,0 +1,45 @@
+package replica
+
+import (
+	"fmt"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/cmd/repair"
+	"github.com/rolandhe/smss/standard"
+	"github.com/rolandhe/smss/store"
+)
+
+// ReplayBinlog 以 slave 的方式把 binlogRoot 中 eventId 大于 fromEventId 的块写入本地，用于从备份恢复。
+// 按块应用，stop 返回 true 时停止，该块不应用。返回最后应用的块的 eventId
+func ReplayBinlog(binlogRoot string, fromEventId int64, stop func(cmd *protocol.DecodedRawMessage) bool, worker standard.MessageWorking, fstore store.Store) (int64, error) {
+	dw := &dependWorker{
+		MessageWorking: worker,
+		ManagerMeta:    fstore.GetManagerMeta(),
+	}
+	cmdParser := &msgParser{}
+	lastEventId := fromEventId
+	count := int64(0)
+	var applyErr error
+	err := repair.WalkBinlog(binlogRoot, func(cmd *protocol.DecodedRawMessage, block []byte) bool {
+		if cmd.EventId <= fromEventId {
+			return true
+		}
+		if count == 0 && cmd.EventId != fromEventId+1 {
+			applyErr = fmt.Errorf("binlog from eventId %d is missing, the first is %d", fromEventId+1, cmd.EventId)
+			return false
+		}
+		if stop(cmd) {
+			return false
+		}
+		var applied appliedBlock
+		if applied, applyErr = applyBinlog(block, cmdParser, dw, count, nil); applyErr != nil {
+			return false
+		}
+		lastEventId = applied.eventId
+		count++
+		return true
+	})
+	if err == nil {
+		err = applyErr
+	}
+	return lastEventId, err
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/binary"
 	"github.com/rolandhe/smss/binlog"
 	"github.com/rolandhe/smss/cmd/protocol"
-	"github.com/rolandhe/smss/conf"
 	"github.com/rolandhe/smss/pkg/logger"
 	"github.com/rolandhe/smss/standard"
 	"github.com/rolandhe/smss/store"
@@ -13,7 +12,26 @@ import (
 type binlogBlock struct {
 	data   []byte
 	rawMsg *protocol.RawMessage
+	// 块中最后一条消息的 eventId，pub 块包含多条消息
+	lastEventId int64
+	// 块结束的位置，用于计算 slave 落后的字节数
+	fileId int64
+	pos    int64
 }
+
+// blockLastEventId binlog 块中最后一条消息的 eventId，payload 不包括末尾的 \n
+func blockLastEventId(cmd *protocol.DecodedRawMessage, payload []byte) int64 {
+	switch cmd.Command {
+	case protocol.CommandPub:
+		return cmd.EventId + int64(max(protocol.PayloadCount(payload), 1)) - 1
+	case protocol.CommandDelayApply:
+		if len(payload) > 16 {
+			return cmd.EventId + int64(max(protocol.PayloadCount(payload[16:]), 1)) - 1
+		}
+	}
+	return cmd.EventId
+}
+
 type serverBlockReader struct {
 	*standard.StdMsgBlockReader[binlogBlock]
 }
@@ -23,7 +41,7 @@ type serverBinlogBlockReader interface {
 }
 
 func newBlockReader(uuidStr string, walMonitor WalMonitorSupport) serverBinlogBlockReader {
-	r := standard.NewStdMsgBlockReader[binlogBlock]("binlog", walMonitor.GetRoot(), uuidStr, 1, conf.MaxLogSize, &serverRegister{
+	r := standard.NewStdMsgBlockReader[binlogBlock]("binlog", walMonitor.GetRoot(), uuidStr, 1, walMonitor.MaxLogSize(), &serverRegister{
 		walMonitor: walMonitor,
 		uuid:       uuidStr,
 	}, &msgParser{})
@@ -48,8 +66,11 @@ func (p *msgParser) ToMessage(payload []byte, fileId, pos int64) *binlogBlock {
 	copy(tmp, payload)
 
 	return &binlogBlock{
-		data:   buf,
-		rawMsg: &p.cmd.RawMessage,
+		data:        buf,
+		rawMsg:      &p.cmd.RawMessage,
+		lastEventId: blockLastEventId(p.cmd, payload[:max(len(payload)-1, 0)]),
+		fileId:      fileId,
+		pos:         pos,
 	}
 }
 func (p *msgParser) Reset() {
@@ -58,7 +79,8 @@ func (p *msgParser) Reset() {
 }
 
 func (p *msgParser) ChangeMessagePos(ins *binlogBlock, fileId, pos int64) {
-
+	ins.fileId = fileId
+	ins.pos = pos
 }
 func (p *msgParser) ParseCmd(cmdBuf []byte) (standard.CmdLine, error) {
 	p.cmdBuf = cmdBuf
@@ -82,6 +104,9 @@ func (c *binlogCmd) GetCmd() protocol.CommandEnum {
 func (c *binlogCmd) GetId() int64 {
 	return c.cmd.EventId
 }
+func (c *binlogCmd) HasChecksum() bool {
+	return c.cmd.HasChecksum
+}
 
 type serverRegister struct {
 	walMonitor WalMonitorSupport
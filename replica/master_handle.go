@@ -18,26 +18,51 @@ import (
 
 const BinlogOutTimeout = time.Second * 120
 
+// skipFrameInterval 连续跳过块时输出 SkipCode 的最小间隔
+const skipFrameInterval = time.Second
+
+// SlaveDivergedErr slave 的 binlog 中有 master 没有的数据，比如失去租约的 master 在切换前接收的发布，
+// 这样的 slave 不能继续复制，需要清空数据后作为新的 slave 通过快照重建
+var SlaveDivergedErr = errors.New("slave binlog diverged from master")
+
 type WalMonitorSupport interface {
 	GetRoot() string
+	MaxLogSize() int64
 	standard.LogFileControl
 }
 
-func getFilePosByEventId(root string, eventId int64, lastFileId int64) (int64, int64, error) {
+// getFilePosByEventId baseEventId 是本实例通过快照初始化时快照的 eventId，本地 binlog 从它的下一个开始，没有快照时是 0。
+// slaveWriteTime 不为 0 时与 eventId 所在块的写入时间比较，不一致说明 slave 的 binlog 已经分叉
+func getFilePosByEventId(root string, eventId int64, slaveWriteTime int64, baseEventId int64, lastFileId int64) (int64, int64, error) {
 	var fileId int64
 	var err error
-	if eventId == 0 {
+	if eventId < baseEventId {
+		return 0, 0, repair.EventIdExpiredErr
+	}
+	if eventId == baseEventId {
 		fileId, err = standard.ReadFirstFileId(root, lastFileId)
 		if err != nil {
 			return 0, 0, err
 		}
+		// 最早的 binlog 已经删除或者过期，从头复制会丢失数据，新的 slave 需要先加载快照
+		if fileId != 0 {
+			return 0, 0, repair.EventIdExpiredErr
+		}
 		return fileId, 0, nil
 	}
 
-	return repair.FindBinlogPosByEventId(root, eventId, lastFileId)
+	fileId, pos, writeTime, err := repair.FindBinlogBlockByEventId(root, eventId, lastFileId)
+	if err != nil {
+		return 0, 0, err
+	}
+	if slaveWriteTime != 0 && writeTime != 0 && slaveWriteTime != writeTime {
+		return 0, 0, SlaveDivergedErr
+	}
+	return fileId, pos, nil
 }
 
-func MasterHandle(conn net.Conn, header *protocol.CommonHeader, walMonitor WalMonitorSupport, readTimeout, writeTimeout time.Duration) error {
+// MasterHandle 向 slave 输出 binlog，masterEventId 是本实例最新的 eventId，slave 的 eventId 比它大时说明 slave 的 binlog 已经分叉
+func (r *Replication) MasterHandle(conn net.Conn, header *protocol.CommonHeader, walMonitor WalMonitorSupport, baseEventId, masterEventId int64, readTimeout, writeTimeout time.Duration) error {
 	buf := make([]byte, 8)
 	err := nets.ReadAll(conn, buf, readTimeout)
 	if err != nil {
@@ -49,39 +74,87 @@ func MasterHandle(conn net.Conn, header *protocol.CommonHeader, walMonitor WalMo
 		logger.Infof("tid=%s,replca server,eventId=%d, event id must >=", header.TraceId, lastEventId)
 		return nets.OutputRecoverErr(conn, "invalid replica eventId", writeTimeout)
 	}
+	filter, err := readTopicFilter(conn, header, readTimeout)
+	if err != nil {
+		logger.Infof("tid=%s,replica server,eventId=%d, read filter err:%v", header.TraceId, lastEventId, err)
+		return nets.OutputRecoverErr(conn, "invalid replica filter", writeTimeout)
+	}
+	if lastEventId > masterEventId {
+		logger.Infof("tid=%s,replica server,slave eventId=%d is ahead of master %d", header.TraceId, lastEventId, masterEventId)
+		return nets.OutputRecoverErr(conn, SlaveDivergedErr.Error(), writeTimeout)
+	}
+	slaveWriteTime := (&protocol.ReplicaHeader{CommonHeader: header}).GetLastWriteTime()
 
 	uuidStr := uuid.NewString()
 
 	reader := newBlockReader(uuidStr, walMonitor)
 
+	var startFileId, startPos int64
 	if err = reader.Init(func(lastFileId int64) (int64, int64, error) {
-		return getFilePosByEventId(walMonitor.GetRoot(), lastEventId, lastFileId)
+		fileId, pos, e := getFilePosByEventId(walMonitor.GetRoot(), lastEventId, slaveWriteTime, baseEventId, lastFileId)
+		startFileId, startPos = fileId, pos
+		return fileId, pos, e
 	}); err != nil {
 		logger.Infof("tid=%s,replica server,eventId=%d, init error:%v", header.TraceId, lastEventId, err)
 		return nets.OutputRecoverErr(conn, err.Error(), writeTimeout)
 	}
 
-	err = noAckPush(conn, header.TraceId, reader)
+	session := newSlaveSession(uuidStr, conn.RemoteAddr().String(), startFileId, startPos)
+	if !filter.IsEmpty() {
+		session.filter = filter
+	}
+	r.semiSync.register(session)
+	defer r.semiSync.unRegister(uuidStr)
+
+	err = noAckPush(conn, header.TraceId, uuidStr, reader, filter, r.semiSync)
 	if err != nil {
 		logger.Infof("master handle finish,eventId=%d, err:%v", lastEventId, err)
 	}
 	return err
 }
 
-func noAckPush(conn net.Conn, tid string, reader serverBinlogBlockReader) error {
+// readTopicFilter 读取 slave 的 topic 过滤条件，老版本的 slave 没有过滤条件
+func readTopicFilter(conn net.Conn, header *protocol.CommonHeader, readTimeout time.Duration) (*TopicFilter, error) {
+	rHeader := &protocol.ReplicaHeader{
+		CommonHeader: header,
+	}
+	size := rHeader.GetFilterSize()
+	if size == 0 {
+		return nil, nil
+	}
+	if size > 64*1024 {
+		return nil, errors.New("filter too large")
+	}
+	buf := make([]byte, size)
+	if err := nets.ReadAll(conn, buf, readTimeout); err != nil {
+		return nil, err
+	}
+	return parseTopicFilter(buf)
+}
+
+func noAckPush(conn net.Conn, tid string, slaveId string, reader serverBinlogBlockReader, filter *TopicFilter, semiSync *semiSyncControl) error {
 	var err error
 
 	clientClosedNotify := &store.ClientClosedNotifyEquipment{
 		ClientClosedNotifyChan: make(chan struct{}),
 	}
 
-	go peerCloseMonitor(conn, clientClosedNotify, tid)
+	go peerCloseMonitor(conn, clientClosedNotify, tid, slaveId, semiSync)
 	defer func() {
 		reader.Close()
 		clientClosedNotify.ClientClosedFlag.Store(true)
 	}()
 	count := int64(0)
 	totalCost := int64(0)
+	// skipped 最后一个跳过并且还没有通知 slave 的块
+	var skipped *binlogBlock
+	var lastSkipFrame time.Time
+	outSkip := func() error {
+		err := writeAllWithTotalTimeout(conn, skipFrame(skipped), BinlogOutTimeout, &clientClosedNotify.ClientClosedFlag)
+		skipped = nil
+		lastSkipFrame = time.Now()
+		return err
+	}
 	for {
 		var msgs []*binlogBlock
 		if clientClosedNotify.ClientClosedFlag.Load() {
@@ -89,28 +162,53 @@ func noAckPush(conn net.Conn, tid string, reader serverBinlogBlockReader) error
 		}
 		msgs, err = reader.Read(clientClosedNotify)
 		if err == nil {
-			outBuf := make([]byte, protocol.RespHeaderSize+4+len(msgs[0].data))
-			binary.LittleEndian.PutUint16(outBuf, protocol.OkCode)
-			msgLen := len(msgs[0].data)
-			binary.LittleEndian.PutUint32(outBuf[protocol.RespHeaderSize:], uint32(msgLen))
-			copy(outBuf[protocol.RespHeaderSize+4:], msgs[0].data)
-
 			start := time.Now().UnixMilli()
-			readDelay := start - msgs[0].rawMsg.WriteTime
-
-			if err = writeAllWithTotalTimeout(conn, outBuf, BinlogOutTimeout, &clientClosedNotify.ClientClosedFlag); err != nil {
-				logger.Infof("tid=%s, eventId=%d,err:%v", tid, msgs[0].rawMsg.EventId, err)
-				return err
+			var last *binlogBlock
+			for _, block := range msgs {
+				if !filter.accept(block.rawMsg) {
+					semiSync.skipped(slaveId, block)
+					skipped = block
+					continue
+				}
+				if err = writeAllWithTotalTimeout(conn, blockFrame(block), BinlogOutTimeout, &clientClosedNotify.ClientClosedFlag); err != nil {
+					logger.Infof("tid=%s, eventId=%d,err:%v", tid, block.rawMsg.EventId, err)
+					return err
+				}
+				semiSync.sent(slaveId, block)
+				skipped = nil
+				last = block
+			}
+			if skipped != nil && time.Since(lastSkipFrame) >= skipFrameInterval {
+				if err = outSkip(); err != nil {
+					logger.Infof("tid=%s,output skip frame err:%v", tid, err)
+					return err
+				}
 			}
-			cost := start - time.Now().UnixMilli()
+			if last == nil {
+				continue
+			}
+			// 延迟按本次发送的最后一个块计算
+			readDelay := start - last.rawMsg.WriteTime
+			cost := time.Now().UnixMilli() - start
 			totalCost += cost
-			if conf.LogSample > 0 && count%conf.LogSample == 0 {
-				logger.Infof("master to slave:tid=%s, eventId=%d,count=%d, delay time=%dms,readDelay=%dms,total cost=%dms", tid, msgs[0].rawMsg.EventId, count, readDelay+cost, readDelay, totalCost)
+			if sample := conf.LogSample.Load(); sample > 0 && count%sample == 0 {
+				logger.Infof("master to slave:tid=%s, eventId=%d,lastEventId=%d,count=%d, delay time=%dms,readDelay=%dms,total cost=%dms", tid, last.rawMsg.EventId, last.lastEventId, count, readDelay+cost, readDelay, totalCost)
 			}
 			count++
 			continue
 		}
+		if errors.Is(err, standard.ServerShutdownErr) {
+			logger.Infof("tid=%s,server shutdown, notify slave", tid)
+			return nets.OutShutdown(conn, BinlogOutTimeout)
+		}
 		if errors.Is(err, standard.WaitNewTimeoutErr) {
+			// 没有新数据时先通知 slave 已经跳过的块，slave 断开后不需要重新读取它们
+			if skipped != nil {
+				if err = outSkip(); err != nil {
+					logger.Infof("tid=%s,output skip frame err:%v", tid, err)
+					return err
+				}
+			}
 			err = nets.OutAlive(conn, BinlogOutTimeout)
 			logger.Infof("tid=%s,sub wait new data timeout, send alive:%v", tid, err)
 			if err != nil {
@@ -123,10 +221,31 @@ func noAckPush(conn net.Conn, tid string, reader serverBinlogBlockReader) error
 	}
 }
 
-func peerCloseMonitor(conn net.Conn, clientClosedNotify *store.ClientClosedNotifyEquipment, tid string) {
-	buf := make([]byte, 20)
+// blockFrame 一个 binlog 块的输出格式：response header + 4字节块长度 + 块
+func blockFrame(block *binlogBlock) []byte {
+	outBuf := make([]byte, protocol.RespHeaderSize+4+len(block.data))
+	binary.LittleEndian.PutUint16(outBuf, protocol.OkCode)
+	binary.LittleEndian.PutUint32(outBuf[protocol.RespHeaderSize:], uint32(len(block.data)))
+	copy(outBuf[protocol.RespHeaderSize+4:], block.data)
+	return outBuf
+}
+
+// skipFrame 跳过块的输出格式：SkipCode 的 response header + 8字节块的 eventId + 8字节块的写入时间
+func skipFrame(block *binlogBlock) []byte {
+	outBuf := make([]byte, protocol.RespHeaderSize+16)
+	binary.LittleEndian.PutUint16(outBuf, protocol.SkipCode)
+	binary.LittleEndian.PutUint64(outBuf[protocol.RespHeaderSize:], uint64(block.rawMsg.EventId))
+	binary.LittleEndian.PutUint64(outBuf[protocol.RespHeaderSize+8:], uint64(block.rawMsg.WriteTime))
+	return outBuf
+}
+
+// peerCloseMonitor 监控slave是否关闭连接，同时读取slave回传的确认，见 ackFrame。读取超时时保留已经读取的部分，避免之后的确认错位
+func peerCloseMonitor(conn net.Conn, clientClosedNotify *store.ClientClosedNotifyEquipment, tid string, slaveId string, semiSync *semiSyncControl) {
+	buf := make([]byte, replicaAckSize)
+	filled := 0
 	for {
-		err := nets.ReadAll(conn, buf, time.Second*5)
+		n, err := nets.ReadFull(conn, buf[filled:], time.Second*5)
+		filled += n
 		if clientClosedNotify.ClientClosedFlag.Load() {
 			break
 		}
@@ -139,6 +258,9 @@ func peerCloseMonitor(conn net.Conn, clientClosedNotify *store.ClientClosedNotif
 			close(clientClosedNotify.ClientClosedNotifyChan)
 			break
 		}
+		filled = 0
+		eventId, ackTime := parseAckFrame(buf)
+		semiSync.ack(slaveId, eventId, ackTime)
 	}
 
 }
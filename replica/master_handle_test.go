@@ -0,0 +1,107 @@
+package replica
+
+import (
+	"encoding/binary"
+	"github.com/rolandhe/smss/binlog"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/nets"
+	"github.com/rolandhe/smss/standard"
+	"github.com/rolandhe/smss/store"
+	"net"
+	"testing"
+	"time"
+)
+
+// batchReader 依次返回 batches，之后返回等待新数据超时
+type batchReader struct {
+	batches [][]*binlogBlock
+}
+
+func (r *batchReader) Read(notify *store.ClientClosedNotifyEquipment) ([]*binlogBlock, error) {
+	if len(r.batches) == 0 {
+		select {
+		case <-notify.ClientClosedNotifyChan:
+			return nil, standard.PeerClosedErr
+		case <-time.After(time.Millisecond * 10):
+			return nil, standard.WaitNewTimeoutErr
+		}
+	}
+	blocks := r.batches[0]
+	r.batches = r.batches[1:]
+	return blocks, nil
+}
+
+func (r *batchReader) Init(func(lastFileId int64) (int64, int64, error)) error {
+	return nil
+}
+
+func (r *batchReader) Close() error {
+	return nil
+}
+
+func topicBlock(eventId int64, topic string) *binlogBlock {
+	block := pubBlock(eventId, 1, eventId*10)
+	block.rawMsg.TopicName = topic
+	block.rawMsg.Body = &protocol.PubPayload{Payload: pubPayload(1)}
+	block.data = binlog.PubEncoder(block.rawMsg).Bytes()
+	return block
+}
+
+func TestMasterNotifiesSkippedBlocksBeforeAlive(t *testing.T) {
+	filter, _ := NewTopicFilter([]string{"order"}, nil)
+	repl := NewReplication(t.TempDir())
+	repl.semiSync.register(newSlaveSession("s1", "addr", 0, 0))
+	reader := &batchReader{batches: [][]*binlogBlock{
+		{topicBlock(3, "user")},
+		{topicBlock(4, "order"), topicBlock(5, "user")},
+		{topicBlock(6, "user")},
+	}}
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		noAckPush(server, "tid", "s1", reader, filter, repl.semiSync)
+		server.Close()
+	}()
+
+	type frame struct {
+		code      int
+		eventId   int64
+		writeTime int64
+	}
+	readFrame := func() frame {
+		header := make([]byte, protocol.RespHeaderSize)
+		if err := nets.ReadAll(client, header, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		f := frame{code: int(binary.LittleEndian.Uint16(header))}
+		switch f.code {
+		case protocol.OkCode:
+			body, err := readPayload(client, make([]byte, 4))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmdLen := binary.LittleEndian.Uint32(body)
+			f.eventId = binlog.CmdDecoder(body[4 : 4+cmdLen]).EventId
+		case protocol.SkipCode:
+			buf := make([]byte, 16)
+			if err := nets.ReadAll(client, buf, time.Second); err != nil {
+				t.Fatal(err)
+			}
+			f.eventId = int64(binary.LittleEndian.Uint64(buf))
+			f.writeTime = int64(binary.LittleEndian.Uint64(buf[8:]))
+		}
+		return f
+	}
+	// 第一次跳过立即通知，之后一秒内跳过的块在输出 AliveCode 之前通知
+	expects := []frame{
+		{protocol.SkipCode, 3, 30},
+		{protocol.OkCode, 4, 0},
+		{protocol.SkipCode, 6, 60},
+		{protocol.AliveCode, 0, 0},
+	}
+	for _, expect := range expects {
+		if f := readFrame(); f != expect {
+			t.Fatalf("expect %+v, got %+v", expect, f)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package replica
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sentBlocksMax 每个slave最多记录多少个已发送未确认的binlog块，老版本的slave不回传确认，超过后丢弃最早的
+const sentBlocksMax = 4096
+
+// ReplicaStatus 复制状态，master 输出已连接的 slave，slave 输出自己的复制进度
+type ReplicaStatus struct {
+	Role   string              `json:"role"`
+	Master *MasterReplicaState `json:"master,omitempty"`
+	Slave  *SlaveReplicaState  `json:"slave,omitempty"`
+}
+
+type MasterReplicaState struct {
+	// master 最新的 eventId
+	LastEventId  int64             `json:"lastEventId"`
+	BinlogFileId int64             `json:"binlogFileId"`
+	BinlogPos    int64             `json:"binlogPos"`
+	Slaves       []*ConnectedSlave `json:"slaves"`
+	SemiSync     *SemiSyncStats    `json:"semiSync"`
+}
+
+// ConnectedSlave master 看到的一个 slave 的复制进度
+type ConnectedSlave struct {
+	Id        string `json:"id"`
+	Addr      string `json:"addr"`
+	StartTime int64  `json:"startTime"`
+	// 已发送给 slave 的最大 eventId，即最后发送的块中最后一条消息的 eventId
+	SentEventId int64 `json:"sentEventId"`
+	// slave 已应用的最大 eventId，老版本的 slave 不回传，一直是 0；老版本的 slave 回传的是块中第一条消息的 eventId
+	AckEventId int64 `json:"ackEventId"`
+	// slave 应用的时间，slave 的时钟
+	ApplyTime int64 `json:"applyTime"`
+	// master 最近一次收到 slave 回传的时间
+	ReportTime  int64 `json:"reportTime"`
+	LagEvents   int64 `json:"lagEvents"`
+	LagMs       int64 `json:"lagMs"`
+	BytesBehind int64 `json:"bytesBehind"`
+	// Filter 只复制部分 topic 的 slave 的过滤条件
+	Filter *TopicFilter `json:"filter,omitempty"`
+}
+
+// SlaveReplicaState slave 自己的复制进度
+type SlaveReplicaState struct {
+	MasterHost string `json:"masterHost"`
+	MasterPort int    `json:"masterPort"`
+	Connected  bool   `json:"connected"`
+	// 已应用的最大 eventId，即最后应用的块中最后一条消息的 eventId
+	LastEventId   int64 `json:"lastEventId"`
+	LastApplyTime int64 `json:"lastApplyTime"`
+	// 最近应用的 binlog 从 master 写入到 slave 应用的延迟
+	LastDelayMs int64 `json:"lastDelayMs"`
+	// 落后 master 的时间，见 LagMs
+	LagMs int64 `json:"lagMs"`
+	// Diverged 本地 binlog 与 master 分叉，已经停止复制，需要清空数据后重建
+	Diverged bool `json:"diverged,omitempty"`
+}
+
+type sentBlock struct {
+	eventId     int64
+	lastEventId int64
+	fileId      int64
+	pos         int64
+	writeTime   int64
+	// 被过滤没有发送给 slave
+	skipped bool
+}
+
+// slaveSession master 上一个复制连接的状态，由 semiSync 统一管理
+type slaveSession struct {
+	id        string
+	addr      string
+	startTime int64
+
+	sentEventId  int64
+	sent         []sentBlock
+	ackEventId   int64
+	ackTime      int64
+	reportTime   int64
+	ackFileId    int64
+	ackPos       int64
+	ackWriteTime int64
+	// filter 不为空时 slave 只复制部分 topic，不参与半同步确认
+	filter *TopicFilter
+}
+
+func newSlaveSession(id, addr string, fileId, pos int64) *slaveSession {
+	return &slaveSession{
+		id:        id,
+		addr:      addr,
+		startTime: time.Now().UnixMilli(),
+		ackFileId: fileId,
+		ackPos:    pos,
+	}
+}
+
+// onSent 记录已发送的binlog块，调用者持有 semiSync 的锁
+func (s *slaveSession) onSent(block *binlogBlock) {
+	s.sentEventId = block.lastEventId
+	if len(s.sent) >= sentBlocksMax {
+		s.sent = s.sent[1:]
+	}
+	s.sent = append(s.sent, sentBlock{
+		eventId:     block.rawMsg.EventId,
+		lastEventId: block.lastEventId,
+		fileId:      block.fileId,
+		pos:         block.pos,
+		writeTime:   block.rawMsg.WriteTime,
+	})
+}
+
+// onSkipped 记录被过滤的binlog块，之前发送的块都已确认时直接视为已确认，调用者持有 semiSync 的锁
+func (s *slaveSession) onSkipped(block *binlogBlock) {
+	if len(s.sent) == 0 {
+		s.ackEventId = block.lastEventId
+		s.ackFileId = block.fileId
+		s.ackPos = block.pos
+		s.ackWriteTime = block.rawMsg.WriteTime
+		return
+	}
+	if len(s.sent) >= sentBlocksMax {
+		s.sent = s.sent[1:]
+	}
+	s.sent = append(s.sent, sentBlock{
+		eventId:     block.rawMsg.EventId,
+		lastEventId: block.lastEventId,
+		fileId:      block.fileId,
+		pos:         block.pos,
+		writeTime:   block.rawMsg.WriteTime,
+		skipped:     true,
+	})
+}
+
+// acked slave 回传的是已应用的块中最后一条消息的 eventId，调用者持有 semiSync 的锁
+func (s *slaveSession) acked(eventId int64, ackTime int64) {
+	if eventId > s.ackEventId {
+		s.ackEventId = eventId
+	}
+	s.ackTime = ackTime
+	s.reportTime = time.Now().UnixMilli()
+	n := 0
+	for n < len(s.sent) && s.sent[n].eventId <= eventId {
+		n++
+	}
+	// 紧跟在已确认的块之后被过滤的块也视为已确认
+	for n > 0 && n < len(s.sent) && s.sent[n].skipped {
+		n++
+	}
+	if n > 0 {
+		last := s.sent[n-1]
+		s.ackEventId = max(s.ackEventId, last.lastEventId)
+		s.ackFileId = last.fileId
+		s.ackPos = last.pos
+		s.ackWriteTime = last.writeTime
+		s.sent = s.sent[n:]
+	}
+}
+
+func (ss *semiSyncControl) skipped(id string, block *binlogBlock) {
+	ss.Lock()
+	defer ss.Unlock()
+	if session := ss.slaves[id]; session != nil {
+		session.onSkipped(block)
+	}
+}
+
+func (ss *semiSyncControl) sent(id string, block *binlogBlock) {
+	ss.Lock()
+	defer ss.Unlock()
+	if session := ss.slaves[id]; session != nil {
+		session.onSent(block)
+	}
+}
+
+// GetMasterStatus master 的复制状态，lastEventId 是 master 最新的 eventId
+func (r *Replication) GetMasterStatus(walMonitor WalMonitorSupport, lastEventId int64) *ReplicaStatus {
+	fileId, pos := walMonitor.Get()
+	state := &MasterReplicaState{
+		LastEventId:  lastEventId,
+		BinlogFileId: fileId,
+		BinlogPos:    pos,
+		Slaves:       []*ConnectedSlave{},
+		SemiSync:     r.GetSemiSyncStats(),
+	}
+	now := time.Now().UnixMilli()
+
+	r.semiSync.Lock()
+	for _, session := range r.semiSync.slaves {
+		cs := &ConnectedSlave{
+			Id:          session.id,
+			Addr:        session.addr,
+			StartTime:   session.startTime,
+			SentEventId: session.sentEventId,
+			AckEventId:  session.ackEventId,
+			ApplyTime:   session.ackTime,
+			ReportTime:  session.reportTime,
+			Filter:      session.filter,
+		}
+		if lastEventId > session.ackEventId {
+			cs.LagEvents = lastEventId - session.ackEventId
+			if session.ackWriteTime > 0 {
+				cs.LagMs = now - session.ackWriteTime
+			} else {
+				cs.LagMs = now - session.startTime
+			}
+		}
+		cs.BytesBehind = bytesBehind(walMonitor.GetRoot(), session.ackFileId, session.ackPos, fileId, pos)
+		state.Slaves = append(state.Slaves, cs)
+	}
+	r.semiSync.Unlock()
+
+	return &ReplicaStatus{
+		Role:   "master",
+		Master: state,
+	}
+}
+
+// bytesBehind 从 slave 已应用的位置到 binlog 写入位置之间的字节数
+func bytesBehind(root string, fromFileId, fromPos, toFileId, toPos int64) int64 {
+	if fromFileId > toFileId || (fromFileId == toFileId && fromPos >= toPos) {
+		return 0
+	}
+	if fromFileId == toFileId {
+		return toPos - fromPos
+	}
+	var total int64
+	for fid := fromFileId; fid < toFileId; fid++ {
+		info, err := os.Stat(path.Join(root, fmt.Sprintf("%d.log", fid)))
+		if err != nil {
+			continue
+		}
+		total += info.Size()
+	}
+	total -= fromPos
+	if total < 0 {
+		total = 0
+	}
+	return total + toPos
+}
+
+// localSlaveState 本实例作为 slave 时的复制进度
+type localSlaveState struct {
+	sync.Mutex
+	masterHost string
+	masterPort int
+	connected  atomic.Bool
+	eventId    atomic.Int64
+	applyTime  atomic.Int64
+	delay      atomic.Int64
+	// caughtUp slave 已经应用到 master 哪个时刻写入的数据，master 的时钟
+	caughtUp atomic.Int64
+	// diverged 本地 binlog 与 master 分叉，已经停止复制
+	diverged atomic.Bool
+}
+
+func (ls *localSlaveState) setMaster(host string, port int) {
+	ls.Lock()
+	defer ls.Unlock()
+	ls.masterHost = host
+	ls.masterPort = port
+}
+
+// applied eventId 是应用的块中最后一条消息的 eventId，writeTime 是该块在 master 上的写入时间
+func (ls *localSlaveState) applied(eventId int64, writeTime int64) {
+	now := time.Now().UnixMilli()
+	ls.eventId.Store(eventId)
+	ls.applyTime.Store(now)
+	ls.delay.Store(now - writeTime)
+	ls.advance(writeTime)
+}
+
+// advance slave 已经追上 master 在 t 时刻之前写入的数据
+func (ls *localSlaveState) advance(t int64) {
+	for {
+		old := ls.caughtUp.Load()
+		if t <= old || ls.caughtUp.CompareAndSwap(old, t) {
+			return
+		}
+	}
+}
+
+// lagMs 从最近应用的数据在 master 上的写入时间或者最近一次收到 AliveCode 到现在。master 没有新数据时定期输出 AliveCode，
+// 这时 slave 已经追上 master，空闲的 slave 落后的时间不会一直增长
+func (ls *localSlaveState) lagMs() int64 {
+	caughtUp := ls.caughtUp.Load()
+	if caughtUp == 0 {
+		return 0
+	}
+	return max(time.Now().UnixMilli()-caughtUp, 0)
+}
+
+// LagMs slave 落后 master 的时间，没有连接 master 时返回 false
+func (r *Replication) LagMs() (int64, bool) {
+	if !r.localSlave.connected.Load() {
+		return 0, false
+	}
+	return r.localSlave.lagMs(), true
+}
+
+// Diverged 本地 binlog 与 master 分叉，已经停止复制，需要清空数据后重建
+func (r *Replication) Diverged() bool {
+	return r.localSlave.diverged.Load()
+}
+
+// GetSlaveStatus slave 的复制状态
+func (r *Replication) GetSlaveStatus() *ReplicaStatus {
+	ls := r.localSlave
+	ls.Lock()
+	host, port := ls.masterHost, ls.masterPort
+	ls.Unlock()
+	return &ReplicaStatus{
+		Role: "slave",
+		Slave: &SlaveReplicaState{
+			MasterHost:    host,
+			MasterPort:    port,
+			Connected:     ls.connected.Load(),
+			LastEventId:   ls.eventId.Load(),
+			LastApplyTime: ls.applyTime.Load(),
+			LastDelayMs:   ls.delay.Load(),
+			LagMs:         ls.lagMs(),
+			Diverged:      ls.diverged.Load(),
+		},
+	}
+}
@@ -0,0 +1,105 @@
+package replica
+
+import (
+	"encoding/binary"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/codec"
+	"github.com/rolandhe/smss/pkg/nets"
+	"net"
+	"testing"
+	"time"
+)
+
+func pubPayload(n int) []byte {
+	var buf []byte
+	for i := 0; i < n; i++ {
+		buf = binary.LittleEndian.AppendUint32(buf, 1)
+		buf = binary.LittleEndian.AppendUint32(buf, 0)
+		buf = append(buf, 'x')
+	}
+	return buf
+}
+
+func pubBlock(eventId int64, n int, writeTime int64) *binlogBlock {
+	cmd := &protocol.DecodedRawMessage{}
+	cmd.Command = protocol.CommandPub
+	cmd.EventId = eventId
+	cmd.WriteTime = writeTime
+	return &binlogBlock{
+		rawMsg:      &cmd.RawMessage,
+		lastEventId: blockLastEventId(cmd, pubPayload(n)),
+		fileId:      0,
+		pos:         eventId * 100,
+	}
+}
+
+func TestBlockLastEventId(t *testing.T) {
+	cmd := &protocol.DecodedRawMessage{}
+	cmd.Command = protocol.CommandPub
+	cmd.EventId = 10
+	if id := blockLastEventId(cmd, pubPayload(5)); id != 14 {
+		t.Fatalf("expect 14, got %d", id)
+	}
+	compressed, _ := protocol.CompressPayload(pubPayload(3), 3, codec.Snappy)
+	if id := blockLastEventId(cmd, compressed); id != 12 {
+		t.Fatalf("expect 12 for compressed block, got %d", id)
+	}
+	cmd.Command = protocol.CommandCreateTopic
+	if id := blockLastEventId(cmd, nil); id != 10 {
+		t.Fatalf("expect 10, got %d", id)
+	}
+}
+
+func TestSessionAckUsesLastEventIdOfBlock(t *testing.T) {
+	s := newSlaveSession("s1", "addr", 0, 0)
+	s.onSent(pubBlock(1, 3, 100))
+	s.onSent(pubBlock(4, 2, 200))
+	if s.sentEventId != 5 {
+		t.Fatalf("sentEventId should be the last message of the last block, got %d", s.sentEventId)
+	}
+	s.acked(3, time.Now().UnixMilli())
+	if s.ackEventId != 3 || s.ackWriteTime != 100 || len(s.sent) != 1 {
+		t.Fatalf("unexpected ack state %+v", s)
+	}
+	s.acked(5, time.Now().UnixMilli())
+	if s.ackEventId != 5 || s.ackWriteTime != 200 || len(s.sent) != 0 {
+		t.Fatalf("unexpected ack state %+v", s)
+	}
+}
+
+func TestSlaveLagMs(t *testing.T) {
+	ls := &localSlaveState{}
+	if ls.lagMs() != 0 {
+		t.Fatal("lag should be 0 before applying anything")
+	}
+	writeTime := time.Now().UnixMilli() - 1500
+	ls.applied(20, writeTime)
+	if lag := ls.lagMs(); lag < 1500 || lag > 2500 {
+		t.Fatalf("unexpected lag %d", lag)
+	}
+	if ls.eventId.Load() != 20 || ls.delay.Load() < 1500 {
+		t.Fatalf("unexpected applied state")
+	}
+}
+
+// TestSlaveLagResetByAlive master 没有新数据时输出 AliveCode，空闲的 slave 不应该一直落后
+func TestSlaveLagResetByAlive(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	ls := &localSlaveState{}
+	ls.applied(20, time.Now().UnixMilli()-60000)
+	sc := &slaveClient{conn: client, local: ls}
+	go func() {
+		req := make([]byte, 28)
+		if err := nets.ReadAll(server, req, time.Second); err != nil {
+			return
+		}
+		nets.OutAlive(server, time.Second)
+		nets.ReadAll(server, make([]byte, replicaAckSize), time.Second)
+		nets.OutShutdown(server, time.Second)
+	}()
+	sc.replica(20)
+	if lag := ls.lagMs(); lag > 1000 {
+		t.Fatalf("lag should be reset by alive, got %d", lag)
+	}
+}
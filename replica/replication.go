@@ -0,0 +1,21 @@
+package replica
+
+// Replication 一个 server 的复制状态：作为 master 时已连接的 slave 与半同步复制，作为 slave 时自己的复制进度。
+// 每个 server 一个，同一进程内的多个 server 互不影响
+type Replication struct {
+	// root 数据目录，作为 slave 开始复制时读取本地 binlog
+	root       string
+	semiSync   *semiSyncControl
+	localSlave *localSlaveState
+}
+
+func NewReplication(root string) *Replication {
+	return &Replication{
+		root: root,
+		semiSync: &semiSyncControl{
+			slaves:  map[string]*slaveSession{},
+			waiters: map[*ackWaiter]struct{}{},
+		},
+		localSlave: &localSlaveState{},
+	}
+}
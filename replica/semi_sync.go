@@ -0,0 +1,159 @@
+package replica
+
+import (
+	"encoding/binary"
+	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/logger"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 半同步复制：从库应用完一个binlog块后通过复制连接回传 eventId，主库的发布请求需要等待至少 K 个从库确认后才返回成功，
+// 等待超时后退化为异步复制，直到有 K 个从库追上后再恢复为半同步
+
+// replicaAckSize slave 回传确认的长度，0-8字节是已应用的 eventId，8-16字节是应用时间，其余保留
+const replicaAckSize = 20
+
+func ackFrame(buf []byte, eventId int64, ackTime int64) []byte {
+	binary.LittleEndian.PutUint64(buf, uint64(eventId))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(ackTime))
+	return buf[:replicaAckSize]
+}
+
+func parseAckFrame(buf []byte) (int64, int64) {
+	return int64(binary.LittleEndian.Uint64(buf)), int64(binary.LittleEndian.Uint64(buf[8:]))
+}
+
+// SemiSyncStats 半同步复制的统计
+type SemiSyncStats struct {
+	// 从库确认后返回的发布请求数
+	Acked int64 `json:"acked"`
+	// 等待从库确认超时的次数
+	Timeouts int64 `json:"timeouts"`
+	// 退化为异步期间没有等待从库确认的发布请求数
+	AsyncAcked int64 `json:"asyncAcked"`
+	// 当前是否退化为异步
+	Async bool `json:"async"`
+}
+
+type ackWaiter struct {
+	eventId int64
+	ch      chan struct{}
+}
+
+type semiSyncControl struct {
+	sync.Mutex
+	// 已连接的 slave，复制状态也从这里读取
+	slaves  map[string]*slaveSession
+	waiters map[*ackWaiter]struct{}
+	// 退化为异步期间等待过的最大 eventId，从库确认到该 eventId 后恢复为半同步
+	maxEventId int64
+	async      atomic.Bool
+
+	acked      atomic.Int64
+	timeouts   atomic.Int64
+	asyncAcked atomic.Int64
+}
+
+func (ss *semiSyncControl) register(session *slaveSession) {
+	ss.Lock()
+	defer ss.Unlock()
+	ss.slaves[session.id] = session
+}
+
+func (ss *semiSyncControl) unRegister(id string) {
+	ss.Lock()
+	defer ss.Unlock()
+	delete(ss.slaves, id)
+}
+
+// countAcked 确认了 eventId 的从库数，只复制部分 topic 的从库不计算在内，调用者持有锁
+func (ss *semiSyncControl) countAcked(eventId int64) int {
+	count := 0
+	for _, session := range ss.slaves {
+		if session.filter == nil && session.ackEventId >= eventId {
+			count++
+		}
+	}
+	return count
+}
+
+func (ss *semiSyncControl) ack(id string, eventId int64, ackTime int64) {
+	ss.Lock()
+	defer ss.Unlock()
+	session := ss.slaves[id]
+	if session == nil {
+		return
+	}
+	session.acked(eventId, ackTime)
+	need := conf.ReplicaSemiSyncAckSlaves
+	for w := range ss.waiters {
+		if ss.countAcked(w.eventId) >= need {
+			close(w.ch)
+			delete(ss.waiters, w)
+		}
+	}
+	if ss.async.Load() && need > 0 && ss.countAcked(ss.maxEventId) >= need {
+		ss.async.Store(false)
+		logger.Infof("semi sync: %d slaves caught up eventId %d, switch back to semi sync", need, ss.maxEventId)
+	}
+}
+
+// WaitSlaveAck 等待至少 K 个从库确认 eventId，没有开启半同步或者已经退化为异步时直接返回
+func (r *Replication) WaitSlaveAck(eventId int64, tid string) {
+	need := conf.ReplicaSemiSyncAckSlaves
+	if need <= 0 {
+		return
+	}
+	ss := r.semiSync
+	ss.Lock()
+	if ss.async.Load() {
+		if eventId > ss.maxEventId {
+			ss.maxEventId = eventId
+		}
+		ss.Unlock()
+		ss.asyncAcked.Add(1)
+		return
+	}
+	if ss.countAcked(eventId) >= need {
+		ss.Unlock()
+		ss.acked.Add(1)
+		return
+	}
+	w := &ackWaiter{
+		eventId: eventId,
+		ch:      make(chan struct{}),
+	}
+	ss.waiters[w] = struct{}{}
+	ss.Unlock()
+
+	timer := time.NewTimer(conf.ReplicaSemiSyncTimeout)
+	defer timer.Stop()
+	select {
+	case <-w.ch:
+		ss.acked.Add(1)
+	case <-timer.C:
+		ss.Lock()
+		delete(ss.waiters, w)
+		if eventId > ss.maxEventId {
+			ss.maxEventId = eventId
+		}
+		switched := ss.async.CompareAndSwap(false, true)
+		ss.Unlock()
+		ss.timeouts.Add(1)
+		if switched {
+			logger.Infof("tid=%s,semi sync: wait %d slaves ack eventId %d timeout %v, switch to async", tid, need, eventId, conf.ReplicaSemiSyncTimeout)
+		}
+	}
+}
+
+func (r *Replication) GetSemiSyncStats() *SemiSyncStats {
+	ss := r.semiSync
+	return &SemiSyncStats{
+		Acked:      ss.acked.Load(),
+		Timeouts:   ss.timeouts.Load(),
+		AsyncAcked: ss.asyncAcked.Load(),
+		Async:      ss.async.Load(),
+	}
+}
@@ -0,0 +1,116 @@
+package replica
+
+import (
+	"github.com/rolandhe/smss/conf"
+	"testing"
+	"time"
+)
+
+func semiSyncReplication(t *testing.T, ackSlaves int, timeout time.Duration) *Replication {
+	oldSlaves, oldTimeout := conf.ReplicaSemiSyncAckSlaves, conf.ReplicaSemiSyncTimeout
+	conf.ReplicaSemiSyncAckSlaves = ackSlaves
+	conf.ReplicaSemiSyncTimeout = timeout
+	t.Cleanup(func() {
+		conf.ReplicaSemiSyncAckSlaves, conf.ReplicaSemiSyncTimeout = oldSlaves, oldTimeout
+	})
+	repl := NewReplication(t.TempDir())
+	repl.semiSync.register(newSlaveSession("s1", "addr1", 0, 0))
+	repl.semiSync.register(newSlaveSession("s2", "addr2", 0, 0))
+	filtered := newSlaveSession("s3", "addr3", 0, 0)
+	filtered.filter, _ = NewTopicFilter([]string{"order"}, nil)
+	repl.semiSync.register(filtered)
+	return repl
+}
+
+func waitAck(repl *Replication, eventId int64) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		repl.WaitSlaveAck(eventId, "tid")
+		close(done)
+	}()
+	return done
+}
+
+func isDone(done chan struct{}, timeout time.Duration) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// TestWaitSlaveAckNeedsEnoughSlaves 需要 K 个从库确认后才返回，只复制部分 topic 的从库不计算在内
+func TestWaitSlaveAckNeedsEnoughSlaves(t *testing.T) {
+	repl := semiSyncReplication(t, 2, time.Second*5)
+	done := waitAck(repl, 5)
+	repl.semiSync.ack("s1", 5, time.Now().UnixMilli())
+	repl.semiSync.ack("s3", 5, time.Now().UnixMilli())
+	repl.semiSync.ack("s2", 4, time.Now().UnixMilli())
+	if isDone(done, time.Millisecond*100) {
+		t.Fatal("returned before 2 slaves acked")
+	}
+	repl.semiSync.ack("s2", 5, time.Now().UnixMilli())
+	if !isDone(done, time.Second) {
+		t.Fatal("not returned after 2 slaves acked")
+	}
+	if stats := repl.GetSemiSyncStats(); stats.Acked != 1 || stats.Timeouts != 0 || stats.Async {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// TestWaitSlaveAckTimeoutSwitchesToAsync 超时后退化为异步，K 个从库追上退化期间的最大 eventId 后恢复为半同步
+func TestWaitSlaveAckTimeoutSwitchesToAsync(t *testing.T) {
+	repl := semiSyncReplication(t, 2, time.Millisecond*50)
+	repl.semiSync.ack("s1", 5, time.Now().UnixMilli())
+	start := time.Now()
+	repl.WaitSlaveAck(5, "tid")
+	if time.Since(start) < time.Millisecond*50 {
+		t.Fatal("returned before timeout")
+	}
+	if stats := repl.GetSemiSyncStats(); stats.Timeouts != 1 || !stats.Async {
+		t.Fatalf("should switch to async after timeout, stats %+v", stats)
+	}
+
+	if !isDone(waitAck(repl, 6), time.Second) {
+		t.Fatal("should not wait in async mode")
+	}
+	if stats := repl.GetSemiSyncStats(); stats.AsyncAcked != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	repl.semiSync.ack("s1", 6, time.Now().UnixMilli())
+	repl.semiSync.ack("s3", 6, time.Now().UnixMilli())
+	repl.semiSync.ack("s2", 5, time.Now().UnixMilli())
+	if !repl.GetSemiSyncStats().Async {
+		t.Fatal("switched back before 2 slaves caught up")
+	}
+	repl.semiSync.ack("s2", 6, time.Now().UnixMilli())
+	if repl.GetSemiSyncStats().Async {
+		t.Fatal("should switch back to semi sync after 2 slaves caught up")
+	}
+
+	done := waitAck(repl, 7)
+	if isDone(done, time.Millisecond*20) {
+		t.Fatal("should wait for acks after switching back")
+	}
+	repl.semiSync.ack("s1", 7, time.Now().UnixMilli())
+	repl.semiSync.ack("s2", 7, time.Now().UnixMilli())
+	if !isDone(done, time.Second) {
+		t.Fatal("not returned after 2 slaves acked")
+	}
+	if stats := repl.GetSemiSyncStats(); stats.Acked != 1 || stats.Timeouts != 1 || stats.Async {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// TestWaitSlaveAckDisabled 没有开启半同步时直接返回
+func TestWaitSlaveAckDisabled(t *testing.T) {
+	repl := semiSyncReplication(t, 0, time.Second*5)
+	if !isDone(waitAck(repl, 5), time.Millisecond*100) {
+		t.Fatal("should not wait when semi sync is disabled")
+	}
+	if stats := repl.GetSemiSyncStats(); stats.Acked != 0 || stats.AsyncAcked != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
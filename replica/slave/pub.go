@@ -6,10 +6,11 @@ import (
 )
 
 func PubHandler(cmd *protocol.DecodedRawMessage, payload []byte, worker DependWorker) error {
-	_, count := protocol.CheckPayload(payload)
+	count := protocol.PayloadCount(payload)
 	pubPayload := &protocol.PubPayload{
 		Payload:   payload,
 		BatchSize: count,
+		Codec:     cmd.Codec,
 	}
 	msg := &protocol.RawMessage{
 		Src:       protocol.RawMessageReplica,
@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/cmd/repair"
 	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/checksum"
 	"github.com/rolandhe/smss/pkg/dir"
 	"github.com/rolandhe/smss/pkg/logger"
 	"github.com/rolandhe/smss/pkg/nets"
@@ -24,11 +26,13 @@ const (
 	replicaReadNewLogTimeout = time.Millisecond * 10000
 )
 
-func newSlaveReplicaClient(masterHost string, masterPort int, worker slave.DependWorker) (*slaveClient, error) {
+func newSlaveReplicaClient(masterHost string, masterPort int, worker slave.DependWorker, filter *TopicFilter, local *localSlaveState) (*slaveClient, error) {
 	c := &slaveClient{
 		host:   masterHost,
 		port:   masterPort,
 		worker: worker,
+		filter: filter,
+		local:  local,
 	}
 	if err := c.connect(); err != nil {
 		return nil, err
@@ -44,6 +48,10 @@ type slaveClient struct {
 	worker      slave.DependWorker
 	state       atomic.Bool
 	lastEventId int64
+	// lastWriteTime lastEventId 所在块在 master 上的写入时间，master 用来检查 binlog 是否分叉
+	lastWriteTime int64
+	filter        *TopicFilter
+	local         *localSlaveState
 }
 
 func (sc *slaveClient) connect() error {
@@ -106,19 +114,29 @@ func (sc *slaveClient) getValidTopic(eventId int64) ([]*store.TopicInfo, error)
 func (sc *slaveClient) replica(eventId int64) error {
 	logger.Infof("slave begin to replica,eventId=%d", eventId)
 	sc.lastEventId = eventId
-	buf := make([]byte, 28)
+	fBuf := sc.filter.bytes()
+	buf := make([]byte, 28+len(fBuf))
 	buf[0] = byte(protocol.CommandReplica)
+	binary.LittleEndian.PutUint32(buf[3:], uint32(len(fBuf)))
+	binary.LittleEndian.PutUint64(buf[7:], uint64(sc.lastWriteTime))
 	binary.LittleEndian.PutUint64(buf[protocol.HeaderSize:], uint64(eventId))
+	copy(buf[28:], fBuf)
 	if err := nets.WriteAll(sc.conn, buf, netWriteTimeout); err != nil {
 		return err
 	}
+	sc.local.connected.Store(true)
+	defer sc.local.connected.Store(false)
 
 	cmdParser := &msgParser{}
 	count := int64(0)
+	ackBuf := make([]byte, replicaAckSize)
 
+	hBuf := make([]byte, protocol.RespHeaderSize)
+	filled := 0
 	for {
-		hBuf := buf[:protocol.RespHeaderSize]
-		err := nets.ReadAll(sc.conn, hBuf, replicaReadNewLogTimeout)
+		// 等待新数据超时时保留已经读取的部分 header
+		n, err := nets.ReadFull(sc.conn, hBuf[filled:], replicaReadNewLogTimeout)
+		filled += n
 		if err != nil {
 			if nets.IsTimeoutError(err) {
 				logger.Infof("wait new binlog data timeout,wait...")
@@ -126,6 +144,7 @@ func (sc *slaveClient) replica(eventId int64) error {
 			}
 			return err
 		}
+		filled = 0
 		code := int(binary.LittleEndian.Uint16(hBuf[:2]))
 		if code == protocol.OkCode {
 			var body []byte
@@ -133,16 +152,50 @@ func (sc *slaveClient) replica(eventId int64) error {
 			if err != nil {
 				return err
 			}
-			if sc.lastEventId, err = applyBinlog(body, cmdParser, sc.worker, count); err != nil {
+			// 应用失败时保留上一个块的 eventId，重新连接后从失败的块开始复制
+			block, applyErr := applyBinlog(body, cmdParser, sc.worker, count, sc.local)
+			if applyErr != nil {
+				return applyErr
+			}
+			sc.lastEventId = block.eventId
+			sc.lastWriteTime = block.writeTime
+			// 回传已应用的 eventId，用于半同步复制
+			if err = nets.WriteAll(sc.conn, ackFrame(ackBuf, block.lastEventId, time.Now().UnixMilli()), netWriteTimeout); err != nil {
 				return err
 			}
 			count++
 			continue
 		}
+		if code == protocol.SkipCode {
+			if err = nets.ReadAll(sc.conn, buf[:16], netReadTimeout); err != nil {
+				return err
+			}
+			eventId := int64(binary.LittleEndian.Uint64(buf))
+			writeTime := int64(binary.LittleEndian.Uint64(buf[8:]))
+			// 跳过的块不写入本地 binlog，记录在 meta 中，重启后从它之后继续复制。通过 CommandBarrier 在 worker 中写入，
+			// 与其他 meta 的修改一样只有 worker 一个写者，并且之前应用的块已经刷盘
+			if err = sc.setResumePoint(eventId, writeTime); err != nil {
+				return err
+			}
+			sc.lastEventId = eventId
+			sc.lastWriteTime = writeTime
+			sc.local.advance(writeTime)
+			continue
+		}
 		if code == protocol.AliveCode {
 			logger.Infof("slave recv alive msg")
+			// master 没有更多的数据
+			sc.local.advance(time.Now().UnixMilli())
+			// 没有新数据时也定期回传复制进度
+			if err = nets.WriteAll(sc.conn, ackFrame(ackBuf, sc.local.eventId.Load(), sc.local.applyTime.Load()), netWriteTimeout); err != nil {
+				return err
+			}
 			continue
 		}
+		if code == protocol.ShutdownCode {
+			logger.Infof("slave recv master shutdown msg")
+			return errors.New("master shutdown")
+		}
 		if code == protocol.ErrCode {
 			errMsgLen := int(binary.LittleEndian.Uint16(hBuf[2:]))
 			if errMsgLen == 0 {
@@ -152,21 +205,59 @@ func (sc *slaveClient) replica(eventId int64) error {
 			if err = nets.ReadAll(sc.conn, eMsgBuf, netReadTimeout); err != nil {
 				return err
 			}
-			return errors.New(string(eMsgBuf))
+			return wireErr(string(eMsgBuf))
 		}
 		logger.Infof("invalid response:%d", code)
 		return errors.New("invalid response")
 	}
 }
 
-func applyBinlog(body []byte, cmdParse *msgParser, worker slave.DependWorker, count int64) (int64, error) {
+// setResumePoint 在 worker 中记录 master 跳过的块
+func (sc *slaveClient) setResumePoint(eventId int64, writeTime int64) error {
+	var setErr error
+	err := sc.worker.Work(&protocol.RawMessage{
+		Command:   protocol.CommandBarrier,
+		Timestamp: time.Now().UnixMilli(),
+		Body: protocol.BarrierFunc(func() {
+			setErr = sc.worker.SetReplicaResumePoint(eventId, writeTime)
+		}),
+	})
+	if err != nil {
+		return err
+	}
+	return setErr
+}
+
+// wireErr master 输出的错误信息转换为 error，已知的错误转换为对应的变量，可以用 errors.Is 判断
+func wireErr(msg string) error {
+	for _, known := range []error{SlaveDivergedErr, repair.EventIdExpiredErr} {
+		if msg == known.Error() {
+			return known
+		}
+	}
+	return errors.New(msg)
+}
+
+// appliedBlock 已经应用的块，eventId 用于断开后继续复制，lastEventId 是块中最后一条消息的 eventId，用于回传确认
+type appliedBlock struct {
+	eventId     int64
+	lastEventId int64
+	writeTime   int64
+}
+
+// applyBinlog local 不为 nil 时记录复制进度
+func applyBinlog(body []byte, cmdParse *msgParser, worker slave.DependWorker, count int64, local *localSlaveState) (appliedBlock, error) {
 	defer cmdParse.Reset()
 	cmdLen := binary.LittleEndian.Uint32(body)
 	cmdLine, err := cmdParse.ParseCmd(body[4 : cmdLen+4])
 	if err != nil {
-		return 0, err
+		return appliedBlock{}, err
 	}
 	next := body[cmdLen+4:]
+	if cmdLine.HasChecksum() && !checksum.Verify(body[4:cmdLen+4], next[:cmdLine.GetPayloadSize()]) {
+		logger.Infof("slave recv corrupt binlog block,eventId=%d", cmdLine.GetId())
+		return appliedBlock{}, fmt.Errorf("corrupt binlog block from master,eventId=%d", cmdLine.GetId())
+	}
 	var payload []byte
 	if cmdLine.GetPayloadSize() > 0 {
 		payload = next[:cmdLine.GetPayloadSize()-1]
@@ -175,15 +266,23 @@ func applyBinlog(body []byte, cmdParse *msgParser, worker slave.DependWorker, co
 	hFunc := bbHandlerMap[cmdLine.GetCmd()]
 	if hFunc == nil {
 		logger.Infof("not support cmd:%d", cmdLine.GetCmd())
-		return 0, dir.NewBizError("not support cmd")
+		return appliedBlock{}, dir.NewBizError("not support cmd")
 	}
 	st := time.Now().UnixMilli()
 	err = hFunc(cmdParse.cmd, payload, worker)
-	if conf.LogSample > 0 && count%conf.LogSample == 0 {
+	if sample := conf.LogSample.Load(); sample > 0 && count%sample == 0 {
 		rCost := time.Now().UnixMilli() - st
 		logger.Infof("slave: tid=%s,cmd=%d,eventId=%d,count=%d,delay=%dms,rCost=%d,err:%v", cmdParse.cmd.TraceId, cmdParse.cmd.Command, cmdParse.cmd.EventId, count, cmdParse.cmd.GetDelay(), rCost, err)
 	}
-	return cmdParse.cmd.EventId, err
+	lastEventId := blockLastEventId(cmdParse.cmd, payload)
+	if err == nil && local != nil {
+		local.applied(lastEventId, cmdParse.cmd.WriteTime)
+	}
+	return appliedBlock{
+		eventId:     cmdParse.cmd.EventId,
+		lastEventId: lastEventId,
+		writeTime:   cmdParse.cmd.WriteTime,
+	}, err
 }
 
 func readPayload(conn net.Conn, lenBuf []byte) ([]byte, error) {
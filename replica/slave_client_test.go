@@ -0,0 +1,106 @@
+package replica
+
+import (
+	"fmt"
+	"github.com/rolandhe/smss/binlog"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/cmd/repair"
+	"github.com/rolandhe/smss/pkg/nets"
+	"github.com/rolandhe/smss/replica/slave"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplicaKeepsResumeEventIdWhenApplyFails(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	sc := &slaveClient{conn: client, local: &localSlaveState{}}
+	go func() {
+		req := make([]byte, 28)
+		if err := nets.ReadAll(server, req, time.Second); err != nil {
+			return
+		}
+		msg := &protocol.RawMessage{
+			Command:   protocol.CommandPub,
+			EventId:   8,
+			TopicName: "order",
+			Body:      &protocol.PubPayload{Payload: pubPayload(2)},
+		}
+		body := binlog.PubEncoder(msg).Bytes()
+		// 破坏 payload，crc 校验失败
+		body[len(body)-2] ^= 0xff
+		nets.WriteAll(server, blockFrame(&binlogBlock{data: body}), time.Second)
+	}()
+	if err := sc.replica(7); err == nil {
+		t.Fatal("expect apply error")
+	}
+	if sc.lastEventId != 7 {
+		t.Fatalf("resume eventId should stay at 7, got %d", sc.lastEventId)
+	}
+}
+
+func TestWireErrMapsKnownErrors(t *testing.T) {
+	err := wireErr(repair.EventIdExpiredErr.Error())
+	if !IsBinlogExpired(err) || !IsBinlogExpired(fmt.Errorf("replica: %w", err)) {
+		t.Fatal("expired error from master should be recognized")
+	}
+	if err = wireErr(SlaveDivergedErr.Error()); err != SlaveDivergedErr {
+		t.Fatal("diverged error from master should be recognized")
+	}
+	if IsBinlogExpired(wireErr("other err")) {
+		t.Fatal("unknown error should not be recognized as expired")
+	}
+}
+
+// resumeWorker 只记录 master 通知的跳过位置，以及是否在 worker 的 barrier 中写入
+type resumeWorker struct {
+	slave.DependWorker
+	inBarrier bool
+	barriers  int
+	eventId   int64
+	writeTime int64
+}
+
+func (w *resumeWorker) Work(msg *protocol.RawMessage) error {
+	if msg.Command != protocol.CommandBarrier {
+		return fmt.Errorf("unexpected command %d", msg.Command)
+	}
+	w.barriers++
+	w.inBarrier = true
+	msg.Body.(protocol.BarrierFunc)()
+	w.inBarrier = false
+	return nil
+}
+
+func (w *resumeWorker) SetReplicaResumePoint(eventId int64, writeTime int64) error {
+	if !w.inBarrier {
+		return fmt.Errorf("resume point is written outside the worker")
+	}
+	w.eventId, w.writeTime = eventId, writeTime
+	return nil
+}
+
+func TestReplicaPersistsSkippedEventId(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	worker := &resumeWorker{}
+	sc := &slaveClient{conn: client, local: &localSlaveState{}, worker: worker}
+	go func() {
+		req := make([]byte, 28)
+		if err := nets.ReadAll(server, req, time.Second); err != nil {
+			return
+		}
+		nets.WriteAll(server, skipFrame(pubBlock(12, 3, 1200)), time.Second)
+		nets.OutShutdown(server, time.Second)
+	}()
+	if err := sc.replica(7); err == nil {
+		t.Fatal("expect master shutdown")
+	}
+	if sc.lastEventId != 12 || sc.lastWriteTime != 1200 {
+		t.Fatalf("resume point should move to the skipped block, got %d/%d", sc.lastEventId, sc.lastWriteTime)
+	}
+	if worker.barriers != 1 || worker.eventId != 12 || worker.writeTime != 1200 {
+		t.Fatalf("skipped block is not persisted through the worker, barriers=%d, got %d/%d", worker.barriers, worker.eventId, worker.writeTime)
+	}
+}
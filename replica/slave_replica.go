@@ -1,50 +1,176 @@
 package replica
 
 import (
+	"errors"
+	"github.com/rolandhe/smss/cmd/repair"
+	"github.com/rolandhe/smss/conf"
 	"github.com/rolandhe/smss/pkg/dir"
 	"github.com/rolandhe/smss/pkg/logger"
 	"github.com/rolandhe/smss/standard"
 	"github.com/rolandhe/smss/store"
+	"path"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func SlaveReplica(masterHost string, masterPort int, eventId int64, needSync bool, worker standard.MessageWorking, fstore store.Store) error {
+// SlaveReplicator 从库复制线程的句柄，用于停止复制
+type SlaveReplicator struct {
+	sync.Mutex
+	client   *slaveClient
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	// eventId 复制线程退出时最后一个已经应用的块的 eventId
+	eventId atomic.Int64
+}
+
+// EventId Stop 之后调用，返回最后一个已经应用的块的 eventId，重新启动复制时从它之后开始
+func (sr *SlaveReplicator) EventId() int64 {
+	return sr.eventId.Load()
+}
+
+// Stop 停止复制线程，并等待正在处理的binlog块处理完成
+func (sr *SlaveReplicator) Stop() {
+	sr.stopOnce.Do(func() {
+		close(sr.quit)
+		sr.Lock()
+		if sr.client != nil {
+			sr.client.Close()
+		}
+		sr.Unlock()
+	})
+	<-sr.done
+}
+
+func (sr *SlaveReplicator) isStopped() bool {
+	select {
+	case <-sr.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sr *SlaveReplicator) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-sr.quit:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (sr *SlaveReplicator) setClient(client *slaveClient) bool {
+	sr.Lock()
+	defer sr.Unlock()
+	if sr.isStopped() {
+		client.Close()
+		return false
+	}
+	sr.client = client
+	return true
+}
+
+func (r *Replication) SlaveReplica(masterHost string, masterPort int, eventId int64, needSync bool, worker standard.MessageWorking, fstore store.Store) (*SlaveReplicator, error) {
+	filter, err := NewTopicFilter(conf.ReplicaFilterInclude, conf.ReplicaFilterExclude)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkTopicFilter(fstore.GetManagerMeta(), filter, eventId); err != nil {
+		return nil, err
+	}
+	// 只复制部分 topic 时 master 最后跳过的块可能在本地 binlog 之后
+	resumeEventId, resumeWriteTime, err := fstore.GetManagerMeta().GetReplicaResumePoint()
+	if err != nil {
+		return nil, err
+	}
 	sc, err := newSlaveReplicaClient(masterHost, masterPort, &dependWorker{
 		MessageWorking: worker,
 		ManagerMeta:    fstore.GetManagerMeta(),
-	})
+	}, filter, r.localSlave)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if needSync {
 		err = syncTopicInfo(sc, eventId, fstore)
 		if err != nil {
 			sc.Close()
-			return err
+			return nil, err
 		}
 	}
 
+	r.localSlave.setMaster(masterHost, masterPort)
+	r.localSlave.eventId.Store(eventId)
+	r.localSlave.diverged.Store(false)
+	if resumeEventId > 0 && resumeEventId >= eventId {
+		logger.Infof("slave resume from skipped eventId=%d, local eventId=%d", resumeEventId, eventId)
+		eventId = resumeEventId
+		sc.lastWriteTime = resumeWriteTime
+	} else {
+		sc.lastWriteTime = r.localWriteTime(eventId)
+	}
+
+	sr := &SlaveReplicator{
+		client: sc,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
 	go func() {
 		client := sc
 		newEventId := eventId
+		writeTime := sc.lastWriteTime
+		defer func() {
+			sr.eventId.Store(newEventId)
+			close(sr.done)
+		}()
+		needSnapshot := false
 		for {
-			newEventId = run(client, newEventId)
-			time.Sleep(time.Millisecond * 2000)
+			if needSnapshot {
+				newEventId, needSnapshot = loadSnapshot(client, fstore, r.localSlave)
+			} else {
+				client.lastWriteTime = writeTime
+				newEventId, writeTime, err = run(client, newEventId)
+				// 只有还没有数据的新 slave 才能通过快照初始化
+				needSnapshot = newEventId == 0 && IsBinlogExpired(err)
+			}
+			if errors.Is(err, SlaveDivergedErr) {
+				// 继续复制会把分叉的数据混在一起，停止复制，直到清空数据后重建
+				logger.Errorf("slave binlog diverged from master %s:%d at eventId=%d, stop replica", masterHost, masterPort, newEventId)
+				r.localSlave.diverged.Store(true)
+				return
+			}
+			if needSnapshot {
+				logger.Infof("master binlog expired, slave will load snapshot")
+			}
+			if !sr.sleep(time.Millisecond * 2000) {
+				logger.Infof("slave replica stopped,last eventId=%d", newEventId)
+				return
+			}
 			for {
 				client, err = newSlaveReplicaClient(masterHost, masterPort, &dependWorker{
 					MessageWorking: worker,
 					ManagerMeta:    fstore.GetManagerMeta(),
-				})
+				}, filter, r.localSlave)
 				if err == nil {
 					break
 				}
 				logger.Infof("new sc err:%v", err)
-				time.Sleep(time.Millisecond * 5000)
+				if !sr.sleep(time.Millisecond * 5000) {
+					logger.Infof("slave replica stopped,last eventId=%d", newEventId)
+					return
+				}
+			}
+			if !sr.setClient(client) {
+				logger.Infof("slave replica stopped,last eventId=%d", newEventId)
+				return
 			}
-
 		}
 	}()
-	return nil
+	return sr, nil
 }
 
 func syncTopicInfo(sc *slaveClient, eventId int64, fstore store.Store) error {
@@ -65,11 +191,36 @@ func syncTopicInfo(sc *slaveClient, eventId int64, fstore store.Store) error {
 	return nil
 }
 
-func run(sc *slaveClient, eventId int64) int64 {
+func run(sc *slaveClient, eventId int64) (int64, int64, error) {
 	defer sc.Close()
 	err := sc.replica(eventId)
 	logger.Infof("slave,last eventId=%d, run err:%v", sc.lastEventId, err)
-	return sc.lastEventId
+	return sc.lastEventId, sc.lastWriteTime, err
+}
+
+// localWriteTime 本地 binlog 中 eventId 所在块的写入时间，找不到时返回 0，master 不检查是否分叉
+func (r *Replication) localWriteTime(eventId int64) int64 {
+	if eventId == 0 {
+		return 0
+	}
+	_, _, writeTime, err := repair.FindBinlogBlockByEventId(path.Join(r.root, store.BinlogDir), eventId, -1)
+	if err != nil {
+		logger.Infof("find local binlog block of eventId=%d err:%v", eventId, err)
+		return 0
+	}
+	return writeTime
+}
+
+// loadSnapshot 加载快照，成功后从快照的 eventId 开始复制，失败时下一次重新加载
+func loadSnapshot(sc *slaveClient, fstore store.Store, local *localSlaveState) (int64, bool) {
+	defer sc.Close()
+	eventId, err := sc.snapshot(fstore)
+	if err != nil {
+		logger.Infof("slave load snapshot err:%v", err)
+		return 0, true
+	}
+	local.eventId.Store(eventId)
+	return eventId, false
 }
 
 type dependWorker struct {
@@ -0,0 +1,391 @@
+package replica
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/cmd/repair"
+	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/dir"
+	"github.com/rolandhe/smss/pkg/logger"
+	"github.com/rolandhe/smss/pkg/nets"
+	"github.com/rolandhe/smss/standard"
+	"github.com/rolandhe/smss/store"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// 新的 slave 从 eventId 0 开始复制，而 master 最早的 binlog 已经被删除时，先从 master 读取快照：meta 中的所有数据(包括未触发的延迟消息)，
+// 以及快照时刻所有 topic 文件的内容，然后从快照的 eventId 开始正常复制 binlog。
+// 快照由多个帧组成，每个帧是 response header + 帧数据，header 的 2-6 字节是帧数据的长度，帧数据的第一个字节是帧类型：
+//  - snapshotFrameMeta: 多个 key/value，每个是 4 字节 key 长度 + key + 4 字节 value 长度 + value
+//  - snapshotFrameFile: 2 字节 topic 名称长度 + topic 名称 + 8 字节 fileId + 8 字节文件内偏移 + 8 字节文件修改时间 + 文件内容
+//  - snapshotFrameEnd: 8 字节快照对应的 eventId
+// 出错时输出 ErrCode
+
+const (
+	snapshotFrameMeta byte = 1
+	snapshotFrameFile byte = 2
+	snapshotFrameEnd  byte = 3
+
+	snapshotChunkSize   = 1024 * 1024
+	snapshotReadTimeout = time.Second * 60
+)
+
+type snapshotFile struct {
+	topicName string
+	fileId    int64
+	size      int64
+	modTime   time.Time
+}
+
+// snapshotPoint 在 worker 中获取的一致性快照点
+type snapshotPoint struct {
+	eventId int64
+	meta    store.MetaSnapshot
+	files   []*snapshotFile
+	err     error
+}
+
+// IsBinlogExpired slave 复制时 master 返回的错误是否是 binlog 已经过期，master 输出的错误由 wireErr 转换为 repair.EventIdExpiredErr
+func IsBinlogExpired(err error) bool {
+	return errors.Is(err, repair.EventIdExpiredErr)
+}
+
+// MasterSnapshot 输出快照。快照点通过 CommandBarrier 在 worker 中获取，此时之前的消息都已经写入，之后的消息还没有写入，
+// 所以 meta 的只读事务、topic 文件的长度与 eventId 是一致的
+// 请求中可以带有 slave 的 topic 过滤条件，格式与复制请求相同，只输出匹配的 topic 的文件。
+// 输出一个 topic 的文件时持有该 topic 的删除锁，避免过期文件的清理和 topic 的删除在输出的过程中删除文件
+func MasterSnapshot(conn net.Conn, header *protocol.CommonHeader, fstore store.Store, worker standard.MessageWorking, locker *protocol.DelFileLock,
+	lastEventId func() int64, readTimeout, writeTimeout time.Duration) error {
+	filter, err := readTopicFilter(conn, header, readTimeout)
+	if err != nil {
+		logger.Infof("tid=%s,snapshot read filter err:%v", header.TraceId, err)
+		return nets.OutputRecoverErr(conn, "invalid replica filter", writeTimeout)
+	}
+	point := &snapshotPoint{}
+	err = worker.Work(&protocol.RawMessage{
+		Command:   protocol.CommandBarrier,
+		Timestamp: time.Now().UnixMilli(),
+		TraceId:   header.TraceId,
+		Body: protocol.BarrierFunc(func() {
+			point.eventId = lastEventId()
+			point.meta = fstore.GetManagerMeta().Snapshot()
+			point.files, point.err = listTopicFiles(fstore, filter)
+		}),
+	})
+	if err == nil {
+		err = point.err
+	}
+	if point.meta != nil {
+		defer point.meta.Close()
+	}
+	if err != nil {
+		logger.Infof("tid=%s,snapshot err:%v", header.TraceId, err)
+		return nets.OutputRecoverErr(conn, err.Error(), writeTimeout)
+	}
+	logger.Infof("tid=%s,snapshot to %s begin, eventId=%d, files=%d", header.TraceId, conn.RemoteAddr(), point.eventId, len(point.files))
+
+	if err = outputSnapshotMeta(conn, point.meta, writeTimeout); err != nil {
+		logger.Infof("tid=%s,snapshot output meta err:%v", header.TraceId, err)
+		return err
+	}
+	for start := 0; start < len(point.files); {
+		end := start + 1
+		for end < len(point.files) && point.files[end].topicName == point.files[start].topicName {
+			end++
+		}
+		if err = outputSnapshotTopic(conn, fstore, locker, point.files[start:end], header.TraceId, writeTimeout); err != nil {
+			return err
+		}
+		start = end
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(point.eventId))
+	if err = writeSnapshotFrame(conn, snapshotFrameEnd, buf, writeTimeout); err != nil {
+		return err
+	}
+	logger.Infof("tid=%s,snapshot to %s end, eventId=%d", header.TraceId, conn.RemoteAddr(), point.eventId)
+	return nil
+}
+
+// listTopicFiles 在 worker 中执行，记录每个 topic 文件的当前长度，已经删除的 topic 不需要复制文件
+func listTopicFiles(fstore store.Store, filter *TopicFilter) ([]*snapshotFile, error) {
+	infos, err := fstore.GetTopicInfoReader().GetTopicSimpleInfoList()
+	if err != nil {
+		return nil, err
+	}
+	var files []*snapshotFile
+	for _, info := range infos {
+		if info.State == store.TopicStateDeleted || !filter.Match(info.Name) {
+			continue
+		}
+		entries, err := os.ReadDir(fstore.GetTopicPath(info.Name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			name, ok := strings.CutSuffix(entry.Name(), ".log")
+			if entry.IsDir() || !ok {
+				continue
+			}
+			fileId := dir.ParseNumber(name)
+			if fileId < 0 {
+				continue
+			}
+			stat, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, &snapshotFile{
+				topicName: info.Name,
+				fileId:    fileId,
+				size:      stat.Size(),
+				modTime:   stat.ModTime(),
+			})
+		}
+	}
+	return files, nil
+}
+
+// outputSnapshotTopic 输出一个 topic 的文件，files 属于同一个 topic。快照点之后被删除的文件不再输出，slave 复制 binlog 时同样会删除它们
+func outputSnapshotTopic(conn net.Conn, fstore store.Store, locker *protocol.DelFileLock, files []*snapshotFile, traceId string, writeTimeout time.Duration) error {
+	topicName := files[0].topicName
+	var unlock func()
+	for unlock == nil {
+		var waiter func(d time.Duration) bool
+		unlock, waiter = locker.Lock(topicName, "snapshot", traceId)
+		if unlock == nil && !waiter(conf.WaitFileDeleteLockerTimeout) {
+			return fmt.Errorf("wait delete locker of topic %s timeout", topicName)
+		}
+	}
+	defer unlock()
+	for _, f := range files {
+		err := outputSnapshotFile(conn, fstore, f, writeTimeout)
+		if os.IsNotExist(err) {
+			logger.Infof("tid=%s,snapshot skip deleted %s/%d.log", traceId, f.topicName, f.fileId)
+			continue
+		}
+		if err != nil {
+			logger.Infof("tid=%s,snapshot output %s/%d.log err:%v", traceId, f.topicName, f.fileId, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func outputSnapshotMeta(conn net.Conn, meta store.MetaSnapshot, writeTimeout time.Duration) error {
+	var buf []byte
+	err := meta.Scan(func(key, value []byte) error {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(key)))
+		buf = append(buf, key...)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(value)))
+		buf = append(buf, value...)
+		if len(buf) < snapshotChunkSize {
+			return nil
+		}
+		err := writeSnapshotFrame(conn, snapshotFrameMeta, buf, writeTimeout)
+		buf = buf[:0]
+		return err
+	})
+	if err != nil || len(buf) == 0 {
+		return err
+	}
+	return writeSnapshotFrame(conn, snapshotFrameMeta, buf, writeTimeout)
+}
+
+// outputSnapshotFile 只输出快照时刻的长度，之后追加的内容通过 binlog 复制
+func outputSnapshotFile(conn net.Conn, fstore store.Store, sf *snapshotFile, writeTimeout time.Duration) error {
+	f, err := os.Open(path.Join(fstore.GetTopicPath(sf.topicName), fmt.Sprintf("%d.log", sf.fileId)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	headLen := 2 + len(sf.topicName) + 24
+	buf := make([]byte, headLen+snapshotChunkSize)
+	binary.LittleEndian.PutUint16(buf, uint16(len(sf.topicName)))
+	copy(buf[2:], sf.topicName)
+	next := buf[2+len(sf.topicName):]
+
+	var offset int64
+	for {
+		n := min(sf.size-offset, snapshotChunkSize)
+		binary.LittleEndian.PutUint64(next, uint64(sf.fileId))
+		binary.LittleEndian.PutUint64(next[8:], uint64(offset))
+		binary.LittleEndian.PutUint64(next[16:], uint64(sf.modTime.UnixMilli()))
+		if _, err = io.ReadFull(f, buf[headLen:headLen+int(n)]); err != nil {
+			return err
+		}
+		if err = writeSnapshotFrame(conn, snapshotFrameFile, buf[:headLen+int(n)], writeTimeout); err != nil {
+			return err
+		}
+		offset += n
+		if offset >= sf.size {
+			return nil
+		}
+	}
+}
+
+func writeSnapshotFrame(conn net.Conn, frameType byte, body []byte, writeTimeout time.Duration) error {
+	buf := make([]byte, protocol.RespHeaderSize+1+len(body))
+	binary.LittleEndian.PutUint16(buf, protocol.OkCode)
+	binary.LittleEndian.PutUint32(buf[2:], uint32(1+len(body)))
+	buf[protocol.RespHeaderSize] = frameType
+	copy(buf[protocol.RespHeaderSize+1:], body)
+	return nets.WriteAll(conn, buf, writeTimeout)
+}
+
+// snapshot 从 master 加载快照，返回快照对应的 eventId。加载前清空本地的 topic 文件与 meta，只用于还没有数据的新 slave
+func (sc *slaveClient) snapshot(fstore store.Store) (int64, error) {
+	logger.Infof("slave begin to load snapshot from %s:%d", sc.host, sc.port)
+	if err := clearLocalData(fstore); err != nil {
+		return 0, err
+	}
+	fBuf := sc.filter.bytes()
+	buf := make([]byte, protocol.HeaderSize+len(fBuf))
+	buf[0] = byte(protocol.CommandSnapshot)
+	binary.LittleEndian.PutUint32(buf[3:], uint32(len(fBuf)))
+	copy(buf[protocol.HeaderSize:], fBuf)
+	if err := nets.WriteAll(sc.conn, buf, netWriteTimeout); err != nil {
+		return 0, err
+	}
+	meta := fstore.GetManagerMeta()
+	hBuf := buf[:protocol.RespHeaderSize]
+	for {
+		if err := nets.ReadAll(sc.conn, hBuf, snapshotReadTimeout); err != nil {
+			return 0, err
+		}
+		code := binary.LittleEndian.Uint16(hBuf)
+		if code == protocol.ErrCode {
+			errMsgLen := int(binary.LittleEndian.Uint16(hBuf[2:]))
+			if errMsgLen == 0 {
+				return 0, errors.New("unknown err")
+			}
+			eMsgBuf := make([]byte, errMsgLen)
+			if err := nets.ReadAll(sc.conn, eMsgBuf, netReadTimeout); err != nil {
+				return 0, err
+			}
+			return 0, wireErr(string(eMsgBuf))
+		}
+		if code != protocol.OkCode {
+			return 0, errors.New("invalid response")
+		}
+		body := make([]byte, binary.LittleEndian.Uint32(hBuf[2:]))
+		if err := nets.ReadAll(sc.conn, body, snapshotReadTimeout); err != nil {
+			return 0, err
+		}
+		if len(body) == 0 {
+			return 0, errors.New("invalid snapshot frame")
+		}
+		var err error
+		switch body[0] {
+		case snapshotFrameMeta:
+			err = loadSnapshotMeta(meta, body[1:])
+		case snapshotFrameFile:
+			err = loadSnapshotFile(fstore, body[1:])
+		case snapshotFrameEnd:
+			eventId := int64(binary.LittleEndian.Uint64(body[1:]))
+			if err = meta.SetSnapshotEventId(eventId); err != nil {
+				return 0, err
+			}
+			logger.Infof("slave load snapshot from %s:%d end, eventId=%d", sc.host, sc.port, eventId)
+			return eventId, nil
+		default:
+			err = errors.New("invalid snapshot frame")
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// clearLocalData 删除上一次没有完成的快照留下的数据
+func clearLocalData(fstore store.Store) error {
+	infos, err := fstore.GetTopicInfoReader().GetTopicSimpleInfoList()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err = os.RemoveAll(fstore.GetTopicPath(info.Name)); err != nil {
+			return err
+		}
+	}
+	return fstore.GetManagerMeta().ClearSnapshotData()
+}
+
+func loadSnapshotMeta(meta store.ManagerMeta, body []byte) error {
+	var items []*store.SnapshotItem
+	for len(body) > 0 {
+		if len(body) < 4 {
+			return errors.New("invalid snapshot meta")
+		}
+		kLen := int(binary.LittleEndian.Uint32(body))
+		if len(body) < 8+kLen {
+			return errors.New("invalid snapshot meta")
+		}
+		key := body[4 : 4+kLen]
+		body = body[4+kLen:]
+		vLen := int(binary.LittleEndian.Uint32(body))
+		if len(body) < 4+vLen {
+			return errors.New("invalid snapshot meta")
+		}
+		items = append(items, &store.SnapshotItem{
+			Key:   key,
+			Value: body[4 : 4+vLen],
+		})
+		body = body[4+vLen:]
+	}
+	return meta.PutSnapshotItems(items)
+}
+
+func loadSnapshotFile(fstore store.Store, body []byte) error {
+	if len(body) < 2 {
+		return errors.New("invalid snapshot file")
+	}
+	nameLen := int(binary.LittleEndian.Uint16(body))
+	if len(body) < 2+nameLen+24 {
+		return errors.New("invalid snapshot file")
+	}
+	topicName := string(body[2 : 2+nameLen])
+	next := body[2+nameLen:]
+	fileId := int64(binary.LittleEndian.Uint64(next))
+	offset := int64(binary.LittleEndian.Uint64(next[8:]))
+	modTime := time.UnixMilli(int64(binary.LittleEndian.Uint64(next[16:])))
+	data := next[24:]
+
+	topicPath := fstore.GetTopicPath(topicName)
+	if err := dir.EnsurePathExist(topicPath); err != nil {
+		return err
+	}
+	p := path.Join(topicPath, fmt.Sprintf("%d.log", fileId))
+	flag := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(p, flag, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteAt(data, offset); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	// 保留 master 上的修改时间，过期文件的清理依赖它
+	return os.Chtimes(p, modTime, modTime)
+}
@@ -0,0 +1,115 @@
+package replica
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/dir"
+	"github.com/rolandhe/smss/store"
+	"path"
+	"slices"
+)
+
+var ReplicaFilterChangedErr = dir.NewBizError("replica filter changed, clear data and replica from eventId 0")
+
+// TopicFilter 只复制部分 topic，pattern 使用 path.Match 的语法，比如 order-*。
+// Include 为空表示包括所有 topic，同时匹配 Include 和 Exclude 时排除
+type TopicFilter struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+func NewTopicFilter(include, exclude []string) (*TopicFilter, error) {
+	tf := &TopicFilter{
+		Include: include,
+		Exclude: exclude,
+	}
+	for _, pattern := range append(slices.Clone(include), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.New("invalid replica filter pattern:" + pattern)
+		}
+	}
+	return tf, nil
+}
+
+func parseTopicFilter(buf []byte) (*TopicFilter, error) {
+	tf := &TopicFilter{}
+	if err := json.Unmarshal(buf, tf); err != nil {
+		return nil, err
+	}
+	return NewTopicFilter(tf.Include, tf.Exclude)
+}
+
+func (tf *TopicFilter) IsEmpty() bool {
+	return tf == nil || (len(tf.Include) == 0 && len(tf.Exclude) == 0)
+}
+
+func (tf *TopicFilter) Match(topicName string) bool {
+	if tf.IsEmpty() {
+		return true
+	}
+	for _, pattern := range tf.Exclude {
+		if ok, _ := path.Match(pattern, topicName); ok {
+			return false
+		}
+	}
+	if len(tf.Include) == 0 {
+		return true
+	}
+	for _, pattern := range tf.Include {
+		if ok, _ := path.Match(pattern, topicName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// accept 过滤 binlog 块，DDL 总是复制，pub 和延迟消息按 topic 过滤
+func (tf *TopicFilter) accept(msg *protocol.RawMessage) bool {
+	switch msg.Command {
+	case protocol.CommandPub, protocol.CommandDelay, protocol.CommandDelayApply:
+		return tf.Match(msg.TopicName)
+	default:
+		return true
+	}
+}
+
+func (tf *TopicFilter) bytes() []byte {
+	if tf.IsEmpty() {
+		return nil
+	}
+	buf, _ := json.Marshal(tf)
+	return buf
+}
+
+// TopicReplicated slave 是否复制了该 topic 的消息
+func TopicReplicated(meta store.ManagerMeta, topicName string) (bool, error) {
+	buf, err := meta.GetReplicaFilter()
+	if err != nil {
+		return false, err
+	}
+	if len(buf) == 0 {
+		return true, nil
+	}
+	tf, err := parseTopicFilter(buf)
+	if err != nil {
+		return false, err
+	}
+	return tf.Match(topicName), nil
+}
+
+// checkTopicFilter slave 的过滤条件记录在 meta 中，已经有数据的 slave 不能修改过滤条件，否则数据不完整
+func checkTopicFilter(meta store.ManagerMeta, tf *TopicFilter, eventId int64) error {
+	stored, err := meta.GetReplicaFilter()
+	if err != nil {
+		return err
+	}
+	current := tf.bytes()
+	if string(stored) == string(current) {
+		return nil
+	}
+	if eventId > 0 {
+		return ReplicaFilterChangedErr
+	}
+	return meta.SetReplicaFilter(current)
+}
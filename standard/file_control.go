@@ -5,17 +5,21 @@ import (
 	"fmt"
 	"github.com/rolandhe/smss/conf"
 	"github.com/rolandhe/smss/pkg/logger"
-	"os"
+	"io"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-type OutputMsgFunc[T any] func(f *os.File, msg *T) (int64, error)
+type OutputMsgFunc[T any] func(w io.Writer, msg *T) (int64, error)
 type LogFileInfoGet func() (int64, int64)
 
 type AfterWriteCallback func(fileId, pos int64) (int, error)
 
+// AfterBatchWriteCallback 批量写入后的回调，indexes 是成功写入的消息在批次中的下标，positions 是对应消息在 fileId 中的起始位置，
+// 返回需要保留的消息条数，其后的消息会从文件中截掉
+type AfterBatchWriteCallback func(indexes []int, fileId int64, positions []int64) int
+
 type WaitNotifyResult int
 
 const (
@@ -23,17 +27,37 @@ const (
 	WaitNotifyTopicDeleted   WaitNotifyResult = 1
 	WaitNotifyResultTimeout  WaitNotifyResult = 2
 	WaitNotifyByClientClosed WaitNotifyResult = 3
+	WaitNotifyServerShutdown WaitNotifyResult = 4
 )
 
 type NotifyDevice struct {
 	notify           chan struct{}
 	wg               atomic.Pointer[sync.WaitGroup]
 	deleteTopicState atomic.Bool
+	shutdown         chan struct{}
+	shutdownOnce     sync.Once
 }
 
 func NewNotifyDevice() *NotifyDevice {
 	return &NotifyDevice{
-		notify: make(chan struct{}, 1),
+		notify:   make(chan struct{}, 1),
+		shutdown: make(chan struct{}),
+	}
+}
+
+// ShutdownNotify server关闭，唤醒等待的读取端
+func (nd *NotifyDevice) ShutdownNotify() {
+	nd.shutdownOnce.Do(func() {
+		close(nd.shutdown)
+	})
+}
+
+func (nd *NotifyDevice) IsShutdown() bool {
+	select {
+	case <-nd.shutdown:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -51,11 +75,13 @@ func (nd *NotifyDevice) Notify() bool {
 	}
 }
 func (nd *NotifyDevice) Wait(clientClosedNotifyChan <-chan struct{}) WaitNotifyResult {
-	timer := time.NewTimer(conf.ServerAliveTimeout)
+	timer := time.NewTimer(time.Duration(conf.ServerAliveTimeout.Load()))
 	defer timer.Stop()
 	select {
 	case <-clientClosedNotifyChan:
 		return WaitNotifyByClientClosed
+	case <-nd.shutdown:
+		return WaitNotifyServerShutdown
 	case <-nd.notify:
 		if nd.IsDeleteTopic() {
 			return WaitNotifyTopicDeleted
@@ -78,6 +104,8 @@ type LogFileControl interface {
 	Notify()
 	InvalidByDeleteTopic()
 	IsInvalid() bool
+	// ShutdownNotify server关闭时通知所有的读取端
+	ShutdownNotify()
 }
 
 func NewLogFileControl(subject, ppath string) (LogFileControl, error) {
@@ -120,13 +148,22 @@ func (n *notifier) notifyAll(closed bool) {
 			return
 		}
 		if c.Notify() {
-			if conf.LogSample > 0 && n.logCount%conf.LogSample == 0 {
+			if sample := conf.LogSample.Load(); sample > 0 && n.logCount%sample == 0 {
 				logger.Infof("writer of %s notify to %s,count=%d", n.subject, k, n.logCount)
 			}
 		}
 	}
 }
 
+func (n *notifier) shutdownAll() {
+	n.Lock()
+	defer n.Unlock()
+	for k, c := range n.waiters {
+		c.ShutdownNotify()
+		logger.Infof("writer of %s notify shutdown to %s", n.subject, k)
+	}
+}
+
 func (fc *logFileCtrl) Set(fileId, fileSize int64) {
 	fc.Lock()
 	defer fc.Unlock()
@@ -171,3 +208,7 @@ func (fc *logFileCtrl) InvalidByDeleteTopic() {
 func (fc *logFileCtrl) IsInvalid() bool {
 	return fc.invalid.Load()
 }
+
+func (fc *logFileCtrl) ShutdownNotify() {
+	fc.notify.shutdownAll()
+}
@@ -76,7 +76,7 @@ func ReadFirstFileId(root string, lastFileId int64) (int64, error) {
 			return 0, err
 		}
 		modDate := tm.ToDate(info.ModTime())
-		if tm.DiffDays(nowDate, modDate) >= conf.StoreMaxDays {
+		if int64(tm.DiffDays(nowDate, modDate)) >= conf.StoreMaxDays.Load() {
 			continue
 		}
 
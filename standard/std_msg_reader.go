@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/rolandhe/smss/cmd/protocol"
 	"github.com/rolandhe/smss/conf"
+	"github.com/rolandhe/smss/pkg/checksum"
 	"github.com/rolandhe/smss/pkg/dir"
 	"github.com/rolandhe/smss/pkg/logger"
 	"github.com/rolandhe/smss/store"
@@ -15,11 +16,14 @@ import (
 var WaitNewTimeoutErr = errors.New("wait timeout")
 var PeerClosedErr = errors.New("peer closed error")
 var TopicWriterTermiteErr = dir.NewBizError("topic writer closed,maybe topic deleted")
+var ServerShutdownErr = errors.New("server shutdown")
 
 type CmdLine interface {
 	GetPayloadSize() int
 	GetCmd() protocol.CommandEnum
 	GetId() int64
+	// HasChecksum 命令行的最后一列是 crc
+	HasChecksum() bool
 }
 
 type MsgParser[T any] interface {
@@ -68,6 +72,9 @@ func (r *StdMsgBlockReader[T]) Read(clientClosedNotify *store.ClientClosedNotify
 	if r.notify.IsDeleteTopic() {
 		return nil, errors.New("topic not exist")
 	}
+	if r.notify.IsShutdown() {
+		return nil, ServerShutdownErr
+	}
 	if err := r.waitFs(clientClosedNotify.ClientClosedNotifyChan); err != nil {
 		return nil, err
 	}
@@ -106,7 +113,11 @@ func (r *StdMsgBlockReader[T]) waitFs(ClientClosedNotifyChan <-chan struct{}) er
 			logger.Infof("%s waited file %d,notify to %s, ret=WaitNotifyResultTimeout", r.subject, r.ctrl.fileId, r.whoami)
 			return WaitNewTimeoutErr
 		}
-		if conf.LogSample > 0 && r.logCount%conf.LogSample == 0 {
+		if waitRet == WaitNotifyServerShutdown {
+			logger.Infof("%s waited file %d,notify to %s, ret=WaitNotifyServerShutdown", r.subject, r.ctrl.fileId, r.whoami)
+			return ServerShutdownErr
+		}
+		if sample := conf.LogSample.Load(); sample > 0 && r.logCount%sample == 0 {
 			logger.Infof("%s waited file %d ok,notify to %s,count=%d", r.subject, r.ctrl.fileId, r.whoami, r.logCount)
 		}
 		r.logCount++
@@ -195,7 +206,11 @@ func (r *StdMsgBlockReader[T]) waitPos(ClientClosedNotifyChan <-chan struct{}) e
 			logger.Infof("%s waited pos,notify %d.%d %s,ret=WaitNotifyResultTimeout", r.subject, r.ctrl.fileId, r.ctrl.pos, r.whoami)
 			return WaitNewTimeoutErr
 		}
-		if conf.LogSample > 0 && r.logCount%conf.LogSample == 0 {
+		if waitRet == WaitNotifyServerShutdown {
+			logger.Infof("%s waited pos,notify %d.%d %s,ret=WaitNotifyServerShutdown", r.subject, r.ctrl.fileId, r.ctrl.pos, r.whoami)
+			return ServerShutdownErr
+		}
+		if sample := conf.LogSample.Load(); sample > 0 && r.logCount%sample == 0 {
 			logger.Infof("%s waited pos ok,notify %d.%d %s,count=%d", r.subject, r.ctrl.fileId, r.ctrl.pos, r.whoami, r.logCount)
 		}
 		r.logCount++
@@ -233,6 +248,7 @@ func (r *StdMsgBlockReader[T]) readCore(clientClosedNotify *store.ClientClosedNo
 	step := 0
 	var cmdStep commandStep
 	var plStep payloadStep
+	var cmdLine CmdLine
 	for {
 		if clientClosedNotify.ClientClosedFlag.Load() {
 			return nil, PeerClosedErr
@@ -253,7 +269,6 @@ func (r *StdMsgBlockReader[T]) readCore(clientClosedNotify *store.ClientClosedNo
 				return nil, err
 			}
 			if isCmd {
-				var cmdLine CmdLine
 				if cmdLine, err = r.parser.ParseCmd(cmdStep.getCmdBuf()); err != nil {
 					return nil, err
 				}
@@ -270,6 +285,11 @@ func (r *StdMsgBlockReader[T]) readCore(clientClosedNotify *store.ClientClosedNo
 				return nil, err
 			}
 			if ok {
+				if cmdLine.HasChecksum() && !checksum.Verify(cmdStep.getCmdBuf(), plStep.payload) {
+					p := path.Join(r.root, fmt.Sprintf("%d.log", r.ctrl.fileId))
+					logger.Infof("%s-%s read corrupt block,file=%s,offset=%d", r.subject, r.whoami, p, r.ctrl.pos)
+					return nil, checksum.NewCorruptBlockErr(p, r.ctrl.pos)
+				}
 				step = 0
 				msg := r.parser.ToMessage(plStep.payload, r.ctrl.fileId, rctx.pos)
 				readMsgs = append(readMsgs, msg)
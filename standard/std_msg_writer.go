@@ -1,6 +1,7 @@
 package standard
 
 import (
+	"bytes"
 	"github.com/rolandhe/smss/conf"
 	"github.com/rolandhe/smss/pkg/logger"
 	"io"
@@ -34,6 +35,11 @@ func (w *StdMsgWriter[T]) GetRoot() string {
 	return w.root
 }
 
+// MaxLogSize 单个文件的最大长度，读取时用于判断文件是否已经写满
+func (w *StdMsgWriter[T]) MaxLogSize() int64 {
+	return w.maxLogSize
+}
+
 func (w *StdMsgWriter[T]) Close() error {
 	if w.curFs != nil {
 		w.curFs.Sync()
@@ -96,6 +102,80 @@ func (w *StdMsgWriter[T]) Write(msg *T, cb AfterWriteCallback) (int, int, error)
 	return syncFd, cbSyncFd, nil
 }
 
+// WriteBatch 把多条消息编码到同一个buffer中，一次写入文件，编码失败的消息不会写入，错误记录在 errs 对应的位置
+func (w *StdMsgWriter[T]) WriteBatch(msgs []*T, errs []error, cb AfterBatchWriteCallback) (int, error) {
+	var err error
+
+	if err = w.ensureFs(); err != nil {
+		return SyncFdIgnore, err
+	}
+
+	var buf bytes.Buffer
+	indexes := make([]int, 0, len(msgs))
+	offsets := make([]int64, 0, len(msgs))
+	for i, msg := range msgs {
+		start := buf.Len()
+		var n int64
+		if n, err = w.outputFunc(&buf, msg); err != nil {
+			buf.Truncate(start)
+			errs[i] = err
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+		indexes = append(indexes, i)
+		offsets = append(offsets, int64(start))
+	}
+	if len(indexes) == 0 {
+		return SyncFdIgnore, nil
+	}
+
+	fid, size := w.LogFileControl.Get()
+	if _, err = w.curFs.Write(buf.Bytes()); err != nil {
+		w.truncate(size)
+		return SyncFdIgnore, err
+	}
+
+	positions := make([]int64, len(offsets))
+	for i, offset := range offsets {
+		positions[i] = size + offset
+	}
+	allSize := size + int64(buf.Len())
+	if keep := cb(indexes, fid, positions); keep < len(indexes) {
+		allSize = positions[keep]
+		w.truncate(allSize)
+		if keep == 0 {
+			return SyncFdIgnore, nil
+		}
+	}
+
+	w.lastWriteTime = time.Now().UnixMilli()
+
+	syncFd := int(w.curFs.Fd())
+	if allSize >= w.maxLogSize {
+		w.curFs.Close()
+		w.curFs = nil
+		syncFd = SyncFdNone
+		w.LogFileControl.Set(fid+1, 0)
+	} else {
+		w.LogFileControl.Set(fid, allSize)
+	}
+	w.LogFileControl.Notify()
+	return syncFd, nil
+}
+
+func (w *StdMsgWriter[T]) truncate(size int64) {
+	if err := w.curFs.Truncate(size); err != nil {
+		logger.Infof("rollback to truncate error,then panic:%v", err)
+		panic("rollback error")
+	}
+	if _, err := w.curFs.Seek(size, io.SeekStart); err != nil {
+		logger.Infof("rollback to seek error,then panic:%v", err)
+		panic("rollback error")
+	}
+}
+
 func (w *StdMsgWriter[T]) ensureFs() error {
 	if w.curFs != nil {
 		return nil
@@ -1,7 +1,33 @@
 package standard
 
-import "github.com/rolandhe/smss/cmd/protocol"
+import (
+	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/dir"
+)
+
+// ServerBusyErr worker 的队列已满，带截止时间的请求不等待，直接拒绝
+var ServerBusyErr = dir.NewBizError("server busy")
+
+// RequestExpiredErr 请求在队列中等待超过了截止时间，没有写入 binlog
+var RequestExpiredErr = dir.NewBizError("request expired in queue")
 
 type MessageWorking interface {
 	Work(msg *protocol.RawMessage) error
+	// WorkAsync 把消息投递给 worker 后立即返回，通过 FutureMsg 等待处理结果
+	WorkAsync(msg *protocol.RawMessage) (*FutureMsg[protocol.RawMessage], error)
+}
+
+// WorkerStats worker 队列的运行状态
+type WorkerStats struct {
+	QueueDepth    int `json:"queueDepth"`
+	QueueCapacity int `json:"queueCapacity"`
+	// Rejected 队列已满被拒绝的请求数
+	Rejected int64 `json:"rejected"`
+	// Expired 在队列中超过截止时间被丢弃的请求数
+	Expired int64 `json:"expired"`
+}
+
+// WorkerStatsReporter 可以输出运行状态的 worker
+type WorkerStatsReporter interface {
+	Stats() *WorkerStats
 }
@@ -23,7 +23,7 @@ func NewMeta(path string) (store.Meta, error) {
 	}, nil
 }
 
-func (bm *badgerMeta) CreateTopic(topicName string, expireAt int64, eventId int64) (*store.TopicInfo, error) {
+func (bm *badgerMeta) CreateTopic(topicName string, expireAt int64, eventId int64, codec byte) (*store.TopicInfo, error) {
 	norTopicName := normalTopicName(topicName)
 	exist, err := bm.existTopic(norTopicName)
 	if err != nil {
@@ -37,6 +37,7 @@ func (bm *badgerMeta) CreateTopic(topicName string, expireAt int64, eventId int6
 		Name:            topicName,
 		CreateTimeStamp: time.Now().UnixMilli(),
 		ExpireAt:        expireAt,
+		Codec:           codec,
 	}
 	valMeta := topicMetaValue{
 		createTime:         info.CreateTimeStamp,
@@ -45,6 +46,7 @@ func (bm *badgerMeta) CreateTopic(topicName string, expireAt int64, eventId int6
 		stateChangeTime:    info.CreateTimeStamp,
 		stateChangeEventId: eventId,
 		state:              store.TopicStateNormal,
+		codec:              codec,
 	}
 	err = bm.db.Update(func(txn *badger.Txn) error {
 		if e := txn.Set(norTopicName, valMeta.toBytes()); e != nil {
@@ -216,6 +218,33 @@ func (bm *badgerMeta) ScanDelays(batchSize int) ([]*store.DelayItem, int64, erro
 	return ret, next, err
 }
 
+func (bm *badgerMeta) WalkDelays(fn func(item *store.DelayItem) error) error {
+	preLen := len(delayPrefix)
+	return bm.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = delayPrefix
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(opts.Prefix); it.ValidForPrefix(opts.Prefix); it.Next() {
+			item := it.Item()
+			key := item.KeyCopy(nil)
+			valueBuf, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err = fn(&store.DelayItem{
+				Key:       key,
+				Payload:   valueBuf,
+				TopicName: string(key[preLen+16:]),
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (bm *badgerMeta) RemoveDelay(key []byte) error {
 	err := bm.db.Update(func(txn *badger.Txn) error {
 		return txn.Delete(key)
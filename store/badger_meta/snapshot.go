@@ -0,0 +1,210 @@
+package badger_meta
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rolandhe/smss/store"
+	"io"
+)
+
+const (
+	backupMaxPendingWrites = 256
+
+	snapshotEventIdKey = "global@snapshotEventId"
+	replicaFilterKey   = "global@replicaFilter"
+	replicaResumeKey   = "global@replicaResume"
+	clusterVoteKey     = "global@clusterVote"
+)
+
+// isLocalKey 只属于本实例的 key，不参与快照
+func isLocalKey(key []byte) bool {
+	k := string(key)
+	return k == roleKey || k == snapshotEventIdKey || k == replicaFilterKey || k == replicaResumeKey || k == clusterVoteKey
+}
+
+type badgerSnapshot struct {
+	txn *badger.Txn
+}
+
+func (bs *badgerSnapshot) Scan(fn func(key, value []byte) error) error {
+	it := bs.txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if isLocalKey(item.Key()) {
+			continue
+		}
+		key := item.KeyCopy(nil)
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if err = fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bs *badgerSnapshot) Close() error {
+	bs.txn.Discard()
+	return nil
+}
+
+// Snapshot 只读事务看到的是打开时的数据，之后的写入不可见
+func (bm *badgerMeta) Snapshot() store.MetaSnapshot {
+	return &badgerSnapshot{
+		txn: bm.db.NewTransaction(false),
+	}
+}
+
+func (bm *badgerMeta) ClearSnapshotData() error {
+	var keys [][]byte
+	err := bm.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if isLocalKey(it.Item().Key()) {
+				continue
+			}
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	wb := bm.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, key := range keys {
+		if err = wb.Delete(key); err != nil {
+			return err
+		}
+	}
+	if err = wb.Flush(); err != nil {
+		return err
+	}
+	if err = bm.SetReplicaResumePoint(0, 0); err != nil {
+		return err
+	}
+	return bm.SetSnapshotEventId(0)
+}
+
+func (bm *badgerMeta) PutSnapshotItems(items []*store.SnapshotItem) error {
+	wb := bm.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, item := range items {
+		if err := wb.Set(item.Key, item.Value); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+func (bm *badgerMeta) SetSnapshotEventId(eventId int64) error {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(eventId))
+	return bm.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(snapshotEventIdKey), buf)
+	})
+}
+
+func (bm *badgerMeta) GetSnapshotEventId() (int64, error) {
+	var value []byte
+	err := bm.db.View(func(txn *badger.Txn) error {
+		var e error
+		value, e = getRawValue([]byte(snapshotEventIdKey), txn)
+		return e
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(value)), nil
+}
+
+func (bm *badgerMeta) SetReplicaFilter(filter []byte) error {
+	return bm.db.Update(func(txn *badger.Txn) error {
+		if len(filter) == 0 {
+			return txn.Delete([]byte(replicaFilterKey))
+		}
+		return txn.Set([]byte(replicaFilterKey), filter)
+	})
+}
+
+func (bm *badgerMeta) GetReplicaFilter() ([]byte, error) {
+	var value []byte
+	err := bm.db.View(func(txn *badger.Txn) error {
+		var e error
+		value, e = getRawValue([]byte(replicaFilterKey), txn)
+		return e
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (bm *badgerMeta) SetReplicaResumePoint(eventId int64, writeTime int64) error {
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint64(buf, uint64(eventId))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(writeTime))
+	return bm.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(replicaResumeKey), buf)
+	})
+}
+
+func (bm *badgerMeta) GetReplicaResumePoint() (int64, int64, error) {
+	var value []byte
+	err := bm.db.View(func(txn *badger.Txn) error {
+		var e error
+		value, e = getRawValue([]byte(replicaResumeKey), txn)
+		return e
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(value)), int64(binary.LittleEndian.Uint64(value[8:])), nil
+}
+
+func (bm *badgerMeta) SetClusterVote(term int64, votedFor string) error {
+	buf := make([]byte, 8+len(votedFor))
+	binary.LittleEndian.PutUint64(buf, uint64(term))
+	copy(buf[8:], votedFor)
+	return bm.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(clusterVoteKey), buf)
+	})
+}
+
+func (bm *badgerMeta) GetClusterVote() (int64, string, error) {
+	var value []byte
+	err := bm.db.View(func(txn *badger.Txn) error {
+		var e error
+		value, e = getRawValue([]byte(clusterVoteKey), txn)
+		return e
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	return int64(binary.LittleEndian.Uint64(value)), string(value[8:]), nil
+}
+
+func (bm *badgerMeta) Backup(w io.Writer) error {
+	_, err := bm.db.Backup(w, 0)
+	return err
+}
+
+func (bm *badgerMeta) LoadBackup(r io.Reader) error {
+	return bm.db.Load(r, backupMaxPendingWrites)
+}
@@ -31,16 +31,18 @@ type topicMetaValue struct {
 	stateChangeTime    int64
 	stateChangeEventId int64
 	state              store.TopicStateEnum
+	codec              byte
 }
 
 func (tmv *topicMetaValue) toBytes() []byte {
-	buf := make([]byte, 41)
+	buf := make([]byte, 42)
 	binary.LittleEndian.PutUint64(buf, uint64(tmv.createTime))
 	binary.LittleEndian.PutUint64(buf[8:], uint64(tmv.expireAtTime))
 	binary.LittleEndian.PutUint64(buf[16:], uint64(tmv.createEventId))
 	binary.LittleEndian.PutUint64(buf[24:], uint64(tmv.stateChangeTime))
 	binary.LittleEndian.PutUint64(buf[32:], uint64(tmv.stateChangeEventId))
 	buf[40] = byte(tmv.state)
+	buf[41] = tmv.codec
 	return buf
 }
 
@@ -51,7 +53,10 @@ func (tmv *topicMetaValue) fromBytes(buf []byte) {
 	tmv.stateChangeTime = int64(binary.LittleEndian.Uint64(buf[24:]))
 	tmv.stateChangeEventId = int64(binary.LittleEndian.Uint64(buf[32:]))
 	tmv.state = store.TopicStateEnum(buf[40])
-
+	// 老版本没有 codec
+	if len(buf) > 41 {
+		tmv.codec = buf[41]
+	}
 }
 
 func (tmv *topicMetaValue) toTopicInfo(topicName string) *store.TopicInfo {
@@ -63,6 +68,7 @@ func (tmv *topicMetaValue) toTopicInfo(topicName string) *store.TopicInfo {
 		StateChangeTime:    tmv.stateChangeTime,
 		StateChangeEventId: tmv.stateChangeEventId,
 		State:              tmv.state,
+		Codec:              tmv.codec,
 	}
 }
 
@@ -73,4 +79,5 @@ func (tmv *topicMetaValue) fromTopicInfo(info *store.TopicInfo) {
 	tmv.stateChangeTime = info.StateChangeTime
 	tmv.stateChangeEventId = info.StateChangeEventId
 	tmv.state = info.State
+	tmv.codec = info.Codec
 }
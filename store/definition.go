@@ -15,13 +15,15 @@ const (
 )
 
 type TopicInfo struct {
-	Name               string         `json:"name" :"name"`
+	Name               string         `json:"name"`
 	CreateTimeStamp    int64          `json:"createTimeStamp"`
 	ExpireAt           int64          `json:"expireAt"`
 	CreateEventId      int64          `json:"createEventId"`
 	StateChangeTime    int64          `json:"stateChangeTime"`
 	StateChangeEventId int64          `json:"stateChangeEventId"`
 	State              TopicStateEnum `json:"state"`
+	// 默认压缩算法
+	Codec byte `json:"codec"`
 }
 
 func (info *TopicInfo) IsTemp() bool {
@@ -48,6 +50,42 @@ type ManagerMeta interface {
 
 	CopyCreateTopic(info *TopicInfo) error
 	DeleteTopic(topicName string, force bool) (bool, error)
+
+	// Snapshot 打开 meta 的一致性只读视图，用于向新的 slave 传输快照，使用完需要 Close
+	Snapshot() MetaSnapshot
+	// ClearSnapshotData 加载快照前清空 meta，实例角色除外
+	ClearSnapshotData() error
+	PutSnapshotItems(items []*SnapshotItem) error
+	// SetSnapshotEventId 记录加载的快照对应的 eventId，本地 binlog 从它的下一个开始
+	SetSnapshotEventId(eventId int64) error
+	GetSnapshotEventId() (int64, error)
+
+	// SetReplicaFilter 记录 slave 复制时使用的 topic 过滤条件，nil 表示不过滤
+	SetReplicaFilter(filter []byte) error
+	GetReplicaFilter() ([]byte, error)
+	// SetReplicaResumePoint 记录 master 最后跳过的块的 eventId 与写入时间，只复制部分 topic 的 slave 重启后从这里继续复制
+	SetReplicaResumePoint(eventId int64, writeTime int64) error
+	GetReplicaResumePoint() (int64, int64, error)
+	// SetClusterVote 记录集群选举的 term 与本节点投票给的节点，回复投票之前写入
+	SetClusterVote(term int64, votedFor string) error
+	GetClusterVote() (int64, string, error)
+
+	// Backup 把 meta 的全部数据以 badger 备份格式写入 w，包括实例角色等本地信息
+	Backup(w io.Writer) error
+	// LoadBackup 加载 Backup 输出的数据，只用于空的 meta
+	LoadBackup(r io.Reader) error
+}
+
+type SnapshotItem struct {
+	Key   []byte
+	Value []byte
+}
+
+// MetaSnapshot meta 在某一时刻的只读视图
+type MetaSnapshot interface {
+	// Scan 按 key 的顺序遍历，不包括实例角色等本地信息
+	Scan(fn func(key, value []byte) error) error
+	io.Closer
 }
 
 type TopicInfoReader interface {
@@ -58,6 +96,8 @@ type TopicInfoReader interface {
 type Scanner interface {
 	ScanExpireTopics() ([]string, int64, error)
 	ScanDelays(batchSize int) ([]*DelayItem, int64, error)
+	// WalkDelays 遍历所有的延迟消息，包括还没有到期的，用于离线检查
+	WalkDelays(fn func(item *DelayItem) error) error
 }
 
 type InstanceRoleEnum byte
@@ -79,7 +119,7 @@ const (
 )
 
 type Meta interface {
-	CreateTopic(topicName string, defaultLifetime int64, eventId int64) (*TopicInfo, error)
+	CreateTopic(topicName string, defaultLifetime int64, eventId int64, codec byte) (*TopicInfo, error)
 
 	SaveDelay(topicName string, payload []byte) error
 
@@ -110,7 +150,7 @@ type Store interface {
 
 	GetReader(topicName, who string, filePosCallback func(lastFileId int64) (int64, int64, error), batchSize int) (TopicBlockReader, error)
 
-	CreateTopic(topicName string, life int64, eventId int64) error
+	CreateTopic(topicName string, life int64, eventId int64, codec byte) error
 
 	ForceDeleteTopic(topicName string, cb func() error) error
 
@@ -123,6 +163,9 @@ type Store interface {
 	GetScanner() Scanner
 
 	GetTopicPath(topicName string) string
+
+	// ShutdownNotify server关闭时通知所有topic的订阅端
+	ShutdownNotify()
 }
 
 type MsgHeader struct {
@@ -134,12 +177,21 @@ type TopicMessage struct {
 	EventId   int64
 	SrcFileId int64
 	SrcPos    int64
-	Content   []byte
+	// 在所属 pub 请求中的下标
+	IndexOfBatch int
+	// Content 的压缩算法，压缩时 Content 是整批消息一次压缩的结果
+	Codec byte
+	// Content 中的消息数，EventId 是其中第一条消息的
+	Count   int
+	Content []byte
 }
 
 type ReadMessage struct {
 	Ts      int64
 	EventId int64
+	Codec   byte
+	// PayLoad 中的消息数，Codec 不为 None 时 PayLoad 是整批压缩的多条消息，EventId 是其中第一条消息的
+	Count   int
 	PayLoad []byte
 	NextPos struct {
 		FileId int64
@@ -17,7 +17,8 @@ func NewMeta(root string) (store.Meta, error) {
 	return badger_meta.NewMeta(metaRoot)
 }
 
-func NewFileStore(root string, meta store.Meta) (store.Store, error) {
+// NewFileStore maxLogSize 是每个 topic 文件的最大长度，超过后写入下一个文件
+func NewFileStore(root string, meta store.Meta, maxLogSize int64) (store.Store, error) {
 	fsStoreRoot := path.Join(root, store.TopicDir)
 	if err := ensureStoreDirectory(fsStoreRoot); err != nil {
 		meta.Close()
@@ -34,8 +35,9 @@ func NewFileStore(root string, meta store.Meta) (store.Store, error) {
 	}
 
 	fstore := &fileStore{
-		root: fsStoreRoot,
-		meta: meta,
+		root:       fsStoreRoot,
+		meta:       meta,
+		maxLogSize: maxLogSize,
 		writerMap: &safeMap{
 			wmap: map[string]*topicWriter{},
 		},
@@ -88,6 +90,16 @@ func (sm *safeMap) invalidWriter(topicName string) *sync.WaitGroup {
 	return &writer.WaitGroup
 }
 
+// closeAll 关闭所有topic writer, 关闭时会fsync
+func (sm *safeMap) closeAll() {
+	sm.Lock()
+	defer sm.Unlock()
+	for name, writer := range sm.wmap {
+		writer.Close()
+		delete(sm.wmap, name)
+	}
+}
+
 func (sm *safeMap) removeWriter(topicName string) {
 	sm.Lock()
 	defer sm.Unlock()
@@ -101,9 +113,10 @@ func (sm *safeMap) removeWriter(topicName string) {
 }
 
 type fileStore struct {
-	root      string
-	meta      store.Meta
-	writerMap *safeMap
+	root       string
+	meta       store.Meta
+	maxLogSize int64
+	writerMap  *safeMap
 }
 
 func (fs *fileStore) ensureWriter(topicName string) (*topicWriter, error) {
@@ -115,13 +128,13 @@ func (fs *fileStore) ensureWriter(topicName string) (*topicWriter, error) {
 		if info == nil || info.IsInvalid() {
 			return nil, errors.New("topic not exist")
 		}
-		writer := newWriter(topicName, TopicPath(fs.root, topicName))
+		writer := newWriter(topicName, TopicPath(fs.root, topicName), fs.maxLogSize)
 		return writer, nil
 	})
 }
 
-func (fs *fileStore) CreateTopic(topicName string, life int64, eventId int64) error {
-	info, err := fs.meta.CreateTopic(topicName, life, eventId)
+func (fs *fileStore) CreateTopic(topicName string, life int64, eventId int64, codec byte) error {
+	info, err := fs.meta.CreateTopic(topicName, life, eventId, codec)
 	if err != nil {
 		return err
 	}
@@ -194,7 +207,16 @@ func (fs *fileStore) SaveDelayMsg(topicName string, payload []byte) error {
 	return fs.meta.SaveDelay(topicName, payload)
 }
 
+func (fs *fileStore) ShutdownNotify() {
+	fs.writerMap.Lock()
+	defer fs.writerMap.Unlock()
+	for _, writer := range fs.writerMap.wmap {
+		writer.ShutdownNotify()
+	}
+}
+
 func (fs *fileStore) Close() error {
+	fs.writerMap.closeAll()
 	return fs.meta.Close()
 }
 
@@ -207,7 +229,7 @@ func (fs *fileStore) GetReader(topicName, whoami string, filePosCallback func(la
 		return nil, errors.New(topicName + " not exist")
 	}
 	dataRoot := TopicPath(fs.root, topicName)
-	reader := newBlockReader(dataRoot, whoami, topicName, batchSize, &TopicNotifyRegister{
+	reader := newBlockReader(dataRoot, whoami, topicName, batchSize, fs.maxLogSize, &TopicNotifyRegister{
 		fs:        fs,
 		topicName: topicName,
 		whoami:    whoami,
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/rolandhe/smss/cmd/protocol"
+	"github.com/rolandhe/smss/pkg/checksum"
 	"strconv"
 	"strings"
 	"time"
@@ -13,6 +14,7 @@ import (
 
 var (
 	lenHolder = []byte{0, 0, 0, 0}
+	lineEnd   = []byte{'\n'}
 )
 
 type TopicMessageCommand struct {
@@ -25,6 +27,11 @@ type TopicMessageCommand struct {
 	SrcFileId int64
 	SrcPos    int64
 	CmdLen    int
+	Codec     byte
+	// Count payload 中的消息数，压缩的记录是整批消息，id 是其中第一条消息的
+	Count int
+
+	hasChecksum bool
 }
 
 func (mc *TopicMessageCommand) GetPayloadSize() int {
@@ -37,6 +44,16 @@ func (mc *TopicMessageCommand) GetId() int64 {
 	return mc.id
 }
 
+// GetLastId 记录中最后一条消息的 eventId
+func (mc *TopicMessageCommand) GetLastId() int64 {
+	return mc.id + int64(max(mc.Count, 1)) - 1
+}
+
+// HasChecksum 命令行的最后一列是 crc，老版本写入的块没有
+func (mc *TopicMessageCommand) HasChecksum() bool {
+	return mc.hasChecksum
+}
+
 func buildCommandsAndCalcSize(amsg *wrappedMsges) ([][]byte, int) {
 	var builder bytes.Buffer
 
@@ -59,13 +76,18 @@ func buildCommandsAndCalcSize(amsg *wrappedMsges) ([][]byte, int) {
 		builder.WriteString(strconv.Itoa(payloadSize))
 		builder.WriteRune('\t')
 
-		builder.WriteString(strconv.Itoa(i))
+		builder.WriteString(strconv.Itoa(msg.IndexOfBatch))
 		builder.WriteRune('\t')
 
 		builder.WriteString(fmt.Sprintf("%d", msg.SrcFileId))
 		builder.WriteRune('\t')
 
 		builder.WriteString(fmt.Sprintf("%d", msg.SrcPos))
+		builder.WriteRune('\t')
+		builder.WriteString(strconv.Itoa(int(msg.Codec)))
+		builder.WriteRune('\t')
+		builder.WriteString(strconv.Itoa(max(msg.Count, 1)))
+		checksum.AppendColumn(&builder, msg.Content, lineEnd)
 		builder.WriteRune('\n')
 
 		binary.LittleEndian.PutUint32(builder.Bytes(), uint32(builder.Len())-4)
@@ -111,5 +133,21 @@ func ReadTopicMessageCmd(buf []byte, msg *TopicMessageCommand) error {
 	if msg.SrcPos, err = strconv.ParseInt(items[6], 10, 64); err != nil {
 		return err
 	}
+	msg.Codec = 0
+	msg.Count = 1
+	msg.hasChecksum = len(items) > 8
+	if len(items) > 7 {
+		var c int
+		if c, err = strconv.Atoi(items[7]); err != nil {
+			return err
+		}
+		msg.Codec = byte(c)
+	}
+	// 老版本写入的块没有消息数列，最后一列是 crc
+	if len(items) > 9 {
+		if msg.Count, err = strconv.Atoi(items[8]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
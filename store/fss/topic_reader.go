@@ -1,7 +1,6 @@
 package fss
 
 import (
-	"github.com/rolandhe/smss/conf"
 	"github.com/rolandhe/smss/standard"
 	"github.com/rolandhe/smss/store"
 )
@@ -23,6 +22,8 @@ func (p *msgParser) ToMessage(payload []byte, fileId, pos int64) *store.ReadMess
 	v := &store.ReadMessage{
 		Ts:      p.msg.ts,
 		EventId: p.msg.id,
+		Codec:   p.msg.Codec,
+		Count:   p.msg.Count,
 		PayLoad: content,
 	}
 	v.NextPos.FileId = fileId
@@ -34,6 +35,8 @@ func (p *msgParser) Reset() {
 	p.msg.id = 0
 	p.msg.sendTime = 0
 	p.msg.payLoadSize = 0
+	p.msg.Codec = 0
+	p.msg.Count = 0
 }
 
 func (p *msgParser) ParseCmd(cmdBuf []byte) (standard.CmdLine, error) {
@@ -62,8 +65,8 @@ func (reg *TopicNotifyRegister) UnRegisterReaderNotify() {
 	reg.fs.unRegisterReaderNotify(reg.topicName, reg.whoami)
 }
 
-func newBlockReader(root string, whoami string, topic string, maxBatch int, register standard.NotifyRegister) store.TopicBlockReader {
-	r := standard.NewStdMsgBlockReader[store.ReadMessage](topic, root, whoami, maxBatch, conf.MaxLogSize, register, &msgParser{})
+func newBlockReader(root string, whoami string, topic string, maxBatch int, maxLogSize int64, register standard.NotifyRegister) store.TopicBlockReader {
+	r := standard.NewStdMsgBlockReader[store.ReadMessage](topic, root, whoami, maxBatch, maxLogSize, register, &msgParser{})
 	return &blockReader{
 		topic:             topic,
 		StdMsgBlockReader: r,
@@ -2,9 +2,8 @@ package fss
 
 import (
 	"bytes"
-	"github.com/rolandhe/smss/conf"
 	"github.com/rolandhe/smss/standard"
-	"os"
+	"io"
 	"sync"
 )
 
@@ -13,15 +12,15 @@ type topicWriter struct {
 	sync.WaitGroup
 }
 
-func newWriter(topicName, topicPath string) *topicWriter {
+func newWriter(topicName, topicPath string, maxLogSize int64) *topicWriter {
 	w := &topicWriter{
-		StdMsgWriter: standard.NewMsgWriter[wrappedMsges](topicName, topicPath, conf.MaxLogSize, buildWriteFunc()),
+		StdMsgWriter: standard.NewMsgWriter[wrappedMsges](topicName, topicPath, maxLogSize, buildWriteFunc()),
 	}
 	return w
 }
 
 func buildWriteFunc() standard.OutputMsgFunc[wrappedMsges] {
-	return func(f *os.File, amsg *wrappedMsges) (int64, error) {
+	return func(f io.Writer, amsg *wrappedMsges) (int64, error) {
 		cmds, size := buildCommandsAndCalcSize(amsg)
 		var buf bytes.Buffer
 		buf.Grow(size)